@@ -0,0 +1,388 @@
+// Package bench runs client and server sides of tunnel over simulated carrier and measures
+// what the tunnel delivers: goodput, carrier messages, time to first byte and CPU time.
+package bench
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/pymq/demhack4/config"
+	"github.com/pymq/demhack4/encoding"
+	"github.com/pymq/demhack4/icq"
+	"github.com/pymq/demhack4/mux"
+	"github.com/pymq/demhack4/socksproxy"
+	log "github.com/sirupsen/logrus"
+)
+
+const chatID = "bench"
+
+// Config is a workload and carrier of one run.
+type Config struct {
+	Carrier Carrier
+	Mux     string
+	FEC     config.FEC
+	// RateLimit enables pacer on both sides, if set
+	RateLimit *config.RateLimit
+	// MessageLimit is a plaintext size of message, encoding.MaxMessageLen if zero
+	MessageLimit int
+	// Streams are opened at once, every stream sends request and reads response
+	Streams      int
+	RequestSize  int
+	ResponseSize int
+	// Timeout fails stalled run, e.g. after loss without FEC
+	Timeout time.Duration
+	Seed    int64
+}
+
+func (cfg *Config) setDefaults() {
+	if cfg.MessageLimit <= 0 {
+		cfg.MessageLimit = encoding.MaxMessageLen
+	}
+	if cfg.Streams <= 0 {
+		cfg.Streams = 1
+	}
+	if cfg.RequestSize <= 0 {
+		cfg.RequestSize = 100
+	}
+	if cfg.Timeout <= 0 {
+		cfg.Timeout = time.Minute
+	}
+	if cfg.FEC.Enabled {
+		config.SetFECDefaults(&cfg.FEC)
+	}
+}
+
+// Result is a measurement of one or more runs.
+type Result struct {
+	// Bytes of responses delivered to client
+	Bytes    int64
+	Duration time.Duration
+	// Messages and CarrierBytes are sent by both sides, including lost ones
+	Messages     int64
+	CarrierBytes int64
+	// TTFB is time from opening stream to the first byte of response, including SOCKS handshake
+	TTFB []time.Duration
+	// CPU is user and system time of the whole process, zero if unsupported
+	CPU time.Duration
+}
+
+// Add accumulates other run into result.
+func (r *Result) Add(other Result) {
+	r.Bytes += other.Bytes
+	r.Duration += other.Duration
+	r.Messages += other.Messages
+	r.CarrierBytes += other.CarrierBytes
+	r.TTFB = append(r.TTFB, other.TTFB...)
+	r.CPU += other.CPU
+}
+
+// Goodput returns delivered payload bytes per second.
+func (r Result) Goodput() float64 {
+	if r.Duration <= 0 {
+		return 0
+	}
+	return float64(r.Bytes) / r.Duration.Seconds()
+}
+
+// MessagesPerMB returns carrier messages per MiB of delivered payload.
+func (r Result) MessagesPerMB() float64 {
+	if r.Bytes == 0 {
+		return 0
+	}
+	return float64(r.Messages) / (float64(r.Bytes) / (1 << 20))
+}
+
+// CPUPerMB returns CPU time per MiB of delivered payload.
+func (r Result) CPUPerMB() time.Duration {
+	if r.Bytes == 0 {
+		return 0
+	}
+	return time.Duration(float64(r.CPU) / (float64(r.Bytes) / (1 << 20)))
+}
+
+// TTFBPercentile returns p-th percentile of time to first byte, p is in [0, 100].
+func (r Result) TTFBPercentile(p float64) time.Duration {
+	if len(r.TTFB) == 0 {
+		return 0
+	}
+	sorted := append([]time.Duration(nil), r.TTFB...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	return sorted[int(float64(len(sorted)-1)*p/100)]
+}
+
+func (r Result) String() string {
+	return fmt.Sprintf("goodput %.1f KiB/s, %.0f messages/MiB, ttfb p50 %s p95 %s, cpu %s/MiB",
+		r.Goodput()/1024, r.MessagesPerMB(), r.TTFBPercentile(50).Round(time.Millisecond),
+		r.TTFBPercentile(95).Round(time.Millisecond), r.CPUPerMB().Round(time.Millisecond))
+}
+
+// Run starts tunnel over simulated carrier and runs workload through it.
+func Run(ctx context.Context, cfg Config) (Result, error) {
+	cfg.setDefaults()
+	ctx, cancel := context.WithTimeout(ctx, cfg.Timeout)
+	defer cancel()
+
+	target, err := newTarget(cfg.RequestSize, cfg.ResponseSize)
+	if err != nil {
+		return Result{}, err
+	}
+	defer target.Close()
+
+	t, err := newTunnel(ctx, cfg)
+	if err != nil {
+		return Result{}, err
+	}
+	defer t.close()
+
+	cpuStart := cpuTime()
+	start := time.Now()
+	ttfb := make([]time.Duration, cfg.Streams)
+	errs := make(chan error, cfg.Streams)
+	var wg sync.WaitGroup
+	for i := 0; i < cfg.Streams; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			var err error
+			ttfb[i], err = t.fetch(ctx, target.Addr().(*net.TCPAddr), cfg.RequestSize, cfg.ResponseSize)
+			if err != nil {
+				errs <- err
+				cancel()
+			}
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+	if err := <-errs; err != nil {
+		return Result{}, err
+	}
+
+	res := Result{
+		Bytes:    int64(cfg.Streams) * int64(cfg.ResponseSize),
+		Duration: time.Since(start),
+		TTFB:     ttfb,
+		CPU:      cpuTime() - cpuStart,
+	}
+	for _, l := range []*link{t.toServer, t.toClient} {
+		messages, size := l.sent()
+		res.Messages += messages
+		res.CarrierBytes += size
+	}
+	return res, nil
+}
+
+// tunnel is a pair of connected client and server sessions.
+type tunnel struct {
+	toServer, toClient *link
+	clientRWC          *icq.RWC
+	serverRWC          *icq.RWC
+	client             mux.Session
+	server             mux.Session
+	proxy              *socksproxy.Server
+}
+
+func newTunnel(ctx context.Context, cfg Config) (*tunnel, error) {
+	clientEnc, serverEnc, err := newEncoders()
+	if err != nil {
+		return nil, err
+	}
+
+	proxy, err := socksproxy.NewServer(socksproxy.ServerOptions{Egress: config.Egress{AllowPrivate: true}})
+	if err != nil {
+		return nil, err
+	}
+
+	t := &tunnel{
+		toServer: newLink(cfg.Carrier, cfg.Seed),
+		toClient: newLink(cfg.Carrier, cfg.Seed+1),
+		proxy:    proxy,
+	}
+	t.clientRWC = icq.NewRWCClient(ctx, t.toServer, t.toClient.out, clientEnc, cfg.MessageLimit, chatID)
+	t.serverRWC = icq.NewRWCClient(ctx, t.toClient, t.toServer.out, serverEnc, cfg.MessageLimit, chatID)
+	for _, rwc := range []*icq.RWC{t.clientRWC, t.serverRWC} {
+		if cfg.RateLimit != nil {
+			rwc.SetPacer(icq.NewPacer(*cfg.RateLimit, config.ICQClientRateLimit))
+		}
+		if cfg.FEC.Enabled {
+			err = rwc.EnableFEC(cfg.FEC)
+			if err != nil {
+				t.close()
+				return nil, fmt.Errorf("enable fec: %v", err)
+			}
+		}
+	}
+
+	t.client, _, err = mux.New(cfg.Mux, socksproxy.ConnWrapper{ReadWriteCloser: t.clientRWC}, true, t.clientRWC.PayloadLimit)
+	if err != nil {
+		t.close()
+		return nil, fmt.Errorf("init client mux: %v", err)
+	}
+	t.server, _, err = mux.New(cfg.Mux, socksproxy.ConnWrapper{ReadWriteCloser: t.serverRWC}, false, t.serverRWC.PayloadLimit)
+	if err != nil {
+		t.close()
+		return nil, fmt.Errorf("init server mux: %v", err)
+	}
+	go t.serve()
+	return t, nil
+}
+
+func newEncoders() (*encoding.Encoder, *encoding.Encoder, error) {
+	clientKey, err := encoding.GenerateKey()
+	if err != nil {
+		return nil, nil, err
+	}
+	serverKey, err := encoding.GenerateKey()
+	if err != nil {
+		return nil, nil, err
+	}
+	clientEnc, serverEnc := encoding.NewEncoder(clientKey), encoding.NewEncoder(serverKey)
+	err = clientEnc.SetPeerPublicKey(serverEnc.GetOwnPublicKey())
+	if err != nil {
+		return nil, nil, err
+	}
+	err = serverEnc.SetPeerPublicKey(clientEnc.GetOwnPublicKey())
+	if err != nil {
+		return nil, nil, err
+	}
+	return clientEnc, serverEnc, nil
+}
+
+func (t *tunnel) serve() {
+	for {
+		stream, err := t.server.AcceptStream()
+		if err != nil {
+			return
+		}
+		t.proxy.ServeConn(stream, socksproxy.Peer{})
+	}
+}
+
+// fetch opens stream to target through SOCKS server, sends request and reads response.
+// It returns time to the first byte of response.
+func (t *tunnel) fetch(ctx context.Context, target *net.TCPAddr, requestSize, responseSize int) (time.Duration, error) {
+	start := time.Now()
+	stream, err := t.client.OpenStream(ctx, "")
+	if err != nil {
+		return 0, fmt.Errorf("open stream: %v", err)
+	}
+	defer stream.Close()
+	go func() {
+		<-ctx.Done()
+		_ = stream.Close()
+	}()
+
+	err = socksConnect(stream, target)
+	if err != nil {
+		return 0, err
+	}
+	_, err = stream.Write(pattern(requestSize))
+	if err != nil {
+		return 0, fmt.Errorf("write request: %v", err)
+	}
+
+	response := make([]byte, responseSize)
+	_, err = io.ReadFull(stream, response[:1])
+	if err != nil {
+		return 0, fmt.Errorf("read response: %v", err)
+	}
+	ttfb := time.Since(start)
+	_, err = io.ReadFull(stream, response[1:])
+	if err != nil {
+		return 0, fmt.Errorf("read response: %v", err)
+	}
+	if !bytes.Equal(response, pattern(responseSize)) {
+		return 0, errors.New("response is corrupted")
+	}
+	return ttfb, nil
+}
+
+func (t *tunnel) close() {
+	for _, s := range []mux.Session{t.client, t.server} {
+		if s != nil {
+			_ = s.Close()
+		}
+	}
+	_ = t.proxy.Close()
+	_ = t.clientRWC.Close()
+	_ = t.serverRWC.Close()
+	t.toServer.close()
+	t.toClient.close()
+}
+
+// socksConnect makes SOCKS5 CONNECT request without auth, waiting for every reply like browsers do.
+func socksConnect(conn io.ReadWriter, target *net.TCPAddr) error {
+	_, err := conn.Write([]byte{5, 1, 0})
+	if err != nil {
+		return fmt.Errorf("write socks greeting: %v", err)
+	}
+	reply := make([]byte, 2)
+	_, err = io.ReadFull(conn, reply)
+	if err != nil {
+		return fmt.Errorf("read socks method: %v", err)
+	}
+	if reply[1] != 0 {
+		return fmt.Errorf("socks method refused: %d", reply[1])
+	}
+
+	request := append([]byte{5, 1, 0, 1}, target.IP.To4()...)
+	request = append(request, 0, 0)
+	binary.BigEndian.PutUint16(request[len(request)-2:], uint16(target.Port))
+	_, err = conn.Write(request)
+	if err != nil {
+		return fmt.Errorf("write socks request: %v", err)
+	}
+	// reply with IPv4 bound address
+	reply = make([]byte, 10)
+	_, err = io.ReadFull(conn, reply)
+	if err != nil {
+		return fmt.Errorf("read socks reply: %v", err)
+	}
+	if reply[1] != 0 {
+		return fmt.Errorf("socks request failed: %d", reply[1])
+	}
+	return nil
+}
+
+// newTarget listens for connections, which read request and answer with response of given size.
+func newTarget(requestSize, responseSize int) (net.Listener, error) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, fmt.Errorf("listen target: %v", err)
+	}
+	response := pattern(responseSize)
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				_, err := io.ReadFull(conn, make([]byte, requestSize))
+				if err != nil {
+					log.Warnf("bench: target: read request: %v", err)
+					return
+				}
+				_, _ = conn.Write(response)
+			}()
+		}
+	}()
+	return listener, nil
+}
+
+// pattern is a payload, which is checked after delivery.
+func pattern(size int) []byte {
+	data := make([]byte, size)
+	for i := range data {
+		data[i] = byte(i % 251)
+	}
+	return data
+}
@@ -0,0 +1,83 @@
+package bench
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/pymq/demhack4/config"
+	"github.com/pymq/demhack4/mux"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRun(t *testing.T) {
+	res, err := Run(context.Background(), Config{
+		Carrier:      Carrier{Latency: 10 * time.Millisecond, Jitter: 5 * time.Millisecond},
+		Mux:          mux.MsgMux,
+		Streams:      3,
+		ResponseSize: 50000,
+	})
+	require.NoError(t, err)
+	assert.Equal(t, int64(150000), res.Bytes)
+	assert.Len(t, res.TTFB, 3)
+	assert.Greater(t, res.TTFBPercentile(50), 20*time.Millisecond)
+	assert.Positive(t, res.Messages)
+	assert.Positive(t, res.Goodput())
+}
+
+func TestRunRecoversLossWithFEC(t *testing.T) {
+	res, err := Run(context.Background(), Config{
+		Carrier:      Carrier{Latency: 5 * time.Millisecond, Loss: 0.02},
+		Mux:          mux.Yamux,
+		FEC:          config.FEC{Enabled: true, DataShards: 4, ParityShards: 2, FlushTimeout: 20 * time.Millisecond},
+		Streams:      2,
+		ResponseSize: 100000,
+		Seed:         3,
+	})
+	require.NoError(t, err)
+	assert.Equal(t, int64(200000), res.Bytes)
+}
+
+func BenchmarkTunnel(b *testing.B) {
+	carriers := []struct {
+		name    string
+		carrier Carrier
+		fec     config.FEC
+	}{
+		{name: "clean", carrier: Carrier{Latency: 50 * time.Millisecond, Jitter: 20 * time.Millisecond}},
+		{
+			name:    "lossy",
+			carrier: Carrier{Latency: 50 * time.Millisecond, Jitter: 20 * time.Millisecond, Loss: 0.01},
+			fec:     config.FEC{Enabled: true, DataShards: 8, ParityShards: 3, FlushTimeout: 200 * time.Millisecond},
+		},
+	}
+	for _, kind := range []string{mux.Yamux, mux.MsgMux} {
+		for _, c := range carriers {
+			b.Run(fmt.Sprintf("%s/%s", kind, c.name), func(b *testing.B) {
+				var total Result
+				for i := 0; i < b.N; i++ {
+					res, err := Run(context.Background(), Config{
+						Carrier:      c.carrier,
+						Mux:          kind,
+						FEC:          c.fec,
+						Streams:      4,
+						ResponseSize: 256 * 1024,
+						Seed:         int64(i),
+					})
+					require.NoError(b, err)
+					total.Add(res)
+				}
+				reportResult(b, total)
+			})
+		}
+	}
+}
+
+func reportResult(b *testing.B, res Result) {
+	b.ReportMetric(res.Goodput()/1024, "KiB/s")
+	b.ReportMetric(res.MessagesPerMB(), "messages/MiB")
+	b.ReportMetric(float64(res.TTFBPercentile(50))/float64(time.Millisecond), "ttfb-p50-ms")
+	b.ReportMetric(float64(res.CPUPerMB())/float64(time.Millisecond), "cpu-ms/MiB")
+}
@@ -0,0 +1,150 @@
+package bench
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pymq/demhack4/icq"
+)
+
+// Carrier describes simulated messenger, the same in both directions.
+type Carrier struct {
+	// Latency is a delivery time of message, Jitter adds up to its value at random.
+	// Messages are delivered in order, like in chat.
+	Latency time.Duration
+	Jitter  time.Duration
+	// SendDuration is how long sending request blocks the sender
+	SendDuration time.Duration
+	// Loss is a probability of silently dropped message
+	Loss float64
+	// MaxPerSecond refuses messages above this rate with icq.ErrRateLimited, zero is unlimited
+	MaxPerSecond int
+	// MaxMessageSize refuses longer encoded messages, zero is unlimited
+	MaxMessageSize int
+}
+
+type delivery struct {
+	at  time.Time
+	msg []byte
+}
+
+// link is one direction of simulated carrier, it implements icq.Client.
+type link struct {
+	cfg      Carrier
+	out      chan icq.ICQMessageEvent
+	queue    chan delivery
+	done     chan struct{}
+	lock     sync.Mutex // guards fields below
+	rnd      *rand.Rand
+	lastAt   time.Time
+	sentLast []time.Time // sends of the last second, for MaxPerSecond
+	messages int64
+	bytes    int64
+}
+
+func newLink(cfg Carrier, seed int64) *link {
+	l := &link{
+		cfg:   cfg,
+		out:   make(chan icq.ICQMessageEvent),
+		queue: make(chan delivery, 4096),
+		done:  make(chan struct{}),
+		rnd:   rand.New(rand.NewSource(seed)),
+	}
+	go l.deliver()
+	return l
+}
+
+func (l *link) SendMessage(ctx context.Context, msg []byte, _ string) error {
+	if l.cfg.SendDuration > 0 {
+		timer := time.NewTimer(l.cfg.SendDuration)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		case <-timer.C:
+		}
+	}
+
+	l.lock.Lock()
+	now := time.Now()
+	if l.cfg.MaxPerSecond > 0 {
+		secondAgo := now.Add(-time.Second)
+		for len(l.sentLast) > 0 && l.sentLast[0].Before(secondAgo) {
+			l.sentLast = l.sentLast[1:]
+		}
+		if len(l.sentLast) >= l.cfg.MaxPerSecond {
+			l.lock.Unlock()
+			return fmt.Errorf("bench: %w", icq.ErrRateLimited)
+		}
+		l.sentLast = append(l.sentLast, now)
+	}
+	if l.cfg.MaxMessageSize > 0 && len(msg) > l.cfg.MaxMessageSize {
+		l.lock.Unlock()
+		return fmt.Errorf("bench: %w", icq.ErrMessageTooLarge)
+	}
+	atomic.AddInt64(&l.messages, 1)
+	atomic.AddInt64(&l.bytes, int64(len(msg)))
+	if l.cfg.Loss > 0 && l.rnd.Float64() < l.cfg.Loss {
+		l.lock.Unlock()
+		return nil
+	}
+	at := now.Add(l.cfg.Latency)
+	if l.cfg.Jitter > 0 {
+		at = at.Add(time.Duration(l.rnd.Int63n(int64(l.cfg.Jitter))))
+	}
+	if at.Before(l.lastAt) {
+		at = l.lastAt
+	}
+	l.lastAt = at
+	l.lock.Unlock()
+
+	select {
+	case l.queue <- delivery{at: at, msg: append([]byte(nil), msg...)}:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-l.done:
+		return errors.New("bench: carrier closed")
+	}
+}
+
+// deliver passes queued messages to receiver at their delivery time.
+func (l *link) deliver() {
+	defer close(l.out)
+	for {
+		var d delivery
+		select {
+		case d = <-l.queue:
+		case <-l.done:
+			return
+		}
+		if wait := time.Until(d.at); wait > 0 {
+			timer := time.NewTimer(wait)
+			select {
+			case <-timer.C:
+			case <-l.done:
+				timer.Stop()
+				return
+			}
+		}
+		select {
+		case l.out <- icq.ICQMessageEvent{Text: d.msg}:
+		case <-l.done:
+			return
+		}
+	}
+}
+
+func (l *link) close() {
+	close(l.done)
+}
+
+// sent returns number and total size of messages accepted by carrier, including lost ones.
+func (l *link) sent() (int64, int64) {
+	return atomic.LoadInt64(&l.messages), atomic.LoadInt64(&l.bytes)
+}
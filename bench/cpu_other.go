@@ -0,0 +1,9 @@
+//go:build !linux && !darwin && !freebsd && !netbsd && !openbsd
+
+package bench
+
+import "time"
+
+func cpuTime() time.Duration {
+	return 0
+}
@@ -0,0 +1,18 @@
+//go:build linux || darwin || freebsd || netbsd || openbsd
+
+package bench
+
+import (
+	"syscall"
+	"time"
+)
+
+// cpuTime returns user and system time consumed by process.
+func cpuTime() time.Duration {
+	var usage syscall.Rusage
+	err := syscall.Getrusage(syscall.RUSAGE_SELF, &usage)
+	if err != nil {
+		return 0
+	}
+	return time.Duration(usage.Utime.Nano() + usage.Stime.Nano())
+}
@@ -0,0 +1,90 @@
+// Command bench measures tunnel over simulated carrier, see package bench.
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	stdlog "log"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/pymq/demhack4/bench"
+	"github.com/pymq/demhack4/config"
+	"github.com/pymq/demhack4/mux"
+	log "github.com/sirupsen/logrus"
+)
+
+func main() {
+	muxes := flag.String("mux", mux.Yamux+","+mux.MsgMux, "comma separated multiplexers to compare")
+	latency := flag.Duration("latency", 100*time.Millisecond, "message delivery latency")
+	jitter := flag.Duration("jitter", 50*time.Millisecond, "random extra latency, up to this value")
+	sendDuration := flag.Duration("send-duration", 0, "how long sending one message blocks sender")
+	loss := flag.Float64("loss", 0, "probability of lost message")
+	maxPerSecond := flag.Int("max-per-second", 0, "carrier refuses messages above this rate, 0 is unlimited")
+	maxMessageSize := flag.Int("max-message-size", 0, "carrier refuses longer encoded messages, 0 is unlimited")
+	messageLimit := flag.Int("message-limit", 0, "plaintext size of message, default is used if 0")
+	pace := flag.Bool("pace", false, "enable pacer with ICQ client rate limits")
+	fecEnabled := flag.Bool("fec", false, "enable forward error correction")
+	fecData := flag.Int("fec-data", 0, "FEC data messages in group")
+	fecParity := flag.Int("fec-parity", 0, "FEC parity messages in group")
+	streams := flag.Int("streams", 4, "concurrent streams")
+	requestSize := flag.Int("request-size", 100, "bytes sent by every stream")
+	responseSize := flag.Int("response-size", 256*1024, "bytes received by every stream")
+	runs := flag.Int("runs", 3, "number of runs of every multiplexer")
+	timeout := flag.Duration("timeout", time.Minute, "timeout of one run")
+	flag.Parse()
+
+	// proxy and yamux log expected errors on teardown of every run
+	log.SetLevel(log.ErrorLevel)
+	stdlog.SetOutput(io.Discard)
+
+	cfg := bench.Config{
+		Carrier: bench.Carrier{
+			Latency:        *latency,
+			Jitter:         *jitter,
+			SendDuration:   *sendDuration,
+			Loss:           *loss,
+			MaxPerSecond:   *maxPerSecond,
+			MaxMessageSize: *maxMessageSize,
+		},
+		FEC:          config.FEC{Enabled: *fecEnabled, DataShards: *fecData, ParityShards: *fecParity},
+		MessageLimit: *messageLimit,
+		Streams:      *streams,
+		RequestSize:  *requestSize,
+		ResponseSize: *responseSize,
+		Timeout:      *timeout,
+	}
+	if *pace {
+		cfg.RateLimit = &config.RateLimit{}
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "mux\tgoodput KiB/s\tmessages/MiB\tttfb p50\tttfb p95\tcpu/MiB\tfailed runs")
+	for _, kind := range strings.Split(*muxes, ",") {
+		if !mux.Valid(kind) {
+			log.Fatalf("unknown multiplexer '%s'", kind)
+		}
+		cfg.Mux = kind
+
+		var total bench.Result
+		failed := 0
+		for i := 0; i < *runs; i++ {
+			cfg.Seed = int64(i)
+			res, err := bench.Run(context.Background(), cfg)
+			if err != nil {
+				log.Errorf("%s run %d failed: %v", kind, i, err)
+				failed++
+				continue
+			}
+			total.Add(res)
+		}
+		fmt.Fprintf(w, "%s\t%.1f\t%.0f\t%s\t%s\t%s\t%d\n", kind, total.Goodput()/1024, total.MessagesPerMB(),
+			total.TTFBPercentile(50).Round(time.Millisecond), total.TTFBPercentile(95).Round(time.Millisecond),
+			total.CPUPerMB().Round(time.Millisecond), failed)
+	}
+	_ = w.Flush()
+}
@@ -2,8 +2,11 @@ package main
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"os"
 	"os/signal"
+	"strings"
 	"syscall"
 
 	"github.com/pymq/demhack4/cmd/internal/client"
@@ -11,9 +14,56 @@ import (
 )
 
 func main() {
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "import":
+			if len(os.Args) != 3 {
+				log.Fatalf("usage: %s import <profile link>", os.Args[0])
+			}
+			err := client.ImportProfile(os.Args[2])
+			if err != nil {
+				log.Fatalf("import profile error: %v", err)
+			}
+			log.Infof("profile imported")
+			return
+		case "verify":
+			if len(os.Args) < 3 {
+				log.Fatalf("usage: %s verify <server fingerprint>", os.Args[0])
+			}
+			ok, err := client.VerifyServerKey(strings.Join(os.Args[2:], " "))
+			if err != nil {
+				log.Fatalf("verify server key error: %v", err)
+			}
+			if !ok {
+				fmt.Println("fingerprint DOES NOT match configured server key")
+				os.Exit(1)
+			}
+			fmt.Println("fingerprint matches, server key is trusted now")
+			return
+		case "pipe":
+			if len(os.Args) != 3 {
+				log.Fatalf("usage: %s pipe <host:port>", os.Args[0])
+			}
+			// stderr of ProxyCommand goes to user terminal, so only problems are logged
+			log.SetLevel(log.WarnLevel)
+			ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+			err := client.Pipe(ctx, os.Args[2], os.Stdin, os.Stdout)
+			stop()
+			if err != nil {
+				log.Fatalf("pipe error: %v", err)
+			}
+			return
+		default:
+			log.Fatalf("unknown command '%s', available commands: import, verify, pipe", os.Args[1])
+		}
+	}
+
 	app := client.NewCliApp()
 	err := app.StartProxy(context.Background())
-	if err != nil {
+	var keyErr client.ServerKeyChangedError
+	if errors.As(err, &keyErr) {
+		log.Fatalf("%v; run '%s verify <fingerprint>' to trust the new key", err, os.Args[0])
+	} else if err != nil {
 		log.Panicf("start proxy error: %v", err)
 	}
 	defer func() {
@@ -42,8 +42,8 @@ func onReady() {
 
 	err = initClientApp()
 	if err != nil {
+		// user still can fix config by importing connection profile
 		showErrorDialog("Init proxy server error", err.Error())
-		systray.Quit()
 	}
 
 	initTray()
@@ -3,16 +3,24 @@ package main
 import (
 	"bytes"
 	"context"
+	"errors"
+	"fmt"
 	"image"
 	"os/exec"
 	"runtime"
+	"time"
 
 	ico "github.com/Kodeworks/golang-image-ico"
 	"github.com/getlantern/systray"
 	"github.com/ncruces/zenity"
+	"github.com/pymq/demhack4/cmd/internal/client"
+	"github.com/pymq/demhack4/sched"
+	"github.com/pymq/demhack4/tunnel"
 	log "github.com/sirupsen/logrus"
 )
 
+const statusUpdateInterval = 2 * time.Second
+
 var kdialogAvailable bool
 
 func init() {
@@ -47,21 +55,85 @@ func initTray() {
 	systray.SetTooltip("Proxy") // TODO set app name
 
 	mStartStop := systray.AddMenuItem("Start proxy", "")
+	mImport := systray.AddMenuItem("Import profile...", "Import connection profile link")
 	go func() {
 		started := false
-		for range mStartStop.ClickedCh {
-			if !started {
-				err := app.StartProxy(context.Background())
+		statusTicker := time.NewTicker(statusUpdateInterval)
+		defer statusTicker.Stop()
+		for {
+			select {
+			case <-statusTicker.C:
+				if app == nil {
+					continue
+				}
+				status, err := app.Status()
+				tooltip := fmt.Sprintf("Proxy: %s", status)
+				if rtt := app.RTT(); status == tunnel.StatusConnected && rtt.Samples > 0 {
+					tooltip = fmt.Sprintf("%s, RTT %s", tooltip, rtt.SRTT.Round(100*time.Millisecond))
+				}
+				if queued := queuedBytes(app.StreamStats()); queued > 0 {
+					tooltip = fmt.Sprintf("%s, queued %d KiB", tooltip, queued/1024)
+				}
 				if err != nil {
-					showErrorDialog("Start proxy server error", err.Error())
+					tooltip = fmt.Sprintf("%s (%v)", tooltip, err)
+				}
+				systray.SetTooltip(tooltip)
+				if started && status == tunnel.StatusStopped {
+					// supervisor gave up reconnecting
+					app.StopProxy()
+					started = false
+					mStartStop.SetTitle("Start proxy")
+					if err != nil {
+						showErrorDialog("Proxy stopped", startProxyErrorMessage(err))
+					}
+				}
+			case <-mStartStop.ClickedCh:
+				if !started {
+					if app == nil {
+						showErrorDialog("Start proxy server error", "proxy is not configured, import connection profile first")
+						continue
+					}
+					err := app.StartProxy(context.Background())
+					var keyErr client.ServerKeyChangedError
+					if errors.As(err, &keyErr) {
+						if !askTrustServerKey(keyErr) {
+							continue
+						}
+						err = app.StartProxy(context.Background())
+					}
+					if err != nil {
+						showErrorDialog("Start proxy server error", startProxyErrorMessage(err))
+						continue
+					}
+					mStartStop.SetTitle("Stop proxy")
+					started = true
+				} else {
+					app.StopProxy()
+					started = false
+					mStartStop.SetTitle("Start proxy")
+				}
+			case <-mImport.ClickedCh:
+				link, err := zenity.Entry("Paste connection profile link:", zenity.Title("Import profile"))
+				if err != nil {
+					if !errors.Is(err, zenity.ErrCanceled) {
+						log.Errorf("show dialog: error handling: %v", err)
+					}
+					continue
+				}
+				err = client.ImportProfile(link)
+				if err != nil {
+					showErrorDialog("Import profile error", err.Error())
 					continue
 				}
-				mStartStop.SetTitle("Stop proxy")
-				started = true
-			} else {
-				app.StopProxy()
-				started = false
-				mStartStop.SetTitle("Start proxy")
+				if started {
+					app.StopProxy()
+					started = false
+					mStartStop.SetTitle("Start proxy")
+				}
+				err = initClientApp()
+				if err != nil {
+					showErrorDialog("Init proxy server error", err.Error())
+				}
 			}
 		}
 	}()
@@ -75,6 +147,46 @@ func initTray() {
 	}()
 }
 
+func startProxyErrorMessage(err error) string {
+	var rejectedErr tunnel.HandshakeRejectedError
+	var versionErr tunnel.VersionMismatchError
+	var throttledErr tunnel.ThrottledError
+	switch {
+	case errors.Is(err, tunnel.ErrNoHandshakeAck):
+		return "Server is not responding.\n\nCheck that server is online and that connection profile is up to date."
+	case errors.As(err, &rejectedErr):
+		return fmt.Sprintf("Server rejected connection: %s.\n\nAsk server owner for a new connection profile.", rejectedErr.Reason)
+	case errors.As(err, &versionErr):
+		return fmt.Sprintf("Incompatible versions: this app uses protocol version %d, server uses %d.\n\nUpdate the older one.",
+			versionErr.ClientVersion, versionErr.ServerVersion)
+	case errors.As(err, &throttledErr):
+		return fmt.Sprintf("Server throttled connection: %s.\n\nTry again in %s.", throttledErr.Reason, throttledErr.RetryAfter)
+	default:
+		return err.Error()
+	}
+}
+
+func askTrustServerKey(keyErr client.ServerKeyChangedError) bool {
+	message := fmt.Sprintf("Server key has changed since last connection!\n\n"+
+		"Old fingerprint: %s\nNew fingerprint: %s\n\n"+
+		"Trust the new key only if server owner confirmed this fingerprint.", keyErr.OldFingerprint, keyErr.NewFingerprint)
+	err := zenity.Question(message, zenity.Title("Server key changed"), zenity.WarningIcon,
+		zenity.OKLabel("Trust new key"), zenity.CancelLabel("Cancel"), zenity.DefaultCancel())
+	if err != nil {
+		if !errors.Is(err, zenity.ErrCanceled) {
+			log.Errorf("show dialog: error handling: %v", err)
+		}
+		return false
+	}
+
+	err = app.TrustServerKey()
+	if err != nil {
+		showErrorDialog("Trust server key error", err.Error())
+		return false
+	}
+	return true
+}
+
 func showErrorDialog(title, message string) {
 	var err error
 	if kdialogAvailable {
@@ -87,3 +199,11 @@ func showErrorDialog(title, message string) {
 		log.Errorf("show dialog: error handling: %v", err)
 	}
 }
+
+func queuedBytes(stats []sched.StreamStats) int {
+	queued := 0
+	for _, s := range stats {
+		queued += s.QueuedBytes
+	}
+	return queued
+}
@@ -4,40 +4,60 @@ import (
 	"context"
 	"fmt"
 	"io"
+	"net/http"
 	"os"
 
 	"filippo.io/age"
 	"github.com/knadh/koanf"
 	"github.com/knadh/koanf/parsers/json"
 	"github.com/knadh/koanf/providers/file"
-	"github.com/libp2p/go-yamux/v3"
 	"github.com/pymq/demhack4/config"
+	"github.com/pymq/demhack4/dnsproxy"
 	"github.com/pymq/demhack4/encoding"
-	"github.com/pymq/demhack4/icq"
+	"github.com/pymq/demhack4/profile"
+	"github.com/pymq/demhack4/sched"
 	"github.com/pymq/demhack4/socksproxy"
+	"github.com/pymq/demhack4/tunnel"
 	log "github.com/sirupsen/logrus"
 )
 
 type CliApp struct {
-	cfg           config.Client
-	encoder       *encoding.Encoder
-	ctxCancel     context.CancelFunc
-	ctxCancelDone chan struct{} // closed on done
+	cfg              config.Client
+	tunnel           *tunnel.Tunnel
+	knownServers     *config.KnownKeys
+	priorityRules    sched.Rules
+	proxyUsers       socksproxy.Users
+	remoteForwards   map[int]string // target by port
+	router           *socksproxy.Router
+	direct           *socksproxy.Server // serves destinations routed directly
+	usage            *usageCounters
+	serverKeyChanged bool
+	ctxCancel        context.CancelFunc
+	ctxCancelDone    chan struct{} // closed on done
+}
+
+// ServerKeyChangedError is returned when configured server key differs from the one trusted before.
+// User should compare fingerprint with server operator and call TrustServerKey (or `client verify`).
+type ServerKeyChangedError struct {
+	OldFingerprint string
+	NewFingerprint string
+}
+
+func (e ServerKeyChangedError) Error() string {
+	return fmt.Sprintf("server key has CHANGED since last connection (old fingerprint: %s, new fingerprint: %s), "+
+		"verify new fingerprint with server owner", e.OldFingerprint, e.NewFingerprint)
 }
 
 func NewCliApp() *CliApp {
-	k := koanf.New(".")
-	err := k.Load(file.Provider(config.ClientFilename), json.Parser())
-	if err != nil && !os.IsNotExist(err) {
-		log.Panicf("error loading config: %v", err)
-	}
+	return newCliApp(os.Stdout)
+}
 
-	cfg := config.Client{}
-	err = k.Unmarshal("", &cfg)
+// newCliApp loads config and keys, printing public key of client to out.
+func newCliApp(out io.Writer) *CliApp {
+	cfg, err := loadConfig()
 	if err != nil {
-		log.Panicf("error unmarshaling config: %v", err)
+		log.Panic(err)
 	}
-	config.SetClientDefaults(&cfg)
 
 	var privateKey *age.X25519Identity
 	if len(cfg.PrivateKey) == 0 {
@@ -53,87 +73,173 @@ func NewCliApp() *CliApp {
 	}
 
 	cfg.PrivateKey = privateKey.String()
-	fmt.Printf("My public key:\n%s\n", privateKey.Recipient().String())
+	fmt.Fprintf(out, "My public key:\n%s\n", privateKey.Recipient().String())
+	fmt.Fprintf(out, "My key fingerprint:\n%s\n", encoding.Fingerprint(privateKey.Recipient().String()))
 	// saving new values from defaults, generated private key
 	err = config.SaveConfig(cfg, config.ClientFilename)
 	if err != nil {
 		log.Panicf("error saving config: %v", err)
 	}
 
-	serverPubKey, err := encoding.UnmarshalPublicKey(cfg.ServerPublicKey)
+	knownServers, err := config.LoadKnownKeys(config.ClientKnownKeysFilename)
 	if err != nil {
-		log.Panicf("error decoding server public key: %v", err)
+		log.Panicf("error loading known servers: %v", err)
 	}
 
-	encoder := encoding.NewEncoder(privateKey)
-	err = encoder.SetPeerPublicKey([]byte(serverPubKey.String()))
+	messageLimits, err := config.LoadMessageLimits(config.MessageLimitsFilename)
 	if err != nil {
-		log.Panicf("error setting server public key: %v", err)
+		log.Panicf("error loading message limits: %v", err)
 	}
 
-	return &CliApp{cfg: cfg, encoder: encoder}
-}
+	proxyUsers, err := socksproxy.NewUsers(cfg.ProxyUsers)
+	if err != nil {
+		log.Panicf("error loading proxy users: %v", err)
+	}
 
-func (app *CliApp) StartProxy(ctx context.Context) error {
-	ctx, app.ctxCancel = context.WithCancel(ctx)
+	remoteForwards, err := remoteForwardTargets(cfg.RemoteForwards)
+	if err != nil {
+		log.Panicf("error loading forwards: %v", err)
+	}
 
-	icqClient := icq.NewICQClient(app.cfg.ICQ.ClientToken)
-	msgCh := icqClient.MessageChan(ctx, app.cfg.ICQ.BotRoomID)
-	rwc := icq.NewRWCClient(ctx, icqClient, msgCh, &icq.ICQEncoder{Encoder: *app.encoder}, encoding.MaxMessageLen, app.cfg.ICQ.BotRoomID)
+	router, err := socksproxy.NewRouter(cfg.Routing)
+	if err != nil {
+		log.Panicf("error loading routing rules: %v", err)
+	}
+	direct, err := socksproxy.NewServer(socksproxy.ServerOptions{Unrestricted: true})
+	if err != nil {
+		log.Panicf("error initializing direct connections: %v", err)
+	}
 
-	encKey, err := app.encoder.PackMessage(encoding.PublicKey, app.encoder.GetOwnPublicKey())
+	app := &CliApp{
+		cfg:            cfg,
+		knownServers:   knownServers,
+		priorityRules:  sched.NewRules(cfg.StreamPriority),
+		proxyUsers:     proxyUsers,
+		remoteForwards: remoteForwards,
+		router:         router,
+		direct:         direct,
+		usage:          newUsageCounters(),
+	}
+	app.tunnel, err = tunnel.New(tunnel.Options{
+		Config:        cfg,
+		MessageLimits: messageLimits,
+		OnConnect:     app.requestRemoteForwards,
+	})
 	if err != nil {
-		return fmt.Errorf("pack message error: %v", err)
+		log.Panicf("error initializing tunnel: %v", err)
 	}
 
-	err = icqClient.SendMessage(ctx, encKey, app.cfg.ICQ.BotRoomID)
+	switch knownServers.Check(cfg.ICQ.BotRoomID, cfg.ServerPublicKey) {
+	case config.KeyNew:
+		log.Infof("trusting server key on first use, fingerprint: %s", encoding.Fingerprint(cfg.ServerPublicKey))
+		err = knownServers.Trust(cfg.ICQ.BotRoomID, cfg.ServerPublicKey)
+		if err != nil {
+			log.Panicf("error saving known server key: %v", err)
+		}
+	case config.KeyChanged:
+		app.serverKeyChanged = true
+		log.Warnf("!!! WARNING: %v !!!", app.serverKeyError())
+	}
+
+	return app
+}
+
+// UserUsage returns tunnel traffic of proxy listener users, anonymous one has empty name.
+func (app *CliApp) UserUsage() []UserUsage {
+	return app.usage.snapshot()
+}
+
+// ServerFingerprint returns fingerprint of configured server key.
+func (app *CliApp) ServerFingerprint() string {
+	return encoding.Fingerprint(app.cfg.ServerPublicKey)
+}
+
+// TrustServerKey accepts configured server key after it has changed.
+func (app *CliApp) TrustServerKey() error {
+	err := app.knownServers.Trust(app.cfg.ICQ.BotRoomID, app.cfg.ServerPublicKey)
 	if err != nil {
-		return fmt.Errorf("send public key error: %v", err)
+		return err
+	}
+	app.serverKeyChanged = false
+	return nil
+}
+
+func (app *CliApp) serverKeyError() ServerKeyChangedError {
+	oldKey, _ := app.knownServers.Get(app.cfg.ICQ.BotRoomID)
+	return ServerKeyChangedError{
+		OldFingerprint: encoding.Fingerprint(oldKey),
+		NewFingerprint: app.ServerFingerprint(),
+	}
+}
+
+func (app *CliApp) StartProxy(ctx context.Context) (err error) {
+	if app.serverKeyChanged {
+		return app.serverKeyError()
 	}
 
-	yamuxCfg := yamux.DefaultConfig()
-	yamuxCfg.EnableKeepAlive = false
-	yamuxSession, err := yamux.Client(socksproxy.ConnWrapper{ReadWriteCloser: rwc}, yamuxCfg, nil)
+	ctx, cancel := context.WithCancel(ctx)
+	defer func() {
+		if err != nil {
+			cancel()
+		}
+	}()
+
+	err = app.tunnel.Start(ctx)
 	if err != nil {
-		return fmt.Errorf("init yamux client connection error: %v", err)
+		return err
 	}
 
 	proxy, err := socksproxy.NewClient(app.cfg.ProxyListenAddr)
 	if err != nil {
+		_ = app.tunnel.Close()
 		return fmt.Errorf("setup proxy error: %v", err)
 	}
 
-	proxyConns := proxy.ConnsChan()
-	closeDone := make(chan struct{})
-	go func() {
-		for {
-			select {
-			case <-ctx.Done():
-				err = yamuxSession.Close()
-				if err != nil {
-					log.Warnf("close yamux session error: %v", err)
-				}
-				err := proxy.Close()
-				if err != nil {
-					log.Warnf("close proxy error: %v", err)
-				}
-				close(closeDone)
-				return
-			case conn := <-proxyConns:
-				stream, err := yamuxSession.Open(ctx)
-				if err != nil {
-					log.Warnf("open yamux session error: %v", err)
-					err = conn.Close()
-					if err != nil {
-						log.Warnf("close proxy connection error: %v", err)
-					}
-				} else {
-					go bidirectionalCopy(stream, conn)
-				}
+	var dns *dnsproxy.Forwarder
+	if app.cfg.DNS.ListenAddr != "" {
+		dns, err = dnsproxy.NewForwarder(dnsproxy.ForwarderOptions{
+			ListenAddr: app.cfg.DNS.ListenAddr,
+			CacheSize:  app.cfg.DNS.CacheSize,
+			Timeout:    app.cfg.DNS.Timeout,
+			Open:       app.openStream,
+			// DNS has no authentication, clients from other hosts would bypass proxy users
+			LoopbackOnly: app.proxyUsers != nil,
+		})
+		if err != nil {
+			_ = proxy.Close()
+			_ = app.tunnel.Close()
+			return fmt.Errorf("setup dns server error: %v", err)
+		}
+		log.Infof("dns server listens on %s", dns.Addr())
+	}
+
+	forwards, err := app.listenLocalForwards()
+	if err != nil {
+		if dns != nil {
+			_ = dns.Close()
+		}
+		_ = proxy.Close()
+		_ = app.tunnel.Close()
+		return fmt.Errorf("setup forwards error: %v", err)
+	}
+
+	var pac *http.Server
+	if app.cfg.Routing.PACListenAddr != "" {
+		pac, err = app.listenPAC()
+		if err != nil {
+			forwards.close()
+			if dns != nil {
+				_ = dns.Close()
 			}
+			_ = proxy.Close()
+			_ = app.tunnel.Close()
+			return fmt.Errorf("setup pac server error: %v", err)
 		}
-	}()
+	}
 
+	closeDone := make(chan struct{})
+	go app.supervise(ctx, proxy, dns, forwards, pac, closeDone)
+	app.ctxCancel = cancel
 	app.ctxCancelDone = closeDone
 
 	return nil
@@ -150,6 +256,62 @@ func (app *CliApp) StopProxy() {
 	}
 }
 
+// ImportProfile saves connection parameters from profile link into client config.
+func ImportProfile(link string) error {
+	p, err := profile.Parse(link)
+	if err != nil {
+		return err
+	}
+
+	cfg, err := loadConfig()
+	if err != nil {
+		return err
+	}
+	cfg.ServerPublicKey = p.ServerPublicKey
+	cfg.InviteToken = p.InviteToken
+	switch p.Carrier {
+	case profile.ICQ:
+		cfg.ICQ.BotRoomID = p.RoomID
+	}
+
+	return config.SaveConfig(cfg, config.ClientFilename)
+}
+
+// VerifyServerKey compares fingerprint told by server owner with configured server key.
+// On match the key becomes trusted.
+func VerifyServerKey(fingerprint string) (bool, error) {
+	cfg, err := loadConfig()
+	if err != nil {
+		return false, err
+	}
+	if !encoding.FingerprintsEqual(fingerprint, encoding.Fingerprint(cfg.ServerPublicKey)) {
+		return false, nil
+	}
+
+	knownServers, err := config.LoadKnownKeys(config.ClientKnownKeysFilename)
+	if err != nil {
+		return false, err
+	}
+	return true, knownServers.Trust(cfg.ICQ.BotRoomID, cfg.ServerPublicKey)
+}
+
+func loadConfig() (config.Client, error) {
+	k := koanf.New(".")
+	err := k.Load(file.Provider(config.ClientFilename), json.Parser())
+	if err != nil && !os.IsNotExist(err) {
+		return config.Client{}, fmt.Errorf("error loading config: %v", err)
+	}
+
+	cfg := config.Client{}
+	err = k.Unmarshal("", &cfg)
+	if err != nil {
+		return config.Client{}, fmt.Errorf("error unmarshaling config: %v", err)
+	}
+	config.SetClientDefaults(&cfg)
+
+	return cfg, nil
+}
+
 func bidirectionalCopy(first io.ReadWriteCloser, second io.ReadWriteCloser) {
 	errCh := make(chan error, 2)
 	go func() {
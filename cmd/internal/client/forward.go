@@ -0,0 +1,150 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/pymq/demhack4/config"
+	"github.com/pymq/demhack4/socksproxy"
+	log "github.com/sirupsen/logrus"
+)
+
+// forwardDialTimeout limits connecting to target of remote forward
+const forwardDialTimeout = 30 * time.Second
+
+// localForwards are listeners of local forwards, which connect to their targets from server.
+type localForwards []net.Listener
+
+// listenLocalForwards starts listeners of configured local forwards.
+func (app *CliApp) listenLocalForwards() (localForwards, error) {
+	var forwards localForwards
+	for _, forward := range app.cfg.LocalForwards {
+		_, _, err := net.SplitHostPort(forward.Target)
+		if err != nil {
+			forwards.close()
+			return nil, fmt.Errorf("local forward %s: invalid target: %v", forward.Listen, err)
+		}
+		listener, err := net.Listen("tcp", forward.Listen)
+		if err != nil {
+			forwards.close()
+			return nil, fmt.Errorf("local forward: %v", err)
+		}
+		log.Infof("forwarding %s to %s", listener.Addr(), forward.Target)
+		forwards = append(forwards, listener)
+		go app.serveLocalForward(listener, forward.Target)
+	}
+	return forwards, nil
+}
+
+func (app *CliApp) serveLocalForward(listener net.Listener, target string) {
+	_, portStr, _ := net.SplitHostPort(target)
+	port, _ := strconv.Atoi(portStr)
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				log.Warnf("local forward accept error: %v", err)
+			}
+			return
+		}
+		go func() {
+			stream, err := app.tunnel.OpenStream(context.Background(), app.priorityRules.Match(port))
+			if err != nil {
+				log.Warnf("local forward to %s error: %v", target, err)
+				_ = conn.Close()
+				return
+			}
+			err = socksproxy.Dial(stream, target)
+			if err != nil {
+				log.Warnf("local forward to %s error: %v", target, err)
+				_ = conn.Close()
+				_ = stream.Close()
+				return
+			}
+			bidirectionalCopy(stream, conn)
+		}()
+	}
+}
+
+func (f localForwards) close() {
+	for _, listener := range f {
+		_ = listener.Close()
+	}
+}
+
+// remoteForwardTargets maps ports, which server listens on for remote forwards, to their targets.
+func remoteForwardTargets(forwards []config.Forward) (map[int]string, error) {
+	targets := map[int]string{}
+	for _, forward := range forwards {
+		portStr := forward.Listen
+		if _, p, err := net.SplitHostPort(forward.Listen); err == nil {
+			portStr = p
+		}
+		port, err := strconv.Atoi(portStr)
+		if err != nil || port < 1 || port > 65535 {
+			return nil, fmt.Errorf("remote forward: invalid port of '%s'", forward.Listen)
+		}
+		if _, _, err = net.SplitHostPort(forward.Target); err != nil {
+			return nil, fmt.Errorf("remote forward %s: invalid target: %v", forward.Listen, err)
+		}
+		if _, ok := targets[port]; ok {
+			return nil, fmt.Errorf("remote forward: duplicate port %d", port)
+		}
+		targets[port] = forward.Target
+	}
+	return targets, nil
+}
+
+// requestRemoteForwards asks server to listen on ports of remote forwards. Server stops listening
+// when session dies, so it is called for every new session.
+func (app *CliApp) requestRemoteForwards() {
+	for port, target := range app.remoteForwards {
+		stream, err := app.tunnel.OpenStream(context.Background(), 0)
+		if err != nil {
+			log.Warnf("remote forward of port %d error: %v", port, err)
+			continue
+		}
+		// control stream stays open while forward lasts
+		err = socksproxy.RequestRemoteForward(stream, port)
+		if err != nil {
+			log.Warnf("remote forward of port %d error: %v", port, err)
+			_ = stream.Close()
+			continue
+		}
+		log.Infof("server forwards port %d to %s", port, target)
+	}
+}
+
+// serveRemoteForwards connects streams of connections accepted by server to targets of remote forwards.
+func (app *CliApp) serveRemoteForwards(ctx context.Context) {
+	for {
+		stream, err := app.tunnel.Accept(ctx)
+		if err != nil {
+			return
+		}
+		go func() {
+			port, err := socksproxy.ReadForwardedPort(stream)
+			if err != nil {
+				_ = stream.Close()
+				return
+			}
+			target, ok := app.remoteForwards[port]
+			if !ok {
+				log.Warnf("server forwarded unknown port %d", port)
+				_ = stream.Close()
+				return
+			}
+			conn, err := net.DialTimeout("tcp", target, forwardDialTimeout)
+			if err != nil {
+				log.Warnf("remote forward to %s error: %v", target, err)
+				_ = stream.Close()
+				return
+			}
+			bidirectionalCopy(stream, conn)
+		}()
+	}
+}
@@ -0,0 +1,58 @@
+package client
+
+import (
+	"context"
+	"io"
+	"os"
+)
+
+// Pipe connects in and out to addr, "host:port", through a single stream of new tunnel,
+// like `nc -X 5` for ssh ProxyCommand. When in ends, only write side of the stream is closed
+// and Pipe returns after destination closes the connection, or when ctx is done.
+// Stdout may be passed as out, client info is printed to stderr.
+func Pipe(ctx context.Context, addr string, in io.Reader, out io.Writer) error {
+	app := newCliApp(os.Stderr)
+	// pipe serves only its own stream
+	app.remoteForwards = nil
+	return app.pipe(ctx, addr, in, out)
+}
+
+func (app *CliApp) pipe(ctx context.Context, addr string, in io.Reader, out io.Writer) error {
+	if app.serverKeyChanged {
+		return app.serverKeyError()
+	}
+	err := app.tunnel.Start(ctx)
+	if err != nil {
+		return err
+	}
+	defer app.tunnel.Close()
+	conn, err := app.tunnel.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	inErr := make(chan error, 1)
+	go func() {
+		_, err := io.Copy(conn, in)
+		if cw, ok := conn.(interface{ CloseWrite() error }); ok && err == nil {
+			// destination may still answer, wait for its output
+			err = cw.CloseWrite()
+			if err == nil {
+				return
+			}
+		}
+		inErr <- err
+	}()
+	outErr := make(chan error, 1)
+	go func() {
+		_, err := io.Copy(out, conn)
+		outErr <- err
+	}()
+	select {
+	case err = <-inErr:
+	case err = <-outErr:
+	case <-ctx.Done():
+	}
+	return err
+}
@@ -0,0 +1,58 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+
+	"github.com/pymq/demhack4/sched"
+	"github.com/pymq/demhack4/socksproxy"
+	log "github.com/sirupsen/logrus"
+)
+
+// openRoute opens stream for request by routing rules: through tunnel, or to local SOCKS server
+// for destinations routed directly. UDP associations have no single destination and take default route.
+func (app *CliApp) openRoute(ctx context.Context, req *socksproxy.Request) (io.ReadWriteCloser, error) {
+	priority := app.priorityRules.Match(req.Port)
+	route := app.router.Default()
+	if req.Command == socksproxy.CommandUDPAssociate {
+		// mostly DNS and realtime traffic
+		priority = sched.PriorityInteractive
+	} else {
+		route = app.router.Route(ctx, req.Host, req.Port)
+	}
+
+	switch route {
+	case socksproxy.RouteBlock:
+		return nil, socksproxy.ErrRouteBlocked
+	case socksproxy.RouteDirect:
+		stream, serverStream := net.Pipe()
+		app.direct.ServeConn(serverStream, socksproxy.Peer{})
+		return stream, nil
+	}
+	stream, err := app.tunnel.OpenStream(ctx, priority)
+	if err != nil {
+		return nil, fmt.Errorf("open mux stream error: %v", err)
+	}
+	return app.usage.track(req.User, stream), nil
+}
+
+// listenPAC serves proxy auto-config file, so browsers route destinations by the same rules.
+func (app *CliApp) listenPAC() (*http.Server, error) {
+	listener, err := net.Listen("tcp", app.cfg.Routing.PACListenAddr)
+	if err != nil {
+		return nil, err
+	}
+	server := &http.Server{Handler: app.router.PACHandler(app.cfg.ProxyListenAddr)}
+	go func() {
+		err := server.Serve(listener)
+		if err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Warnf("pac server error: %v", err)
+		}
+	}()
+	log.Infof("pac file is served on http://%s/proxy.pac", listener.Addr())
+	return server, nil
+}
@@ -0,0 +1,137 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/pymq/demhack4/dnsproxy"
+	"github.com/pymq/demhack4/icq"
+	"github.com/pymq/demhack4/sched"
+	"github.com/pymq/demhack4/socksproxy"
+	"github.com/pymq/demhack4/tunnel"
+	log "github.com/sirupsen/logrus"
+)
+
+// Status returns current tunnel status and the last connection error, if any.
+func (app *CliApp) Status() (tunnel.Status, error) {
+	return app.tunnel.Status()
+}
+
+// RTT returns round trip estimate of current tunnel.
+func (app *CliApp) RTT() icq.RTTStats {
+	return app.tunnel.RTT()
+}
+
+// StreamStats returns outgoing queues of current tunnel streams.
+func (app *CliApp) StreamStats() []sched.StreamStats {
+	return app.tunnel.StreamStats()
+}
+
+// openStream opens interactive stream of tunnel, waiting while tunnel is reconnecting.
+func (app *CliApp) openStream(ctx context.Context) (io.ReadWriteCloser, error) {
+	return app.tunnel.OpenStream(ctx, sched.PriorityInteractive)
+}
+
+// supervise serves proxy connections until ctx is done or tunnel stops, it reconnects by itself meanwhile.
+// Tunnel, DNS and PAC servers, if any, local forwards and direct connections are closed with proxy.
+func (app *CliApp) supervise(ctx context.Context, proxy *socksproxy.Client, dns *dnsproxy.Forwarder,
+	forwards localForwards, pac *http.Server, done chan struct{}) {
+	defer close(done)
+	defer func() {
+		err := proxy.Close()
+		if err != nil {
+			log.Warnf("close proxy error: %v", err)
+		}
+		if dns != nil {
+			_ = dns.Close()
+		}
+		forwards.close()
+		if pac != nil {
+			_ = pac.Close()
+		}
+		_ = app.tunnel.Close()
+		_ = app.direct.Close()
+		if app.proxyUsers != nil {
+			app.usage.logChanged()
+		}
+	}()
+
+	if len(app.remoteForwards) > 0 {
+		go app.serveRemoteForwards(ctx)
+	}
+	usageTicker := time.NewTicker(usageLogInterval)
+	defer usageTicker.Stop()
+	proxyConns := proxy.ConnsChan()
+	tunnelDone := app.tunnel.Done()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-tunnelDone:
+			return
+		case <-usageTicker.C:
+			if app.proxyUsers != nil {
+				app.usage.logChanged()
+			}
+		case conn := <-proxyConns:
+			go app.proxyConn(ctx, conn)
+		}
+	}
+}
+
+// proxyConn answers SOCKS5, SOCKS4 or HTTP proxy request of connection and serves it with stream
+// of its route: connections are forwarded to server, prioritizing stream by destination port,
+// or to destination directly; UDP associations are relayed locally. While tunnel reconnects,
+// connection waits for it.
+func (app *CliApp) proxyConn(ctx context.Context, conn net.Conn) {
+	req, err := socksproxy.Accept(conn, app.proxyUsers)
+	if err != nil {
+		log.Warnf("proxy connection from %s error: %v", conn.RemoteAddr(), err)
+		_ = conn.Close()
+		return
+	}
+	if req.Command != socksproxy.CommandConnect && req.Command != socksproxy.CommandUDPAssociate {
+		_ = req.Refuse(socksproxy.ReplyCommandNotSupported)
+		_ = req.Conn.Close()
+		return
+	}
+	stream, err := app.openRoute(ctx, req)
+	if err != nil {
+		code := socksproxy.ReplyGeneralFailure
+		if errors.Is(err, socksproxy.ErrRouteBlocked) {
+			code = socksproxy.ReplyNotAllowed
+		}
+		log.Warnf("proxy connection to %s error: %v", req.Addr(), err)
+		_ = req.Refuse(code)
+		_ = req.Conn.Close()
+		return
+	}
+
+	switch {
+	case req.HTTP != nil:
+		err = socksproxy.ForwardHTTP(req, stream, func(req *socksproxy.Request) (io.ReadWriteCloser, error) {
+			return app.openRoute(ctx, req)
+		})
+		if err != nil {
+			log.Warnf("proxy http request error: %v", err)
+		}
+	case req.Command == socksproxy.CommandConnect:
+		err = req.Connect(stream)
+		if err != nil {
+			log.Warnf("proxy connection to %s error: %v", req.Addr(), err)
+			_ = req.Conn.Close()
+			_ = stream.Close()
+			return
+		}
+		bidirectionalCopy(stream, req.Conn)
+	case req.Command == socksproxy.CommandUDPAssociate:
+		err = socksproxy.OpenUDPAssociation(req.Conn, stream)
+		if err != nil {
+			log.Warnf("proxy UDP association error: %v", err)
+		}
+	}
+}
@@ -0,0 +1,98 @@
+package client
+
+import (
+	"io"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// usageLogInterval is how often traffic of proxy users is logged
+const usageLogInterval = 10 * time.Minute
+
+// UserUsage is tunnel traffic of proxy listener user since proxy start, direct connections are not counted.
+type UserUsage struct {
+	Name        string
+	Sent        int64
+	Received    int64
+	Connections int64
+}
+
+// usageCounters count traffic of proxy streams by user.
+type usageCounters struct {
+	lock   sync.Mutex // guards users
+	users  map[string]*UserUsage
+	logged map[string]UserUsage // usage at last log
+}
+
+func newUsageCounters() *usageCounters {
+	return &usageCounters{users: map[string]*UserUsage{}, logged: map[string]UserUsage{}}
+}
+
+// track counts new connection of user and traffic of its stream.
+func (c *usageCounters) track(user string, stream io.ReadWriteCloser) io.ReadWriteCloser {
+	c.lock.Lock()
+	u, ok := c.users[user]
+	if !ok {
+		u = &UserUsage{Name: user}
+		c.users[user] = u
+	}
+	c.lock.Unlock()
+	atomic.AddInt64(&u.Connections, 1)
+	return &countingStream{ReadWriteCloser: stream, usage: u}
+}
+
+// snapshot returns usage of all users sorted by name.
+func (c *usageCounters) snapshot() []UserUsage {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	usage := make([]UserUsage, 0, len(c.users))
+	for _, u := range c.users {
+		usage = append(usage, UserUsage{
+			Name:        u.Name,
+			Sent:        atomic.LoadInt64(&u.Sent),
+			Received:    atomic.LoadInt64(&u.Received),
+			Connections: atomic.LoadInt64(&u.Connections),
+		})
+	}
+	sort.Slice(usage, func(i, j int) bool {
+		return usage[i].Name < usage[j].Name
+	})
+	return usage
+}
+
+// logChanged logs usage of users who made connections or traffic since the last call.
+func (c *usageCounters) logChanged() {
+	for _, u := range c.snapshot() {
+		c.lock.Lock()
+		last := c.logged[u.Name]
+		c.logged[u.Name] = u
+		c.lock.Unlock()
+		if u == last {
+			continue
+		}
+		log.Infof("proxy user '%s': sent %d KiB, received %d KiB in %d connections",
+			u.Name, u.Sent/1024, u.Received/1024, u.Connections)
+	}
+}
+
+// countingStream counts bytes written to stream as sent and read from it as received.
+type countingStream struct {
+	io.ReadWriteCloser
+	usage *UserUsage
+}
+
+func (s *countingStream) Read(p []byte) (int, error) {
+	n, err := s.ReadWriteCloser.Read(p)
+	atomic.AddInt64(&s.usage.Received, int64(n))
+	return n, err
+}
+
+func (s *countingStream) Write(p []byte) (int, error) {
+	n, err := s.ReadWriteCloser.Write(p)
+	atomic.AddInt64(&s.usage.Sent, int64(n))
+	return n, err
+}
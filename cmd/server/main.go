@@ -1,23 +1,102 @@
 package main
 
 import (
+	"crypto/rand"
+	"flag"
 	"fmt"
 	"os"
 	"os/signal"
+	"strings"
 	"syscall"
 
 	"filippo.io/age"
 	"github.com/knadh/koanf"
 	"github.com/knadh/koanf/parsers/json"
 	"github.com/knadh/koanf/providers/file"
+	botgolang "github.com/mail-ru-im/bot-golang"
 	"github.com/pymq/demhack4/config"
 	"github.com/pymq/demhack4/encoding"
 	"github.com/pymq/demhack4/icq"
+	"github.com/pymq/demhack4/profile"
+	"github.com/pymq/demhack4/quota"
 	"github.com/pymq/demhack4/socksproxy"
 	log "github.com/sirupsen/logrus"
 )
 
 func main() {
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "export-profile":
+			exportProfile(os.Args[2:])
+			return
+		case "verify":
+			verify(os.Args[2:])
+			return
+		default:
+			log.Fatalf("unknown command '%s', available commands: export-profile, verify", os.Args[1])
+		}
+	}
+
+	cfg, privateKey := loadConfig()
+	fmt.Printf("My public key:\n%s\n", privateKey.Recipient().String())
+	fmt.Printf("My key fingerprint:\n%s\n", encoding.Fingerprint(privateKey.Recipient().String()))
+
+	knownClients, err := config.LoadKnownKeys(config.ServerKnownKeysFilename)
+	if err != nil {
+		log.Fatalf("error loading known clients: %v", err)
+	}
+
+	proxy, err := socksproxy.NewServer(socksproxy.ServerOptions{Egress: cfg.Egress, RemoteForward: cfg.RemoteForward})
+	if err != nil {
+		log.Fatalf("error initializing proxy: %v", err)
+	}
+	defer func() {
+		err := proxy.Close()
+		if err != nil {
+			log.Warnf("close proxy: %v", err)
+		}
+	}()
+
+	quotaTracker, err := quota.Load(quota.UsageFilename, cfg.Quota)
+	if err != nil {
+		log.Fatalf("error loading quota usage: %v", err)
+	}
+	defer func() {
+		err := quotaTracker.Close()
+		if err != nil {
+			log.Warnf("close quota tracker: %v", err)
+		}
+	}()
+
+	encoder := encoding.NewEncoder(privateKey)
+
+	icqBot, err := icq.NewICQBot(cfg.ICQBotToken, encoder, proxy, icq.BotOptions{
+		InviteTokens:       cfg.InviteTokens,
+		KnownClients:       knownClients,
+		SessionIdleTimeout: cfg.SessionIdleTimeout,
+		SessionQueueBytes:  cfg.SessionQueueBytes,
+		Keepalive:          cfg.Keepalive,
+		RateLimit:          cfg.RateLimit,
+		StreamPriority:     cfg.StreamPriority,
+		Quota:              quotaTracker,
+	})
+	if err != nil {
+		log.Fatalf("error initializing icq bot: %v", err)
+	}
+	defer func() {
+		err := icqBot.Close()
+		if err != nil {
+			log.Warnf("close icq bot: %v", err)
+		}
+	}()
+
+	quitCh := make(chan os.Signal, 1)
+	signal.Notify(quitCh, os.Interrupt, syscall.SIGTERM, syscall.SIGQUIT)
+	sig := <-quitCh
+	log.Infof("received exit signal '%s'", sig)
+}
+
+func loadConfig() (config.Server, *age.X25519Identity) {
 	k := koanf.New(".")
 	err := k.Load(file.Provider(config.ServerFilename), json.Parser())
 	if err != nil && !os.IsNotExist(err) {
@@ -29,6 +108,7 @@ func main() {
 	if err != nil {
 		log.Fatalf("error unmarshaling config: %v", err)
 	}
+	config.SetServerDefaults(&cfg)
 
 	var privateKey *age.X25519Identity
 	if len(cfg.PrivateKey) == 0 {
@@ -44,36 +124,90 @@ func main() {
 	}
 
 	cfg.PrivateKey = privateKey.String()
-	fmt.Printf("My public key:\n%s\n", privateKey.Recipient().String())
 	// saving new values from defaults, generated private key
 	err = config.SaveConfig(cfg, config.ServerFilename)
 	if err != nil {
 		log.Fatalf("error saving config: %v", err)
 	}
 
-	proxy := socksproxy.NewServer()
-	defer func() {
-		err := proxy.Close()
-		if err != nil {
-			log.Warnf("close proxy: %v", err)
-		}
-	}()
+	return cfg, privateKey
+}
 
-	encoder := encoding.NewEncoder(privateKey)
+func exportProfile(args []string) {
+	flags := flag.NewFlagSet("export-profile", flag.ExitOnError)
+	invite := flags.Bool("invite", false, "generate new invite token and put it into the link")
+	qrPath := flags.String("qr", "", "also save link as PNG QR code to this path")
+	qrSize := flags.Int("qr-size", 512, "QR code size in pixels")
+	_ = flags.Parse(args)
 
-	icqBot, err := icq.NewICQBot(cfg.ICQBotToken, encoder, proxy)
+	cfg, privateKey := loadConfig()
+
+	bot, err := botgolang.NewBot(cfg.ICQBotToken)
 	if err != nil {
 		log.Fatalf("error initializing icq bot: %v", err)
 	}
-	defer func() {
-		err := icqBot.Close()
+
+	p := profile.Profile{
+		Carrier:         profile.ICQ,
+		ServerPublicKey: privateKey.Recipient().String(),
+		RoomID:          bot.Info.ID,
+	}
+	if *invite {
+		token := make([]byte, 16)
+		_, err = rand.Read(token)
 		if err != nil {
-			log.Warnf("close icq bot: %v", err)
+			log.Fatalf("error generating invite token: %v", err)
 		}
-	}()
+		p.InviteToken = string(encoding.EncodeBase64(token))
+		cfg.InviteTokens = append(cfg.InviteTokens, p.InviteToken)
+		err = config.SaveConfig(cfg, config.ServerFilename)
+		if err != nil {
+			log.Fatalf("error saving config: %v", err)
+		}
+	}
 
-	quitCh := make(chan os.Signal, 1)
-	signal.Notify(quitCh, os.Interrupt, syscall.SIGTERM, syscall.SIGQUIT)
-	sig := <-quitCh
-	log.Infof("received exit signal '%s'", sig)
+	link, err := p.Link()
+	if err != nil {
+		log.Fatalf("error creating profile link: %v", err)
+	}
+	fmt.Println(link)
+
+	if *qrPath != "" {
+		png, err := p.QRCode(*qrSize)
+		if err != nil {
+			log.Fatalf("error creating QR code: %v", err)
+		}
+		err = os.WriteFile(*qrPath, png, 0644)
+		if err != nil {
+			log.Fatalf("error saving QR code: %v", err)
+		}
+	}
+}
+
+// verify compares fingerprint told by user with server's own and known client keys
+func verify(args []string) {
+	if len(args) == 0 {
+		log.Fatalf("usage: %s verify <fingerprint>", os.Args[0])
+	}
+	fingerprint := strings.Join(args, " ")
+
+	_, privateKey := loadConfig()
+	if encoding.FingerprintsEqual(fingerprint, encoding.Fingerprint(privateKey.Recipient().String())) {
+		fmt.Println("fingerprint matches server's own key")
+		return
+	}
+
+	knownClients, err := config.LoadKnownKeys(config.ServerKnownKeysFilename)
+	if err != nil {
+		log.Fatalf("error loading known clients: %v", err)
+	}
+	for key, chatID := range knownClients.All() {
+		if encoding.FingerprintsEqual(fingerprint, encoding.Fingerprint(key)) {
+			fmt.Printf("fingerprint matches client from chat '%s'\n", chatID)
+			return
+		}
+	}
+
+	fmt.Println("fingerprint DOES NOT match any known key")
+	os.Exit(1)
 }
@@ -0,0 +1,31 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/knadh/koanf"
+	"github.com/knadh/koanf/parsers/json"
+	"github.com/knadh/koanf/providers/file"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSaveConfigDurations(t *testing.T) {
+	cfg := Client{LocalForwards: []Forward{{Listen: "127.0.0.1:8080", Target: "example.com:80"}}}
+	SetClientDefaults(&cfg)
+	path := filepath.Join(t.TempDir(), ClientFilename)
+	require.NoError(t, SaveConfig(cfg, path))
+
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+	assert.Contains(t, string(data), `"HandshakeTimeout": "30s"`)
+	assert.Contains(t, string(data), `"ReconnectMaxDelay": "5m0s"`)
+
+	k := koanf.New(".")
+	require.NoError(t, k.Load(file.Provider(path), json.Parser()))
+	var loaded Client
+	require.NoError(t, k.Unmarshal("", &loaded))
+	assert.Equal(t, cfg, loaded)
+}
@@ -0,0 +1,108 @@
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"sync"
+)
+
+const (
+	ClientKnownKeysFilename = "known_servers.json"
+	ServerKnownKeysFilename = "known_clients.json"
+)
+
+type KeyStatus int
+
+const (
+	KeyNew KeyStatus = iota
+	KeyKnown
+	KeyChanged
+)
+
+// KnownKeys is a trust-on-first-use storage of peer public keys.
+// Client indexes server keys by room id, server indexes chat ids by client key.
+type KnownKeys struct {
+	path string
+	keys map[string]string
+	lock sync.Mutex
+}
+
+func LoadKnownKeys(path string) (*KnownKeys, error) {
+	k := &KnownKeys{
+		path: path,
+		keys: map[string]string{},
+	}
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return k, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("read known keys: %v", err)
+	}
+	err = json.Unmarshal(data, &k.keys)
+	if err != nil {
+		return nil, fmt.Errorf("unmarshal known keys: %v", err)
+	}
+
+	return k, nil
+}
+
+func (k *KnownKeys) Check(id, value string) KeyStatus {
+	k.lock.Lock()
+	defer k.lock.Unlock()
+
+	known, ok := k.keys[id]
+	switch {
+	case !ok:
+		return KeyNew
+	case known == value:
+		return KeyKnown
+	default:
+		return KeyChanged
+	}
+}
+
+func (k *KnownKeys) Get(id string) (string, bool) {
+	k.lock.Lock()
+	defer k.lock.Unlock()
+
+	key, ok := k.keys[id]
+	return key, ok
+}
+
+// IDs returns sorted ids stored with value.
+func (k *KnownKeys) IDs(value string) []string {
+	k.lock.Lock()
+	defer k.lock.Unlock()
+
+	var ids []string
+	for id, v := range k.keys {
+		if v == value {
+			ids = append(ids, id)
+		}
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+// All returns copy of stored keys
+func (k *KnownKeys) All() map[string]string {
+	k.lock.Lock()
+	defer k.lock.Unlock()
+
+	keys := make(map[string]string, len(k.keys))
+	for id, key := range k.keys {
+		keys[id] = key
+	}
+	return keys
+}
+
+// Trust remembers value for the id and saves storage to disk.
+func (k *KnownKeys) Trust(id, value string) error {
+	k.lock.Lock()
+	defer k.lock.Unlock()
+
+	k.keys[id] = value
+	return SaveConfig(k.keys, k.path)
+}
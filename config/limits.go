@@ -0,0 +1,57 @@
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+)
+
+const MessageLimitsFilename = "message_limits.json"
+
+// MessageLimits stores message size limits found by probing, indexed by carrier and room,
+// so probing is done once per profile.
+type MessageLimits struct {
+	path   string
+	limits map[string]int
+	lock   sync.Mutex
+}
+
+func LoadMessageLimits(path string) (*MessageLimits, error) {
+	l := &MessageLimits{
+		path:   path,
+		limits: map[string]int{},
+	}
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return l, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("read message limits: %v", err)
+	}
+	err = json.Unmarshal(data, &l.limits)
+	if err != nil {
+		return nil, fmt.Errorf("unmarshal message limits: %v", err)
+	}
+
+	return l, nil
+}
+
+func (l *MessageLimits) Get(id string) (int, bool) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	limit, ok := l.limits[id]
+	return limit, ok
+}
+
+// Set remembers limit for the id and saves storage to disk.
+func (l *MessageLimits) Set(id string, limit int) error {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	if l.limits[id] == limit {
+		return nil
+	}
+	l.limits[id] = limit
+	return SaveConfig(l.limits, l.path)
+}
@@ -0,0 +1,214 @@
+package dnsproxy
+
+import (
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+const (
+	// maxCacheTTL caps caching of answers with long TTLs, so changed records are picked up
+	maxCacheTTL = time.Hour
+	// cdFlag is "checking disabled" bit of the 4th header byte
+	cdFlag = 0x10
+)
+
+// cacheKey is a question of query with its flags, which change answer: EDNS0 allows larger answers,
+// DO asks for DNSSEC records and CD disables their validation.
+type cacheKey struct {
+	name             string
+	qtype            dnsmessage.Type
+	class            dnsmessage.Class
+	edns             bool
+	dnssecOK         bool
+	checkingDisabled bool
+}
+
+type cacheEntry struct {
+	answer  dnsmessage.Message
+	stored  time.Time
+	expires time.Time
+}
+
+// cache keeps answers until their TTL expires. Cached answers are returned with TTLs
+// decreased by time spent in cache.
+type cache struct {
+	size    int
+	lock    sync.Mutex // guards entries
+	entries map[cacheKey]cacheEntry
+	now     func() time.Time
+}
+
+func newCache(size int) *cache {
+	return &cache{
+		size:    size,
+		entries: map[cacheKey]cacheEntry{},
+		now:     time.Now,
+	}
+}
+
+// queryKey returns cache key of query with single question.
+func queryKey(query []byte) (cacheKey, bool) {
+	var p dnsmessage.Parser
+	_, err := p.Start(query)
+	if err != nil {
+		return cacheKey{}, false
+	}
+	questions, err := p.AllQuestions()
+	if err != nil || len(questions) != 1 {
+		return cacheKey{}, false
+	}
+	q := questions[0]
+	key := cacheKey{
+		name:             strings.ToLower(q.Name.String()),
+		qtype:            q.Type,
+		class:            q.Class,
+		checkingDisabled: query[3]&cdFlag != 0,
+	}
+	if p.SkipAllAnswers() != nil || p.SkipAllAuthorities() != nil {
+		return cacheKey{}, false
+	}
+	for {
+		h, err := p.AdditionalHeader()
+		if err == dnsmessage.ErrSectionDone {
+			break
+		} else if err != nil {
+			return cacheKey{}, false
+		}
+		if h.Type == dnsmessage.TypeOPT {
+			key.edns = true
+			key.dnssecOK = h.DNSSECAllowed()
+		}
+		if p.SkipAdditional() != nil {
+			return cacheKey{}, false
+		}
+	}
+	return key, true
+}
+
+// get returns cached answer to query with ID of query.
+func (c *cache) get(query []byte) ([]byte, bool) {
+	key, ok := queryKey(query)
+	if !ok || c.size <= 0 {
+		return nil, false
+	}
+	c.lock.Lock()
+	entry, ok := c.entries[key]
+	now := c.now()
+	if ok && !now.Before(entry.expires) {
+		delete(c.entries, key)
+		ok = false
+	}
+	c.lock.Unlock()
+	if !ok {
+		return nil, false
+	}
+
+	answer := entry.answer
+	answer.Answers = agedResources(answer.Answers, now.Sub(entry.stored))
+	answer.Authorities = agedResources(answer.Authorities, now.Sub(entry.stored))
+	answer.Additionals = agedResources(answer.Additionals, now.Sub(entry.stored))
+	answer.Header.ID = uint16(query[0])<<8 | uint16(query[1])
+	msg, err := answer.Pack()
+	if err != nil {
+		return nil, false
+	}
+	return msg, true
+}
+
+func agedResources(resources []dnsmessage.Resource, age time.Duration) []dnsmessage.Resource {
+	aged := make([]dnsmessage.Resource, len(resources))
+	copy(aged, resources)
+	for i := range aged {
+		if aged[i].Header.Type == dnsmessage.TypeOPT {
+			continue
+		}
+		ttl := time.Duration(aged[i].Header.TTL)*time.Second - age
+		if ttl < 0 {
+			ttl = 0
+		}
+		aged[i].Header.TTL = uint32(ttl / time.Second)
+	}
+	return aged
+}
+
+// put caches answer to query for the least TTL of its records. Negative answers
+// are cached for TTL of SOA record, if any.
+func (c *cache) put(query, answer []byte) {
+	key, ok := queryKey(query)
+	if !ok || c.size <= 0 {
+		return
+	}
+	var msg dnsmessage.Message
+	err := msg.Unpack(answer)
+	if err != nil || msg.Header.Truncated {
+		return
+	}
+	ttl, ok := answerTTL(msg)
+	if !ok || ttl <= 0 {
+		return
+	}
+	if ttl > maxCacheTTL {
+		ttl = maxCacheTTL
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	now := c.now()
+	if _, exists := c.entries[key]; !exists && len(c.entries) >= c.size {
+		c.evict(now)
+	}
+	c.entries[key] = cacheEntry{answer: msg, stored: now, expires: now.Add(ttl)}
+}
+
+// evict removes expired entries, or any one if none expired. Should be called with lock held.
+func (c *cache) evict(now time.Time) {
+	for key, entry := range c.entries {
+		if !now.Before(entry.expires) {
+			delete(c.entries, key)
+		}
+	}
+	for key := range c.entries {
+		if len(c.entries) < c.size {
+			break
+		}
+		delete(c.entries, key)
+	}
+}
+
+func answerTTL(msg dnsmessage.Message) (time.Duration, bool) {
+	switch msg.Header.RCode {
+	case dnsmessage.RCodeSuccess:
+		if len(msg.Answers) == 0 {
+			return negativeTTL(msg)
+		}
+		ttl := msg.Answers[0].Header.TTL
+		for _, r := range msg.Answers {
+			if r.Header.TTL < ttl {
+				ttl = r.Header.TTL
+			}
+		}
+		return time.Duration(ttl) * time.Second, true
+	case dnsmessage.RCodeNameError:
+		return negativeTTL(msg)
+	default:
+		return 0, false
+	}
+}
+
+func negativeTTL(msg dnsmessage.Message) (time.Duration, bool) {
+	for _, r := range msg.Authorities {
+		soa, ok := r.Body.(*dnsmessage.SOAResource)
+		if !ok {
+			continue
+		}
+		ttl := r.Header.TTL
+		if soa.MinTTL < ttl {
+			ttl = soa.MinTTL
+		}
+		return time.Duration(ttl) * time.Second, true
+	}
+	return 0, false
+}
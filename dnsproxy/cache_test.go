@@ -0,0 +1,153 @@
+package dnsproxy
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+func newQuery(t *testing.T, id uint16, name string, qtype dnsmessage.Type) []byte {
+	msg := dnsmessage.Message{
+		Header: dnsmessage.Header{ID: id, RecursionDesired: true},
+		Questions: []dnsmessage.Question{{
+			Name:  dnsmessage.MustNewName(name),
+			Type:  qtype,
+			Class: dnsmessage.ClassINET,
+		}},
+	}
+	query, err := msg.Pack()
+	require.NoError(t, err)
+	return query
+}
+
+func newAnswer(t *testing.T, query []byte, rcode dnsmessage.RCode, resources ...dnsmessage.Resource) []byte {
+	var msg dnsmessage.Message
+	require.NoError(t, msg.Unpack(query))
+	msg.Header.Response = true
+	msg.Header.RCode = rcode
+	for _, r := range resources {
+		if _, ok := r.Body.(*dnsmessage.SOAResource); ok {
+			msg.Authorities = append(msg.Authorities, r)
+		} else {
+			msg.Answers = append(msg.Answers, r)
+		}
+	}
+	answer, err := msg.Pack()
+	require.NoError(t, err)
+	return answer
+}
+
+func aRecord(name string, ttl uint32, ip [4]byte) dnsmessage.Resource {
+	return dnsmessage.Resource{
+		Header: dnsmessage.ResourceHeader{Name: dnsmessage.MustNewName(name), Class: dnsmessage.ClassINET, TTL: ttl},
+		Body:   &dnsmessage.AResource{A: ip},
+	}
+}
+
+func TestCache(t *testing.T) {
+	c := newCache(2)
+	now := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	c.now = func() time.Time { return now }
+
+	query := newQuery(t, 1, "example.com.", dnsmessage.TypeA)
+	c.put(query, newAnswer(t, query, dnsmessage.RCodeSuccess,
+		aRecord("example.com.", 300, [4]byte{1, 2, 3, 4}),
+		aRecord("example.com.", 60, [4]byte{1, 2, 3, 5})))
+
+	now = now.Add(20 * time.Second)
+	cached, ok := c.get(newQuery(t, 7, "EXAMPLE.com.", dnsmessage.TypeA))
+	require.True(t, ok)
+	var msg dnsmessage.Message
+	require.NoError(t, msg.Unpack(cached))
+	assert.Equal(t, uint16(7), msg.Header.ID)
+	require.Len(t, msg.Answers, 2)
+	assert.Equal(t, uint32(280), msg.Answers[0].Header.TTL)
+	assert.Equal(t, uint32(40), msg.Answers[1].Header.TTL)
+
+	_, ok = c.get(newQuery(t, 7, "example.com.", dnsmessage.TypeAAAA))
+	assert.False(t, ok, "other type is not cached")
+
+	// answer expires by the least TTL
+	now = now.Add(40 * time.Second)
+	_, ok = c.get(query)
+	assert.False(t, ok)
+}
+
+func TestCacheNegative(t *testing.T) {
+	c := newCache(10)
+	now := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	c.now = func() time.Time { return now }
+
+	soa := dnsmessage.Resource{
+		Header: dnsmessage.ResourceHeader{Name: dnsmessage.MustNewName("com."), Class: dnsmessage.ClassINET, TTL: 900},
+		Body: &dnsmessage.SOAResource{
+			NS:     dnsmessage.MustNewName("a.gtld-servers.net."),
+			MBox:   dnsmessage.MustNewName("nstld.verisign-grs.com."),
+			MinTTL: 30,
+		},
+	}
+	query := newQuery(t, 1, "missing.com.", dnsmessage.TypeA)
+	c.put(query, newAnswer(t, query, dnsmessage.RCodeNameError, soa))
+	_, ok := c.get(query)
+	assert.True(t, ok)
+	now = now.Add(30 * time.Second)
+	_, ok = c.get(query)
+	assert.False(t, ok, "negative answer is cached for SOA minimum")
+
+	// failures and negative answers without SOA are not cached
+	query = newQuery(t, 2, "broken.com.", dnsmessage.TypeA)
+	c.put(query, newAnswer(t, query, dnsmessage.RCodeServerFailure))
+	_, ok = c.get(query)
+	assert.False(t, ok)
+	c.put(query, newAnswer(t, query, dnsmessage.RCodeNameError))
+	_, ok = c.get(query)
+	assert.False(t, ok)
+}
+
+func TestCacheEviction(t *testing.T) {
+	c := newCache(2)
+	for i, name := range []string{"a.com.", "b.com.", "c.com."} {
+		query := newQuery(t, uint16(i), name, dnsmessage.TypeA)
+		c.put(query, newAnswer(t, query, dnsmessage.RCodeSuccess, aRecord(name, 60, [4]byte{1, 1, 1, byte(i)})))
+	}
+	assert.Len(t, c.entries, 2)
+	_, ok := c.get(newQuery(t, 1, "c.com.", dnsmessage.TypeA))
+	assert.True(t, ok, "the last answer is cached")
+}
+
+func TestCacheKeyFlags(t *testing.T) {
+	c := newCache(10)
+	query := newQuery(t, 1, "example.com.", dnsmessage.TypeA)
+	c.put(query, newAnswer(t, query, dnsmessage.RCodeSuccess, aRecord("example.com.", 60, [4]byte{1, 2, 3, 4})))
+
+	var opt dnsmessage.ResourceHeader
+	require.NoError(t, opt.SetEDNS0(4096, dnsmessage.RCodeSuccess, false))
+	ednsQuery := withOPT(t, query, opt)
+	_, ok := c.get(ednsQuery)
+	assert.False(t, ok, "answer to query without EDNS0 isn't used for EDNS0 query")
+
+	require.NoError(t, opt.SetEDNS0(4096, dnsmessage.RCodeSuccess, true))
+	doQuery := withOPT(t, query, opt)
+	c.put(ednsQuery, newAnswer(t, ednsQuery, dnsmessage.RCodeSuccess, aRecord("example.com.", 60, [4]byte{1, 2, 3, 4})))
+	_, ok = c.get(doQuery)
+	assert.False(t, ok, "answer without DNSSEC records isn't used for DO query")
+	_, ok = c.get(ednsQuery)
+	assert.True(t, ok)
+
+	cdQuery := append([]byte(nil), query...)
+	cdQuery[3] |= cdFlag
+	_, ok = c.get(cdQuery)
+	assert.False(t, ok, "validated answer isn't used for CD query")
+}
+
+func withOPT(t *testing.T, query []byte, opt dnsmessage.ResourceHeader) []byte {
+	var msg dnsmessage.Message
+	require.NoError(t, msg.Unpack(query))
+	msg.Additionals = []dnsmessage.Resource{{Header: opt, Body: &dnsmessage.OPTResource{}}}
+	packed, err := msg.Pack()
+	require.NoError(t, err)
+	return packed
+}
@@ -0,0 +1,171 @@
+// Package dnsproxy resolves names through the tunnel. Client side runs local DNS server and
+// forwards queries in one stream to server side, which asks its resolvers.
+//
+// DNS stream starts with StreamMark instead of SOCKS version, then carries messages in
+// DNS over TCP framing: 2 bytes of length and message. Messages written together are batched
+// in one write, so they go in one carrier message.
+package dnsproxy
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"sync"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+const (
+	// StreamMark is the first byte of DNS stream
+	StreamMark byte = 0xf4
+	// batchDelay is how long written message waits for others to be sent together
+	batchDelay = 5 * time.Millisecond
+	maxBatch   = 16 * 1024
+	// maxUDPSize is answer size for UDP clients without EDNS
+	maxUDPSize = 512
+)
+
+var errClosed = errors.New("dnsproxy: stream closed")
+
+// readMsg reads message in DNS over TCP framing.
+func readMsg(r io.Reader) ([]byte, error) {
+	var size [2]byte
+	_, err := io.ReadFull(r, size[:])
+	if err != nil {
+		return nil, err
+	}
+	msg := make([]byte, binary.BigEndian.Uint16(size[:]))
+	_, err = io.ReadFull(r, msg)
+	if err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
+
+func frame(msg []byte) []byte {
+	buf := make([]byte, 2+len(msg))
+	binary.BigEndian.PutUint16(buf, uint16(len(msg)))
+	copy(buf[2:], msg)
+	return buf
+}
+
+// batchWriter writes messages queued within batchDelay in one write.
+type batchWriter struct {
+	w         io.WriteCloser
+	queue     chan []byte
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+func newBatchWriter(w io.WriteCloser) *batchWriter {
+	b := &batchWriter{
+		w:     w,
+		queue: make(chan []byte, 64),
+		done:  make(chan struct{}),
+	}
+	go b.loop()
+	return b
+}
+
+func (b *batchWriter) write(msg []byte) error {
+	select {
+	case b.queue <- frame(msg):
+		return nil
+	case <-b.done:
+		return errClosed
+	}
+}
+
+func (b *batchWriter) loop() {
+	for {
+		var buf []byte
+		select {
+		case buf = <-b.queue:
+		case <-b.done:
+			return
+		}
+
+		timer := time.NewTimer(batchDelay)
+	collect:
+		for len(buf) < maxBatch {
+			select {
+			case msg := <-b.queue:
+				buf = append(buf, msg...)
+			case <-timer.C:
+				break collect
+			case <-b.done:
+				timer.Stop()
+				return
+			}
+		}
+		timer.Stop()
+
+		_, err := b.w.Write(buf)
+		if err != nil {
+			b.close()
+			return
+		}
+	}
+}
+
+// close stops writer and closes underlying stream.
+func (b *batchWriter) close() {
+	b.closeOnce.Do(func() {
+		close(b.done)
+		_ = b.w.Close()
+	})
+}
+
+// setID returns copy of message with given ID.
+func setID(msg []byte, id uint16) []byte {
+	msg = append([]byte(nil), msg...)
+	binary.BigEndian.PutUint16(msg, id)
+	return msg
+}
+
+// errorReply builds reply to query with given code and no records.
+func errorReply(query []byte, rcode dnsmessage.RCode) ([]byte, error) {
+	return emptyReply(query, func(h *dnsmessage.Header) {
+		h.RCode = rcode
+	})
+}
+
+// truncatedReply tells client to repeat query over TCP.
+func truncatedReply(query []byte) ([]byte, error) {
+	return emptyReply(query, func(h *dnsmessage.Header) {
+		h.Truncated = true
+	})
+}
+
+func emptyReply(query []byte, setup func(h *dnsmessage.Header)) ([]byte, error) {
+	var p dnsmessage.Parser
+	header, err := p.Start(query)
+	if err != nil {
+		return nil, err
+	}
+	questions, err := p.AllQuestions()
+	if err != nil {
+		return nil, err
+	}
+	header.Response = true
+	header.RecursionAvailable = true
+	setup(&header)
+	msg := dnsmessage.Message{Header: header, Questions: questions}
+	return msg.Pack()
+}
+
+// udpSizeLimit returns answer size client accepts over UDP, advertised by EDNS.
+func udpSizeLimit(query []byte) int {
+	var msg dnsmessage.Message
+	err := msg.Unpack(query)
+	if err != nil {
+		return maxUDPSize
+	}
+	for _, r := range msg.Additionals {
+		if r.Header.Type == dnsmessage.TypeOPT && int(r.Header.Class) > maxUDPSize {
+			return int(r.Header.Class)
+		}
+	}
+	return maxUDPSize
+}
@@ -0,0 +1,305 @@
+package dnsproxy
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// Forwarder is a local DNS server, which resolves queries through the tunnel and caches answers.
+type Forwarder struct {
+	open      func(ctx context.Context) (io.ReadWriteCloser, error)
+	timeout   time.Duration
+	loopback  bool
+	cache     *cache
+	udp       *net.UDPConn
+	tcp       net.Listener
+	lock      sync.Mutex // guards stream
+	stream    *tunnelStream
+	closeOnce sync.Once
+}
+
+type ForwarderOptions struct {
+	// ListenAddr is UDP and TCP address of DNS server
+	ListenAddr string
+	CacheSize  int
+	// Timeout is how long to wait for answer from the tunnel
+	Timeout time.Duration
+	// Open opens stream of current tunnel
+	Open func(ctx context.Context) (io.ReadWriteCloser, error)
+	// LoopbackOnly refuses queries of clients from other hosts, e.g. when proxy requires
+	// authentication, which DNS doesn't have
+	LoopbackOnly bool
+}
+
+func NewForwarder(opts ForwarderOptions) (*Forwarder, error) {
+	udpAddr, err := net.ResolveUDPAddr("udp", opts.ListenAddr)
+	if err != nil {
+		return nil, fmt.Errorf("dnsproxy: invalid listen address: %v", err)
+	}
+	udp, err := net.ListenUDP("udp", udpAddr)
+	if err != nil {
+		return nil, fmt.Errorf("dnsproxy: %v", err)
+	}
+	// use port chosen for UDP, when it is not set
+	tcp, err := net.Listen("tcp", udp.LocalAddr().String())
+	if err != nil {
+		_ = udp.Close()
+		return nil, fmt.Errorf("dnsproxy: %v", err)
+	}
+
+	f := &Forwarder{
+		open:     opts.Open,
+		timeout:  opts.Timeout,
+		loopback: opts.LoopbackOnly,
+		cache:    newCache(opts.CacheSize),
+		udp:      udp,
+		tcp:      tcp,
+	}
+	if f.timeout <= 0 {
+		f.timeout = 30 * time.Second
+	}
+	go f.serveUDP()
+	go f.serveTCP()
+	return f, nil
+}
+
+// Addr returns address of DNS server.
+func (f *Forwarder) Addr() net.Addr {
+	return f.udp.LocalAddr()
+}
+
+func (f *Forwarder) serveUDP() {
+	buf := make([]byte, 65535)
+	for {
+		n, addr, err := f.udp.ReadFromUDP(buf)
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				log.Warnf("dnsproxy: read UDP query: %v", err)
+			}
+			return
+		}
+		query := append([]byte(nil), buf[:n]...)
+		go func() {
+			var answer []byte
+			if f.allowed(addr.IP) {
+				answer = f.answer(query)
+			} else {
+				answer, _ = errorReply(query, dnsmessage.RCodeRefused)
+			}
+			if answer == nil {
+				return
+			}
+			if len(answer) > udpSizeLimit(query) {
+				answer, err = truncatedReply(query)
+				if err != nil {
+					return
+				}
+			}
+			_, _ = f.udp.WriteToUDP(answer, addr)
+		}()
+	}
+}
+
+func (f *Forwarder) serveTCP() {
+	for {
+		conn, err := f.tcp.Accept()
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				log.Warnf("dnsproxy: accept TCP connection: %v", err)
+			}
+			return
+		}
+		if addr, ok := conn.RemoteAddr().(*net.TCPAddr); ok && !f.allowed(addr.IP) {
+			log.Debugf("dnsproxy: refused TCP connection from %s", addr)
+			_ = conn.Close()
+			continue
+		}
+		go func() {
+			defer conn.Close()
+			var writeLock sync.Mutex
+			for {
+				_ = conn.SetReadDeadline(time.Now().Add(f.timeout))
+				query, err := readMsg(conn)
+				if err != nil {
+					return
+				}
+				// queries may be pipelined, answers go in any order
+				go func() {
+					answer := f.answer(query)
+					if answer == nil {
+						return
+					}
+					writeLock.Lock()
+					defer writeLock.Unlock()
+					_, _ = conn.Write(frame(answer))
+				}()
+			}
+		}()
+	}
+}
+
+// allowed reports if client with given address may query the server.
+func (f *Forwarder) allowed(ip net.IP) bool {
+	return !f.loopback || ip.IsLoopback()
+}
+
+// answer returns answer to query, SERVFAIL if tunnel doesn't answer, or nil for invalid query.
+func (f *Forwarder) answer(query []byte) []byte {
+	answer, err := f.Resolve(query)
+	if err == nil {
+		return answer
+	}
+	log.Debugf("dnsproxy: %v", err)
+	answer, err = errorReply(query, dnsmessage.RCodeServerFailure)
+	if err != nil {
+		return nil
+	}
+	return answer
+}
+
+// Resolve answers query from cache or through the tunnel.
+func (f *Forwarder) Resolve(query []byte) ([]byte, error) {
+	if len(query) < 12 {
+		return nil, errors.New("query is too short")
+	}
+	if answer, ok := f.cache.get(query); ok {
+		return answer, nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), f.timeout)
+	defer cancel()
+	stream, err := f.tunnelStream(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("open DNS stream: %v", err)
+	}
+	answer, err := stream.exchange(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	f.cache.put(query, answer)
+	return answer, nil
+}
+
+// tunnelStream returns DNS stream, opening new one if previous is closed, e.g. on reconnect.
+func (f *Forwarder) tunnelStream(ctx context.Context) (*tunnelStream, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if f.stream != nil && !f.stream.closed() {
+		return f.stream, nil
+	}
+	conn, err := f.open(ctx)
+	if err != nil {
+		return nil, err
+	}
+	_, err = conn.Write([]byte{StreamMark})
+	if err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	f.stream = newTunnelStream(conn)
+	return f.stream, nil
+}
+
+func (f *Forwarder) Close() error {
+	f.closeOnce.Do(func() {
+		_ = f.udp.Close()
+		_ = f.tcp.Close()
+		f.lock.Lock()
+		if f.stream != nil {
+			f.stream.w.close()
+		}
+		f.lock.Unlock()
+	})
+	return nil
+}
+
+// tunnelStream sends queries with IDs unique within stream, so queries of different
+// clients don't mix up, and passes answers back.
+type tunnelStream struct {
+	w       *batchWriter
+	lock    sync.Mutex // guards fields below
+	nextID  uint16
+	pending map[uint16]chan []byte
+}
+
+func newTunnelStream(conn io.ReadWriteCloser) *tunnelStream {
+	s := &tunnelStream{
+		w:       newBatchWriter(conn),
+		pending: map[uint16]chan []byte{},
+	}
+	go s.readLoop(conn)
+	return s
+}
+
+func (s *tunnelStream) readLoop(r io.Reader) {
+	defer s.w.close()
+	for {
+		answer, err := readMsg(r)
+		if err != nil {
+			return
+		}
+		if len(answer) < 12 {
+			continue
+		}
+		id := binary.BigEndian.Uint16(answer)
+		s.lock.Lock()
+		ch, ok := s.pending[id]
+		delete(s.pending, id)
+		s.lock.Unlock()
+		if ok {
+			ch <- answer
+		}
+	}
+}
+
+func (s *tunnelStream) closed() bool {
+	select {
+	case <-s.w.done:
+		return true
+	default:
+		return false
+	}
+}
+
+func (s *tunnelStream) exchange(ctx context.Context, query []byte) ([]byte, error) {
+	ch := make(chan []byte, 1)
+	s.lock.Lock()
+	if len(s.pending) >= 1<<16-1 {
+		s.lock.Unlock()
+		return nil, errors.New("too many pending queries")
+	}
+	id := s.nextID
+	for _, taken := s.pending[id]; taken; _, taken = s.pending[id] {
+		id++
+	}
+	s.nextID = id + 1
+	s.pending[id] = ch
+	s.lock.Unlock()
+	defer func() {
+		s.lock.Lock()
+		delete(s.pending, id)
+		s.lock.Unlock()
+	}()
+
+	err := s.w.write(setID(query, id))
+	if err != nil {
+		return nil, err
+	}
+	select {
+	case answer := <-ch:
+		return setID(answer, binary.BigEndian.Uint16(query)), nil
+	case <-s.w.done:
+		return nil, errClosed
+	case <-ctx.Done():
+		return nil, fmt.Errorf("wait for answer: %v", ctx.Err())
+	}
+}
@@ -0,0 +1,195 @@
+package dnsproxy
+
+import (
+	"context"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// fakeResolver answers A queries over UDP and TCP, big.test has answer too long for UDP.
+type fakeResolver struct {
+	t       *testing.T
+	udp     *net.UDPConn
+	tcp     net.Listener
+	queries int32
+}
+
+func newFakeResolver(t *testing.T) *fakeResolver {
+	udp, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	require.NoError(t, err)
+	tcp, err := net.Listen("tcp", udp.LocalAddr().String())
+	require.NoError(t, err)
+	r := &fakeResolver{t: t, udp: udp, tcp: tcp}
+	t.Cleanup(func() {
+		_ = udp.Close()
+		_ = tcp.Close()
+	})
+
+	go func() {
+		buf := make([]byte, 65535)
+		for {
+			n, addr, err := udp.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			answer := r.answer(buf[:n])
+			if len(answer) > maxUDPSize {
+				answer, _ = truncatedReply(buf[:n])
+			}
+			_, _ = udp.WriteToUDP(answer, addr)
+		}
+	}()
+	go func() {
+		for {
+			conn, err := tcp.Accept()
+			if err != nil {
+				return
+			}
+			query, err := readMsg(conn)
+			if err == nil {
+				_, _ = conn.Write(frame(r.answer(query)))
+			}
+			_ = conn.Close()
+		}
+	}()
+	return r
+}
+
+func (r *fakeResolver) answer(query []byte) []byte {
+	atomic.AddInt32(&r.queries, 1)
+	var msg dnsmessage.Message
+	if msg.Unpack(query) != nil || len(msg.Questions) != 1 {
+		return nil
+	}
+	name := msg.Questions[0].Name.String()
+	records := 1
+	if name == "big.test." {
+		records = 40
+	}
+	var resources []dnsmessage.Resource
+	for i := 0; i < records; i++ {
+		resources = append(resources, aRecord(name, 60, [4]byte{10, 0, 0, byte(i + 1)}))
+	}
+	return newAnswer(r.t, query, dnsmessage.RCodeSuccess, resources...)
+}
+
+// countingConn counts writes to stream.
+type countingConn struct {
+	net.Conn
+	writes int32
+}
+
+func (c *countingConn) Write(p []byte) (int, error) {
+	atomic.AddInt32(&c.writes, 1)
+	return c.Conn.Write(p)
+}
+
+func newTestForwarder(t *testing.T, resolver *fakeResolver) (*Forwarder, *countingConn) {
+	server := NewServer(ServerOptions{Servers: []string{resolver.udp.LocalAddr().String()}})
+	var streamLock sync.Mutex
+	var stream *countingConn
+	f, err := NewForwarder(ForwarderOptions{
+		ListenAddr: "127.0.0.1:0",
+		CacheSize:  100,
+		Open: func(ctx context.Context) (io.ReadWriteCloser, error) {
+			client, serverSide := net.Pipe()
+			go func() {
+				mark := make([]byte, 1)
+				if _, err := io.ReadFull(serverSide, mark); err == nil && mark[0] == StreamMark {
+					server.ServeStream(serverSide, serverSide)
+				}
+			}()
+			streamLock.Lock()
+			defer streamLock.Unlock()
+			stream = &countingConn{Conn: client}
+			return stream, nil
+		},
+	})
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = f.Close() })
+	_, err = f.Resolve(newQuery(t, 1, "warmup.test.", dnsmessage.TypeA))
+	require.NoError(t, err)
+	streamLock.Lock()
+	defer streamLock.Unlock()
+	return f, stream
+}
+
+func TestForwarder(t *testing.T) {
+	resolver := newFakeResolver(t)
+	f, _ := newTestForwarder(t, resolver)
+
+	r := &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, network, f.Addr().String())
+		},
+	}
+	ips, err := r.LookupIP(context.Background(), "ip4", "example.test")
+	require.NoError(t, err)
+	assert.Equal(t, []net.IP{net.IPv4(10, 0, 0, 1).To4()}, ips)
+	queries := atomic.LoadInt32(&resolver.queries)
+	_, err = r.LookupIP(context.Background(), "ip4", "example.test")
+	require.NoError(t, err)
+	assert.Equal(t, queries, atomic.LoadInt32(&resolver.queries), "answer should be cached")
+
+	// too long answer is truncated over UDP, so client repeats it over TCP
+	ips, err = r.LookupIP(context.Background(), "ip4", "big.test")
+	require.NoError(t, err)
+	assert.Len(t, ips, 40)
+}
+
+func TestForwarderBatchesQueries(t *testing.T) {
+	resolver := newFakeResolver(t)
+	f, stream := newTestForwarder(t, resolver)
+	writes := atomic.LoadInt32(&stream.writes)
+
+	const queries = 10
+	var wg sync.WaitGroup
+	for i := 0; i < queries; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			query := newQuery(t, 1, "host"+string(rune('a'+i))+".test.", dnsmessage.TypeA)
+			answer, err := f.Resolve(query)
+			assert.NoError(t, err)
+			assert.Equal(t, query[:2], answer[:2], "answer has ID of query")
+		}(i)
+	}
+	wg.Wait()
+	assert.Less(t, atomic.LoadInt32(&stream.writes)-writes, int32(queries))
+}
+
+func TestForwarderFailsWithoutTunnel(t *testing.T) {
+	f, err := NewForwarder(ForwarderOptions{
+		ListenAddr: "127.0.0.1:0",
+		Open: func(ctx context.Context) (io.ReadWriteCloser, error) {
+			return nil, io.ErrClosedPipe
+		},
+	})
+	require.NoError(t, err)
+	defer f.Close()
+
+	query := newQuery(t, 5, "example.test.", dnsmessage.TypeA)
+	answer := f.answer(query)
+	var msg dnsmessage.Message
+	require.NoError(t, msg.Unpack(answer))
+	assert.Equal(t, uint16(5), msg.Header.ID)
+	assert.Equal(t, dnsmessage.RCodeServerFailure, msg.Header.RCode)
+}
+
+func TestForwarderLoopbackOnly(t *testing.T) {
+	f := &Forwarder{loopback: true}
+	assert.True(t, f.allowed(net.IPv4(127, 0, 0, 1)))
+	assert.True(t, f.allowed(net.IPv6loopback))
+	assert.False(t, f.allowed(net.IPv4(192, 168, 1, 10)))
+
+	f.loopback = false
+	assert.True(t, f.allowed(net.IPv4(192, 168, 1, 10)))
+}
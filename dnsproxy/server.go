@@ -0,0 +1,196 @@
+package dnsproxy
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+const (
+	// maxStreamQueries limits queries of one stream resolved at the same time
+	maxStreamQueries = 64
+	resolvConfPath   = "/etc/resolv.conf"
+)
+
+// Server answers queries of DNS streams by asking its resolvers.
+type Server struct {
+	servers []string
+	dial    func(ctx context.Context, network, addr string) (net.Conn, error)
+	tcpOnly bool
+	timeout time.Duration
+	next    uint32
+}
+
+type ServerOptions struct {
+	// Servers are resolvers, e.g. "1.1.1.1" or "9.9.9.9:53", system ones are used if empty
+	Servers []string
+	// Dial connects to resolvers, TCPOnly is set if it can't dial UDP, e.g. through upstream proxy
+	Dial    func(ctx context.Context, network, addr string) (net.Conn, error)
+	TCPOnly bool
+	// Timeout of one exchange with resolver
+	Timeout time.Duration
+}
+
+func NewServer(opts ServerOptions) *Server {
+	s := &Server{
+		dial:    opts.Dial,
+		tcpOnly: opts.TCPOnly,
+		timeout: opts.Timeout,
+	}
+	servers := opts.Servers
+	if len(servers) == 0 {
+		servers = systemServers(resolvConfPath)
+	}
+	for _, server := range servers {
+		if _, _, err := net.SplitHostPort(server); err != nil {
+			server = net.JoinHostPort(server, "53")
+		}
+		s.servers = append(s.servers, server)
+	}
+	if s.dial == nil {
+		s.dial = (&net.Dialer{}).DialContext
+	}
+	if s.timeout <= 0 {
+		s.timeout = 5 * time.Second
+	}
+	return s
+}
+
+// systemServers reads nameservers of resolv.conf.
+func systemServers(path string) []string {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil
+	}
+	defer f.Close()
+
+	var servers []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) >= 2 && fields[0] == "nameserver" && net.ParseIP(fields[1]) != nil {
+			servers = append(servers, fields[1])
+		}
+	}
+	return servers
+}
+
+// ServeStream answers queries read from r, which is stream after StreamMark, until stream is closed.
+func (s *Server) ServeStream(stream io.ReadWriteCloser, r io.Reader) {
+	w := newBatchWriter(stream)
+	defer w.close()
+	sem := make(chan struct{}, maxStreamQueries)
+	for {
+		query, err := readMsg(r)
+		if err != nil {
+			if !errors.Is(err, io.EOF) && !errors.Is(err, net.ErrClosed) {
+				log.Warnf("dnsproxy: server: read DNS stream: %v", err)
+			}
+			return
+		}
+		sem <- struct{}{}
+		go func() {
+			defer func() { <-sem }()
+			answer, err := s.Resolve(context.Background(), query)
+			if err != nil {
+				log.Debugf("dnsproxy: server: %v", err)
+				answer, err = errorReply(query, dnsmessage.RCodeServerFailure)
+				if err != nil {
+					return
+				}
+			}
+			_ = w.write(answer)
+		}()
+	}
+}
+
+// Resolve asks resolvers in turn until one of them answers.
+func (s *Server) Resolve(ctx context.Context, query []byte) ([]byte, error) {
+	if len(query) < 12 {
+		return nil, errors.New("query is too short")
+	}
+	if len(s.servers) == 0 {
+		return nil, errors.New("no resolvers configured")
+	}
+	start := int(atomic.AddUint32(&s.next, 1))
+	var err error
+	for i := range s.servers {
+		server := s.servers[(start+i)%len(s.servers)]
+		var answer []byte
+		answer, err = s.exchange(ctx, server, query)
+		if err == nil {
+			return answer, nil
+		}
+	}
+	return nil, fmt.Errorf("resolve: %v", err)
+}
+
+// exchange sends query over UDP, repeating it over TCP if answer is truncated.
+func (s *Server) exchange(ctx context.Context, server string, query []byte) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(ctx, s.timeout)
+	defer cancel()
+	if !s.tcpOnly {
+		answer, err := s.exchangeOver(ctx, "udp", server, query)
+		if err != nil {
+			return nil, err
+		}
+		if answer[2]&0x02 == 0 {
+			return answer, nil
+		}
+	}
+	return s.exchangeOver(ctx, "tcp", server, query)
+}
+
+func (s *Server) exchangeOver(ctx context.Context, network, server string, query []byte) ([]byte, error) {
+	conn, err := s.dial(ctx, network, server)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = conn.SetDeadline(deadline)
+	}
+
+	id := binary.BigEndian.Uint16(query)
+	if network == "tcp" {
+		_, err = conn.Write(frame(query))
+		if err != nil {
+			return nil, err
+		}
+		answer, err := readMsg(conn)
+		if err != nil {
+			return nil, err
+		}
+		if len(answer) < 12 || binary.BigEndian.Uint16(answer) != id {
+			return nil, errors.New("invalid answer")
+		}
+		return answer, nil
+	}
+
+	_, err = conn.Write(query)
+	if err != nil {
+		return nil, err
+	}
+	buf := make([]byte, 65535)
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			return nil, err
+		}
+		// skip stray datagrams
+		if n >= 12 && binary.BigEndian.Uint16(buf) == id {
+			return buf[:n], nil
+		}
+	}
+}
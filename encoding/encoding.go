@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"encoding/base64"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"io"
 
@@ -11,6 +12,7 @@ import (
 )
 
 const (
+	// MaxMessageLen is a default plaintext size of message, until carrier is probed
 	MaxMessageLen = 10000
 )
 
@@ -19,17 +21,44 @@ type MessageType uint64
 const (
 	PublicKey MessageType = iota + 1
 	Text
+	Close        // peer closes session, empty payload
+	Backpressure // receiver asks to pause (payload 1) or resume (payload 0) sending
+	PublicKeyAck // server reply to PublicKey message, HandshakeAck payload
+	Ping         // keepalive request, payload is echoed in Pong
+	Pong
+	FECData   // data message framed by forward error correction
+	FECParity // parity message of forward error correction group
+	Probe     // message size probe, payload is echoed in ProbeAck
+	ProbeAck
+	MessageLimit // peer announces message size limit, uint32 payload
+	Throttle     // server tells client it is throttled by quota, QuotaNotice payload
 )
 
+// SessionID distinguishes tunnels opened from the same chat, e.g. from laptop and phone.
+type SessionID uint64
+
 // Packet structure:
 // flags (8 bytes) - type, version
+// session id (8 bytes)
 // signature // TODO ?
 // ciphertext
 
+const headerLen = 16
+
+// Header is unencrypted part of a message.
+type Header struct {
+	Type    MessageType
+	Session SessionID
+}
+
+// ErrForeignSession is returned for messages from another session in the same chat.
+var ErrForeignSession = errors.New("message belongs to another session")
+
 type Encoder struct {
 	ownPrivKey     *age.X25519Identity
 	publicKeyBytes []byte
 	peerPublicKey  *age.X25519Recipient
+	session        SessionID
 }
 
 func NewEncoder(privateKey *age.X25519Identity) *Encoder {
@@ -53,19 +82,31 @@ func (e *Encoder) GetOwnPublicKey() []byte {
 	return e.publicKeyBytes
 }
 
+// SetSession sets session id for outgoing messages. Incoming messages of other sessions are rejected,
+// unless session is zero.
+func (e *Encoder) SetSession(session SessionID) {
+	e.session = session
+}
+
+func (e *Encoder) Session() SessionID {
+	return e.session
+}
+
 func (e *Encoder) Copy() *Encoder {
 	return &Encoder{
 		ownPrivKey:     e.ownPrivKey,
 		publicKeyBytes: e.publicKeyBytes,
 		peerPublicKey:  e.peerPublicKey,
+		session:        e.session,
 	}
 }
 
 func (e *Encoder) PackMessage(flags MessageType, message []byte) ([]byte, error) {
 	// TODO: reuse buffers with sync.Pool, optimize allocations
 	buf := &bytes.Buffer{}
-	var data [8]byte
-	binary.BigEndian.PutUint64(data[:], uint64(flags))
+	var data [headerLen]byte
+	binary.BigEndian.PutUint64(data[:8], uint64(flags))
+	binary.BigEndian.PutUint64(data[8:], uint64(e.session))
 	buf.Write(data[:])
 
 	w, err := age.Encrypt(buf, e.peerPublicKey)
@@ -88,11 +129,14 @@ func (e *Encoder) UnpackMessage(encodedBody []byte) ([]byte, MessageType, error)
 		return nil, 0, err
 	}
 
-	if len(decoded) < 8 {
-		return nil, 0, fmt.Errorf("invalid decoded message length, should be > 8, got %d", len(decoded))
+	if len(decoded) < headerLen {
+		return nil, 0, fmt.Errorf("invalid decoded message length, should be > %d, got %d", headerLen, len(decoded))
+	}
+	header := parseHeader(decoded)
+	if e.session != 0 && header.Session != e.session {
+		return nil, 0, ErrForeignSession
 	}
-	flags := binary.BigEndian.Uint64(decoded[:8])
-	r, err := age.Decrypt(bytes.NewReader(decoded[8:]), e.ownPrivKey)
+	r, err := age.Decrypt(bytes.NewReader(decoded[headerLen:]), e.ownPrivKey)
 	if err != nil {
 		return nil, 0, fmt.Errorf("failed to open decrypted stream: %v", err)
 	}
@@ -101,7 +145,29 @@ func (e *Encoder) UnpackMessage(encodedBody []byte) ([]byte, MessageType, error)
 		return nil, 0, fmt.Errorf("failed to read from decrypted stream: %v", err)
 	}
 
-	return out.Bytes(), MessageType(flags), nil
+	return out.Bytes(), header.Type, nil
+}
+
+// PeekHeader reads message header without decrypting message.
+func PeekHeader(encodedBody []byte) (Header, error) {
+	// 16 bytes of header are encoded into first 22 base64 characters
+	const headerEncodedLen = 22
+	if len(encodedBody) < headerEncodedLen {
+		return Header{}, fmt.Errorf("invalid encoded message length, should be >= %d, got %d", headerEncodedLen, len(encodedBody))
+	}
+	decoded, err := DecodeBase64(encodedBody[:headerEncodedLen])
+	if err != nil {
+		return Header{}, err
+	}
+
+	return parseHeader(decoded), nil
+}
+
+func parseHeader(decoded []byte) Header {
+	return Header{
+		Type:    MessageType(binary.BigEndian.Uint64(decoded[:8])),
+		Session: SessionID(binary.BigEndian.Uint64(decoded[8:headerLen])),
+	}
 }
 
 func GenerateKey() (*age.X25519Identity, error) {
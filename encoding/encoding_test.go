@@ -4,6 +4,7 @@ import (
 	"encoding/base64"
 	"fmt"
 	"math/rand"
+	"strings"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -13,8 +14,12 @@ func TestEncoding(t *testing.T) {
 	encOne, encTwo := setupTwoEncoders(t)
 	const expectedText = "hello world!"
 
+	encOne.SetSession(42)
 	encodedMessage, err := encOne.PackMessage(PublicKey, []byte(expectedText))
 	assert.NoError(t, err)
+	header, err := PeekHeader(encodedMessage)
+	assert.NoError(t, err)
+	assert.Equal(t, Header{Type: PublicKey, Session: 42}, header)
 	decodedMessage, flags, err := encTwo.UnpackMessage(encodedMessage)
 	assert.NoError(t, err)
 	assert.Equal(t, PublicKey, flags)
@@ -66,3 +71,30 @@ func setupTwoEncoders(t testing.TB) (*Encoder, *Encoder) {
 
 	return encOne, encTwo
 }
+
+func TestForeignSession(t *testing.T) {
+	encOne, encTwo := setupTwoEncoders(t)
+	encOne.SetSession(1)
+	encTwo.SetSession(2)
+
+	encodedMessage, err := encOne.PackMessage(Text, []byte("hello"))
+	assert.NoError(t, err)
+	_, _, err = encTwo.UnpackMessage(encodedMessage)
+	assert.ErrorIs(t, err, ErrForeignSession)
+
+	encTwo.SetSession(1)
+	_, _, err = encTwo.UnpackMessage(encodedMessage)
+	assert.NoError(t, err)
+}
+
+func TestFingerprint(t *testing.T) {
+	encOne, encTwo := setupTwoEncoders(t)
+	fpOne := Fingerprint(string(encOne.GetOwnPublicKey()))
+	fpTwo := Fingerprint(string(encTwo.GetOwnPublicKey()))
+
+	assert.Len(t, strings.Split(fpOne, "-"), fingerprintLen)
+	assert.NotEqual(t, fpOne, fpTwo)
+	assert.Equal(t, fpOne, Fingerprint(string(encOne.GetOwnPublicKey())))
+	assert.True(t, FingerprintsEqual(fpOne, strings.ToUpper(strings.ReplaceAll(fpOne, "-", " "))))
+	assert.False(t, FingerprintsEqual(fpOne, fpTwo))
+}
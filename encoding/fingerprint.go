@@ -0,0 +1,69 @@
+package encoding
+
+import (
+	"crypto/sha256"
+	"strings"
+)
+
+// fingerprintLen is 12 words, 96 bits, so carrier can't find key with the same fingerprint
+const fingerprintLen = 12
+
+// Fingerprint returns human-comparable representation of age public key,
+// e.g. "tiger-pasta-orbit-denim-koala-sugar-otter-lamp-cedar-drum-iris-wafer".
+// Users compare it over independent channel.
+func Fingerprint(publicKey string) string {
+	sum := sha256.Sum256([]byte(strings.TrimSpace(publicKey)))
+	words := make([]string, 0, fingerprintLen)
+	for _, b := range sum[:fingerprintLen] {
+		words = append(words, fingerprintWords[b])
+	}
+
+	return strings.Join(words, "-")
+}
+
+// FingerprintsEqual compares fingerprints ignoring case and word separators.
+func FingerprintsEqual(a, b string) bool {
+	return normalizeFingerprint(a) == normalizeFingerprint(b)
+}
+
+func normalizeFingerprint(fingerprint string) string {
+	fields := strings.FieldsFunc(strings.ToLower(fingerprint), func(r rune) bool {
+		return r < 'a' || r > 'z'
+	})
+	return strings.Join(fields, "-")
+}
+
+var fingerprintWords = [256]string{
+	"acid", "acorn", "actor", "adobe", "agent", "alarm", "album", "alien",
+	"amber", "angle", "apple", "apron", "arena", "armor", "arrow", "atlas",
+	"attic", "audio", "award", "bacon", "badge", "bagel", "baker", "banjo",
+	"barn", "basin", "beach", "beard", "bench", "berry", "bison", "blade",
+	"blank", "blaze", "blimp", "bloom", "board", "boat", "bonus", "boots",
+	"brain", "brass", "bread", "brick", "broom", "brush", "buddy", "bugle",
+	"cabin", "cable", "cactus", "camel", "candy", "canoe", "canyon", "cargo",
+	"carpet", "castle", "cedar", "chalk", "charm", "cheese", "cherry", "chess",
+	"chimp", "cider", "circle", "clamp", "cloud", "clover", "cobra", "cocoa",
+	"comet", "coral", "cotton", "couch", "crane", "crayon", "crown", "cube",
+	"curry", "daisy", "dance", "delta", "denim", "desk", "diary", "dingo",
+	"dock", "donut", "dove", "dragon", "dream", "drum", "eagle", "easel",
+	"echo", "elbow", "ember", "engine", "falcon", "fern", "ferry", "fiber",
+	"field", "fig", "flute", "foam", "forest", "fossil", "fox", "frog",
+	"gadget", "galaxy", "garden", "garlic", "gecko", "ghost", "giant", "ginger",
+	"glove", "goat", "grape", "gravel", "guitar", "hammer", "harbor", "hazel",
+	"helmet", "hero", "honey", "hook", "horse", "husky", "igloo", "index",
+	"iris", "island", "ivory", "jacket", "jaguar", "jelly", "jewel", "judge",
+	"juice", "kayak", "kettle", "kiwi", "koala", "ladder", "lagoon", "lamp",
+	"laser", "lemon", "lily", "lion", "lizard", "llama", "locket", "lotus",
+	"lunar", "magnet", "mango", "maple", "marble", "meadow", "melon", "mint",
+	"mirror", "monkey", "moose", "motor", "muffin", "mural", "napkin", "nectar",
+	"noodle", "oasis", "ocean", "olive", "onion", "opera", "orbit", "otter",
+	"owl", "paddle", "panda", "parrot", "pasta", "peach", "pearl", "pebble",
+	"pencil", "pepper", "piano", "pilot", "pixel", "planet", "plum", "pony",
+	"potato", "prism", "pump", "puzzle", "quartz", "quill", "rabbit", "radar",
+	"radio", "raven", "reef", "rhino", "ribbon", "river", "robot", "rocket",
+	"ruby", "saddle", "salmon", "salt", "sandal", "satin", "scarf", "shark",
+	"shell", "silver", "sketch", "sloth", "snail", "sofa", "spider", "spoon",
+	"squid", "star", "stone", "sugar", "summit", "sunset", "swan", "table",
+	"tango", "tiger", "toast", "tomato", "torch", "tower", "tulip", "turtle",
+	"velvet", "violin", "wafer", "walnut", "whale", "wizard", "yacht", "zebra",
+}
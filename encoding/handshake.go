@@ -0,0 +1,99 @@
+package encoding
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// ProtocolVersion is increased on incompatible wire format changes.
+const ProtocolVersion = 1
+
+// Handshake is a payload of PublicKey message, client sends it to open a session.
+type Handshake struct {
+	Version     int
+	PublicKey   string
+	InviteToken string `json:",omitempty"`
+	// FEC, if set, asks server to protect its messages with forward error correction
+	FEC *FECParams `json:",omitempty"`
+	// Mux is a stream multiplexer of session, yamux if empty
+	Mux string `json:",omitempty"`
+}
+
+// FECParams is a forward error correction setup requested by client.
+type FECParams struct {
+	DataShards      int
+	ParityShards    int
+	MaxParityShards int
+	Adaptive        bool
+}
+
+func (h Handshake) Marshal() ([]byte, error) {
+	return json.Marshal(h)
+}
+
+func UnmarshalHandshake(data []byte) (Handshake, error) {
+	var h Handshake
+	err := json.Unmarshal(data, &h)
+	if err != nil {
+		return Handshake{}, fmt.Errorf("unmarshal handshake: %v", err)
+	}
+	if _, err = UnmarshalPublicKey(h.PublicKey); err != nil {
+		return Handshake{}, fmt.Errorf("invalid handshake public key: %v", err)
+	}
+
+	return h, nil
+}
+
+type HandshakeStatus int
+
+const (
+	HandshakeAccepted HandshakeStatus = iota + 1
+	HandshakeRejected
+	HandshakeVersionMismatch
+	// HandshakeThrottled rejects client which used up its quota, until RetryAfter
+	HandshakeThrottled
+)
+
+// HandshakeAck is a payload of HandshakeAck message, server replies with it to client handshake.
+type HandshakeAck struct {
+	Version int
+	Status  HandshakeStatus
+	Reason  string `json:",omitempty"`
+	// RetryAfter is a number of seconds to wait before the next handshake
+	RetryAfter int64 `json:",omitempty"`
+}
+
+func (a HandshakeAck) Marshal() ([]byte, error) {
+	return json.Marshal(a)
+}
+
+func UnmarshalHandshakeAck(data []byte) (HandshakeAck, error) {
+	var a HandshakeAck
+	err := json.Unmarshal(data, &a)
+	if err != nil {
+		return HandshakeAck{}, fmt.Errorf("unmarshal handshake ack: %v", err)
+	}
+
+	return a, nil
+}
+
+// QuotaNotice is a payload of Throttle message. RetryAfter is a number of seconds until quota is reset,
+// zero if only message rate is capped.
+type QuotaNotice struct {
+	Reason     string
+	RetryAfter int64 `json:",omitempty"`
+}
+
+func (n QuotaNotice) Marshal() ([]byte, error) {
+	return json.Marshal(n)
+}
+
+func UnmarshalQuotaNotice(data []byte) (QuotaNotice, error) {
+	var n QuotaNotice
+	err := json.Unmarshal(data, &n)
+	if err != nil {
+		return QuotaNotice{}, fmt.Errorf("unmarshal quota notice: %v", err)
+	}
+
+	return n, nil
+}
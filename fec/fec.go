@@ -0,0 +1,349 @@
+// Package fec implements forward error correction over messenger messages.
+//
+// Data messages are grouped, every group of N data messages is followed by K parity messages,
+// computed with Reed-Solomon code. Receiver recovers up to K lost messages of a group
+// without retransmission.
+//
+// Data frame: group start seq (uvarint), index in group (uvarint), payload
+// Parity frame: group start seq (uvarint), data count (uvarint), parity count (uvarint),
+// parity index (uvarint), shard
+// Data shard: payload length (uvarint), payload, zero padding up to the longest shard of the group
+package fec
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+
+	"github.com/klauspost/reedsolomon"
+)
+
+const (
+	DefaultDataShards   = 8
+	DefaultParityShards = 1
+	MaxShards           = 256
+	// MaxOverhead is the longest framing added to payload, by parity frame
+	MaxOverhead = 5 * binary.MaxVarintLen64
+	// maxPendingGroups limits memory of decoder waiting for recovery
+	maxPendingGroups = 16
+)
+
+// ErrUnrecoverable is returned when a group lost more messages than it has parity.
+var ErrUnrecoverable = errors.New("fec: too many lost messages, can't recover")
+
+type Params struct {
+	DataShards   int
+	ParityShards int
+}
+
+func (p Params) Validate() error {
+	if p.DataShards < 1 || p.ParityShards < 1 || p.DataShards+p.ParityShards > MaxShards {
+		return fmt.Errorf("fec: invalid shards count: %d data, %d parity", p.DataShards, p.ParityShards)
+	}
+	return nil
+}
+
+// Encoder frames outgoing data messages and produces parity messages.
+type Encoder struct {
+	params     Params
+	groupStart uint64
+	group      [][]byte
+}
+
+func NewEncoder(params Params) (*Encoder, error) {
+	if err := params.Validate(); err != nil {
+		return nil, err
+	}
+	return &Encoder{params: params}, nil
+}
+
+// SetParityShards changes redundancy starting from the next group.
+func (e *Encoder) SetParityShards(parity int) {
+	if parity < 1 {
+		parity = 1
+	}
+	if e.params.DataShards+parity > MaxShards {
+		parity = MaxShards - e.params.DataShards
+	}
+	e.params.ParityShards = parity
+}
+
+func (e *Encoder) Params() Params {
+	return e.params
+}
+
+// Pending reports whether current group has data without parity.
+func (e *Encoder) Pending() bool {
+	return len(e.group) > 0
+}
+
+// Add frames payload as data message. If the group is complete, parity messages are returned too.
+func (e *Encoder) Add(payload []byte) (frame []byte, parity [][]byte, err error) {
+	buf := &bytes.Buffer{}
+	writeUvarint(buf, e.groupStart)
+	writeUvarint(buf, uint64(len(e.group)))
+	buf.Write(payload)
+
+	e.group = append(e.group, append([]byte(nil), payload...))
+	if len(e.group) < e.params.DataShards {
+		return buf.Bytes(), nil, nil
+	}
+
+	parity, err = e.Flush()
+	return buf.Bytes(), parity, err
+}
+
+// Flush returns parity messages for incomplete group, so receiver doesn't wait for the rest of it.
+func (e *Encoder) Flush() ([][]byte, error) {
+	if len(e.group) == 0 {
+		return nil, nil
+	}
+	dataCount, parityCount := len(e.group), e.params.ParityShards
+
+	shards, err := encodeShards(e.group, parityCount)
+	if err != nil {
+		return nil, err
+	}
+	frames := make([][]byte, 0, parityCount)
+	for i := 0; i < parityCount; i++ {
+		buf := &bytes.Buffer{}
+		writeUvarint(buf, e.groupStart)
+		writeUvarint(buf, uint64(dataCount))
+		writeUvarint(buf, uint64(parityCount))
+		writeUvarint(buf, uint64(i))
+		buf.Write(shards[dataCount+i])
+		frames = append(frames, buf.Bytes())
+	}
+
+	e.groupStart += uint64(dataCount)
+	e.group = e.group[:0]
+	return frames, nil
+}
+
+func encodeShards(payloads [][]byte, parityCount int) ([][]byte, error) {
+	rs, err := reedsolomon.New(len(payloads), parityCount)
+	if err != nil {
+		return nil, fmt.Errorf("fec: %v", err)
+	}
+
+	shardLen := 0
+	for _, p := range payloads {
+		if l := uvarintLen(uint64(len(p))) + len(p); l > shardLen {
+			shardLen = l
+		}
+	}
+	shards := make([][]byte, len(payloads)+parityCount)
+	for i := range shards {
+		shards[i] = make([]byte, shardLen)
+		if i < len(payloads) {
+			n := binary.PutUvarint(shards[i], uint64(len(payloads[i])))
+			copy(shards[i][n:], payloads[i])
+		}
+	}
+	err = rs.Encode(shards)
+	if err != nil {
+		return nil, fmt.Errorf("fec: encode: %v", err)
+	}
+	return shards, nil
+}
+
+type group struct {
+	dataCount   int // zero until the first parity message
+	parityCount int
+	data        map[int][]byte
+	parity      map[int][]byte
+}
+
+// Stats is accounting of decoder.
+type Stats struct {
+	Received  uint64
+	Recovered uint64
+}
+
+// Decoder restores order of data messages and recovers lost ones from parity.
+type Decoder struct {
+	next   uint64 // seq of the next payload to deliver
+	groups map[uint64]*group
+	stats  Stats
+}
+
+func NewDecoder() *Decoder {
+	return &Decoder{groups: map[uint64]*group{}}
+}
+
+func (d *Decoder) Stats() Stats {
+	return d.stats
+}
+
+// AddData handles data frame and returns payloads ready for delivery, in order.
+func (d *Decoder) AddData(frame []byte) ([][]byte, error) {
+	r := bytes.NewReader(frame)
+	groupStart, err1 := binary.ReadUvarint(r)
+	index, err2 := binary.ReadUvarint(r)
+	if err1 != nil || err2 != nil {
+		return nil, errors.New("fec: invalid data frame header")
+	}
+	d.stats.Received++
+	if groupStart+index < d.next {
+		return nil, nil // duplicate or already recovered
+	}
+
+	g := d.group(groupStart)
+	g.data[int(index)] = frame[len(frame)-r.Len():]
+	return d.deliver()
+}
+
+// AddParity handles parity frame and returns payloads ready for delivery, in order.
+func (d *Decoder) AddParity(frame []byte) ([][]byte, error) {
+	r := bytes.NewReader(frame)
+	var header [4]uint64
+	for i := range header {
+		v, err := binary.ReadUvarint(r)
+		if err != nil {
+			return nil, errors.New("fec: invalid parity frame header")
+		}
+		header[i] = v
+	}
+	groupStart, dataCount, parityCount, index := header[0], int(header[1]), int(header[2]), int(header[3])
+	if dataCount < 1 || parityCount < 1 || dataCount+parityCount > MaxShards || index >= parityCount {
+		return nil, errors.New("fec: invalid parity frame header")
+	}
+	if groupStart+uint64(dataCount) <= d.next {
+		delete(d.groups, groupStart) // group is delivered already
+		return nil, nil
+	}
+
+	g := d.group(groupStart)
+	g.dataCount, g.parityCount = dataCount, parityCount
+	g.parity[index] = frame[len(frame)-r.Len():]
+	return d.deliver()
+}
+
+func (d *Decoder) group(groupStart uint64) *group {
+	g, ok := d.groups[groupStart]
+	if !ok {
+		g = &group{data: map[int][]byte{}, parity: map[int][]byte{}}
+		d.groups[groupStart] = g
+	}
+	return g
+}
+
+// deliver returns in-order payloads, recovering lost ones where possible.
+func (d *Decoder) deliver() ([][]byte, error) {
+	var out [][]byte
+	for {
+		start, g := d.currentGroup()
+		if g == nil {
+			break
+		}
+		payload, ok := g.data[int(d.next-start)]
+		if !ok {
+			if !d.recover(g) {
+				break
+			}
+			continue
+		}
+		out = append(out, payload)
+		d.next++
+		if g.dataCount > 0 && d.next >= start+uint64(g.dataCount) {
+			delete(d.groups, start)
+		}
+	}
+
+	if len(d.groups) > maxPendingGroups {
+		return out, ErrUnrecoverable
+	}
+	if _, g := d.currentGroup(); g != nil && g.dataCount > 0 && len(g.parity) == g.parityCount &&
+		len(g.data)+len(g.parity) < g.dataCount {
+		// all parity arrived after data, lost messages won't come
+		return out, ErrUnrecoverable
+	}
+	return out, nil
+}
+
+// currentGroup finds group which contains next seq, groups before it are delivered and dropped.
+func (d *Decoder) currentGroup() (uint64, *group) {
+	var current *group
+	var currentStart uint64
+	for start, g := range d.groups {
+		if start <= d.next && (current == nil || start > currentStart) {
+			current, currentStart = g, start
+		}
+	}
+	if current == nil {
+		return 0, nil
+	}
+	for start := range d.groups {
+		if start < currentStart {
+			delete(d.groups, start)
+		}
+	}
+	if current.dataCount > 0 && d.next >= currentStart+uint64(current.dataCount) {
+		return 0, nil
+	}
+	return currentStart, current
+}
+
+// recover reconstructs missing data of group, reports if all data is restored.
+func (d *Decoder) recover(g *group) bool {
+	if g.dataCount == 0 || len(g.data)+len(g.parity) < g.dataCount {
+		return false
+	}
+
+	shardLen := 0
+	for _, p := range g.parity {
+		shardLen = len(p)
+	}
+	shards := make([][]byte, g.dataCount+g.parityCount)
+	for i, payload := range g.data {
+		if i >= g.dataCount {
+			return false
+		}
+		shard := make([]byte, shardLen)
+		n := binary.PutUvarint(shard, uint64(len(payload)))
+		if n+len(payload) > shardLen {
+			return false
+		}
+		copy(shard[n:], payload)
+		shards[i] = shard
+	}
+	for i, p := range g.parity {
+		if len(p) != shardLen {
+			return false
+		}
+		shards[g.dataCount+i] = p
+	}
+
+	rs, err := reedsolomon.New(g.dataCount, g.parityCount)
+	if err != nil {
+		return false
+	}
+	if rs.ReconstructData(shards) != nil {
+		return false
+	}
+
+	for i := 0; i < g.dataCount; i++ {
+		if _, ok := g.data[i]; ok {
+			continue
+		}
+		l, n := binary.Uvarint(shards[i])
+		if n <= 0 || n+int(l) > len(shards[i]) {
+			return false
+		}
+		g.data[i] = shards[i][n : n+int(l)]
+		d.stats.Recovered++
+	}
+	return true
+}
+
+func writeUvarint(buf *bytes.Buffer, v uint64) {
+	var data [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(data[:], v)
+	buf.Write(data[:n])
+}
+
+func uvarintLen(v uint64) int {
+	var data [binary.MaxVarintLen64]byte
+	return binary.PutUvarint(data[:], v)
+}
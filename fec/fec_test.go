@@ -0,0 +1,103 @@
+package fec
+
+import (
+	"fmt"
+	"math/rand"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type frame struct {
+	parity bool
+	data   []byte
+}
+
+func encodeAll(t *testing.T, params Params, payloads [][]byte) []frame {
+	enc, err := NewEncoder(params)
+	require.NoError(t, err)
+
+	var frames []frame
+	for _, p := range payloads {
+		data, parity, err := enc.Add(p)
+		require.NoError(t, err)
+		frames = append(frames, frame{data: data})
+		for _, pf := range parity {
+			frames = append(frames, frame{parity: true, data: pf})
+		}
+	}
+	parity, err := enc.Flush()
+	require.NoError(t, err)
+	for _, pf := range parity {
+		frames = append(frames, frame{parity: true, data: pf})
+	}
+	return frames
+}
+
+func decodeAll(dec *Decoder, frames []frame) ([][]byte, error) {
+	var out [][]byte
+	for _, f := range frames {
+		var payloads [][]byte
+		var err error
+		if f.parity {
+			payloads, err = dec.AddParity(f.data)
+		} else {
+			payloads, err = dec.AddData(f.data)
+		}
+		out = append(out, payloads...)
+		if err != nil {
+			return out, err
+		}
+	}
+	return out, nil
+}
+
+func genPayloads(count int) [][]byte {
+	rnd := rand.New(rand.NewSource(42))
+	payloads := make([][]byte, count)
+	for i := range payloads {
+		payloads[i] = []byte(fmt.Sprintf("message %d %s", i, string(make([]byte, rnd.Intn(100)))))
+	}
+	return payloads
+}
+
+func TestNoLoss(t *testing.T) {
+	payloads := genPayloads(21)
+	frames := encodeAll(t, Params{DataShards: 8, ParityShards: 1}, payloads)
+
+	dec := NewDecoder()
+	out, err := decodeAll(dec, frames)
+	require.NoError(t, err)
+	assert.Equal(t, payloads, out)
+	assert.Empty(t, dec.groups)
+}
+
+func TestRecoverLoss(t *testing.T) {
+	payloads := genPayloads(20)
+	frames := encodeAll(t, Params{DataShards: 8, ParityShards: 2}, payloads)
+
+	// lose two data messages of the first group, one of the second and one of the last partial group
+	var lossy []frame
+	for i, f := range frames {
+		if i == 1 || i == 5 || i == 12 || i == 21 {
+			assert.False(t, f.parity)
+			continue
+		}
+		lossy = append(lossy, f)
+	}
+
+	dec := NewDecoder()
+	out, err := decodeAll(dec, lossy)
+	require.NoError(t, err)
+	assert.Equal(t, payloads, out)
+	assert.Equal(t, uint64(4), dec.Stats().Recovered)
+}
+
+func TestUnrecoverable(t *testing.T) {
+	payloads := genPayloads(8)
+	frames := encodeAll(t, Params{DataShards: 8, ParityShards: 1}, payloads)
+
+	_, err := decodeAll(NewDecoder(), append(frames[:1:1], frames[3:]...))
+	assert.ErrorIs(t, err, ErrUnrecoverable)
+}
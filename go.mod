@@ -7,11 +7,13 @@ require (
 	github.com/Kodeworks/golang-image-ico v0.0.0-20141118225523-73f0f4cfade9
 	github.com/getlantern/systray v1.2.1
 	github.com/haxii/socks5 v1.0.0
+	github.com/klauspost/reedsolomon v1.10.0
 	github.com/knadh/koanf v1.4.1
 	github.com/libp2p/go-yamux/v3 v3.1.1
 	github.com/mail-ru-im/bot-golang v0.0.0-20220405132937-fea9ed755353
 	github.com/ncruces/zenity v0.8.7
 	github.com/sirupsen/logrus v1.8.1
+	github.com/skip2/go-qrcode v0.0.0-20200617195104-da1b6568686e
 	github.com/stretchr/testify v1.7.1
 	golang.org/x/net v0.0.0-20220517181318-183a9ca12b87
 )
@@ -30,6 +32,7 @@ require (
 	github.com/go-stack/stack v1.8.0 // indirect
 	github.com/hako/durafmt v0.0.0-20190612201238-650ed9f29a84 // indirect
 	github.com/josephspurrier/goversioninfo v1.4.0 // indirect
+	github.com/klauspost/cpuid/v2 v2.0.14 // indirect
 	github.com/libp2p/go-buffer-pool v0.0.2 // indirect
 	github.com/mailru/easyjson v0.0.0-20190626092158-b2ccc519800e // indirect
 	github.com/mitchellh/copystructure v1.2.0 // indirect
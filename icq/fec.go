@@ -0,0 +1,221 @@
+package icq
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/pymq/demhack4/config"
+	"github.com/pymq/demhack4/encoding"
+	"github.com/pymq/demhack4/fec"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// lossSmoothing is a weight of one message in loss rate estimate
+	lossSmoothing = 1.0 / 32
+	// lossHeadroom is how much parity exceeds expected losses of a group in adaptive mode
+	lossHeadroom = 2
+)
+
+// fecSender frames outgoing messages into FEC groups and sends parity after every group.
+// Loss rate is estimated from own send failures and from messages recovered by receiving side,
+// links are assumed to be roughly symmetric.
+type fecSender struct {
+	rwc         *RWC
+	cfg         config.FEC
+	lock        sync.Mutex // serializes writes and flushes of the group
+	enc         *fec.Encoder
+	flushTimer  *time.Timer
+	groupLosses int
+	lossLock    sync.Mutex
+	lossRate    float64
+}
+
+func newFECSender(rwc *RWC, cfg config.FEC) (*fecSender, error) {
+	config.SetFECDefaults(&cfg)
+	enc, err := fec.NewEncoder(fec.Params{DataShards: cfg.DataShards, ParityShards: cfg.ParityShards})
+	if err != nil {
+		return nil, err
+	}
+	if cfg.MaxParityShards+cfg.DataShards > fec.MaxShards {
+		cfg.MaxParityShards = fec.MaxShards - cfg.DataShards
+	}
+	return &fecSender{rwc: rwc, cfg: cfg, enc: enc}, nil
+}
+
+// FECConfig converts client request from handshake into FEC config.
+func FECConfig(p *encoding.FECParams) config.FEC {
+	if p == nil {
+		return config.FEC{}
+	}
+	return config.FEC{
+		Enabled:         true,
+		DataShards:      p.DataShards,
+		ParityShards:    p.ParityShards,
+		Adaptive:        p.Adaptive,
+		MaxParityShards: p.MaxParityShards,
+	}
+}
+
+func (s *fecSender) write(chunk []byte) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	frame, parity, err := s.enc.Add(chunk)
+	if err != nil {
+		return fmt.Errorf("write error: %v", err)
+	}
+	msg, err := s.rwc.PackMessage(encoding.FECData, frame)
+	if err != nil {
+		return errors.New("write error: can't encode message")
+	}
+	err = s.rwc.send(s.rwc.ctx, msg)
+	if err != nil {
+		if s.rwc.ctx.Err() != nil {
+			return err
+		}
+		s.observe(1, 1)
+		s.rwc.adaptMessageLimit(len(frame), err)
+		s.groupLosses++
+		if s.groupLosses > s.enc.Params().ParityShards {
+			return err
+		}
+		log.Debugf("icq: fec: message lost, peer will recover it from parity: %v", err)
+	} else {
+		s.observe(0, 1)
+		s.rwc.adaptMessageLimit(len(frame), nil)
+	}
+
+	if parity != nil {
+		s.sendParity(parity)
+		return nil
+	}
+	if s.flushTimer == nil {
+		s.flushTimer = time.AfterFunc(s.cfg.FlushTimeout, s.flush)
+	} else {
+		s.flushTimer.Reset(s.cfg.FlushTimeout)
+	}
+	return nil
+}
+
+// flush sends parity of incomplete group, so peer can recover its tail without waiting for more data.
+func (s *fecSender) flush() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if !s.enc.Pending() || s.rwc.ctx.Err() != nil {
+		return
+	}
+	parity, err := s.enc.Flush()
+	if err != nil {
+		log.Warnf("icq: fec: flush: %v", err)
+		return
+	}
+	s.sendParity(parity)
+}
+
+// sendParity sends parity of finished group and adapts redundancy of the next one, should be called with lock held.
+func (s *fecSender) sendParity(parity [][]byte) {
+	if s.flushTimer != nil {
+		s.flushTimer.Stop()
+	}
+	for _, frame := range parity {
+		msg, err := s.rwc.PackMessage(encoding.FECParity, frame)
+		if err != nil {
+			log.Warnf("icq: fec: pack parity message: %v", err)
+			continue
+		}
+		err = s.rwc.send(s.rwc.ctx, msg)
+		if err != nil {
+			// lost parity only weakens protection of the group
+			log.Debugf("icq: fec: send parity: %v", err)
+		}
+	}
+	s.groupLosses = 0
+	if s.cfg.Adaptive {
+		s.enc.SetParityShards(s.parityShards())
+	}
+}
+
+// observe updates loss rate estimate with a number of lost messages out of total.
+func (s *fecSender) observe(lost, total uint64) {
+	s.lossLock.Lock()
+	defer s.lossLock.Unlock()
+	for i := uint64(0); i < total; i++ {
+		sample := 0.0
+		if i < lost {
+			sample = 1
+		}
+		s.lossRate += (sample - s.lossRate) * lossSmoothing
+	}
+}
+
+func (s *fecSender) parityShards() int {
+	s.lossLock.Lock()
+	lossRate := s.lossRate
+	s.lossLock.Unlock()
+
+	parity := int(math.Ceil(lossRate * float64(s.cfg.DataShards) * lossHeadroom))
+	if parity < s.cfg.ParityShards {
+		parity = s.cfg.ParityShards
+	}
+	if parity > s.cfg.MaxParityShards {
+		parity = s.cfg.MaxParityShards
+	}
+	return parity
+}
+
+// EnableFEC protects outgoing messages with forward error correction. Incoming FEC messages
+// are decoded regardless of it. Should be called before connection is used.
+func (icq *RWC) EnableFEC(cfg config.FEC) error {
+	sender, err := newFECSender(icq, cfg)
+	if err != nil {
+		return err
+	}
+	icq.fecSender = sender
+	return nil
+}
+
+// FECStats returns accounting of incoming FEC messages.
+func (icq *RWC) FECStats() fec.Stats {
+	icq.fecLock.Lock()
+	defer icq.fecLock.Unlock()
+	return icq.fecStats
+}
+
+// readFEC decodes FEC message and queues restored payloads for Read.
+func (icq *RWC) readFEC(flags encoding.MessageType, frame []byte) error {
+	if icq.fecDecoder == nil {
+		icq.fecDecoder = fec.NewDecoder()
+	}
+	before := icq.fecDecoder.Stats()
+
+	var payloads [][]byte
+	var err error
+	if flags == encoding.FECData {
+		payloads, err = icq.fecDecoder.AddData(frame)
+	} else {
+		payloads, err = icq.fecDecoder.AddParity(frame)
+	}
+	icq.fecReady = append(icq.fecReady, payloads...)
+
+	stats := icq.fecDecoder.Stats()
+	icq.fecLock.Lock()
+	icq.fecStats = stats
+	icq.fecLock.Unlock()
+	if recovered := stats.Recovered - before.Recovered; recovered > 0 {
+		log.Debugf("icq: fec: recovered %d lost messages in chat '%s'", recovered, icq.chatId)
+	}
+	if icq.fecSender != nil {
+		lost := stats.Recovered - before.Recovered
+		icq.fecSender.observe(lost, lost+stats.Received-before.Received)
+	}
+
+	if err != nil {
+		return fmt.Errorf("read error: %v", err)
+	}
+	return nil
+}
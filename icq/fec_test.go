@@ -0,0 +1,65 @@
+package icq
+
+import (
+	"context"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/pymq/demhack4/config"
+	"github.com/pymq/demhack4/encoding"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// plainEncoding prefixes message with its type, without encryption
+type plainEncoding struct{}
+
+func (plainEncoding) PackMessage(flags encoding.MessageType, message []byte) ([]byte, error) {
+	return append([]byte{byte(flags)}, message...), nil
+}
+
+func (plainEncoding) UnpackMessage(encodedBody []byte) ([]byte, encoding.MessageType, error) {
+	return encodedBody[1:], encoding.MessageType(encodedBody[0]), nil
+}
+
+// lossyClient silently drops messages with given numbers
+type lossyClient struct {
+	out  chan ICQMessageEvent
+	sent int
+	drop map[int]bool
+}
+
+func (c *lossyClient) SendMessage(_ context.Context, msg []byte, _ string) error {
+	c.sent++
+	if !c.drop[c.sent] {
+		c.out <- ICQMessageEvent{Text: msg}
+	}
+	return nil
+}
+
+func TestRWCRecoversLoss(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	ch := make(chan ICQMessageEvent, 100)
+	// 3 groups of 4 data and 1 parity messages, one data message of every group is lost
+	cli := &lossyClient{out: ch, drop: map[int]bool{2: true, 8: true, 12: true}}
+	writer := NewRWCClient(ctx, cli, nil, plainEncoding{}, 100, "chat")
+	require.NoError(t, writer.EnableFEC(config.FEC{Enabled: true, DataShards: 4, ParityShards: 1, FlushTimeout: time.Hour}))
+	reader := NewRWCClient(ctx, nil, ch, plainEncoding{}, 100, "chat")
+
+	var expected []byte
+	for i := 0; i < 12; i++ {
+		msg := []byte{byte(i), byte(i), byte(i)}
+		expected = append(expected, msg...)
+		_, err := writer.Write(msg)
+		require.NoError(t, err)
+	}
+	close(ch)
+
+	data, err := io.ReadAll(reader)
+	require.NoError(t, err)
+	assert.Equal(t, expected, data)
+	assert.Equal(t, uint64(3), reader.FECStats().Recovered)
+}
@@ -2,124 +2,349 @@ package icq
 
 import (
 	"context"
+	"crypto/subtle"
+	"errors"
 	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
 
-	"github.com/libp2p/go-yamux/v3"
 	botgolang "github.com/mail-ru-im/bot-golang"
+	"github.com/pymq/demhack4/config"
 	"github.com/pymq/demhack4/encoding"
+	"github.com/pymq/demhack4/mux"
+	"github.com/pymq/demhack4/quota"
+	"github.com/pymq/demhack4/sched"
 	"github.com/pymq/demhack4/socksproxy"
 	log "github.com/sirupsen/logrus"
 )
 
+const (
+	DefaultSessionIdleTimeout = 30 * time.Minute
+	idleCheckInterval         = time.Minute
+)
+
 // TODO: refactor business logic out of ICQBot, including encoder, socksproxy
 type ICQBot struct {
-	Bot       *botgolang.Bot
-	ctx       context.Context
-	ctxCancel context.CancelFunc
-	openConns map[string]*RWC
-	encoder   *encoding.Encoder
-	proxy     *socksproxy.Server
+	requestSeq uint64 // ids of sent messages to find their status codes, first for atomic alignment
+	Bot        *botgolang.Bot
+	statuses   *statusTransport
+	sender     Client // sends messages of sessions, the bot itself
+	ctx        context.Context
+	ctxCancel  context.CancelFunc
+	done       chan struct{}                 // closed when all sessions are closed
+	sessions   map[sessionKey]*serverSession // owned by processEvents
+	encoder    *encoding.Encoder
+	proxy      *socksproxy.Server
+	pacer      *Pacer
+	rules      sched.Rules
+	opts       BotOptions
+}
+
+type BotOptions struct {
+	// InviteTokens, if not empty, are required in client handshake
+	InviteTokens []string
+	// KnownClients, if set, is used to remember client keys and report new or changed ones
+	KnownClients *config.KnownKeys
+	// SessionIdleTimeout closes sessions without incoming messages, DefaultSessionIdleTimeout if zero
+	SessionIdleTimeout time.Duration
+	// SessionQueueBytes limits inbound queue of every session, DefaultSessionQueueBytes if zero
+	SessionQueueBytes int
+	// Keepalive pings idle clients, dead sessions are closed
+	Keepalive config.Keepalive
+	// RateLimit paces messages of the bot account, shared by all sessions
+	RateLimit config.RateLimit
+	// StreamPriority prioritizes proxied streams by destination port
+	StreamPriority config.StreamPriority
+	// Quota, if set, accounts messages of every client and enforces its limits
+	Quota *quota.Tracker
 }
 
-func NewICQBot(botToken string, encoder *encoding.Encoder, proxy *socksproxy.Server) (*ICQBot, error) {
-	bot, err := botgolang.NewBot(botToken)
+func NewICQBot(botToken string, encoder *encoding.Encoder, proxy *socksproxy.Server, opts BotOptions) (*ICQBot, error) {
+	statuses := newStatusTransport(http.DefaultTransport)
+	bot, err := botgolang.NewBot(botToken, botgolang.BotHTTPClient(http.Client{Transport: statuses}))
 	if err != nil {
 		return nil, err
 	}
+	if opts.SessionIdleTimeout <= 0 {
+		opts.SessionIdleTimeout = DefaultSessionIdleTimeout
+	}
 	ctx, cancel := context.WithCancel(context.Background())
 	b := &ICQBot{
 		Bot:       bot,
+		statuses:  statuses,
 		ctx:       ctx,
 		ctxCancel: cancel,
-		openConns: map[string]*RWC{},
+		done:      make(chan struct{}),
+		sessions:  map[sessionKey]*serverSession{},
 		encoder:   encoder,
 		proxy:     proxy,
+		pacer:     NewPacer(opts.RateLimit, config.ICQBotRateLimit),
+		rules:     sched.NewRules(opts.StreamPriority),
+		opts:      opts,
 	}
+	b.sender = b
 	go b.processEvents(ctx)
 
 	return b, nil
 }
 
 func (bot *ICQBot) SendMessage(_ context.Context, msg []byte, chatId string) error {
-	icqMsg := bot.Bot.NewTextMessage(chatId, string(msg))
+	requestID := strconv.FormatUint(atomic.AddUint64(&bot.requestSeq, 1), 10)
+	icqMsg := bot.Bot.NewTextMessageWithRequestID(chatId, string(msg), requestID)
 	err := icqMsg.Send()
 	if err != nil {
+		if code, ok := bot.statuses.takeStatus(requestID); ok {
+			return fmt.Errorf("bot send message error: %w", StatusError{Code: code})
+		}
 		return fmt.Errorf("bot send message error: %s", err)
 	}
 	return nil
 }
 
+// Close closes all sessions, notifying clients.
 func (bot *ICQBot) Close() error {
 	bot.ctxCancel()
+	<-bot.done
 	return nil
 }
 
 func (bot *ICQBot) processEvents(ctx context.Context) {
+	defer close(bot.done)
 	updates := bot.Bot.GetUpdatesChannel(ctx)
+	idleTicker := time.NewTicker(idleCheckInterval)
+	defer idleTicker.Stop()
 
 	for {
 		select {
 		case <-ctx.Done():
+			for key := range bot.sessions {
+				bot.closeSession(key, true)
+			}
 			return
+		case <-idleTicker.C:
+			bot.closeIdleSessions()
 		case update := <-updates:
 			if update.Type != botgolang.NEW_MESSAGE {
 				continue
 			}
-			chatID := update.Payload.Chat.ID
-			message := update.Payload.Message().Text
-
-			rwc, exists := bot.openConns[chatID]
-			if exists {
-				rwc.messageChan <- ICQMessageEvent{
-					Text: []byte(message),
-				}
-				continue
-			}
+			bot.handleMessage(ctx, update.Payload.Chat.ID, []byte(update.Payload.Message().Text))
+		}
+	}
+}
 
-			publicKey, flags, err := bot.encoder.UnpackMessage([]byte(message))
-			if err != nil {
-				log.Errorf("icq: server: unpack encoded message: %v", err)
-				continue
-			}
+func (bot *ICQBot) handleMessage(ctx context.Context, chatID string, message []byte) {
+	header, err := encoding.PeekHeader(message)
+	if err != nil {
+		log.Errorf("icq: server: read message header: %v", err)
+		return
+	}
 
-			if flags != encoding.PublicKey {
-				log.Errorf("icq: server: invalid first message type from peer: '%d', should be '%d'", flags, encoding.PublicKey)
-				continue
-			}
+	key := sessionKey{chatID: chatID, session: header.Session}
+	session, exists := bot.sessions[key]
+	if exists && session.closed() {
+		bot.closeSession(key, false)
+		exists = false
+	}
 
-			encoder := bot.encoder.Copy()
-			err = encoder.SetPeerPublicKey(publicKey)
-			if err != nil {
-				log.Errorf("icq: server: set peer public key: %v", err)
-				continue
-			}
+	switch header.Type {
+	case encoding.PublicKey:
+		// live session is replaced only by accepted handshake
+		bot.openSession(ctx, key, message)
+	case encoding.Close:
+		if exists {
+			log.Infof("icq: server: client closed session '%s'", key)
+			bot.closeSession(key, false)
+		}
+	default:
+		if !exists {
+			log.Errorf("icq: server: message type '%d' for unknown session '%s', should start with '%d'", header.Type, key, encoding.PublicKey)
+			return
+		}
+		if session.quota != nil {
+			session.quota.account(len(message))
+		}
+		if !session.push(ICQMessageEvent{Text: message}, header.Type) {
+			// there is no retransmission below yamux, so dropped message breaks the stream
+			log.Warnf("icq: server: inbound queue overflow in session '%s', message dropped, resetting session", key)
+			bot.closeSession(key, true)
+		}
+	}
+}
 
-			msgCh := make(chan ICQMessageEvent, 1)
-			rwc = NewRWCClient(ctx, bot, msgCh, &ICQEncoder{Encoder: *encoder}, encoding.MaxMessageLen, chatID)
+// openSession accepts client handshake and opens its session. Existing session of key is replaced
+// only when new handshake is accepted, so rejected handshake doesn't break working session.
+func (bot *ICQBot) openSession(ctx context.Context, key sessionKey, message []byte) {
+	handshakeData, _, err := bot.encoder.UnpackMessage(message)
+	if err != nil {
+		log.Errorf("icq: server: unpack encoded message: %v", err)
+		return
+	}
 
-			yamuxCfg := yamux.DefaultConfig()
-			yamuxCfg.EnableKeepAlive = false
-			yamuxServer, err := yamux.Server(socksproxy.ConnWrapper{ReadWriteCloser: rwc}, yamuxCfg, nil)
-			if err != nil {
-				log.Errorf("icq: server: create yamux server: %v", err)
-				continue
-			}
-			bot.openConns[chatID] = rwc
-
-			go func() {
-				for {
-					if ctx.Err() != nil {
-						return
-					}
-					session, err := yamuxServer.Accept()
-					if err != nil {
-						log.Errorf("icq: server: accept yamux session: %v", err)
-						return
-					}
-
-					bot.proxy.ServeConn(session)
-				}
-			}()
+	handshake, err := encoding.UnmarshalHandshake(handshakeData)
+	if err != nil {
+		log.Errorf("icq: server: %v", err)
+		return
+	}
+
+	encoder := bot.encoder.Copy()
+	encoder.SetSession(key.session)
+	err = encoder.SetPeerPublicKey([]byte(handshake.PublicKey))
+	if err != nil {
+		log.Errorf("icq: server: set peer public key: %v", err)
+		return
+	}
+
+	if handshake.Version != encoding.ProtocolVersion {
+		log.Warnf("icq: server: rejected client from chat '%s': protocol version %d, server version %d",
+			key.chatID, handshake.Version, encoding.ProtocolVersion)
+		go bot.sendHandshakeAck(encoder, key, encoding.HandshakeVersionMismatch, "unsupported protocol version")
+		return
+	}
+	if !mux.Valid(handshake.Mux) {
+		log.Warnf("icq: server: rejected client from chat '%s': unsupported multiplexer %q", key.chatID, handshake.Mux)
+		go bot.sendHandshakeAck(encoder, key, encoding.HandshakeRejected, "unsupported multiplexer")
+		return
+	}
+	if !bot.checkInviteToken(handshake.InviteToken) {
+		log.Warnf("icq: server: rejected client from chat '%s': invalid invite token", key.chatID)
+		go bot.sendHandshakeAck(encoder, key, encoding.HandshakeRejected, "invalid invite token")
+		return
+	}
+
+	if bot.opts.Quota != nil {
+		err = bot.opts.Quota.Check(handshake.PublicKey)
+		var exceededErr *quota.ExceededError
+		if errors.As(err, &exceededErr) {
+			log.Warnf("icq: server: rejected client from chat '%s': %v", key.chatID, err)
+			go bot.rejectThrottled(encoder, key, exceededErr)
+			return
 		}
 	}
+
+	bot.reportClientKey(key.chatID, handshake.PublicKey)
+
+	session, err := newServerSession(ctx, bot, key, encoder, handshake)
+	if err != nil {
+		log.Errorf("icq: server: create session: %v", err)
+		go bot.sendHandshakeAck(encoder, key, encoding.HandshakeRejected, "internal server error")
+		return
+	}
+	if _, exists := bot.sessions[key]; exists {
+		log.Infof("icq: server: new handshake for session '%s', replacing old session", key)
+		bot.closeSession(key, false)
+	}
+	bot.sessions[key] = session
+
+	go bot.sendHandshakeAck(encoder, key, encoding.HandshakeAccepted, "")
+}
+
+func (bot *ICQBot) sendHandshakeAck(encoder *encoding.Encoder, key sessionKey, status encoding.HandshakeStatus, reason string) {
+	bot.sendAck(encoder, key, encoding.HandshakeAck{Status: status, Reason: reason})
+}
+
+// rejectThrottled rejects handshake of client which used up its quota.
+func (bot *ICQBot) rejectThrottled(encoder *encoding.Encoder, key sessionKey, err *quota.ExceededError) {
+	bot.sendAck(encoder, key, encoding.HandshakeAck{
+		Status:     encoding.HandshakeThrottled,
+		Reason:     err.Limit + " limit exceeded",
+		RetryAfter: retryAfter(err),
+	})
+}
+
+func (bot *ICQBot) sendAck(encoder *encoding.Encoder, key sessionKey, ack encoding.HandshakeAck) {
+	ack.Version = encoding.ProtocolVersion
+	payload, err := ack.Marshal()
+	if err != nil {
+		log.Errorf("icq: server: marshal handshake ack: %v", err)
+		return
+	}
+	err = bot.sendMessage(encoder, key, encoding.PublicKeyAck, payload)
+	if err != nil {
+		log.Errorf("icq: server: send handshake ack to session '%s': %v", key, err)
+	}
+}
+
+// sendMessage sends message to session directly, outside of its RWC.
+func (bot *ICQBot) sendMessage(enc Encoding, key sessionKey, flags encoding.MessageType, payload []byte) error {
+	msg, err := enc.PackMessage(flags, payload)
+	if err != nil {
+		return fmt.Errorf("pack message: %v", err)
+	}
+	return bot.pacer.Do(bot.ctx, func() error {
+		return bot.sender.SendMessage(bot.ctx, msg, key.chatID)
+	})
+}
+
+func (bot *ICQBot) closeSession(key sessionKey, notifyPeer bool) {
+	session, exists := bot.sessions[key]
+	if !exists {
+		return
+	}
+	delete(bot.sessions, key)
+	session.close(notifyPeer)
+}
+
+func (bot *ICQBot) closeIdleSessions() {
+	for key, session := range bot.sessions {
+		if session.closed() {
+			bot.closeSession(key, false)
+			continue
+		}
+		if time.Since(session.lastActive) > bot.opts.SessionIdleTimeout {
+			log.Infof("icq: server: closing idle session '%s'", key)
+			bot.closeSession(key, true)
+		}
+	}
+}
+
+func (bot *ICQBot) checkInviteToken(token string) bool {
+	if len(bot.opts.InviteTokens) == 0 {
+		return true
+	}
+	for _, t := range bot.opts.InviteTokens {
+		if subtle.ConstantTimeCompare([]byte(t), []byte(token)) == 1 {
+			return true
+		}
+	}
+
+	return false
+}
+
+// reportClientKey logs client key fingerprint. Known clients are indexed by public key,
+// because one chat can have several clients with different keys, new key of known chat is warned about.
+func (bot *ICQBot) reportClientKey(chatID, publicKey string) {
+	fingerprint := encoding.Fingerprint(publicKey)
+	if bot.opts.KnownClients == nil {
+		log.Infof("icq: server: client connected from chat '%s', key fingerprint: %s", chatID, fingerprint)
+		return
+	}
+
+	switch bot.opts.KnownClients.Check(publicKey, chatID) {
+	case config.KeyKnown:
+		log.Infof("icq: server: known client connected from chat '%s', key fingerprint: %s", chatID, fingerprint)
+		return
+	case config.KeyNew:
+		otherKeys := bot.opts.KnownClients.IDs(chatID)
+		if len(otherKeys) == 0 {
+			log.Infof("icq: server: NEW client connected from chat '%s', key fingerprint: %s", chatID, fingerprint)
+			break
+		}
+		oldFingerprints := make([]string, 0, len(otherKeys))
+		for _, key := range otherKeys {
+			oldFingerprints = append(oldFingerprints, encoding.Fingerprint(key))
+		}
+		log.Warnf("icq: server: client key in chat '%s' CHANGED or another client connected, known fingerprints: %s, new fingerprint: %s",
+			chatID, strings.Join(oldFingerprints, "; "), fingerprint)
+	case config.KeyChanged:
+		oldChatID, _ := bot.opts.KnownClients.Get(publicKey)
+		log.Warnf("icq: server: known client key with fingerprint %s moved from chat '%s' to chat '%s'",
+			fingerprint, oldChatID, chatID)
+	}
+	err := bot.opts.KnownClients.Trust(publicKey, chatID)
+	if err != nil {
+		log.Errorf("icq: server: save known client key: %v", err)
+	}
 }
@@ -0,0 +1,231 @@
+package icq
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	botgolang "github.com/mail-ru-im/bot-golang"
+	"github.com/pymq/demhack4/config"
+	"github.com/pymq/demhack4/encoding"
+	"github.com/pymq/demhack4/sched"
+	"github.com/pymq/demhack4/socksproxy"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBotSendMessageStatus(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Query().Get("text") {
+		case "limited":
+			w.WriteHeader(http.StatusTooManyRequests)
+		case "429-in-text":
+			// connection breaks without response, error text contains request URL with the text
+			conn, _, err := w.(http.Hijacker).Hijack()
+			if err == nil {
+				_ = conn.Close()
+			}
+		default:
+			_, _ = w.Write([]byte(`{"ok":true}`))
+		}
+	}))
+	defer srv.Close()
+
+	statuses := newStatusTransport(http.DefaultTransport)
+	b, err := botgolang.NewBot("token", botgolang.BotApiURL(srv.URL), botgolang.BotHTTPClient(http.Client{Transport: statuses}))
+	require.NoError(t, err)
+	bot := &ICQBot{Bot: b, statuses: statuses}
+
+	assert.NoError(t, bot.SendMessage(context.Background(), []byte("hello"), "chat"))
+
+	err = bot.SendMessage(context.Background(), []byte("limited"), "chat")
+	assert.ErrorIs(t, err, ErrRateLimited)
+
+	err = bot.SendMessage(context.Background(), []byte("429-in-text"), "chat")
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "429")
+	assert.NotErrorIs(t, err, ErrRateLimited)
+	assert.Empty(t, statuses.codes)
+}
+
+// recordingClient records sent messages
+type recordingClient struct {
+	sent chan []byte
+}
+
+func (c *recordingClient) SendMessage(_ context.Context, msg []byte, _ string) error {
+	c.sent <- msg
+	return nil
+}
+
+func TestCloseNotifyAfterPause(t *testing.T) {
+	cli := &recordingClient{sent: make(chan []byte, 1)}
+	rwc := NewRWCClient(context.Background(), cli, nil, plainEncoding{}, 100, "chat")
+	pacer := NewPacer(config.RateLimit{}, config.ICQClientRateLimit)
+	pacer.pausedUntil = time.Now().Add(300 * time.Millisecond)
+	rwc.SetPacer(pacer)
+
+	start := time.Now()
+	require.NoError(t, rwc.close(true))
+	assert.Less(t, time.Since(start), 100*time.Millisecond, "close shouldn't wait for pause")
+
+	select {
+	case msg := <-cli.sent:
+		assert.Equal(t, encoding.Close, encoding.MessageType(msg[0]))
+		assert.GreaterOrEqual(t, time.Since(start), 250*time.Millisecond)
+	case <-time.After(5 * time.Second):
+		t.Fatal("close message isn't sent after pause")
+	}
+}
+
+// newTestBot creates bot which sends messages to recording client and doesn't poll messenger.
+func newTestBot(t *testing.T, opts BotOptions) (*ICQBot, *recordingClient) {
+	key, err := encoding.GenerateKey()
+	require.NoError(t, err)
+	proxy, err := socksproxy.NewServer(socksproxy.ServerOptions{})
+	require.NoError(t, err)
+	if opts.SessionIdleTimeout <= 0 {
+		opts.SessionIdleTimeout = DefaultSessionIdleTimeout
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	sender := &recordingClient{sent: make(chan []byte, 100)}
+	bot := &ICQBot{
+		sender:    sender,
+		ctx:       ctx,
+		ctxCancel: cancel,
+		done:      make(chan struct{}),
+		sessions:  map[sessionKey]*serverSession{},
+		encoder:   encoding.NewEncoder(key),
+		proxy:     proxy,
+		pacer:     NewPacer(config.RateLimit{}, config.ICQBotRateLimit),
+		rules:     sched.NewRules(config.StreamPriority{}),
+		opts:      opts,
+	}
+	t.Cleanup(func() {
+		for key := range bot.sessions {
+			bot.closeSession(key, false)
+		}
+		cancel()
+		_ = proxy.Close()
+	})
+	return bot, sender
+}
+
+// newTestClientEncoder creates encoder of client session talking to bot.
+func newTestClientEncoder(t *testing.T, bot *ICQBot, session encoding.SessionID) *encoding.Encoder {
+	key, err := encoding.GenerateKey()
+	require.NoError(t, err)
+	enc := encoding.NewEncoder(key)
+	require.NoError(t, enc.SetPeerPublicKey(bot.encoder.GetOwnPublicKey()))
+	enc.SetSession(session)
+	return enc
+}
+
+func handshakeMessage(t *testing.T, enc *encoding.Encoder, inviteToken string) []byte {
+	h, err := encoding.Handshake{
+		Version:     encoding.ProtocolVersion,
+		PublicKey:   string(enc.GetOwnPublicKey()),
+		InviteToken: inviteToken,
+	}.Marshal()
+	require.NoError(t, err)
+	msg, err := enc.PackMessage(encoding.PublicKey, h)
+	require.NoError(t, err)
+	return msg
+}
+
+// nextMessage returns the next message of given type sent to client, skipping others
+// and messages of other sessions.
+func nextMessage(t *testing.T, sender *recordingClient, enc *encoding.Encoder, msgType encoding.MessageType) []byte {
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case msg := <-sender.sent:
+			data, flags, err := enc.UnpackMessage(msg)
+			if errors.Is(err, encoding.ErrForeignSession) {
+				continue
+			}
+			require.NoError(t, err)
+			if flags == msgType {
+				return data
+			}
+		case <-timeout:
+			t.Fatalf("message of type %d isn't sent", msgType)
+			return nil
+		}
+	}
+}
+
+func nextAck(t *testing.T, sender *recordingClient, enc *encoding.Encoder) encoding.HandshakeAck {
+	ack, err := encoding.UnmarshalHandshakeAck(nextMessage(t, sender, enc, encoding.PublicKeyAck))
+	require.NoError(t, err)
+	return ack
+}
+
+func TestBotSessionClose(t *testing.T) {
+	bot, sender := newTestBot(t, BotOptions{})
+	enc := newTestClientEncoder(t, bot, 1)
+	key := sessionKey{chatID: "chat", session: 1}
+
+	bot.handleMessage(bot.ctx, "chat", handshakeMessage(t, enc, ""))
+	assert.Equal(t, encoding.HandshakeAccepted, nextAck(t, sender, enc).Status)
+	session, ok := bot.sessions[key]
+	require.True(t, ok)
+
+	closeMsg, err := enc.PackMessage(encoding.Close, nil)
+	require.NoError(t, err)
+	bot.handleMessage(bot.ctx, "chat", closeMsg)
+	assert.NotContains(t, bot.sessions, key)
+	assert.True(t, session.closed())
+}
+
+func TestBotClosesIdleSessions(t *testing.T) {
+	bot, sender := newTestBot(t, BotOptions{SessionIdleTimeout: time.Minute})
+	idleEnc := newTestClientEncoder(t, bot, 1)
+	activeEnc := newTestClientEncoder(t, bot, 2)
+	idleKey := sessionKey{chatID: "chat", session: 1}
+	activeKey := sessionKey{chatID: "chat", session: 2}
+
+	bot.handleMessage(bot.ctx, "chat", handshakeMessage(t, idleEnc, ""))
+	nextAck(t, sender, idleEnc)
+	bot.handleMessage(bot.ctx, "chat", handshakeMessage(t, activeEnc, ""))
+	nextAck(t, sender, activeEnc)
+	require.Len(t, bot.sessions, 2)
+
+	bot.sessions[idleKey].lastActive = time.Now().Add(-2 * time.Minute)
+	bot.closeIdleSessions()
+	assert.NotContains(t, bot.sessions, idleKey)
+	assert.Contains(t, bot.sessions, activeKey)
+	// client of idle session is notified
+	nextMessage(t, sender, idleEnc, encoding.Close)
+}
+
+func TestBotKeepsSessionOnRejectedHandshake(t *testing.T) {
+	bot, sender := newTestBot(t, BotOptions{InviteTokens: []string{"secret"}})
+	enc := newTestClientEncoder(t, bot, 1)
+	key := sessionKey{chatID: "chat", session: 1}
+
+	bot.handleMessage(bot.ctx, "chat", handshakeMessage(t, enc, "secret"))
+	assert.Equal(t, encoding.HandshakeAccepted, nextAck(t, sender, enc).Status)
+	session := bot.sessions[key]
+	require.NotNil(t, session)
+
+	// handshake with wrong token for the same session is rejected
+	bot.handleMessage(bot.ctx, "chat", handshakeMessage(t, enc, "wrong"))
+	assert.Equal(t, encoding.HandshakeRejected, nextAck(t, sender, enc).Status)
+	// junk handshake isn't even answered
+	junk, err := enc.PackMessage(encoding.PublicKey, []byte("junk"))
+	require.NoError(t, err)
+	bot.handleMessage(bot.ctx, "chat", junk)
+
+	assert.Same(t, session, bot.sessions[key])
+	assert.False(t, session.closed())
+
+	// accepted handshake replaces session
+	bot.handleMessage(bot.ctx, "chat", handshakeMessage(t, enc, "secret"))
+	assert.Equal(t, encoding.HandshakeAccepted, nextAck(t, sender, enc).Status)
+	assert.NotSame(t, session, bot.sessions[key])
+	assert.True(t, session.closed())
+}
@@ -59,7 +59,7 @@ func (icqInst *ICQClient) SendMessage(ctx context.Context, msg []byte, chatId st
 
 	req, err := DoPostRequest(ctx, fmt.Sprint(BaseUrl, requestUrl), []byte(data.Encode()), headers, sharedHeaders)
 	if err != nil {
-		return fmt.Errorf("send message error: %s", err)
+		return fmt.Errorf("send message error: %w", err)
 	}
 
 	return req.Body.Close()
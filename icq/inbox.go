@@ -0,0 +1,122 @@
+package icq
+
+import (
+	"context"
+	"sync"
+)
+
+const DefaultSessionQueueBytes = 1 << 20
+
+// inboxStats is an accounting of session inbound queue.
+type inboxStats struct {
+	Received     uint64
+	Dropped      uint64
+	DroppedBytes uint64
+	QueuedBytes  int
+	MaxBytes     int
+	Paused       bool // backpressure is signalled to client
+}
+
+// inbox is a bounded queue of incoming messages of one session.
+// Producer (bot update loop) never blocks, consumer pumps messages into RWC at its own pace.
+// When queue grows above high watermark, client is asked to pause sending,
+// when it shrinks below low watermark, client is asked to resume.
+type inbox struct {
+	lock     sync.Mutex
+	queue    []ICQMessageEvent
+	bytes    int
+	maxBytes int
+	paused   bool
+	stats    inboxStats
+	notify   chan struct{} // new message in queue
+	pressure chan struct{} // paused state changed
+}
+
+func newInbox(maxBytes int) *inbox {
+	if maxBytes <= 0 {
+		maxBytes = DefaultSessionQueueBytes
+	}
+	return &inbox{
+		maxBytes: maxBytes,
+		notify:   make(chan struct{}, 1),
+		pressure: make(chan struct{}, 1),
+	}
+}
+
+// push adds message to queue, returns false if message was dropped due to overflow.
+func (q *inbox) push(msg ICQMessageEvent) bool {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	q.stats.Received++
+	size := len(msg.Text)
+	if q.bytes+size > q.maxBytes {
+		q.stats.Dropped++
+		q.stats.DroppedBytes += uint64(size)
+		return false
+	}
+	q.queue = append(q.queue, msg)
+	q.bytes += size
+	if !q.paused && q.bytes > q.maxBytes/2 {
+		q.setPaused(true)
+	}
+	signal(q.notify)
+
+	return true
+}
+
+// pop waits for next message, returns false if ctx is done.
+func (q *inbox) pop(ctx context.Context) (ICQMessageEvent, bool) {
+	for {
+		q.lock.Lock()
+		if len(q.queue) > 0 {
+			msg := q.queue[0]
+			q.queue[0] = ICQMessageEvent{}
+			q.queue = q.queue[1:]
+			q.bytes -= len(msg.Text)
+			if q.paused && q.bytes < q.maxBytes/4 {
+				q.setPaused(false)
+			}
+			q.lock.Unlock()
+			return msg, true
+		}
+		q.lock.Unlock()
+
+		select {
+		case <-ctx.Done():
+			return ICQMessageEvent{}, false
+		case <-q.notify:
+		}
+	}
+}
+
+func (q *inbox) isPaused() bool {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	return q.paused
+}
+
+func (q *inbox) getStats() inboxStats {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	stats := q.stats
+	stats.QueuedBytes = q.bytes
+	stats.MaxBytes = q.maxBytes
+	stats.Paused = q.paused
+	return stats
+}
+
+// setPaused should be called with lock held
+func (q *inbox) setPaused(paused bool) {
+	q.paused = paused
+	signal(q.pressure)
+}
+
+// signal does non-blocking send to notification channel with capacity 1
+func signal(ch chan struct{}) {
+	select {
+	case ch <- struct{}{}:
+	default:
+	}
+}
@@ -0,0 +1,56 @@
+package icq
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/pymq/demhack4/encoding"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestInbox(t *testing.T) {
+	q := newInbox(100)
+	msg := ICQMessageEvent{Text: make([]byte, 30)}
+
+	require.True(t, q.push(msg))
+	assert.False(t, q.isPaused())
+	require.True(t, q.push(msg))
+	assert.True(t, q.isPaused(), "should pause above half of limit")
+	require.True(t, q.push(msg))
+	assert.False(t, q.push(msg), "should drop on overflow")
+
+	stats := q.getStats()
+	assert.Equal(t, uint64(4), stats.Received)
+	assert.Equal(t, uint64(1), stats.Dropped)
+	assert.Equal(t, uint64(30), stats.DroppedBytes)
+	assert.Equal(t, 90, stats.QueuedBytes)
+
+	ctx := context.Background()
+	for i := 0; i < 2; i++ {
+		_, ok := q.pop(ctx)
+		require.True(t, ok)
+		assert.True(t, q.isPaused())
+	}
+	_, ok := q.pop(ctx)
+	require.True(t, ok)
+	assert.False(t, q.isPaused(), "should resume below quarter of limit")
+
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Millisecond)
+	defer cancel()
+	_, ok = q.pop(ctx)
+	assert.False(t, ok)
+}
+
+func TestSessionPushActivity(t *testing.T) {
+	idle := time.Now().Add(-time.Hour)
+	s := &serverSession{inbox: newInbox(0), lastActive: idle}
+
+	require.True(t, s.push(ICQMessageEvent{Text: []byte("ping")}, encoding.Ping))
+	require.True(t, s.push(ICQMessageEvent{Text: []byte("pong")}, encoding.Pong))
+	assert.Equal(t, idle, s.lastActive, "keepalive isn't activity")
+
+	require.True(t, s.push(ICQMessageEvent{Text: []byte("data")}, encoding.Text))
+	assert.True(t, s.lastActive.After(idle))
+}
@@ -0,0 +1,198 @@
+package icq
+
+import (
+	"encoding/binary"
+	"sync"
+	"time"
+
+	"github.com/pymq/demhack4/config"
+	"github.com/pymq/demhack4/encoding"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// minPongTimeout is a lower bound of retransmission timeout, messenger round trip takes seconds
+	minPongTimeout = 5 * time.Second
+	maxPongTimeout = 2 * time.Minute
+	// defaultKeepaliveInterval is used, if config has no interval
+	defaultKeepaliveInterval = time.Minute
+)
+
+// RTTStats is a smoothed round trip estimate of messenger link (RFC 6298).
+type RTTStats struct {
+	SRTT     time.Duration
+	RTTVar   time.Duration
+	Samples  int
+	Interval time.Duration // current ping interval
+	LastRecv time.Time
+	Alive    bool
+}
+
+// RTO returns timeout to wait for a reply from peer.
+func (s RTTStats) RTO() time.Duration {
+	if s.Samples == 0 {
+		return minPongTimeout
+	}
+	rto := s.SRTT + 4*s.RTTVar
+	if rto < minPongTimeout {
+		rto = minPongTimeout
+	}
+	if rto > maxPongTimeout {
+		rto = maxPongTimeout
+	}
+	return rto
+}
+
+// keepalive pings peer, when link is idle, and declares it dead after several missed pongs.
+type keepalive struct {
+	rwc         *RWC
+	cfg         config.Keepalive
+	lock        sync.Mutex
+	stats       RTTStats
+	pingSeq     uint64
+	pingSent    time.Time
+	outstanding bool
+	missed      int
+}
+
+func newKeepalive(rwc *RWC, cfg config.Keepalive) *keepalive {
+	config.SetKeepaliveDefaults(&cfg, defaultKeepaliveInterval)
+	return &keepalive{
+		rwc: rwc,
+		cfg: cfg,
+		stats: RTTStats{
+			Interval: cfg.Interval,
+			LastRecv: time.Now(),
+			Alive:    true,
+		},
+	}
+}
+
+func (k *keepalive) run() {
+	timer := time.NewTimer(k.cfg.Interval)
+	defer timer.Stop()
+	for {
+		select {
+		case <-k.rwc.Done():
+			return
+		case <-timer.C:
+		}
+
+		ping, dead := k.tick()
+		if dead {
+			log.Warnf("icq: keepalive: peer in chat '%s' did not answer %d pings, closing connection", k.rwc.chatId, k.cfg.MissedLimit)
+			_ = k.rwc.Close()
+			return
+		}
+		if ping != nil {
+			err := k.rwc.SendControl(encoding.Ping, ping)
+			if err != nil {
+				log.Warnf("icq: keepalive: send ping: %v", err)
+			}
+		}
+		timer.Reset(k.nextWake())
+	}
+}
+
+// tick checks pong deadline and returns ping payload, if ping should be sent now.
+func (k *keepalive) tick() (ping []byte, dead bool) {
+	k.lock.Lock()
+	defer k.lock.Unlock()
+
+	now := time.Now()
+	if k.outstanding {
+		if now.Sub(k.pingSent) < k.stats.RTO() {
+			return nil, false
+		}
+		k.outstanding = false
+		if k.stats.LastRecv.After(k.pingSent) {
+			// pong is lost or late, but peer is sending something
+			k.missed = 0
+		} else {
+			k.missed++
+		}
+		k.stats.Interval = k.cfg.Interval
+		if k.missed >= k.cfg.MissedLimit {
+			k.stats.Alive = false
+			return nil, true
+		}
+	}
+
+	if now.Sub(k.stats.LastRecv) < k.stats.Interval {
+		// link is busy, messages prove peer is alive
+		return nil, false
+	}
+
+	k.pingSeq++
+	k.pingSent = now
+	k.outstanding = true
+	ping = make([]byte, 8)
+	binary.BigEndian.PutUint64(ping, k.pingSeq)
+	return ping, false
+}
+
+func (k *keepalive) nextWake() time.Duration {
+	k.lock.Lock()
+	defer k.lock.Unlock()
+
+	if k.outstanding {
+		return time.Until(k.pingSent.Add(k.stats.RTO()))
+	}
+	wake := time.Until(k.stats.LastRecv.Add(k.stats.Interval))
+	if wake < time.Second {
+		wake = time.Second
+	}
+	return wake
+}
+
+// onReceive is called for every incoming message.
+func (k *keepalive) onReceive() {
+	k.lock.Lock()
+	defer k.lock.Unlock()
+	k.stats.LastRecv = time.Now()
+}
+
+func (k *keepalive) onPong(payload []byte) {
+	if len(payload) != 8 {
+		return
+	}
+	seq := binary.BigEndian.Uint64(payload)
+
+	k.lock.Lock()
+	defer k.lock.Unlock()
+	if !k.outstanding || seq != k.pingSeq {
+		return
+	}
+	k.outstanding = false
+	k.missed = 0
+	k.addSample(time.Since(k.pingSent))
+
+	// link is stable, ping less often
+	k.stats.Interval = k.stats.Interval * 3 / 2
+	if k.stats.Interval > k.cfg.MaxInterval {
+		k.stats.Interval = k.cfg.MaxInterval
+	}
+}
+
+// addSample updates smoothed RTT, should be called with lock held.
+func (k *keepalive) addSample(rtt time.Duration) {
+	s := &k.stats
+	if s.Samples == 0 {
+		s.SRTT = rtt
+		s.RTTVar = rtt / 2
+	} else {
+		delta := s.SRTT - rtt
+		if delta < 0 {
+			delta = -delta
+		}
+		s.RTTVar = (3*s.RTTVar + delta) / 4
+		s.SRTT = (7*s.SRTT + rtt) / 8
+	}
+	s.Samples++
+}
+
+func (k *keepalive) getStats() RTTStats {
+	k.lock.Lock()
+	defer k.lock.Unlock()
+	return k.stats
+}
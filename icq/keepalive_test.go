@@ -0,0 +1,61 @@
+package icq
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/pymq/demhack4/config"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestKeepaliveRTT(t *testing.T) {
+	rwc := NewRWCClient(context.Background(), nil, nil, nil, 0, "")
+	k := newKeepalive(rwc, config.Keepalive{Interval: time.Minute, MissedLimit: 2})
+
+	assert.Equal(t, minPongTimeout, k.getStats().RTO())
+	k.addSample(2 * time.Second)
+	k.addSample(2 * time.Second)
+	stats := k.getStats()
+	assert.Equal(t, 2*time.Second, stats.SRTT)
+	assert.Equal(t, 2*time.Second+4*stats.RTTVar, stats.RTO())
+	assert.Equal(t, 4*time.Minute, k.cfg.MaxInterval)
+}
+
+func TestKeepaliveDefaults(t *testing.T) {
+	rwc := NewRWCClient(context.Background(), nil, nil, nil, 0, "")
+	k := newKeepalive(rwc, config.Keepalive{})
+	assert.Equal(t, defaultKeepaliveInterval, k.cfg.Interval)
+	assert.Equal(t, defaultKeepaliveInterval, k.getStats().Interval)
+}
+
+func TestKeepaliveTick(t *testing.T) {
+	rwc := NewRWCClient(context.Background(), nil, nil, nil, 0, "")
+	k := newKeepalive(rwc, config.Keepalive{Interval: time.Minute, MissedLimit: 2})
+
+	ping, dead := k.tick()
+	assert.Nil(t, ping, "recently created link shouldn't be pinged")
+	assert.False(t, dead)
+
+	// idle link is pinged
+	k.stats.LastRecv = time.Now().Add(-2 * time.Minute)
+	ping, dead = k.tick()
+	assert.NotNil(t, ping)
+	assert.False(t, dead)
+
+	// pong grows interval
+	k.onPong(ping)
+	assert.Equal(t, 90*time.Second, k.getStats().Interval)
+	assert.Equal(t, 1, k.getStats().Samples)
+
+	// unanswered pings kill the link
+	k.stats.LastRecv = time.Now().Add(-2 * time.Hour)
+	for i := 0; i < 2; i++ {
+		ping, _ = k.tick()
+		assert.NotNil(t, ping)
+		k.pingSent = time.Now().Add(-time.Hour)
+	}
+	_, dead = k.tick()
+	assert.True(t, dead)
+	assert.False(t, k.getStats().Alive)
+}
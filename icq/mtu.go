@@ -0,0 +1,220 @@
+package icq
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/pymq/demhack4/encoding"
+	"github.com/pymq/demhack4/fec"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// MinMessageLimit is a plaintext size every carrier is expected to deliver
+	MinMessageLimit = 1000
+	// MaxProbeMessageLimit is the largest plaintext size tried by probing
+	MaxProbeMessageLimit = 30000
+	// probePrecision stops probing when the search range is narrower than 1/probePrecision of found size
+	probePrecision = 16
+	// shrinkRatio reduces message limit after messenger refused large message
+	shrinkRatio = 0.75
+	// shrinkBackoff is a pause before resending refused message in smaller chunks, it doubles on every resend
+	// up to maxBackoffGrowth times and is reset after delivered chunk
+	shrinkBackoff    = 500 * time.Millisecond
+	maxBackoffGrowth = 8
+	// growAfterSends is a number of successful sends of large messages to grow shrunk limit back,
+	// it doubles on every shrink up to maxGrowAfterSends, so limit doesn't flap around carrier limit
+	growAfterSends    = 100
+	maxGrowAfterSends = 100 << 6
+)
+
+// MessageLimit returns current plaintext size limit of outgoing messages.
+func (icq *RWC) MessageLimit() int {
+	icq.limitLock.Lock()
+	defer icq.limitLock.Unlock()
+	return icq.messageLimit
+}
+
+// PayloadLimit returns max bytes of Write which are sent in one message.
+func (icq *RWC) PayloadLimit() int {
+	limit := icq.MessageLimit()
+	if icq.fecSender != nil {
+		limit -= fec.MaxOverhead
+	}
+	return limit
+}
+
+// SetMessageLimit changes plaintext size limit of outgoing messages.
+func (icq *RWC) SetMessageLimit(limit int) {
+	if limit < MinMessageLimit {
+		limit = MinMessageLimit
+	}
+	icq.limitLock.Lock()
+	defer icq.limitLock.Unlock()
+	icq.messageLimit = limit
+	icq.limitCeiling = limit
+	icq.limitSends = 0
+}
+
+// OnMessageLimitChange sets callback called when limit shrinks after messenger refused large message
+// or grows back. Should be called before connection is used.
+func (icq *RWC) OnMessageLimitChange(f func(limit int)) {
+	icq.onLimitChange = f
+}
+
+// AnnounceMessageLimit asks peer to use current limit for its messages too.
+func (icq *RWC) AnnounceMessageLimit() error {
+	payload := make([]byte, 4)
+	binary.BigEndian.PutUint32(payload, uint32(icq.MessageLimit()))
+	return icq.SendControl(encoding.MessageLimit, payload)
+}
+
+func (icq *RWC) handleMessageLimit(payload []byte) {
+	if len(payload) != 4 {
+		return
+	}
+	limit := int(binary.BigEndian.Uint32(payload))
+	if limit > MaxProbeMessageLimit {
+		limit = MaxProbeMessageLimit
+	}
+	icq.SetMessageLimit(limit)
+	log.Debugf("icq: peer in chat '%s' announced message limit %d", icq.chatId, limit)
+}
+
+// adaptMessageLimit adjusts limit after send of message with given size: limit shrinks, when messenger
+// refuses message as too large, and grows back to the set limit after a run of successful sends
+// of large messages. Other errors don't change limit. It reports if the message should be resent
+// with smaller size.
+func (icq *RWC) adaptMessageLimit(sentLen int, err error) bool {
+	if err == nil {
+		icq.growMessageLimit(sentLen)
+		return false
+	}
+	if !errors.Is(err, ErrMessageTooLarge) || icq.ctx.Err() != nil || sentLen <= MinMessageLimit {
+		return false
+	}
+
+	limit := int(float64(sentLen) * shrinkRatio)
+	if limit < MinMessageLimit {
+		limit = MinMessageLimit
+	}
+	icq.limitLock.Lock()
+	if limit >= icq.messageLimit {
+		icq.limitLock.Unlock()
+		return true // shrunk by concurrent send already
+	}
+	icq.messageLimit = limit
+	icq.limitSends = 0
+	icq.growAfter *= 2
+	if icq.growAfter > maxGrowAfterSends {
+		icq.growAfter = maxGrowAfterSends
+	}
+	icq.limitLock.Unlock()
+
+	log.Warnf("icq: messenger refused %d bytes message to chat '%s', reducing message limit to %d: %v",
+		sentLen, icq.chatId, limit, err)
+	if icq.onLimitChange != nil {
+		icq.onLimitChange(limit)
+	}
+	return true
+}
+
+// growMessageLimit counts successful send and grows shrunk limit after enough sends of large messages.
+func (icq *RWC) growMessageLimit(sentLen int) {
+	icq.limitLock.Lock()
+	if icq.messageLimit >= icq.limitCeiling || float64(sentLen) < float64(icq.messageLimit)*shrinkRatio {
+		icq.limitLock.Unlock()
+		return
+	}
+	icq.limitSends++
+	if icq.limitSends < icq.growAfter {
+		icq.limitLock.Unlock()
+		return
+	}
+	limit := int(float64(icq.messageLimit) / shrinkRatio)
+	if limit > icq.limitCeiling {
+		limit = icq.limitCeiling
+	}
+	icq.messageLimit = limit
+	icq.limitSends = 0
+	icq.limitLock.Unlock()
+
+	log.Infof("icq: messages to chat '%s' are delivered, growing message limit to %d", icq.chatId, limit)
+	if icq.onLimitChange != nil {
+		icq.onLimitChange(limit)
+	}
+}
+
+// ProbeMessageLimit finds the largest plaintext size which peer receives and echoes intact,
+// with binary search over probe messages. It reads messages itself, so must be called
+// before connection is used.
+func (icq *RWC) ProbeMessageLimit(ctx context.Context, timeout time.Duration) (int, error) {
+	lo, hi := MinMessageLimit, MaxProbeMessageLimit+1
+	for seq := uint64(1); hi-lo > lo/probePrecision; seq++ {
+		size := lo + (hi-lo)/2
+		ok, err := icq.probe(ctx, seq, size, timeout)
+		if err != nil {
+			return 0, err
+		}
+		log.Debugf("icq: probe of %d bytes message: delivered %v", size, ok)
+		if ok {
+			lo = size
+		} else {
+			hi = size
+		}
+	}
+	return lo, nil
+}
+
+// probe sends message of given size and waits for its echo.
+func (icq *RWC) probe(ctx context.Context, seq uint64, size int, timeout time.Duration) (bool, error) {
+	payload := make([]byte, size)
+	_, err := rand.Read(payload)
+	if err != nil {
+		return false, fmt.Errorf("generate probe: %v", err)
+	}
+	binary.BigEndian.PutUint64(payload, seq)
+
+	msg, err := icq.PackMessage(encoding.Probe, payload)
+	if err != nil {
+		return false, fmt.Errorf("pack probe message: %v", err)
+	}
+	err = icq.send(ctx, msg)
+	if ctx.Err() != nil {
+		return false, ctx.Err()
+	} else if err != nil {
+		// carrier refused message
+		return false, nil
+	}
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	for {
+		var result ICQMessageEvent
+		var open bool
+		select {
+		case <-ctx.Done():
+			return false, ctx.Err()
+		case <-timer.C:
+			return false, nil
+		case result, open = <-icq.messageChan:
+		}
+		if result.Err != nil {
+			return false, result.Err
+		} else if !open {
+			return false, io.EOF
+		}
+
+		echo, flags, err := icq.UnpackMessage(result.Text)
+		if err != nil || flags != encoding.ProbeAck || len(echo) < 8 || binary.BigEndian.Uint64(echo) != seq {
+			continue // foreign, late or unrelated message
+		}
+		return bytes.Equal(echo, payload), nil
+	}
+}
@@ -0,0 +1,123 @@
+package icq
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/pymq/demhack4/encoding"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// limitedClient refuses messages longer than limit, echoes probes and records delivered sizes
+type limitedClient struct {
+	limit     int
+	echo      chan ICQMessageEvent
+	delivered []int
+}
+
+func (c *limitedClient) SendMessage(_ context.Context, msg []byte, _ string) error {
+	if len(msg) > c.limit {
+		return StatusError{Code: http.StatusRequestURITooLong}
+	}
+	c.delivered = append(c.delivered, len(msg))
+	if encoding.MessageType(msg[0]) == encoding.Probe {
+		c.echo <- ICQMessageEvent{Text: append([]byte{byte(encoding.ProbeAck)}, msg[1:]...)}
+	}
+	return nil
+}
+
+func TestProbeMessageLimit(t *testing.T) {
+	ch := make(chan ICQMessageEvent, 1)
+	cli := &limitedClient{limit: 4097, echo: ch}
+	rwc := NewRWCClient(context.Background(), cli, ch, plainEncoding{}, encoding.MaxMessageLen, "chat")
+
+	limit, err := rwc.ProbeMessageLimit(context.Background(), time.Second)
+	require.NoError(t, err)
+	assert.LessOrEqual(t, limit, 4096)
+	assert.Greater(t, limit, 4096-4096/probePrecision)
+}
+
+func TestShrinkMessageLimit(t *testing.T) {
+	cli := &limitedClient{limit: 3001}
+	rwc := NewRWCClient(context.Background(), cli, nil, plainEncoding{}, encoding.MaxMessageLen, "chat")
+	rwc.resendBackoff = time.Millisecond
+	var stored int
+	rwc.OnMessageLimitChange(func(limit int) { stored = limit })
+
+	n, err := rwc.Write(make([]byte, 20000))
+	require.NoError(t, err)
+	assert.Equal(t, 20000, n)
+	assert.Equal(t, 2372, rwc.MessageLimit()) // 10000 -> 7500 -> 5625 -> 4218 -> 3163 -> 2372
+	assert.Equal(t, rwc.MessageLimit(), stored)
+	for _, size := range cli.delivered {
+		assert.LessOrEqual(t, size, 3001)
+	}
+}
+
+// failingClient fails every send with err
+type failingClient struct {
+	err  error
+	sent int
+}
+
+func (c *failingClient) SendMessage(_ context.Context, _ []byte, _ string) error {
+	c.sent++
+	return c.err
+}
+
+func TestMessageLimitKeptOnOtherErrors(t *testing.T) {
+	cli := &failingClient{err: errors.New("connection reset")}
+	rwc := NewRWCClient(context.Background(), cli, nil, plainEncoding{}, encoding.MaxMessageLen, "chat")
+
+	_, err := rwc.Write(make([]byte, 20000))
+	require.Error(t, err)
+	assert.Equal(t, 1, cli.sent, "failed message shouldn't be resent")
+	assert.Equal(t, encoding.MaxMessageLen, rwc.MessageLimit())
+}
+
+func TestMessageLimitGrowsBack(t *testing.T) {
+	cli := &limitedClient{limit: 8000}
+	rwc := NewRWCClient(context.Background(), cli, nil, plainEncoding{}, encoding.MaxMessageLen, "chat")
+	rwc.resendBackoff = time.Millisecond
+	var stored int
+	rwc.OnMessageLimitChange(func(limit int) { stored = limit })
+
+	_, err := rwc.Write(make([]byte, 10000))
+	require.NoError(t, err)
+	assert.Equal(t, 7500, rwc.MessageLimit())
+
+	// carrier accepts large messages again, run to grow is doubled by shrink and includes resent chunk
+	cli.limit = encoding.MaxMessageLen + 1
+	for i := 0; i < 2*growAfterSends-2; i++ {
+		_, err = rwc.Write(make([]byte, 7500))
+		require.NoError(t, err)
+	}
+	assert.Equal(t, 7500, rwc.MessageLimit(), "limit should grow after enough sends only")
+	_, err = rwc.Write(make([]byte, 7500))
+	require.NoError(t, err)
+	assert.Equal(t, encoding.MaxMessageLen, rwc.MessageLimit())
+	assert.Equal(t, encoding.MaxMessageLen, stored)
+
+	// small messages don't grow limit
+	rwc.SetMessageLimit(2000)
+	_, err = rwc.Write(make([]byte, 2000))
+	require.NoError(t, err)
+	assert.Equal(t, 2000, rwc.MessageLimit())
+}
+
+func TestShrinkBackoffIsCapped(t *testing.T) {
+	cli := &limitedClient{limit: 1001}
+	rwc := NewRWCClient(context.Background(), cli, nil, plainEncoding{}, encoding.MaxMessageLen, "chat")
+	rwc.resendBackoff = 10 * time.Millisecond
+
+	// 8 shrinks from 10000 to 1000 pause 10+20+40+80*5 ms, uncapped pauses would take 2.55s
+	start := time.Now()
+	_, err := rwc.Write(make([]byte, 10000))
+	require.NoError(t, err)
+	assert.Equal(t, MinMessageLimit, rwc.MessageLimit())
+	assert.Less(t, time.Since(start), 1500*time.Millisecond)
+}
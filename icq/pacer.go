@@ -0,0 +1,170 @@
+package icq
+
+import (
+	"context"
+	"errors"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/pymq/demhack4/config"
+)
+
+const (
+	// rate multipliers on congestion signals
+	rateLimitedDecrease = 0.5
+	errorDecrease       = 0.8
+	latencyDecrease     = 0.9
+	// additive increase per successful message, in messages per second
+	rateIncrease = 0.05
+	// latency above baseLatency*latencyGrowth is a sign of congestion
+	latencyGrowth = 2
+	// pause after explicit rate limit response
+	rateLimitedPause = 10 * time.Second
+)
+
+// PacerStats is a snapshot of pacer state.
+type PacerStats struct {
+	Rate        float64 // messages per second
+	BaseLatency time.Duration
+	Sent        uint64
+	RateLimited uint64
+	Errors      uint64
+}
+
+// Pacer is a congestion controller of one messenger account, shared by all its connections.
+// It paces messages with token bucket and adapts the rate: slows down multiplicatively on send errors,
+// latency growth and rate limit responses, and probes back up additively on success.
+type Pacer struct {
+	cfg         config.RateLimit
+	lock        sync.Mutex
+	rate        float64
+	tokens      float64
+	lastRefill  time.Time
+	pausedUntil time.Time
+	sentTimes   []time.Time // sends of the last minute, for hard cap
+	baseLatency time.Duration
+	stats       PacerStats
+}
+
+func NewPacer(cfg config.RateLimit, defaults config.RateLimit) *Pacer {
+	config.SetRateLimitDefaults(&cfg, defaults)
+	return &Pacer{
+		cfg:        cfg,
+		rate:       cfg.InitialRate,
+		tokens:     float64(cfg.Burst),
+		lastRefill: time.Now(),
+	}
+}
+
+// Wait blocks until message can be sent.
+func (p *Pacer) Wait(ctx context.Context) error {
+	for {
+		delay := p.reserve()
+		if delay <= 0 {
+			return nil
+		}
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		case <-timer.C:
+		}
+	}
+}
+
+// Do waits for pacing, runs send and feeds its result into controller.
+func (p *Pacer) Do(ctx context.Context, send func() error) error {
+	err := p.Wait(ctx)
+	if err != nil {
+		return err
+	}
+	start := time.Now()
+	err = send()
+	p.OnResult(time.Since(start), err)
+	return err
+}
+
+// PausedFor returns time left of pause after rate limit response, zero if pacer isn't paused.
+func (p *Pacer) PausedFor() time.Duration {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if d := time.Until(p.pausedUntil); d > 0 {
+		return d
+	}
+	return 0
+}
+
+// reserve takes a token and returns zero, or returns time to wait for the next try.
+func (p *Pacer) reserve() time.Duration {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	now := time.Now()
+	if now.Before(p.pausedUntil) {
+		return p.pausedUntil.Sub(now)
+	}
+
+	p.tokens = math.Min(float64(p.cfg.Burst), p.tokens+now.Sub(p.lastRefill).Seconds()*p.rate)
+	p.lastRefill = now
+	if p.tokens < 1 {
+		return time.Duration((1 - p.tokens) / p.rate * float64(time.Second))
+	}
+
+	minuteAgo := now.Add(-time.Minute)
+	for len(p.sentTimes) > 0 && p.sentTimes[0].Before(minuteAgo) {
+		p.sentTimes = p.sentTimes[1:]
+	}
+	if len(p.sentTimes) >= p.cfg.MaxPerMinute {
+		return p.sentTimes[0].Sub(minuteAgo)
+	}
+
+	p.tokens--
+	p.sentTimes = append(p.sentTimes, now)
+	return 0
+}
+
+// OnResult feeds send outcome and its latency into controller.
+func (p *Pacer) OnResult(latency time.Duration, err error) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	switch {
+	case errors.Is(err, ErrRateLimited):
+		p.stats.RateLimited++
+		p.setRate(p.rate * rateLimitedDecrease)
+		p.tokens = 0
+		p.pausedUntil = time.Now().Add(rateLimitedPause)
+	case err != nil:
+		p.stats.Errors++
+		p.setRate(p.rate * errorDecrease)
+	default:
+		p.stats.Sent++
+		if p.baseLatency == 0 || latency < p.baseLatency {
+			p.baseLatency = latency
+		}
+		if latency > p.baseLatency*latencyGrowth {
+			p.setRate(p.rate * latencyDecrease)
+			// let base latency follow slow changes of the path
+			p.baseLatency += (latency - p.baseLatency) / 16
+		} else {
+			p.setRate(p.rate + rateIncrease)
+		}
+	}
+}
+
+func (p *Pacer) setRate(rate float64) {
+	p.rate = math.Max(p.cfg.MinRate, math.Min(p.cfg.MaxRate, rate))
+}
+
+func (p *Pacer) Stats() PacerStats {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	stats := p.stats
+	stats.Rate = p.rate
+	stats.BaseLatency = p.baseLatency
+	return stats
+}
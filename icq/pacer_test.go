@@ -0,0 +1,47 @@
+package icq
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/pymq/demhack4/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPacerAdaptsRate(t *testing.T) {
+	p := NewPacer(config.RateLimit{InitialRate: 1, MinRate: 0.1, MaxRate: 2}, config.ICQClientRateLimit)
+
+	p.OnResult(100*time.Millisecond, nil)
+	assert.InDelta(t, 1+rateIncrease, p.Stats().Rate, 1e-9)
+
+	p.OnResult(time.Second, nil)
+	assert.InDelta(t, (1+rateIncrease)*latencyDecrease, p.Stats().Rate, 1e-9, "latency growth should slow down")
+
+	p.OnResult(0, errors.New("network error"))
+	p.OnResult(0, StatusError{Code: 429})
+	stats := p.Stats()
+	assert.Equal(t, uint64(1), stats.Errors)
+	assert.Equal(t, uint64(1), stats.RateLimited)
+	assert.Less(t, stats.Rate, 0.5)
+	assert.Greater(t, p.reserve(), 5*time.Second, "should pause after rate limit response")
+
+	for i := 0; i < 1000; i++ {
+		p.OnResult(100*time.Millisecond, nil)
+	}
+	assert.Equal(t, 2.0, p.Stats().Rate, "rate should be capped")
+}
+
+func TestPacerHardCap(t *testing.T) {
+	p := NewPacer(config.RateLimit{InitialRate: 1000, MaxRate: 1000, Burst: 1000, MaxPerMinute: 5}, config.ICQClientRateLimit)
+	ctx := context.Background()
+	for i := 0; i < 5; i++ {
+		require.NoError(t, p.Wait(ctx))
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, 50*time.Millisecond)
+	defer cancel()
+	assert.ErrorIs(t, p.Wait(ctx), context.DeadlineExceeded)
+}
@@ -0,0 +1,81 @@
+package icq
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/pymq/demhack4/encoding"
+	"github.com/pymq/demhack4/quota"
+	log "github.com/sirupsen/logrus"
+)
+
+// quotaClient sends messages of server session, accounting them in client quota.
+// Its wait delays messages above client rate cap, before they are paced.
+type quotaClient struct {
+	bot       *ICQBot
+	tracker   *quota.Tracker
+	client    string // public key
+	key       sessionKey
+	rwc       *RWC // set right after RWC is created
+	throttled sync.Once
+}
+
+func (c *quotaClient) SendMessage(ctx context.Context, msg []byte, chatId string) error {
+	err := c.bot.sender.SendMessage(ctx, msg, chatId)
+	if err != nil {
+		return err
+	}
+	c.account(len(msg))
+	return nil
+}
+
+// wait blocks until client may be sent another message under its rate cap.
+func (c *quotaClient) wait(ctx context.Context) error {
+	notify, err := c.tracker.Wait(ctx, c.client)
+	if notify {
+		log.Infof("icq: server: session '%s' throttled by message rate cap", c.key)
+		go c.notify(encoding.QuotaNotice{Reason: "message rate cap"})
+	}
+	return err
+}
+
+// account counts message of session, closing session when client quota is used up.
+func (c *quotaClient) account(size int) {
+	err := c.tracker.Use(c.client, 1, size)
+	var exceededErr *quota.ExceededError
+	if errors.As(err, &exceededErr) {
+		c.throttled.Do(func() {
+			go c.throttle(exceededErr)
+		})
+	}
+}
+
+// throttle tells client that its quota is used up and closes session.
+func (c *quotaClient) throttle(err *quota.ExceededError) {
+	log.Warnf("icq: server: closing session '%s' of client %s: %v", c.key, encoding.Fingerprint(c.client), err)
+	c.notify(encoding.QuotaNotice{Reason: err.Limit + " limit exceeded", RetryAfter: retryAfter(err)})
+	closeErr := c.rwc.close(true)
+	if closeErr != nil {
+		log.Warnf("icq: server: notify client of session '%s' about closed session: %v", c.key, closeErr)
+	}
+}
+
+// notify sends quota notice bypassing quota, so it isn't delayed by rate cap.
+func (c *quotaClient) notify(notice encoding.QuotaNotice) {
+	payload, err := notice.Marshal()
+	if err != nil {
+		log.Errorf("icq: server: marshal quota notice: %v", err)
+		return
+	}
+	err = c.bot.sendMessage(c.rwc, c.key, encoding.Throttle, payload)
+	if err != nil {
+		log.Warnf("icq: server: send quota notice to session '%s': %v", c.key, err)
+	}
+}
+
+// retryAfter returns seconds until quota is reset, rounded up.
+func retryAfter(err *quota.ExceededError) int64 {
+	return int64((time.Until(err.Until) + time.Second - 1) / time.Second)
+}
@@ -0,0 +1,45 @@
+package icq
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/pymq/demhack4/config"
+	"github.com/pymq/demhack4/encoding"
+	"github.com/pymq/demhack4/quota"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRateCapDoesNotSlowBotPacer(t *testing.T) {
+	tracker, err := quota.Load(filepath.Join(t.TempDir(), "usage.json"), config.Quota{
+		Default: config.QuotaLimits{MessagesPerMinute: 1},
+	})
+	require.NoError(t, err)
+	defer tracker.Close()
+	bot, sender := newTestBot(t, BotOptions{Quota: tracker})
+	enc := newTestClientEncoder(t, bot, 1)
+
+	bot.handleMessage(bot.ctx, "chat", handshakeMessage(t, enc, ""))
+	require.Equal(t, encoding.HandshakeAccepted, nextAck(t, sender, enc).Status)
+	rwc := bot.sessions[sessionKey{chatID: "chat", session: 1}].rwc
+
+	require.NoError(t, rwc.SendControl(encoding.Ping, nil))
+	before := bot.pacer.Stats()
+
+	// the next message waits for rate cap of the client until it is canceled
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	msg, err := rwc.PackMessage(encoding.Ping, nil)
+	require.NoError(t, err)
+	err = rwc.send(ctx, msg)
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+
+	// client is notified about throttling, but waiting isn't accounted by pacer of the bot
+	nextMessage(t, sender, enc, encoding.Throttle)
+	after := bot.pacer.Stats()
+	assert.Equal(t, before.Errors, after.Errors)
+	assert.GreaterOrEqual(t, after.Rate, before.Rate)
+}
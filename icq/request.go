@@ -6,6 +6,7 @@ import (
 	"errors"
 	"fmt"
 	"net/http"
+	"sync"
 	"time"
 )
 
@@ -17,6 +18,34 @@ var reqHTTP = &http.Client{
 	},
 }
 
+var (
+	// ErrRateLimited is returned when messenger refuses to send messages that fast.
+	ErrRateLimited = errors.New("rate limited by messenger")
+	// ErrMessageTooLarge is returned when messenger refuses message because of its size.
+	ErrMessageTooLarge = errors.New("message is too large for messenger")
+)
+
+// StatusError is returned for non 200 responses.
+type StatusError struct {
+	Code int
+}
+
+func (e StatusError) Error() string {
+	return fmt.Sprintf("query error: code is not 200, got %d", e.Code)
+}
+
+func (e StatusError) Is(target error) bool {
+	switch target {
+	case ErrRateLimited:
+		return e.Code == http.StatusTooManyRequests || e.Code == http.StatusServiceUnavailable
+	case ErrMessageTooLarge:
+		// bot API takes message text in URL
+		return e.Code == http.StatusRequestEntityTooLarge || e.Code == http.StatusRequestURITooLong
+	default:
+		return false
+	}
+}
+
 func doRequest(ctx context.Context, methode, url string, body []byte, headers, sharedHeaders map[string]string) (*http.Response, error) {
 	req, err := http.NewRequestWithContext(ctx, methode, url, bytes.NewBuffer(body))
 	if err != nil {
@@ -33,7 +62,7 @@ func doRequest(ctx context.Context, methode, url string, body []byte, headers, s
 		return nil, err
 	}
 	if resp.StatusCode != 200 {
-		err = errors.New("query error: code is not 200")
+		err = StatusError{Code: resp.StatusCode}
 		cbErr := resp.Body.Close()
 		if cbErr != nil {
 			err = fmt.Errorf("%s; close response body error: %s", err, cbErr)
@@ -50,3 +79,37 @@ func DoGetRequest(ctx context.Context, url string, headers, sharedHeaders map[st
 func DoPostRequest(ctx context.Context, url string, body []byte, headers, sharedHeaders map[string]string) (*http.Response, error) {
 	return doRequest(ctx, http.MethodPost, url, body, headers, sharedHeaders)
 }
+
+// statusTransport remembers non 200 status codes of bot API requests by request id, because
+// bot library reports them only in error text.
+type statusTransport struct {
+	base  http.RoundTripper
+	lock  sync.Mutex
+	codes map[string]int
+}
+
+func newStatusTransport(base http.RoundTripper) *statusTransport {
+	return &statusTransport{base: base, codes: map[string]int{}}
+}
+
+func (t *statusTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := t.base.RoundTrip(req)
+	if err != nil || resp.StatusCode == http.StatusOK {
+		return resp, err
+	}
+	if id := req.URL.Query().Get("request-id"); id != "" {
+		t.lock.Lock()
+		t.codes[id] = resp.StatusCode
+		t.lock.Unlock()
+	}
+	return resp, nil
+}
+
+// takeStatus returns status code of failed request with id, if it got a response.
+func (t *statusTransport) takeStatus(id string) (int, bool) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	code, ok := t.codes[id]
+	delete(t.codes, id)
+	return code, ok
+}
@@ -3,7 +3,23 @@ package icq
 import (
 	"context"
 	"errors"
+	"fmt"
 	"io"
+	"sync"
+	"time"
+
+	"github.com/pymq/demhack4/config"
+	"github.com/pymq/demhack4/encoding"
+	"github.com/pymq/demhack4/fec"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	closeNotifyTimeout = 5 * time.Second
+	// maxPause limits waiting for resume after peer backpressure, in case resume message is lost
+	maxPause = 30 * time.Second
+	// maxRateLimitedRetries is a number of resends of a message refused by messenger rate limit
+	maxRateLimitedRetries = 5
 )
 
 type Client interface {
@@ -11,31 +27,52 @@ type Client interface {
 }
 
 type Encoding interface {
-	Encode(message []byte) ([]byte, error)
-	Decode(message []byte) ([]byte, error)
+	PackMessage(flags encoding.MessageType, message []byte) ([]byte, error)
+	UnpackMessage(encodedBody []byte) ([]byte, encoding.MessageType, error)
 }
 
 type RWC struct {
 	Client
 	Encoding
-	messageChan  chan ICQMessageEvent
-	unreadBytes  []byte
-	ctx          context.Context
-	ctxCancel    context.CancelFunc
-	chatId       string
-	messageLimit int
+	messageChan   chan ICQMessageEvent
+	unreadBytes   []byte
+	ctx           context.Context
+	ctxCancel     context.CancelFunc
+	chatId        string
+	messageLimit  int
+	limitCeiling  int // limit which was set, shrunk limit grows back up to it
+	limitSends    int // successful sends of large messages since limit changed
+	growAfter     int // limitSends needed to grow limit
+	resendBackoff time.Duration
+	limitLock     sync.Mutex // guards messageLimit and fields above
+	onLimitChange func(limit int)
+	onThrottle    func(notice encoding.QuotaNotice)
+	beforeSend    func(ctx context.Context) error
+	closeOnce     sync.Once
+	pauseLock     sync.Mutex
+	resumeCh      chan struct{} // not nil while peer asked to pause, closed on resume
+	keepalive     *keepalive
+	pacer         *Pacer
+	fecSender     *fecSender
+	fecDecoder    *fec.Decoder // used by Read only
+	fecReady      [][]byte     // payloads restored by decoder, waiting for Read
+	fecStats      fec.Stats
+	fecLock       sync.Mutex // guards fecStats
 }
 
 func NewRWCClient(ctx context.Context, cli Client, messageChan chan ICQMessageEvent, enc Encoding, messageLimit int, chatId string) *RWC {
 	ctx, cancel := context.WithCancel(ctx)
 	return &RWC{
-		Client:       cli,
-		Encoding:     enc,
-		messageChan:  messageChan,
-		ctx:          ctx,
-		ctxCancel:    cancel,
-		chatId:       chatId,
-		messageLimit: messageLimit,
+		Client:        cli,
+		Encoding:      enc,
+		messageChan:   messageChan,
+		ctx:           ctx,
+		ctxCancel:     cancel,
+		chatId:        chatId,
+		messageLimit:  messageLimit,
+		limitCeiling:  messageLimit,
+		growAfter:     growAfterSends,
+		resendBackoff: shrinkBackoff,
 	}
 }
 
@@ -44,28 +81,58 @@ func (icq *RWC) Write(p []byte) (n int, err error) {
 		return 0, errors.New("write error: connection closed")
 	}
 
+	backoff := icq.resendBackoff
 	for len(p) != 0 {
+		err = icq.waitResume()
+		if err != nil {
+			return n, err
+		}
+
+		limit := icq.PayloadLimit()
+
 		chunk := p
-		if len(p) > icq.messageLimit {
-			chunk = p[:icq.messageLimit]
+		if len(p) > limit {
+			chunk = p[:limit]
 		}
 
-		msg, err := icq.Encode(chunk)
-		if err != nil {
-			return n, errors.New("write error: can't encode message")
+		if icq.fecSender != nil {
+			err = icq.fecSender.write(chunk)
+		} else {
+			err = icq.writeMessage(chunk)
+			if icq.adaptMessageLimit(len(chunk), err) {
+				// resend in smaller chunks
+				select {
+				case <-icq.ctx.Done():
+					return n, errors.New("write error: connection closed")
+				case <-time.After(backoff):
+				}
+				backoff *= 2
+				if backoff > icq.resendBackoff*maxBackoffGrowth {
+					backoff = icq.resendBackoff * maxBackoffGrowth
+				}
+				continue
+			}
 		}
-		err = icq.SendMessage(icq.ctx, msg, icq.chatId)
 		if err != nil {
 			return n, err
 		}
 
 		n += len(chunk)
 		p = p[len(chunk):]
+		backoff = icq.resendBackoff
 	}
 
 	return n, nil
 }
 
+func (icq *RWC) writeMessage(chunk []byte) error {
+	msg, err := icq.PackMessage(encoding.Text, chunk)
+	if err != nil {
+		return errors.New("write error: can't encode message")
+	}
+	return icq.send(icq.ctx, msg)
+}
+
 func (icq *RWC) Read(p []byte) (n int, err error) {
 	if icq.ctx.Err() != nil {
 		return 0, errors.New("read error: connection closed")
@@ -80,16 +147,74 @@ func (icq *RWC) Read(p []byte) (n int, err error) {
 		return n, nil
 	}
 
-	result, open := <-icq.messageChan
-	if result.Err != nil {
-		return 0, result.Err
-	} else if !open && len(result.Text) == 0 {
-		return 0, io.EOF
-	}
+	var result ICQMessageEvent
+	var open bool
+	var flags encoding.MessageType
+	for {
+		if len(icq.fecReady) > 0 {
+			result.Text, icq.fecReady = icq.fecReady[0], icq.fecReady[1:]
+			open = true
+			break
+		}
 
-	result.Text, err = icq.Decode(result.Text)
-	if err != nil {
-		return 0, errors.New("read error: can't decode message")
+		select {
+		case <-icq.ctx.Done():
+			return 0, errors.New("read error: connection closed")
+		case result, open = <-icq.messageChan:
+		}
+		if result.Err != nil {
+			return 0, result.Err
+		} else if !open && len(result.Text) == 0 {
+			return 0, io.EOF
+		}
+
+		result.Text, flags, err = icq.UnpackMessage(result.Text)
+		if errors.Is(err, encoding.ErrForeignSession) {
+			continue
+		} else if err != nil {
+			return 0, errors.New("read error: can't decode message")
+		}
+		if icq.keepalive != nil {
+			icq.keepalive.onReceive()
+		}
+		if flags == encoding.Text {
+			break
+		}
+		switch flags {
+		case encoding.FECData, encoding.FECParity:
+			err = icq.readFEC(flags, result.Text)
+			if err != nil {
+				return 0, err
+			}
+		case encoding.Close:
+			_ = icq.close(false)
+			return 0, io.EOF
+		case encoding.Backpressure:
+			icq.setPaused(len(result.Text) > 0 && result.Text[0] == 1)
+		case encoding.Ping:
+			go func(payload []byte) {
+				err := icq.SendControl(encoding.Pong, payload)
+				if err != nil {
+					log.Warnf("icq: send pong: %v", err)
+				}
+			}(result.Text)
+		case encoding.Pong:
+			if icq.keepalive != nil {
+				icq.keepalive.onPong(result.Text)
+			}
+		case encoding.Probe:
+			go func(payload []byte) {
+				err := icq.SendControl(encoding.ProbeAck, payload)
+				if err != nil {
+					log.Debugf("icq: send probe echo: %v", err)
+				}
+			}(result.Text)
+		case encoding.MessageLimit:
+			icq.handleMessageLimit(result.Text)
+		case encoding.Throttle:
+			icq.handleThrottle(result.Text)
+		}
+		// skip other control messages
 	}
 
 	readBytesCounter := copy(p, result.Text)
@@ -103,7 +228,171 @@ func (icq *RWC) Read(p []byte) (n int, err error) {
 	return readBytesCounter, nil
 }
 
+// StartKeepalive starts pinging peer when link is idle, connection is closed if peer stops responding.
+// Should be called once, before connection is used.
+func (icq *RWC) StartKeepalive(cfg config.Keepalive) {
+	icq.keepalive = newKeepalive(icq, cfg)
+	go icq.keepalive.run()
+}
+
+// RTT returns round trip estimate and liveness of the peer, zero stats if keepalive isn't started.
+func (icq *RWC) RTT() RTTStats {
+	if icq.keepalive == nil {
+		return RTTStats{}
+	}
+	return icq.keepalive.getStats()
+}
+
+// SendControl sends control message of given type to peer.
+func (icq *RWC) SendControl(flags encoding.MessageType, payload []byte) error {
+	msg, err := icq.PackMessage(flags, payload)
+	if err != nil {
+		return fmt.Errorf("pack control message: %v", err)
+	}
+	return icq.send(icq.ctx, msg)
+}
+
+// SetPacer enables rate control of outgoing messages. Should be called before connection is used.
+func (icq *RWC) SetPacer(p *Pacer) {
+	icq.pacer = p
+}
+
+// OnBeforeSend sets callback called before message is paced, e.g. to delay it by rate cap of the client,
+// so delay isn't accounted by pacer shared with other connections. Should be called before connection is used.
+func (icq *RWC) OnBeforeSend(f func(ctx context.Context) error) {
+	icq.beforeSend = f
+}
+
+// OnThrottle sets callback called when peer throttles connection by quota.
+// Should be called before connection is used.
+func (icq *RWC) OnThrottle(f func(notice encoding.QuotaNotice)) {
+	icq.onThrottle = f
+}
+
+func (icq *RWC) handleThrottle(payload []byte) {
+	notice, err := encoding.UnmarshalQuotaNotice(payload)
+	if err != nil {
+		log.Warnf("icq: %v", err)
+		return
+	}
+	log.Warnf("icq: peer in chat '%s' throttled connection: %s", icq.chatId, notice.Reason)
+	if icq.onThrottle != nil {
+		icq.onThrottle(notice)
+	}
+}
+
+// send paces message and resends it, if it was refused by rate limit.
+func (icq *RWC) send(ctx context.Context, msg []byte) error {
+	if icq.beforeSend != nil {
+		err := icq.beforeSend(ctx)
+		if err != nil {
+			return err
+		}
+	}
+	if icq.pacer == nil {
+		return icq.SendMessage(ctx, msg, icq.chatId)
+	}
+
+	for attempt := 0; ; attempt++ {
+		err := icq.pacer.Do(ctx, func() error {
+			return icq.SendMessage(ctx, msg, icq.chatId)
+		})
+		if err == nil || !errors.Is(err, ErrRateLimited) || attempt >= maxRateLimitedRetries {
+			return err
+		}
+	}
+}
+
+func encodeBackpressure(paused bool) []byte {
+	if paused {
+		return []byte{1}
+	}
+	return []byte{0}
+}
+
+func (icq *RWC) setPaused(paused bool) {
+	icq.pauseLock.Lock()
+	defer icq.pauseLock.Unlock()
+
+	switch {
+	case paused && icq.resumeCh == nil:
+		icq.resumeCh = make(chan struct{})
+	case !paused && icq.resumeCh != nil:
+		close(icq.resumeCh)
+		icq.resumeCh = nil
+	}
+}
+
+// waitResume blocks writes while peer asked to pause.
+func (icq *RWC) waitResume() error {
+	icq.pauseLock.Lock()
+	resumeCh := icq.resumeCh
+	icq.pauseLock.Unlock()
+	if resumeCh == nil {
+		return nil
+	}
+
+	timer := time.NewTimer(maxPause)
+	defer timer.Stop()
+	select {
+	case <-resumeCh:
+	case <-timer.C:
+		icq.setPaused(false)
+	case <-icq.ctx.Done():
+		return errors.New("write error: connection closed")
+	}
+	return nil
+}
+
+// Close closes connection and notifies peer, unless peer has closed it first.
 func (icq *RWC) Close() error {
-	icq.ctxCancel()
+	return icq.close(true)
+}
+
+func (icq *RWC) close(notifyPeer bool) error {
+	var err error
+	icq.closeOnce.Do(func() {
+		icq.ctxCancel()
+		if !notifyPeer {
+			return
+		}
+
+		var msg []byte
+		msg, err = icq.PackMessage(encoding.Close, nil)
+		if err != nil {
+			err = fmt.Errorf("pack close message: %v", err)
+			return
+		}
+		err = icq.notifyClose(msg)
+	})
+
+	return err
+}
+
+// notifyClose sends close message to peer. If pacer is paused by rate limit, message is sent
+// after the pause in background, so closing doesn't wait for it.
+func (icq *RWC) notifyClose(msg []byte) error {
+	if icq.pacer == nil || icq.pacer.PausedFor() == 0 {
+		ctx, cancel := context.WithTimeout(context.Background(), closeNotifyTimeout)
+		err := icq.send(ctx, msg)
+		cancel()
+		if err == nil || icq.pacer == nil || icq.pacer.PausedFor() == 0 {
+			return err
+		}
+	}
+
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), icq.pacer.PausedFor()+closeNotifyTimeout)
+		defer cancel()
+		err := icq.send(ctx, msg)
+		if err != nil {
+			log.Warnf("icq: notify peer in chat '%s' about closed connection after rate limit pause: %v", icq.chatId, err)
+		}
+	}()
 	return nil
 }
+
+// Done is closed when connection is closed by either side.
+func (icq *RWC) Done() <-chan struct{} {
+	return icq.ctx.Done()
+}
@@ -0,0 +1,205 @@
+package icq
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/pymq/demhack4/encoding"
+	"github.com/pymq/demhack4/mux"
+	"github.com/pymq/demhack4/sched"
+	"github.com/pymq/demhack4/socksproxy"
+	log "github.com/sirupsen/logrus"
+)
+
+// serverSession is a tunnel opened by client handshake in a chat.
+// It is owned by ICQBot.processEvents goroutine.
+type serverSession struct {
+	key        sessionKey
+	client     string       // public key
+	quota      *quotaClient // nil if quota is not enforced
+	inbox      *inbox
+	msgCh      chan ICQMessageEvent
+	rwc        *RWC
+	sched      *sched.Conn
+	mux        mux.Session
+	lastActive time.Time
+	done       chan struct{} // closed when accept loop exits
+}
+
+type sessionKey struct {
+	chatID  string
+	session encoding.SessionID
+}
+
+func (k sessionKey) String() string {
+	return fmt.Sprintf("%s/%016x", k.chatID, uint64(k.session))
+}
+
+func newServerSession(ctx context.Context, bot *ICQBot, key sessionKey, enc Encoding, handshake encoding.Handshake) (*serverSession, error) {
+	msgCh := make(chan ICQMessageEvent, 1)
+	cli := bot.sender
+	var quotaCli *quotaClient
+	if bot.opts.Quota != nil {
+		quotaCli = &quotaClient{bot: bot, tracker: bot.opts.Quota, client: handshake.PublicKey, key: key}
+		cli = quotaCli
+	}
+	rwc := NewRWCClient(ctx, cli, msgCh, enc, encoding.MaxMessageLen, key.chatID)
+	if quotaCli != nil {
+		quotaCli.rwc = rwc
+		// rate cap of one client doesn't slow down pacer of the bot
+		rwc.OnBeforeSend(quotaCli.wait)
+	}
+	if handshake.FEC != nil {
+		err := rwc.EnableFEC(FECConfig(handshake.FEC))
+		if err != nil {
+			_ = rwc.close(false)
+			return nil, fmt.Errorf("enable fec: %v", err)
+		}
+	}
+
+	rwc.SetPacer(bot.pacer)
+	rwc.StartKeepalive(bot.opts.Keepalive)
+
+	muxSession, conn, err := mux.New(handshake.Mux, socksproxy.ConnWrapper{ReadWriteCloser: rwc}, false, rwc.PayloadLimit)
+	if err != nil {
+		_ = rwc.close(false)
+		return nil, err
+	}
+
+	s := &serverSession{
+		key:        key,
+		client:     handshake.PublicKey,
+		quota:      quotaCli,
+		inbox:      newInbox(bot.opts.SessionQueueBytes),
+		msgCh:      msgCh,
+		rwc:        rwc,
+		sched:      conn,
+		mux:        muxSession,
+		lastActive: time.Now(),
+		done:       make(chan struct{}),
+	}
+	go s.serve(bot.proxy, bot.rules)
+	go s.pump()
+	go s.signalBackpressure()
+
+	return s, nil
+}
+
+func (s *serverSession) serve(proxy *socksproxy.Server, rules sched.Rules) {
+	defer close(s.done)
+	peer := socksproxy.Peer{Client: s.client, OpenStream: s.openStream}
+	for {
+		stream, err := s.mux.AcceptStream()
+		if err != nil {
+			if !s.mux.IsClosed() {
+				log.Errorf("icq: server: accept yamux session: %v", err)
+			}
+			return
+		}
+
+		id := stream.StreamID()
+		if destination := stream.Destination(); destination != "" {
+			s.sched.SetPriority(id, rules.MatchAddr(destination))
+			proxy.ServeDestination(s.sched.Track(stream, id), destination, s.client)
+			continue
+		}
+		proxy.ServeConn(socksproxy.Sniff(s.sched.Track(stream, id), func(port int) {
+			s.sched.SetPriority(id, rules.Match(port))
+		}), peer)
+	}
+}
+
+// openStream opens stream to client, e.g. for connection accepted by remote forward.
+func (s *serverSession) openStream(ctx context.Context) (io.ReadWriteCloser, error) {
+	stream, err := s.mux.OpenStream(ctx, "")
+	if err != nil {
+		return nil, err
+	}
+	return s.sched.Track(stream, stream.StreamID()), nil
+}
+
+// push queues message for session without blocking, returns false if message was dropped.
+// Keepalive messages don't count as activity, so session of idle client still times out.
+func (s *serverSession) push(msg ICQMessageEvent, msgType encoding.MessageType) bool {
+	if msgType != encoding.Ping && msgType != encoding.Pong {
+		s.lastActive = time.Now()
+	}
+	return s.inbox.push(msg)
+}
+
+// pump delivers queued messages to RWC.
+func (s *serverSession) pump() {
+	for {
+		msg, ok := s.inbox.pop(s.rwc.ctx)
+		if !ok {
+			return
+		}
+		select {
+		case s.msgCh <- msg:
+		case <-s.rwc.Done():
+			return
+		}
+	}
+}
+
+// signalBackpressure tells client to pause or resume sending, when inbox fills up or drains.
+func (s *serverSession) signalBackpressure() {
+	sentPaused := false
+	for {
+		select {
+		case <-s.rwc.Done():
+			return
+		case <-s.inbox.pressure:
+		}
+		paused := s.inbox.isPaused()
+		if paused == sentPaused {
+			continue
+		}
+		err := s.rwc.SendControl(encoding.Backpressure, encodeBackpressure(paused))
+		if err != nil {
+			log.Warnf("icq: server: send backpressure to session '%s': %v", s.key, err)
+			continue
+		}
+		sentPaused = paused
+	}
+}
+
+func (s *serverSession) closed() bool {
+	select {
+	case <-s.rwc.Done():
+		return true
+	default:
+		return false
+	}
+}
+
+// close closes yamux session with all proxied streams and notifies client, if notifyPeer is set.
+func (s *serverSession) close(notifyPeer bool) {
+	err := s.rwc.close(notifyPeer)
+	if err != nil {
+		log.Warnf("icq: server: notify client of session '%s' about closed session: %v", s.key, err)
+	}
+	s.logStats()
+	err = s.mux.Close()
+	if err != nil {
+		log.Warnf("icq: server: close yamux session: %v", err)
+	}
+	<-s.done
+}
+
+// logStats logs inbound queue accounting and outgoing data left in stream queues of closed session.
+func (s *serverSession) logStats() {
+	inbox := s.inbox.getStats()
+	var streams, frames, bytes int
+	for _, stream := range s.sched.Stats() {
+		if stream.QueuedFrames > 0 {
+			streams++
+			frames += stream.QueuedFrames
+			bytes += stream.QueuedBytes
+		}
+	}
+	log.Infof("icq: server: session '%s' closed, received %d messages, dropped %d messages (%d bytes), "+
+		"%d streams had %d frames (%d bytes) unsent", s.key, inbox.Received, inbox.Dropped, inbox.DroppedBytes, streams, frames, bytes)
+}
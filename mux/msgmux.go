@@ -0,0 +1,523 @@
+package mux
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// msgmux frames start with type byte, numbers are uvarints:
+//
+//	open:   stream id, destination length, destination
+//	data:   stream id, length, payload
+//	close:  stream id (sender won't read or write anymore)
+//	reset:  stream id
+//	credit: count, count pairs of stream id and credit in bytes
+//	goaway
+//
+// Stream open doesn't wait for reply, data may follow it immediately. Every stream may send
+// msgWindow bytes, receiver grants more credit as application reads, in one frame for all streams.
+const (
+	frameOpen byte = iota + 1
+	frameData
+	frameClose
+	frameReset
+	frameCredit
+	frameGoAway
+)
+
+const (
+	msgWindow = 256 * 1024
+	// msgCreditThreshold is consumed bytes of a stream to send credit, pending credits of other streams go in the same frame
+	msgCreditThreshold = msgWindow / 4
+	msgMaxFrameData    = 8 * 1024
+	msgMaxDestination  = 1024
+	msgMaxCredits      = 4096
+	msgAcceptBacklog   = 256
+)
+
+type msgSession struct {
+	conn      io.ReadWriteCloser
+	lock      sync.Mutex
+	nextID    uint32
+	streams   map[uint32]*msgStream
+	credits   map[uint32]int // granted credit not sent yet
+	acceptCh  chan *msgStream
+	closeCh   chan struct{}
+	closeOnce sync.Once
+}
+
+func newMsgSession(conn io.ReadWriteCloser, client bool) *msgSession {
+	s := &msgSession{
+		conn:     conn,
+		nextID:   2,
+		streams:  map[uint32]*msgStream{},
+		credits:  map[uint32]int{},
+		acceptCh: make(chan *msgStream, msgAcceptBacklog),
+		closeCh:  make(chan struct{}),
+	}
+	if client {
+		s.nextID = 1
+	}
+	go s.recvLoop()
+	return s
+}
+
+func (s *msgSession) OpenStream(ctx context.Context, destination string) (Stream, error) {
+	if len(destination) > msgMaxDestination {
+		return nil, fmt.Errorf("mux: destination is too long")
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	s.lock.Lock()
+	if s.IsClosed() {
+		s.lock.Unlock()
+		return nil, ErrSessionClosed
+	}
+	id := s.nextID
+	s.nextID += 2
+	stream := newMsgStream(s, id, destination)
+	s.streams[id] = stream
+	s.lock.Unlock()
+
+	buf := &bytes.Buffer{}
+	buf.WriteByte(frameOpen)
+	writeUvarint(buf, uint64(id))
+	writeUvarint(buf, uint64(len(destination)))
+	buf.WriteString(destination)
+	err := s.write(buf.Bytes())
+	if err != nil {
+		s.remove(id)
+		return nil, err
+	}
+	return stream, nil
+}
+
+func (s *msgSession) AcceptStream() (Stream, error) {
+	select {
+	case stream := <-s.acceptCh:
+		return stream, nil
+	case <-s.closeCh:
+		return nil, ErrSessionClosed
+	}
+}
+
+func (s *msgSession) Close() error {
+	if s.IsClosed() {
+		return nil
+	}
+	_ = s.write([]byte{frameGoAway})
+	s.close()
+	return nil
+}
+
+func (s *msgSession) CloseChan() <-chan struct{} {
+	return s.closeCh
+}
+
+func (s *msgSession) IsClosed() bool {
+	select {
+	case <-s.closeCh:
+		return true
+	default:
+		return false
+	}
+}
+
+func (s *msgSession) close() {
+	s.closeOnce.Do(func() {
+		close(s.closeCh)
+		err := s.conn.Close()
+		if err != nil {
+			log.Debugf("mux: close connection: %v", err)
+		}
+
+		s.lock.Lock()
+		streams := s.streams
+		s.streams = map[uint32]*msgStream{}
+		s.lock.Unlock()
+		for _, stream := range streams {
+			stream.fail(ErrSessionClosed)
+		}
+	})
+}
+
+func (s *msgSession) write(frame []byte) error {
+	if s.IsClosed() {
+		return ErrSessionClosed
+	}
+	_, err := s.conn.Write(frame)
+	if err != nil {
+		s.close()
+		return fmt.Errorf("mux: write: %v", err)
+	}
+	return nil
+}
+
+func (s *msgSession) writeStreamFrame(frameType byte, id uint32) error {
+	buf := &bytes.Buffer{}
+	buf.WriteByte(frameType)
+	writeUvarint(buf, uint64(id))
+	return s.write(buf.Bytes())
+}
+
+func (s *msgSession) stream(id uint32) *msgStream {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.streams[id]
+}
+
+func (s *msgSession) remove(id uint32) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	delete(s.streams, id)
+	delete(s.credits, id)
+}
+
+// grant gives peer credit for consumed bytes. Credits are sent when one of streams consumed enough.
+func (s *msgSession) grant(id uint32, n int) {
+	s.lock.Lock()
+	if _, ok := s.streams[id]; !ok {
+		s.lock.Unlock()
+		return
+	}
+	s.credits[id] += n
+	if s.credits[id] < msgCreditThreshold {
+		s.lock.Unlock()
+		return
+	}
+
+	buf := &bytes.Buffer{}
+	buf.WriteByte(frameCredit)
+	writeUvarint(buf, uint64(len(s.credits)))
+	for streamID, credit := range s.credits {
+		writeUvarint(buf, uint64(streamID))
+		writeUvarint(buf, uint64(credit))
+	}
+	s.credits = map[uint32]int{}
+	s.lock.Unlock()
+
+	err := s.write(buf.Bytes())
+	if err != nil {
+		log.Debugf("mux: send credit: %v", err)
+	}
+}
+
+func (s *msgSession) recvLoop() {
+	r := bufio.NewReader(s.conn)
+	for {
+		err := s.recvFrame(r)
+		if err != nil {
+			if !s.IsClosed() && !errors.Is(err, io.EOF) {
+				log.Warnf("mux: receive: %v", err)
+			}
+			s.close()
+			return
+		}
+	}
+}
+
+func (s *msgSession) recvFrame(r *bufio.Reader) error {
+	frameType, err := r.ReadByte()
+	if err != nil {
+		return err
+	}
+	if frameType == frameGoAway {
+		return io.EOF
+	}
+	if frameType == frameCredit {
+		return s.recvCredit(r)
+	}
+
+	id64, err := binary.ReadUvarint(r)
+	if err != nil {
+		return err
+	}
+	id := uint32(id64)
+
+	switch frameType {
+	case frameOpen:
+		destination, err := readBytes(r, msgMaxDestination)
+		if err != nil {
+			return err
+		}
+		s.recvOpen(id, string(destination))
+	case frameData:
+		data, err := readBytes(r, msgMaxFrameData)
+		if err != nil {
+			return err
+		}
+		stream := s.stream(id)
+		if stream == nil {
+			return nil // closed already
+		}
+		if !stream.push(data) {
+			log.Warnf("mux: stream %d exceeded flow control window, resetting", id)
+			stream.fail(ErrStreamReset)
+			s.remove(id)
+			_ = s.writeStreamFrame(frameReset, id)
+		}
+	case frameClose:
+		if stream := s.stream(id); stream != nil {
+			stream.remoteClose()
+		}
+	case frameReset:
+		if stream := s.stream(id); stream != nil {
+			stream.fail(ErrStreamReset)
+			s.remove(id)
+		}
+	default:
+		return fmt.Errorf("unknown frame type %d", frameType)
+	}
+	return nil
+}
+
+func (s *msgSession) recvOpen(id uint32, destination string) {
+	s.lock.Lock()
+	if _, exists := s.streams[id]; exists || id%2 == s.nextID%2 {
+		s.lock.Unlock()
+		log.Warnf("mux: invalid open of stream %d", id)
+		_ = s.writeStreamFrame(frameReset, id)
+		return
+	}
+	stream := newMsgStream(s, id, destination)
+	s.streams[id] = stream
+	s.lock.Unlock()
+
+	select {
+	case s.acceptCh <- stream:
+	default:
+		log.Warnf("mux: accept backlog is full, resetting stream %d", id)
+		s.remove(id)
+		_ = s.writeStreamFrame(frameReset, id)
+	}
+}
+
+func (s *msgSession) recvCredit(r *bufio.Reader) error {
+	count, err := binary.ReadUvarint(r)
+	if err != nil {
+		return err
+	}
+	if count > msgMaxCredits {
+		return fmt.Errorf("too many credits in frame: %d", count)
+	}
+	for i := uint64(0); i < count; i++ {
+		id, err1 := binary.ReadUvarint(r)
+		credit, err2 := binary.ReadUvarint(r)
+		if err1 != nil || err2 != nil {
+			return errors.New("invalid credit frame")
+		}
+		if stream := s.stream(uint32(id)); stream != nil && credit <= msgWindow {
+			stream.addCredit(int(credit))
+		}
+	}
+	return nil
+}
+
+type msgStream struct {
+	session      *msgSession
+	id           uint32
+	destination  string
+	lock         sync.Mutex
+	cond         *sync.Cond
+	buf          []byte
+	recvWindow   int // bytes peer may send before credit
+	sendCredit   int
+	localClosed  bool
+	remoteClosed bool
+	err          error
+}
+
+func newMsgStream(s *msgSession, id uint32, destination string) *msgStream {
+	stream := &msgStream{
+		session:     s,
+		id:          id,
+		destination: destination,
+		recvWindow:  msgWindow,
+		sendCredit:  msgWindow,
+	}
+	stream.cond = sync.NewCond(&stream.lock)
+	return stream
+}
+
+func (st *msgStream) StreamID() uint32 {
+	return st.id
+}
+
+func (st *msgStream) Destination() string {
+	return st.destination
+}
+
+func (st *msgStream) Read(p []byte) (int, error) {
+	st.lock.Lock()
+	for len(st.buf) == 0 && !st.remoteClosed && !st.localClosed && st.err == nil {
+		st.cond.Wait()
+	}
+	switch {
+	case len(st.buf) > 0:
+		n := copy(p, st.buf)
+		st.buf = st.buf[n:]
+		st.recvWindow += n
+		st.lock.Unlock()
+		st.session.grant(st.id, n)
+		return n, nil
+	case st.err != nil:
+		err := st.err
+		st.lock.Unlock()
+		return 0, err
+	case st.localClosed:
+		st.lock.Unlock()
+		return 0, ErrStreamClosed
+	default:
+		st.lock.Unlock()
+		return 0, io.EOF
+	}
+}
+
+func (st *msgStream) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		st.lock.Lock()
+		for st.sendCredit == 0 && !st.localClosed && !st.remoteClosed && st.err == nil {
+			st.cond.Wait()
+		}
+		if st.err != nil {
+			err := st.err
+			st.lock.Unlock()
+			return written, err
+		}
+		if st.localClosed || st.remoteClosed {
+			// peer doesn't read after close
+			st.lock.Unlock()
+			return written, ErrStreamClosed
+		}
+		n := len(p)
+		if n > st.sendCredit {
+			n = st.sendCredit
+		}
+		if n > msgMaxFrameData {
+			n = msgMaxFrameData
+		}
+		st.sendCredit -= n
+		st.lock.Unlock()
+
+		buf := &bytes.Buffer{}
+		buf.WriteByte(frameData)
+		writeUvarint(buf, uint64(st.id))
+		writeUvarint(buf, uint64(n))
+		buf.Write(p[:n])
+		err := st.session.write(buf.Bytes())
+		if err != nil {
+			return written, err
+		}
+		written += n
+		p = p[n:]
+	}
+	return written, nil
+}
+
+// Close closes both directions of stream, peer reads EOF after received data and can't write anymore.
+func (st *msgStream) Close() error {
+	st.lock.Lock()
+	if st.localClosed {
+		st.lock.Unlock()
+		return nil
+	}
+	st.localClosed = true
+	st.buf = nil
+	st.cond.Broadcast()
+	failed, done := st.err != nil, st.remoteClosed
+	st.lock.Unlock()
+
+	if failed {
+		return nil
+	}
+	err := st.session.writeStreamFrame(frameClose, st.id)
+	if done || err != nil {
+		st.session.remove(st.id)
+	}
+	return err
+}
+
+// push adds received data, reports false if peer exceeded window.
+func (st *msgStream) push(data []byte) bool {
+	st.lock.Lock()
+	defer st.lock.Unlock()
+	if len(data) > st.recvWindow {
+		return false
+	}
+	st.recvWindow -= len(data)
+	if st.localClosed {
+		return true // nobody reads it
+	}
+	st.buf = append(st.buf, data...)
+	st.cond.Broadcast()
+	return true
+}
+
+func (st *msgStream) addCredit(n int) {
+	st.lock.Lock()
+	defer st.lock.Unlock()
+	st.sendCredit += n
+	st.cond.Broadcast()
+}
+
+func (st *msgStream) remoteClose() {
+	st.lock.Lock()
+	st.remoteClosed = true
+	st.cond.Broadcast()
+	done := st.localClosed
+	st.lock.Unlock()
+	if done {
+		st.session.remove(st.id)
+	}
+}
+
+func (st *msgStream) fail(err error) {
+	st.lock.Lock()
+	defer st.lock.Unlock()
+	if st.err == nil {
+		st.err = err
+	}
+	st.cond.Broadcast()
+}
+
+// msgFraming reads stream id of frame for scheduler, credits and go away are session frames
+func msgFraming(frame []byte) uint32 {
+	if len(frame) < 2 || frame[0] == frameCredit || frame[0] == frameGoAway {
+		return 0
+	}
+	id, n := binary.Uvarint(frame[1:])
+	if n <= 0 {
+		return 0
+	}
+	return uint32(id)
+}
+
+func readBytes(r *bufio.Reader, limit uint64) ([]byte, error) {
+	n, err := binary.ReadUvarint(r)
+	if err != nil {
+		return nil, err
+	}
+	if n > limit {
+		return nil, fmt.Errorf("frame field is too long: %d", n)
+	}
+	data := make([]byte, n)
+	_, err = io.ReadFull(r, data)
+	return data, err
+}
+
+func writeUvarint(buf *bytes.Buffer, v uint64) {
+	var data [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(data[:], v)
+	buf.Write(data[:n])
+}
@@ -0,0 +1,69 @@
+// Package mux multiplexes proxied streams over one carrier connection.
+//
+// Two implementations are available: yamux, and msgmux which is designed for messengers,
+// where every message costs an HTTP request. Frames of both are scheduled by sched.Conn.
+package mux
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+
+	"github.com/pymq/demhack4/sched"
+)
+
+const (
+	Yamux  = "yamux"
+	MsgMux = "msgmux"
+)
+
+var (
+	ErrDestinationUnsupported = errors.New("mux: stream destination is not supported by yamux")
+	ErrSessionClosed          = errors.New("mux: session closed")
+	ErrStreamClosed           = errors.New("mux: stream closed")
+	ErrStreamReset            = errors.New("mux: stream reset by peer")
+)
+
+// Session is a multiplexed connection.
+type Session interface {
+	// OpenStream opens a stream, optional destination tells peer where to connect the stream
+	OpenStream(ctx context.Context, destination string) (Stream, error)
+	AcceptStream() (Stream, error)
+	Close() error
+	CloseChan() <-chan struct{}
+	IsClosed() bool
+}
+
+type Stream interface {
+	io.ReadWriteCloser
+	StreamID() uint32
+	// Destination is set by peer on open, empty for SOCKS streams
+	Destination() string
+}
+
+// Valid reports if mux kind is known, empty kind is yamux.
+func Valid(kind string) bool {
+	return kind == "" || kind == Yamux || kind == MsgMux
+}
+
+// New starts session of given kind over conn. Frames are scheduled by returned sched.Conn,
+// batchLimit, if set, returns carrier message size to coalesce frames.
+func New(kind string, conn net.Conn, client bool, batchLimit func() int) (Session, *sched.Conn, error) {
+	switch kind {
+	case "", Yamux:
+		sc := sched.NewConn(conn, yamuxFraming, batchLimit)
+		s, err := newYamuxSession(sc, client)
+		if err != nil {
+			_ = sc.Close()
+			return nil, nil, err
+		}
+		return s, sc, nil
+	case MsgMux:
+		sc := sched.NewConn(conn, msgFraming, batchLimit)
+		return newMsgSession(sc, client), sc, nil
+	default:
+		return nil, nil, fmt.Errorf("mux: unknown kind %q", kind)
+	}
+}
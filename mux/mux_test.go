@@ -0,0 +1,193 @@
+package mux
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const loopbackMessageLimit = 4000
+
+// loopbackCarrier is a message oriented pipe: every write is split into messages
+// of limited size, which are counted like carrier requests
+type loopbackCarrier struct {
+	net.Conn
+	in       chan []byte
+	out      chan []byte
+	unread   []byte
+	messages *int64
+	bytes    *int64
+	done     chan struct{}
+	once     *sync.Once
+}
+
+func newLoopbackCarrier() (*loopbackCarrier, *loopbackCarrier) {
+	a, b := make(chan []byte, 1024), make(chan []byte, 1024)
+	var messages, size int64
+	done, once := make(chan struct{}), &sync.Once{}
+	return &loopbackCarrier{in: a, out: b, messages: &messages, bytes: &size, done: done, once: once},
+		&loopbackCarrier{in: b, out: a, messages: &messages, bytes: &size, done: done, once: once}
+}
+
+func (c *loopbackCarrier) Write(p []byte) (int, error) {
+	for i := 0; i < len(p); i += loopbackMessageLimit {
+		end := i + loopbackMessageLimit
+		if end > len(p) {
+			end = len(p)
+		}
+		atomic.AddInt64(c.messages, 1)
+		atomic.AddInt64(c.bytes, int64(end-i))
+		select {
+		case c.out <- append([]byte(nil), p[i:end]...):
+		case <-c.done:
+			return i, io.ErrClosedPipe
+		}
+	}
+	return len(p), nil
+}
+
+func (c *loopbackCarrier) Read(p []byte) (int, error) {
+	if len(c.unread) == 0 {
+		select {
+		case c.unread = <-c.in:
+		case <-c.done:
+			return 0, io.EOF
+		}
+	}
+	n := copy(p, c.unread)
+	c.unread = c.unread[n:]
+	return n, nil
+}
+
+func (c *loopbackCarrier) Close() error {
+	c.once.Do(func() { close(c.done) })
+	return nil
+}
+
+func (c *loopbackCarrier) SetWriteDeadline(time.Time) error {
+	return nil
+}
+
+func (c *loopbackCarrier) SetDeadline(time.Time) error {
+	return nil
+}
+
+func (c *loopbackCarrier) SetReadDeadline(time.Time) error {
+	return nil
+}
+
+// runWorkload opens streams which send request and read response of given size,
+// it returns number of carrier messages and bytes
+func runWorkload(t testing.TB, kind string, streams, responseSize int) (int64, int64) {
+	clientConn, serverConn := newLoopbackCarrier()
+	batch := func() int { return loopbackMessageLimit }
+	client, _, err := New(kind, clientConn, true, batch)
+	require.NoError(t, err)
+	server, _, err := New(kind, serverConn, false, batch)
+	require.NoError(t, err)
+	defer client.Close()
+	defer server.Close()
+
+	response := bytes.Repeat([]byte{'r'}, responseSize)
+	go func() {
+		for {
+			stream, err := server.AcceptStream()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer stream.Close()
+				request := make([]byte, 100)
+				_, err := io.ReadFull(stream, request)
+				if err != nil {
+					return
+				}
+				_, _ = stream.Write(response)
+			}()
+		}
+	}()
+
+	var wg sync.WaitGroup
+	for i := 0; i < streams; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			stream, err := client.OpenStream(context.Background(), "")
+			if !assert.NoError(t, err) {
+				return
+			}
+			defer stream.Close()
+			_, err = stream.Write(make([]byte, 100))
+			assert.NoError(t, err)
+			data, err := io.ReadAll(stream)
+			assert.NoError(t, err)
+			assert.Equal(t, responseSize, len(data))
+		}()
+	}
+	wg.Wait()
+	return atomic.LoadInt64(clientConn.messages), atomic.LoadInt64(clientConn.bytes)
+}
+
+func TestMuxLoopback(t *testing.T) {
+	// bulk transfer exercises flow control
+	runWorkload(t, Yamux, 5, 600*1024)
+	runWorkload(t, MsgMux, 5, 600*1024)
+
+	// short streams are dominated by mux overhead, message count depends on timing of batches
+	const streams, request, response = 50, 100, 2000
+	yamuxMessages, yamuxBytes := runWorkload(t, Yamux, streams, response)
+	msgMessages, msgBytes := runWorkload(t, MsgMux, streams, response)
+	payload := int64(streams * (request + response))
+	t.Logf("short streams: yamux %d messages, %d bytes of framing; msgmux %d messages, %d bytes of framing",
+		yamuxMessages, yamuxBytes-payload, msgMessages, msgBytes-payload)
+	assert.Less(t, msgBytes-payload, (yamuxBytes-payload)/3)
+}
+
+func TestMsgMuxDestination(t *testing.T) {
+	clientConn, serverConn := newLoopbackCarrier()
+	client, _, err := New(MsgMux, clientConn, true, nil)
+	require.NoError(t, err)
+	server, _, err := New(MsgMux, serverConn, false, nil)
+	require.NoError(t, err)
+	defer client.Close()
+	defer server.Close()
+
+	stream, err := client.OpenStream(context.Background(), "example.com:22")
+	require.NoError(t, err)
+	_, err = stream.Write([]byte("hello"))
+	require.NoError(t, err)
+
+	accepted, err := server.AcceptStream()
+	require.NoError(t, err)
+	assert.Equal(t, "example.com:22", accepted.Destination())
+	data := make([]byte, 5)
+	_, err = io.ReadFull(accepted, data)
+	require.NoError(t, err)
+	assert.Equal(t, "hello", string(data))
+
+	require.NoError(t, accepted.Close())
+	_, err = stream.Read(data)
+	assert.Equal(t, io.EOF, err)
+}
+
+func BenchmarkMuxLoopback(b *testing.B) {
+	for _, kind := range []string{Yamux, MsgMux} {
+		b.Run(kind, func(b *testing.B) {
+			var messages, size int64
+			for i := 0; i < b.N; i++ {
+				m, s := runWorkload(b, kind, 10, 64*1024)
+				messages, size = messages+m, size+s
+			}
+			b.ReportMetric(float64(messages)/float64(b.N), "messages/op")
+			b.ReportMetric(float64(size)/float64(b.N), "carrier-bytes/op")
+		})
+	}
+}
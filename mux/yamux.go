@@ -0,0 +1,75 @@
+package mux
+
+import (
+	"context"
+	"encoding/binary"
+	"net"
+
+	"github.com/libp2p/go-yamux/v3"
+)
+
+// yamuxMaxFrameSize is about one carrier message, so streams interleave often
+const yamuxMaxFrameSize = 8 * 1024
+
+type yamuxSession struct {
+	*yamux.Session
+}
+
+type yamuxStream struct {
+	*yamux.Stream
+}
+
+// yamuxConfig disables yamux keepalive, carrier keepalive is used instead. Stream windows don't grow,
+// so frames queued by one stream are bounded by initial window.
+func yamuxConfig() *yamux.Config {
+	cfg := yamux.DefaultConfig()
+	cfg.EnableKeepAlive = false
+	cfg.MaxStreamWindowSize = cfg.InitialStreamWindowSize
+	cfg.MaxMessageSize = yamuxMaxFrameSize
+	return cfg
+}
+
+func newYamuxSession(conn net.Conn, client bool) (*yamuxSession, error) {
+	var s *yamux.Session
+	var err error
+	if client {
+		s, err = yamux.Client(conn, yamuxConfig(), nil)
+	} else {
+		s, err = yamux.Server(conn, yamuxConfig(), nil)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &yamuxSession{Session: s}, nil
+}
+
+func (s *yamuxSession) OpenStream(ctx context.Context, destination string) (Stream, error) {
+	if destination != "" {
+		return nil, ErrDestinationUnsupported
+	}
+	stream, err := s.Session.OpenStream(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return yamuxStream{Stream: stream}, nil
+}
+
+func (s *yamuxSession) AcceptStream() (Stream, error) {
+	stream, err := s.Session.AcceptStream()
+	if err != nil {
+		return nil, err
+	}
+	return yamuxStream{Stream: stream}, nil
+}
+
+func (yamuxStream) Destination() string {
+	return ""
+}
+
+// yamuxFraming reads stream id from yamux header: version, type, flags, stream id, length
+func yamuxFraming(frame []byte) uint32 {
+	if len(frame) < 12 {
+		return 0
+	}
+	return binary.BigEndian.Uint32(frame[4:8])
+}
@@ -0,0 +1,157 @@
+package profile
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"strings"
+
+	"github.com/pymq/demhack4/encoding"
+	"github.com/skip2/go-qrcode"
+)
+
+const (
+	Scheme         = "demhack://"
+	CurrentVersion = 1
+
+	checksumLen = 4
+)
+
+type Carrier uint8
+
+const (
+	ICQ Carrier = iota + 1
+)
+
+func (c Carrier) String() string {
+	switch c {
+	case ICQ:
+		return "icq"
+	default:
+		return fmt.Sprintf("unknown(%d)", uint8(c))
+	}
+}
+
+var (
+	ErrInvalidScheme   = errors.New("profile: link should start with " + Scheme)
+	ErrInvalidChecksum = errors.New("profile: checksum mismatch, link is probably mistyped or truncated")
+	ErrUnknownVersion  = errors.New("profile: unsupported link version")
+)
+
+// Profile is everything client needs to connect to a server.
+//
+// Link structure:
+// demhack://v<version>/<base64 payload>
+// payload: carrier (1 byte), server public key, room ID, invite token
+// (each prefixed with uvarint length), crc32 of all preceding bytes (4 bytes)
+type Profile struct {
+	Carrier         Carrier
+	ServerPublicKey string
+	RoomID          string
+	InviteToken     string
+}
+
+func (p Profile) Validate() error {
+	if p.Carrier != ICQ {
+		return fmt.Errorf("profile: unsupported carrier %s", p.Carrier)
+	}
+	if _, err := encoding.UnmarshalPublicKey(p.ServerPublicKey); err != nil {
+		return fmt.Errorf("profile: invalid server public key: %v", err)
+	}
+	if p.RoomID == "" {
+		return errors.New("profile: empty room id")
+	}
+
+	return nil
+}
+
+func (p Profile) Link() (string, error) {
+	if err := p.Validate(); err != nil {
+		return "", err
+	}
+
+	buf := &bytes.Buffer{}
+	buf.WriteByte(byte(p.Carrier))
+	for _, field := range []string{p.ServerPublicKey, p.RoomID, p.InviteToken} {
+		writeString(buf, field)
+	}
+	var sum [checksumLen]byte
+	binary.BigEndian.PutUint32(sum[:], crc32.ChecksumIEEE(buf.Bytes()))
+	buf.Write(sum[:])
+
+	return fmt.Sprintf("%sv%d/%s", Scheme, CurrentVersion, encoding.EncodeBase64(buf.Bytes())), nil
+}
+
+// QRCode returns link encoded as PNG image with given size in pixels.
+func (p Profile) QRCode(size int) ([]byte, error) {
+	link, err := p.Link()
+	if err != nil {
+		return nil, err
+	}
+
+	return qrcode.Encode(link, qrcode.Medium, size)
+}
+
+func Parse(link string) (Profile, error) {
+	link = strings.TrimSpace(link)
+	if !strings.HasPrefix(link, Scheme) {
+		return Profile{}, ErrInvalidScheme
+	}
+	version, payload, found := strings.Cut(strings.TrimPrefix(link, Scheme), "/")
+	if !found {
+		return Profile{}, errors.New("profile: missing link payload")
+	}
+	if version != fmt.Sprintf("v%d", CurrentVersion) {
+		return Profile{}, fmt.Errorf("%w: '%s'", ErrUnknownVersion, version)
+	}
+
+	data, err := encoding.DecodeBase64([]byte(payload))
+	if err != nil {
+		return Profile{}, ErrInvalidChecksum
+	}
+	if len(data) < 1+checksumLen {
+		return Profile{}, ErrInvalidChecksum
+	}
+	body, sum := data[:len(data)-checksumLen], data[len(data)-checksumLen:]
+	if crc32.ChecksumIEEE(body) != binary.BigEndian.Uint32(sum) {
+		return Profile{}, ErrInvalidChecksum
+	}
+
+	p := Profile{Carrier: Carrier(body[0])}
+	r := bytes.NewReader(body[1:])
+	for _, field := range []*string{&p.ServerPublicKey, &p.RoomID, &p.InviteToken} {
+		*field, err = readString(r)
+		if err != nil {
+			return Profile{}, fmt.Errorf("profile: decode payload: %v", err)
+		}
+	}
+	if r.Len() > 0 {
+		return Profile{}, fmt.Errorf("profile: decode payload: %d unexpected trailing bytes", r.Len())
+	}
+
+	return p, p.Validate()
+}
+
+func writeString(buf *bytes.Buffer, s string) {
+	var l [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(l[:], uint64(len(s)))
+	buf.Write(l[:n])
+	buf.WriteString(s)
+}
+
+func readString(r *bytes.Reader) (string, error) {
+	l, err := binary.ReadUvarint(r)
+	if err != nil {
+		return "", err
+	}
+	if l > uint64(r.Len()) {
+		return "", fmt.Errorf("field length %d exceeds payload", l)
+	}
+	s := make([]byte, l)
+	_, err = io.ReadFull(r, s)
+
+	return string(s), err
+}
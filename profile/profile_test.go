@@ -0,0 +1,77 @@
+package profile
+
+import (
+	"encoding/binary"
+	"hash/crc32"
+	"strings"
+	"testing"
+
+	"github.com/pymq/demhack4/encoding"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLink(t *testing.T) {
+	key, err := encoding.GenerateKey()
+	require.NoError(t, err)
+
+	for _, token := range []string{"", "secret-invite"} {
+		expected := Profile{
+			Carrier:         ICQ,
+			ServerPublicKey: key.Recipient().String(),
+			RoomID:          "752000000000",
+			InviteToken:     token,
+		}
+		link, err := expected.Link()
+		require.NoError(t, err)
+		assert.True(t, strings.HasPrefix(link, Scheme+"v1/"))
+
+		actual, err := Parse(link)
+		require.NoError(t, err)
+		assert.Equal(t, expected, actual)
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	key, err := encoding.GenerateKey()
+	require.NoError(t, err)
+	link, err := Profile{Carrier: ICQ, ServerPublicKey: key.Recipient().String(), RoomID: "bot"}.Link()
+	require.NoError(t, err)
+
+	// flip one character in payload
+	typo := []byte(link)
+	last := len(typo) - 3
+	if typo[last] == 'A' {
+		typo[last] = 'B'
+	} else {
+		typo[last] = 'A'
+	}
+	_, err = Parse(string(typo))
+	assert.ErrorIs(t, err, ErrInvalidChecksum)
+
+	_, err = Parse(link[:len(link)-5])
+	assert.ErrorIs(t, err, ErrInvalidChecksum)
+
+	_, err = Parse("https://example.com")
+	assert.ErrorIs(t, err, ErrInvalidScheme)
+
+	_, err = Parse(strings.Replace(link, "/v1/", "/v9/", 1))
+	assert.ErrorIs(t, err, ErrUnknownVersion)
+
+	// valid fields followed by extra bytes with matching checksum
+	data, err := encoding.DecodeBase64([]byte(strings.TrimPrefix(link, Scheme+"v1/")))
+	require.NoError(t, err)
+	body := append(data[:len(data)-checksumLen:len(data)-checksumLen], 0)
+	var sum [checksumLen]byte
+	binary.BigEndian.PutUint32(sum[:], crc32.ChecksumIEEE(body))
+	_, err = Parse(Scheme + "v1/" + string(encoding.EncodeBase64(append(body, sum[:]...))))
+	assert.Error(t, err)
+}
+
+func TestQRCode(t *testing.T) {
+	key, err := encoding.GenerateKey()
+	require.NoError(t, err)
+	png, err := Profile{Carrier: ICQ, ServerPublicKey: key.Recipient().String(), RoomID: "bot"}.QRCode(256)
+	require.NoError(t, err)
+	assert.Equal(t, "\x89PNG", string(png[:4]))
+}
@@ -0,0 +1,241 @@
+// Package quota accounts server usage by clients and enforces their limits.
+package quota
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/pymq/demhack4/config"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	UsageFilename = "quota_usage.json"
+	saveInterval  = time.Minute
+)
+
+// ExceededError is returned when client used up its daily or monthly limit.
+type ExceededError struct {
+	Limit string
+	Until time.Time
+}
+
+func (e *ExceededError) Error() string {
+	return fmt.Sprintf("quota: %s limit exceeded until %s", e.Limit, e.Until.Format(time.RFC3339))
+}
+
+// Usage is accounting of one client for current day and month.
+type Usage struct {
+	Day             string
+	DayBytes        int64
+	DayMessages     int64
+	Month           string
+	MonthBytes      int64
+	MonthMessages   int64
+	sentLastMinute  []time.Time
+	throttledNotice time.Time
+}
+
+// Tracker counts usage per client public key and persists counters.
+type Tracker struct {
+	path   string
+	cfg    config.Quota
+	lock   sync.Mutex // guards fields below
+	usage  map[string]*Usage
+	dirty  bool
+	now    func() time.Time
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+// Load reads counters from path and starts saving them periodically.
+func Load(path string, cfg config.Quota) (*Tracker, error) {
+	t := &Tracker{
+		path:  path,
+		cfg:   cfg,
+		usage: map[string]*Usage{},
+		now:   time.Now,
+		done:  make(chan struct{}),
+	}
+	data, err := os.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("read quota usage: %v", err)
+	}
+	if err == nil {
+		err = json.Unmarshal(data, &t.usage)
+		if err != nil {
+			return nil, fmt.Errorf("unmarshal quota usage: %v", err)
+		}
+	}
+
+	var ctx context.Context
+	ctx, t.cancel = context.WithCancel(context.Background())
+	go t.saveLoop(ctx)
+	return t, nil
+}
+
+func (t *Tracker) limits(client string) config.QuotaLimits {
+	if limits, ok := t.cfg.Clients[client]; ok {
+		return limits
+	}
+	return t.cfg.Default
+}
+
+// clientUsage returns usage of client, resetting counters of past day and month. Should be called with lock held.
+func (t *Tracker) clientUsage(client string, now time.Time) *Usage {
+	u, ok := t.usage[client]
+	if !ok {
+		u = &Usage{}
+		t.usage[client] = u
+	}
+	day, month := now.UTC().Format("2006-01-02"), now.UTC().Format("2006-01")
+	if u.Day != day {
+		u.Day, u.DayBytes, u.DayMessages = day, 0, 0
+	}
+	if u.Month != month {
+		u.Month, u.MonthBytes, u.MonthMessages = month, 0, 0
+	}
+	return u
+}
+
+// exceeded returns error if any of daily or monthly limits is used up. Should be called with lock held.
+func exceeded(u *Usage, limits config.QuotaLimits, now time.Time) error {
+	now = now.UTC()
+	nextDay := time.Date(now.Year(), now.Month(), now.Day()+1, 0, 0, 0, 0, time.UTC)
+	nextMonth := time.Date(now.Year(), now.Month()+1, 1, 0, 0, 0, 0, time.UTC)
+	switch {
+	case limits.MonthlyBytes > 0 && u.MonthBytes >= limits.MonthlyBytes:
+		return &ExceededError{Limit: "monthly bytes", Until: nextMonth}
+	case limits.MonthlyMessages > 0 && u.MonthMessages >= limits.MonthlyMessages:
+		return &ExceededError{Limit: "monthly messages", Until: nextMonth}
+	case limits.DailyBytes > 0 && u.DayBytes >= limits.DailyBytes:
+		return &ExceededError{Limit: "daily bytes", Until: nextDay}
+	case limits.DailyMessages > 0 && u.DayMessages >= limits.DailyMessages:
+		return &ExceededError{Limit: "daily messages", Until: nextDay}
+	}
+	return nil
+}
+
+// Check returns *ExceededError if client has used up one of its limits.
+func (t *Tracker) Check(client string) error {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	now := t.now()
+	return exceeded(t.clientUsage(client, now), t.limits(client), now)
+}
+
+// Use accounts messages of client with their total size. It returns *ExceededError
+// once client has used up one of its limits.
+func (t *Tracker) Use(client string, messages, bytes int) error {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	now := t.now()
+	u := t.clientUsage(client, now)
+	u.DayMessages += int64(messages)
+	u.MonthMessages += int64(messages)
+	u.DayBytes += int64(bytes)
+	u.MonthBytes += int64(bytes)
+	t.dirty = true
+	return exceeded(u, t.limits(client), now)
+}
+
+// Wait blocks until client may be sent another message under its rate cap and reserves it.
+// It reports if client should be notified about throttling, at most once a minute.
+func (t *Tracker) Wait(ctx context.Context, client string) (bool, error) {
+	notify := false
+	for {
+		delay, throttled := t.reserve(client)
+		notify = notify || throttled
+		if delay <= 0 {
+			return notify, nil
+		}
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return notify, ctx.Err()
+		case <-timer.C:
+		}
+	}
+}
+
+// reserve returns zero delay if message can be sent now, or time to wait. It reports
+// if this is a new episode of throttling.
+func (t *Tracker) reserve(client string) (time.Duration, bool) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	limit := t.limits(client).MessagesPerMinute
+	if limit <= 0 {
+		return 0, false
+	}
+
+	now := t.now()
+	u := t.clientUsage(client, now)
+	minuteAgo := now.Add(-time.Minute)
+	for len(u.sentLastMinute) > 0 && u.sentLastMinute[0].Before(minuteAgo) {
+		u.sentLastMinute = u.sentLastMinute[1:]
+	}
+	if len(u.sentLastMinute) < limit {
+		u.sentLastMinute = append(u.sentLastMinute, now)
+		return 0, false
+	}
+
+	notify := now.Sub(u.throttledNotice) >= time.Minute
+	if notify {
+		u.throttledNotice = now
+	}
+	return u.sentLastMinute[0].Sub(minuteAgo), notify
+}
+
+// Usage returns current counters of client.
+func (t *Tracker) Usage(client string) Usage {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	u := *t.clientUsage(client, t.now())
+	u.sentLastMinute = nil
+	return u
+}
+
+// Save writes counters to disk, if they have changed.
+func (t *Tracker) Save() error {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if !t.dirty {
+		return nil
+	}
+	err := config.SaveConfig(t.usage, t.path)
+	if err != nil {
+		return fmt.Errorf("save quota usage: %v", err)
+	}
+	t.dirty = false
+	return nil
+}
+
+func (t *Tracker) saveLoop(ctx context.Context) {
+	defer close(t.done)
+	ticker := time.NewTicker(saveInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			err := t.Save()
+			if err != nil {
+				log.Warnf("quota: %v", err)
+			}
+		}
+	}
+}
+
+// Close stops periodic saving and saves counters.
+func (t *Tracker) Close() error {
+	t.cancel()
+	<-t.done
+	return t.Save()
+}
@@ -0,0 +1,77 @@
+package quota
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/pymq/demhack4/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTrackerLimits(t *testing.T) {
+	path := filepath.Join(t.TempDir(), UsageFilename)
+	tracker, err := Load(path, config.Quota{
+		Default: config.QuotaLimits{DailyMessages: 3, MonthlyBytes: 1000},
+		Clients: map[string]config.QuotaLimits{"age1vip": {}},
+	})
+	require.NoError(t, err)
+	now := time.Date(2026, 3, 31, 23, 0, 0, 0, time.UTC)
+	tracker.now = func() time.Time { return now }
+
+	assert.NoError(t, tracker.Use("age1user", 1, 100))
+	assert.NoError(t, tracker.Use("age1user", 1, 100))
+	err = tracker.Use("age1user", 1, 100)
+	var exceededErr *ExceededError
+	require.ErrorAs(t, err, &exceededErr)
+	assert.Equal(t, "daily messages", exceededErr.Limit)
+	assert.Equal(t, time.Date(2026, 4, 1, 0, 0, 0, 0, time.UTC), exceededErr.Until)
+	assert.ErrorAs(t, tracker.Check("age1user"), &exceededErr)
+	assert.NoError(t, tracker.Use("age1vip", 100, 100000), "client limits override default")
+
+	// daily counters are reset, monthly ones too in a new month
+	now = now.Add(2 * time.Hour)
+	assert.NoError(t, tracker.Check("age1user"))
+	now = time.Date(2026, 4, 2, 0, 0, 0, 0, time.UTC)
+	require.NoError(t, tracker.Use("age1user", 1, 900))
+	assert.NoError(t, tracker.Use("age1user", 1, 50))
+	err = tracker.Use("age1user", 0, 50)
+	require.ErrorAs(t, err, &exceededErr)
+	assert.Equal(t, "monthly bytes", exceededErr.Limit)
+	assert.Equal(t, time.Date(2026, 5, 1, 0, 0, 0, 0, time.UTC), exceededErr.Until)
+
+	require.NoError(t, tracker.Close())
+	loaded, err := Load(path, config.Quota{})
+	require.NoError(t, err)
+	loaded.now = tracker.now
+	defer loaded.Close()
+	assert.Equal(t, Usage{Day: "2026-04-02", DayBytes: 1000, DayMessages: 2, Month: "2026-04", MonthBytes: 1000, MonthMessages: 2},
+		loaded.Usage("age1user"))
+}
+
+func TestTrackerRateCap(t *testing.T) {
+	tracker, err := Load(filepath.Join(t.TempDir(), UsageFilename), config.Quota{
+		Default: config.QuotaLimits{MessagesPerMinute: 2},
+	})
+	require.NoError(t, err)
+	defer tracker.Close()
+	now := time.Date(2026, 3, 31, 12, 0, 0, 0, time.UTC)
+	tracker.now = func() time.Time { return now }
+
+	for i := 0; i < 2; i++ {
+		delay, notify := tracker.reserve("age1user")
+		assert.Zero(t, delay)
+		assert.False(t, notify)
+		now = now.Add(10 * time.Second)
+	}
+	delay, notify := tracker.reserve("age1user")
+	assert.Equal(t, 40*time.Second, delay)
+	assert.True(t, notify)
+	_, notify = tracker.reserve("age1user")
+	assert.False(t, notify, "client is notified once a minute")
+
+	now = now.Add(40 * time.Second)
+	delay, _ = tracker.reserve("age1user")
+	assert.Zero(t, delay)
+}
@@ -0,0 +1,350 @@
+// Package sched interleaves frames of stream multiplexer before they reach the carrier.
+//
+// Multiplexers write frames of all streams into connection in order of arrival,
+// so one bulk stream delays everything behind it for seconds on a slow carrier.
+// Conn queues frames per stream and sends them with deficit round robin, weighted by stream priority.
+// Frames of the same stream keep their order, session frames (pings, credits, go away) go first.
+// Queued frames are coalesced into one write up to carrier message size.
+package sched
+
+import (
+	"errors"
+	"io"
+	"math"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/pymq/demhack4/config"
+)
+
+type Priority int
+
+const (
+	PriorityBulk Priority = iota + 1
+	PriorityNormal
+	PriorityInteractive
+)
+
+func (p Priority) String() string {
+	switch p {
+	case PriorityBulk:
+		return "bulk"
+	case PriorityNormal:
+		return "normal"
+	case PriorityInteractive:
+		return "interactive"
+	default:
+		return "unknown"
+	}
+}
+
+// weight is a share of bandwidth of a stream relative to other streams.
+func (p Priority) weight() int {
+	switch p {
+	case PriorityBulk:
+		return 1
+	case PriorityInteractive:
+		return 16
+	default:
+		return 4
+	}
+}
+
+func ParsePriority(s string) (Priority, error) {
+	switch strings.ToLower(s) {
+	case "bulk":
+		return PriorityBulk, nil
+	case "normal", "":
+		return PriorityNormal, nil
+	case "interactive":
+		return PriorityInteractive, nil
+	default:
+		return 0, errors.New("unknown priority: " + s)
+	}
+}
+
+// Rules assign priority of stream by its destination port.
+type Rules struct {
+	ports map[int]Priority
+}
+
+func NewRules(cfg config.StreamPriority) Rules {
+	r := Rules{ports: map[int]Priority{}}
+	for _, port := range cfg.BulkPorts {
+		r.ports[port] = PriorityBulk
+	}
+	for _, port := range cfg.InteractivePorts {
+		r.ports[port] = PriorityInteractive
+	}
+	return r
+}
+
+func (r Rules) Match(port int) Priority {
+	if p, ok := r.ports[port]; ok {
+		return p
+	}
+	return PriorityNormal
+}
+
+// MatchAddr matches port of host:port address.
+func (r Rules) MatchAddr(addr string) Priority {
+	_, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return PriorityNormal
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil {
+		return PriorityNormal
+	}
+	return r.Match(port)
+}
+
+// quantum is bytes added to stream deficit per round, multiplied by priority weight
+const quantum = 1024
+
+// StreamStats is a snapshot of stream queue.
+type StreamStats struct {
+	ID           uint32
+	Priority     Priority
+	QueuedFrames int
+	QueuedBytes  int
+	SentBytes    uint64 // including framing
+}
+
+type stream struct {
+	id       uint32
+	priority Priority
+	frames   [][]byte
+	queued   int
+	sent     uint64
+	deficit  int
+	active   bool // in round robin ring
+	pinned   bool // priority is set, keep stream until it is forgotten
+}
+
+// Framing returns stream id of a frame, zero for session frames.
+type Framing func(frame []byte) uint32
+
+// Conn is a connection for multiplexer session, which schedules outgoing frames.
+// Write queues frame and returns immediately, memory is bounded by flow control windows of streams.
+type Conn struct {
+	net.Conn
+	framing    Framing
+	batchLimit func() int
+	lock       sync.Mutex
+	cond       *sync.Cond
+	control    [][]byte
+	streams    map[uint32]*stream
+	ring       []*stream
+	next       int
+	err        error
+	closed     bool
+	doneCh     chan struct{}
+	closeErr   error
+}
+
+// NewConn starts scheduling frames of multiplexer, which writes exactly one frame per call.
+// batchLimit, if set, returns max size of coalesced write, e.g. carrier message size.
+func NewConn(conn net.Conn, framing Framing, batchLimit func() int) *Conn {
+	c := &Conn{
+		Conn:       conn,
+		framing:    framing,
+		batchLimit: batchLimit,
+		streams:    map[uint32]*stream{},
+		doneCh:     make(chan struct{}),
+	}
+	c.cond = sync.NewCond(&c.lock)
+	go c.writeLoop()
+	return c
+}
+
+// Write queues a frame.
+func (c *Conn) Write(b []byte) (int, error) {
+	frame := append([]byte(nil), b...) // multiplexer may reuse buffer after write
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.err != nil {
+		return 0, c.err
+	}
+	if c.closed {
+		return 0, net.ErrClosed
+	}
+
+	if id := c.framing(frame); id == 0 {
+		c.control = append(c.control, frame)
+	} else {
+		s := c.stream(id)
+		s.frames = append(s.frames, frame)
+		s.queued += len(frame)
+		if !s.active {
+			s.active = true
+			c.ring = append(c.ring, s)
+		}
+	}
+	c.cond.Signal()
+	return len(b), nil
+}
+
+// SetPriority changes priority of stream, it applies to already queued frames too.
+func (c *Conn) SetPriority(streamID uint32, p Priority) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	s := c.stream(streamID)
+	s.priority = p
+	s.pinned = true
+}
+
+// Forget drops priority of closed stream, its queue is still sent.
+func (c *Conn) Forget(streamID uint32) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	s, ok := c.streams[streamID]
+	if !ok {
+		return
+	}
+	s.pinned = false
+	if !s.active {
+		delete(c.streams, streamID)
+	}
+}
+
+// Track wraps stream, so its priority is forgotten when it is closed.
+func (c *Conn) Track(rwc io.ReadWriteCloser, streamID uint32) io.ReadWriteCloser {
+	return trackedStream{ReadWriteCloser: rwc, forget: func() { c.Forget(streamID) }}
+}
+
+type trackedStream struct {
+	io.ReadWriteCloser
+	forget func()
+}
+
+func (s trackedStream) Close() error {
+	s.forget()
+	return s.ReadWriteCloser.Close()
+}
+
+func (c *Conn) stream(id uint32) *stream {
+	s, ok := c.streams[id]
+	if !ok {
+		s = &stream{id: id, priority: PriorityNormal}
+		c.streams[id] = s
+	}
+	return s
+}
+
+// Stats returns queues of known streams, ordered by id.
+func (c *Conn) Stats() []StreamStats {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	stats := make([]StreamStats, 0, len(c.streams))
+	for _, s := range c.streams {
+		stats = append(stats, StreamStats{
+			ID:           s.id,
+			Priority:     s.priority,
+			QueuedFrames: len(s.frames),
+			QueuedBytes:  s.queued,
+			SentBytes:    s.sent,
+		})
+	}
+	sort.Slice(stats, func(i, j int) bool {
+		return stats[i].ID < stats[j].ID
+	})
+	return stats
+}
+
+func (c *Conn) Close() error {
+	c.lock.Lock()
+	if c.closed {
+		c.lock.Unlock()
+		<-c.doneCh
+		return c.closeErr
+	}
+	c.closed = true
+	c.cond.Broadcast()
+	c.lock.Unlock()
+
+	c.closeErr = c.Conn.Close()
+	close(c.doneCh)
+	return c.closeErr
+}
+
+func (c *Conn) writeLoop() {
+	for {
+		c.lock.Lock()
+		for !c.closed && len(c.control) == 0 && len(c.ring) == 0 {
+			c.cond.Wait()
+		}
+		if c.closed {
+			c.lock.Unlock()
+			return
+		}
+		batch := c.pop(math.MaxInt)
+		if c.batchLimit != nil {
+			limit := c.batchLimit()
+			for len(c.control) > 0 || len(c.ring) > 0 {
+				frame := c.pop(limit - len(batch))
+				if frame == nil {
+					break
+				}
+				batch = append(batch, frame...)
+			}
+		}
+		c.lock.Unlock()
+
+		_, err := c.Conn.Write(batch)
+		if err != nil {
+			c.lock.Lock()
+			c.err = err
+			c.lock.Unlock()
+			return
+		}
+	}
+}
+
+// pop takes the next frame not longer than budget, should be called with lock held and non-empty queues.
+// It returns nil if the next frame doesn't fit.
+func (c *Conn) pop(budget int) []byte {
+	if len(c.control) > 0 {
+		frame := c.control[0]
+		if len(frame) > budget {
+			return nil
+		}
+		c.control = c.control[1:]
+		return frame
+	}
+
+	for {
+		if c.next >= len(c.ring) {
+			c.next = 0
+		}
+		s := c.ring[c.next]
+		frame := s.frames[0]
+		if s.deficit < len(frame) {
+			s.deficit += quantum * s.priority.weight()
+			c.next++
+			continue
+		}
+		if len(frame) > budget {
+			return nil
+		}
+
+		s.deficit -= len(frame)
+		s.frames = s.frames[1:]
+		s.queued -= len(frame)
+		s.sent += uint64(len(frame))
+		if len(s.frames) == 0 {
+			s.deficit = 0
+			s.active = false
+			c.ring = append(c.ring[:c.next], c.ring[c.next+1:]...)
+			if !s.pinned {
+				delete(c.streams, s.id)
+			}
+		}
+		return frame
+	}
+}
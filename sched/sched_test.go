@@ -0,0 +1,125 @@
+package sched
+
+import (
+	"encoding/binary"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pymq/demhack4/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// recordConn records written frames, writes block until released
+type recordConn struct {
+	net.Conn
+	lock    sync.Mutex
+	frames  [][]byte
+	release chan struct{}
+}
+
+func (c *recordConn) Write(b []byte) (int, error) {
+	<-c.release
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.frames = append(c.frames, b)
+	return len(b), nil
+}
+
+func (c *recordConn) Close() error {
+	return nil
+}
+
+const headerSize = 12
+
+// yamuxFraming reads stream id from yamux header
+func yamuxFraming(frame []byte) uint32 {
+	return binary.BigEndian.Uint32(frame[4:8])
+}
+
+func frame(streamID uint32, size int) []byte {
+	f := make([]byte, headerSize+size)
+	binary.BigEndian.PutUint32(f[4:8], streamID)
+	binary.BigEndian.PutUint32(f[8:12], uint32(size))
+	return f
+}
+
+func TestSchedulerPriority(t *testing.T) {
+	rc := &recordConn{release: make(chan struct{})}
+	c := NewConn(rc, yamuxFraming, nil)
+	defer c.Close()
+	c.SetPriority(3, PriorityInteractive)
+	c.SetPriority(1, PriorityBulk)
+
+	// the first frame is taken by writer, it waits for release
+	_, err := c.Write(frame(1, 4096))
+	require.NoError(t, err)
+	time.Sleep(10 * time.Millisecond)
+
+	for i := 0; i < 8; i++ {
+		_, err = c.Write(frame(1, 4096))
+		require.NoError(t, err)
+	}
+	_, err = c.Write(frame(3, 100))
+	require.NoError(t, err)
+	_, err = c.Write(frame(0, 0))
+	require.NoError(t, err)
+
+	stats := c.Stats()
+	require.Len(t, stats, 2)
+	assert.Equal(t, StreamStats{ID: 1, Priority: PriorityBulk, QueuedFrames: 8, QueuedBytes: 8 * (4096 + headerSize), SentBytes: 4096 + headerSize}, stats[0])
+	assert.Equal(t, 1, stats[1].QueuedFrames)
+
+	close(rc.release)
+	require.Eventually(t, func() bool {
+		rc.lock.Lock()
+		defer rc.lock.Unlock()
+		return len(rc.frames) == 11
+	}, time.Second, time.Millisecond)
+
+	ids := make([]uint32, len(rc.frames))
+	for i, f := range rc.frames {
+		ids[i] = binary.BigEndian.Uint32(f[4:8])
+	}
+	// session frame goes first, interactive frame overtakes bulk queue
+	assert.Equal(t, []uint32{1, 0, 3, 1, 1, 1, 1, 1, 1, 1, 1}, ids)
+	assert.Equal(t, uint64(9*(4096+headerSize)), c.Stats()[0].SentBytes)
+
+	c.Forget(1)
+	c.Forget(3)
+	assert.Empty(t, c.Stats())
+}
+
+func TestSchedulerBatch(t *testing.T) {
+	rc := &recordConn{release: make(chan struct{})}
+	c := NewConn(rc, yamuxFraming, func() int { return 1000 })
+	defer c.Close()
+
+	_, err := c.Write(frame(1, 10))
+	require.NoError(t, err)
+	time.Sleep(10 * time.Millisecond)
+	for i := 0; i < 5; i++ {
+		_, err = c.Write(frame(1, 300))
+		require.NoError(t, err)
+	}
+
+	close(rc.release)
+	require.Eventually(t, func() bool {
+		rc.lock.Lock()
+		defer rc.lock.Unlock()
+		return len(rc.frames) == 3
+	}, time.Second, time.Millisecond)
+	// frames are coalesced up to batch limit
+	assert.Len(t, rc.frames[0], 10+headerSize)
+	assert.Len(t, rc.frames[1], 3*(300+headerSize))
+	assert.Len(t, rc.frames[2], 2*(300+headerSize))
+}
+
+func TestRules(t *testing.T) {
+	r := NewRules(config.StreamPriority{InteractivePorts: []int{22}, BulkPorts: []int{873}})
+	assert.Equal(t, PriorityInteractive, r.Match(22))
+	assert.Equal(t, PriorityBulk, r.Match(873))
+	assert.Equal(t, PriorityNormal, r.Match(443))
+}
@@ -0,0 +1,311 @@
+package socksproxy
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// protocol of proxy client
+type protocol int
+
+const (
+	protoSOCKS5 protocol = iota
+	protoSOCKS4
+	protoHTTP
+)
+
+const (
+	socks4Version  = 4
+	socks4Granted  = 90
+	socks4Rejected = 91
+	// maxSOCKS4Field limits user id and domain of SOCKS4 request
+	maxSOCKS4Field = 255
+)
+
+// Accept reads request of SOCKS5, SOCKS4/4a or HTTP proxy client, detecting protocol by the first byte.
+// If there are users, clients should authenticate and SOCKS4 clients, which can't, are refused.
+func Accept(conn net.Conn, users Users) (*Request, error) {
+	r := bufio.NewReader(conn)
+	first, err := r.Peek(1)
+	if err != nil {
+		return nil, fmt.Errorf("read proxy request: %v", err)
+	}
+	bc := &bufferedConn{Conn: conn, r: r}
+
+	var req *Request
+	switch {
+	case first[0] == socksVersion:
+		req, err = ReadRequest(bc, users)
+	case first[0] == socks4Version && users != nil:
+		_, _ = conn.Write([]byte{0, socks4Rejected, 0, 0, 0, 0, 0, 0})
+		err = fmt.Errorf("%w: socks4 client can't authenticate", errAuthFailed)
+	case first[0] == socks4Version:
+		req, err = readSOCKS4Request(r)
+	case first[0] >= 'A' && first[0] <= 'Z':
+		req, err = readHTTPRequest(r, users)
+		if errors.Is(err, errAuthFailed) {
+			_ = writeHTTPAuthRequired(conn)
+		} else if err != nil {
+			_ = writeHTTPError(conn, http.StatusBadRequest)
+		}
+	default:
+		err = fmt.Errorf("unknown proxy protocol, first byte %#x", first[0])
+	}
+	if err != nil {
+		return nil, err
+	}
+	req.Conn, req.r, req.users = bc, r, users
+	return req, nil
+}
+
+// readSOCKS4Request reads SOCKS4 or SOCKS4a request: version, command, port, IP, user id,
+// and domain if IP is 0.0.0.x.
+func readSOCKS4Request(r *bufio.Reader) (*Request, error) {
+	header := make([]byte, 8)
+	_, err := io.ReadFull(r, header)
+	if err != nil {
+		return nil, fmt.Errorf("read socks4 request: %v", err)
+	}
+	_, err = readNullTerminated(r)
+	if err != nil {
+		return nil, fmt.Errorf("read socks4 user id: %v", err)
+	}
+	req := &Request{
+		Command: header[1],
+		Port:    int(header[2])<<8 | int(header[3]),
+		Host:    net.IP(header[4:8]).String(),
+		proto:   protoSOCKS4,
+	}
+	if header[4] == 0 && header[5] == 0 && header[6] == 0 && header[7] != 0 {
+		req.Host, err = readNullTerminated(r)
+		if err != nil {
+			return nil, fmt.Errorf("read socks4a domain: %v", err)
+		}
+	}
+	return req, req.encode()
+}
+
+func readNullTerminated(r *bufio.Reader) (string, error) {
+	var field []byte
+	for len(field) <= maxSOCKS4Field {
+		b, err := r.ReadByte()
+		if err != nil {
+			return "", err
+		}
+		if b == 0 {
+			return string(field), nil
+		}
+		field = append(field, b)
+	}
+	return "", errors.New("field is too long")
+}
+
+// readHTTPRequest reads request of HTTP proxy client: CONNECT or request with absolute URI.
+func readHTTPRequest(r *bufio.Reader, users Users) (*Request, error) {
+	httpReq, err := http.ReadRequest(r)
+	if err != nil {
+		return nil, fmt.Errorf("read http proxy request: %w", err)
+	}
+	req := &Request{Command: CommandConnect, proto: protoHTTP}
+	if users != nil {
+		req.User, err = users.authenticateHTTP(httpReq)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if httpReq.Method == http.MethodConnect {
+		req.Host, req.Port, err = splitHostPort(httpReq.RequestURI, 443)
+	} else {
+		req.HTTP = httpReq
+		if httpReq.URL.Scheme != "http" {
+			return nil, fmt.Errorf("unsupported http proxy request '%s %s'", httpReq.Method, httpReq.RequestURI)
+		}
+		req.Host, req.Port, err = splitHostPort(httpReq.URL.Host, 80)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return req, req.encode()
+}
+
+func splitHostPort(hostport string, defaultPort int) (string, int, error) {
+	host, portStr, err := net.SplitHostPort(hostport)
+	if err != nil {
+		host, portStr = strings.Trim(hostport, "[]"), strconv.Itoa(defaultPort)
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil || port < 1 || port > 65535 || host == "" {
+		return "", 0, fmt.Errorf("invalid address '%s'", hostport)
+	}
+	return host, port, nil
+}
+
+// encode builds SOCKS5 request for server.
+func (r *Request) encode() error {
+	var err error
+	r.raw, err = appendHostAddr([]byte{socksVersion, r.Command, 0}, r.Host, r.Port)
+	return err
+}
+
+// Connect passes request to SOCKS server on the other side of stream. SOCKS5 client gets
+// reply of server in stream, replies to others are translated to their protocol, and Connect
+// fails if server couldn't connect. Client is refused on failure.
+func (r *Request) Connect(stream io.ReadWriter) error {
+	err := r.Forward(stream)
+	if err != nil {
+		_ = r.Refuse(ReplyGeneralFailure)
+		return err
+	}
+	if r.proto == protoSOCKS5 {
+		return nil
+	}
+
+	code, err := readReply(stream)
+	if err != nil {
+		_ = r.Refuse(ReplyGeneralFailure)
+		return err
+	}
+	if code != ReplySucceeded {
+		_ = r.Refuse(code)
+		return fmt.Errorf("server refused to connect to %s with code %d", r.Addr(), code)
+	}
+
+	switch r.proto {
+	case protoSOCKS4:
+		_, err = r.Conn.Write([]byte{0, socks4Granted, 0, 0, 0, 0, 0, 0})
+	case protoHTTP:
+		_, err = io.WriteString(r.Conn, "HTTP/1.1 200 Connection established\r\n\r\n")
+	}
+	return err
+}
+
+// readReply reads SOCKS5 reply of server and returns its code.
+func readReply(stream io.Reader) (byte, error) {
+	reply := make([]byte, 3)
+	_, err := io.ReadFull(stream, reply)
+	if err == nil {
+		_, _, _, err = readAddr(stream)
+	}
+	if err != nil {
+		return 0, fmt.Errorf("read socks reply of server: %v", err)
+	}
+	return reply[1], nil
+}
+
+// Refuse replies to client that request failed with SOCKS5 reply code.
+func (r *Request) Refuse(code byte) error {
+	var err error
+	switch r.proto {
+	case protoSOCKS4:
+		_, err = r.Conn.Write([]byte{0, socks4Rejected, 0, 0, 0, 0, 0, 0})
+	case protoHTTP:
+		status := http.StatusBadGateway
+		switch code {
+		case ReplyNotAllowed:
+			status = http.StatusForbidden
+		case ReplyCommandNotSupported:
+			status = http.StatusNotImplemented
+		}
+		err = writeHTTPError(r.Conn, status)
+	default:
+		err = Reply(r.Conn, code, nil)
+	}
+	return err
+}
+
+func writeHTTPError(w io.Writer, status int) error {
+	_, err := fmt.Fprintf(w, "HTTP/1.1 %d %s\r\nContent-Length: 0\r\nConnection: close\r\n\r\n", status, http.StatusText(status))
+	return err
+}
+
+// hopHeaders are meant for proxy and are not forwarded.
+var hopHeaders = []string{
+	"Connection", "Proxy-Connection", "Keep-Alive", "Proxy-Authenticate",
+	"Proxy-Authorization", "Te", "Trailer", "Upgrade",
+}
+
+// ForwardHTTP serves plain HTTP proxy requests of client with streams to their destinations,
+// starting with given stream connected to nothing yet. Following requests of keep-alive connection
+// reuse the stream while they go to the same destination, open opens streams for others.
+func ForwardHTTP(req *Request, stream io.ReadWriteCloser, open func(req *Request) (io.ReadWriteCloser, error)) error {
+	defer func() {
+		_ = stream.Close()
+		_ = req.Conn.Close()
+	}()
+	connected := ""
+	var upstream *bufio.Reader
+	for {
+		httpReq := req.HTTP
+		if connected != req.Addr() {
+			if connected != "" {
+				_ = stream.Close()
+				var err error
+				stream, err = open(req)
+				if errors.Is(err, ErrRouteBlocked) {
+					_ = writeHTTPError(req.Conn, http.StatusForbidden)
+					return err
+				} else if err != nil {
+					_ = writeHTTPError(req.Conn, http.StatusBadGateway)
+					return err
+				}
+			}
+			err := req.Forward(stream)
+			var code byte
+			if err == nil {
+				code, err = readReply(stream)
+			}
+			if err == nil && code != ReplySucceeded {
+				err = fmt.Errorf("server refused to connect to %s with code %d", req.Addr(), code)
+			}
+			if err != nil {
+				_ = writeHTTPError(req.Conn, http.StatusBadGateway)
+				return err
+			}
+			connected = req.Addr()
+			upstream = bufio.NewReader(stream)
+		}
+
+		for _, h := range hopHeaders {
+			httpReq.Header.Del(h)
+		}
+		err := httpReq.Write(stream)
+		if err != nil {
+			return fmt.Errorf("forward http request: %v", err)
+		}
+		resp, err := http.ReadResponse(upstream, httpReq)
+		if err != nil {
+			_ = writeHTTPError(req.Conn, http.StatusBadGateway)
+			return fmt.Errorf("read http response: %v", err)
+		}
+		err = resp.Write(req.Conn)
+		_ = resp.Body.Close()
+		if err != nil || httpReq.Close || resp.Close {
+			return err
+		}
+
+		next, err := readHTTPRequest(req.r, req.users)
+		switch {
+		case errors.Is(err, io.EOF):
+			return nil
+		case errors.Is(err, errAuthFailed):
+			_ = writeHTTPAuthRequired(req.Conn)
+			return err
+		case err != nil:
+			_ = writeHTTPError(req.Conn, http.StatusBadRequest)
+			return err
+		}
+		if next.HTTP == nil {
+			// CONNECT after plain requests is unusual, client should open new connection
+			_ = writeHTTPError(req.Conn, http.StatusBadRequest)
+			return nil
+		}
+		next.Conn, next.r, next.users = req.Conn, req.r, req.users
+		req = next
+	}
+}
@@ -0,0 +1,167 @@
+package socksproxy
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"testing"
+
+	"github.com/pymq/demhack4/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// serveTunnel serves proxy connections of client like client app does, with net.Pipe as tunnel stream.
+func serveTunnel(t *testing.T, server *Server, users Users) *Client {
+	client, err := NewClient("127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = client.Close() })
+	go func() {
+		for conn := range client.ConnsChan() {
+			stream, serverStream := net.Pipe()
+			server.ServeConn(serverStream, Peer{})
+			go func(conn net.Conn) {
+				req, err := Accept(conn, users)
+				if err != nil {
+					_ = conn.Close()
+					return
+				}
+				switch {
+				case req.HTTP != nil:
+					_ = ForwardHTTP(req, stream, func(*Request) (io.ReadWriteCloser, error) {
+						stream, serverStream := net.Pipe()
+						server.ServeConn(serverStream, Peer{})
+						return stream, nil
+					})
+				case req.Command == CommandConnect:
+					if req.Connect(stream) == nil {
+						pipe(stream, req.Conn)
+					}
+				case req.Command == CommandUDPAssociate:
+					_ = OpenUDPAssociation(req.Conn, stream)
+				default:
+					_ = req.Refuse(ReplyCommandNotSupported)
+				}
+			}(conn)
+		}
+	}()
+	return client
+}
+
+func newTestHTTPServer(t *testing.T, name string) *httptest.Server {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Empty(t, r.Header.Get("Proxy-Connection"))
+		_, _ = fmt.Fprintf(w, "%s %s", name, r.URL.Path)
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func TestAcceptHTTP(t *testing.T) {
+	first := newTestHTTPServer(t, "first")
+	second := newTestHTTPServer(t, "second")
+	server, err := NewServer(ServerOptions{Egress: config.Egress{AllowPrivate: true}})
+	require.NoError(t, err)
+	defer server.Close()
+	client := serveTunnel(t, server, nil)
+
+	proxyURL := &url.URL{Scheme: "http", Host: client.listener.Addr().String()}
+	httpClient := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL)}}
+	get := func(target string) string {
+		resp, err := httpClient.Get(target)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		return string(body)
+	}
+
+	// plain requests, the keep-alive connection switches destination
+	assert.Equal(t, "first /a", get(first.URL+"/a"))
+	assert.Equal(t, "first /b", get(first.URL+"/b"))
+	assert.Equal(t, "second /c", get(second.URL+"/c"))
+
+	// CONNECT
+	conn, err := net.Dial("tcp", client.listener.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+	host := first.Listener.Addr().String()
+	_, err = fmt.Fprintf(conn, "CONNECT %s HTTP/1.1\r\nHost: %s\r\n\r\nGET /d HTTP/1.1\r\nHost: %s\r\n\r\n", host, host, host)
+	require.NoError(t, err)
+	r := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(r, nil)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	resp, err = http.ReadResponse(r, nil)
+	require.NoError(t, err)
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	assert.Equal(t, "first /d", string(body))
+}
+
+func TestAcceptHTTPDenied(t *testing.T) {
+	target := newTestHTTPServer(t, "target")
+	server, err := NewServer(ServerOptions{})
+	require.NoError(t, err)
+	defer server.Close()
+	client := serveTunnel(t, server, nil)
+
+	proxyURL := &url.URL{Scheme: "http", Host: client.listener.Addr().String()}
+	httpClient := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL)}}
+	resp, err := httpClient.Get(target.URL)
+	require.NoError(t, err)
+	_ = resp.Body.Close()
+	assert.Equal(t, http.StatusBadGateway, resp.StatusCode)
+}
+
+func TestAcceptSOCKS4(t *testing.T) {
+	target := newTestHTTPServer(t, "target")
+	server, err := NewServer(ServerOptions{Egress: config.Egress{AllowPrivate: true}})
+	require.NoError(t, err)
+	defer server.Close()
+	client := serveTunnel(t, server, nil)
+	addr := target.Listener.Addr().(*net.TCPAddr)
+	port := []byte{byte(addr.Port >> 8), byte(addr.Port)}
+
+	for name, request := range map[string][]byte{
+		"socks4":  append(append(append([]byte{4, 1}, port...), addr.IP.To4()...), 'u', 0),
+		"socks4a": append(append(append([]byte{4, 1}, port...), 0, 0, 0, 1, 'u', 0), "localhost\x00"...),
+	} {
+		conn, err := net.Dial("tcp", client.listener.Addr().String())
+		require.NoError(t, err)
+		_, err = conn.Write(request)
+		require.NoError(t, err)
+		reply := make([]byte, 8)
+		_, err = io.ReadFull(conn, reply)
+		require.NoError(t, err)
+		assert.Equal(t, byte(socks4Granted), reply[1], name)
+
+		_, err = fmt.Fprintf(conn, "GET /%s HTTP/1.1\r\nHost: localhost:%s\r\nConnection: close\r\n\r\n", name, strconv.Itoa(addr.Port))
+		require.NoError(t, err)
+		resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+		require.NoError(t, err)
+		body, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		assert.Equal(t, "target /"+name, string(body))
+		_ = conn.Close()
+	}
+
+	// denied destination is rejected
+	denied, err := NewServer(ServerOptions{})
+	require.NoError(t, err)
+	defer denied.Close()
+	conn, err := net.Dial("tcp", serveTunnel(t, denied, nil).listener.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+	_, err = conn.Write(append(append(append([]byte{4, 1}, port...), addr.IP.To4()...), 0))
+	require.NoError(t, err)
+	reply := make([]byte, 8)
+	_, err = io.ReadFull(conn, reply)
+	require.NoError(t, err)
+	assert.Equal(t, byte(socks4Rejected), reply[1])
+}
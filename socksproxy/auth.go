@@ -0,0 +1,107 @@
+package socksproxy
+
+import (
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/pymq/demhack4/config"
+)
+
+const (
+	methodUserPassword  byte = 2
+	userPasswordVersion      = 1
+)
+
+var errAuthFailed = errors.New("proxy authentication failed")
+
+// Users are accounts of proxy listener, nil allows everyone without authentication.
+type Users map[string]string
+
+func NewUsers(cfg []config.ProxyUser) (Users, error) {
+	if len(cfg) == 0 {
+		return nil, nil
+	}
+	users := Users{}
+	for _, u := range cfg {
+		if u.Name == "" || len(u.Name) > 255 || len(u.Password) > 255 {
+			return nil, fmt.Errorf("proxy: invalid user '%s', name should be 1-255 bytes and password up to 255", u.Name)
+		}
+		if _, ok := users[u.Name]; ok {
+			return nil, fmt.Errorf("proxy: duplicate user '%s'", u.Name)
+		}
+		users[u.Name] = u.Password
+	}
+	return users, nil
+}
+
+func (u Users) check(name, password string) bool {
+	expected, ok := u[name]
+	// compare anyway, so unknown names take as long as wrong passwords
+	match := subtle.ConstantTimeCompare([]byte(expected), []byte(password)) == 1
+	return ok && match
+}
+
+// authenticateSOCKS5 reads username/password of SOCKS5 client (RFC 1929) and replies with status.
+func (u Users) authenticateSOCKS5(rw io.ReadWriter) (string, error) {
+	header := make([]byte, 2)
+	_, err := io.ReadFull(rw, header)
+	if err != nil {
+		return "", fmt.Errorf("read socks credentials: %v", err)
+	}
+	if header[0] != userPasswordVersion {
+		return "", fmt.Errorf("unsupported socks auth version %d", header[0])
+	}
+	name := make([]byte, header[1])
+	_, err = io.ReadFull(rw, name)
+	if err != nil {
+		return "", fmt.Errorf("read socks credentials: %v", err)
+	}
+	size := make([]byte, 1)
+	_, err = io.ReadFull(rw, size)
+	if err != nil {
+		return "", fmt.Errorf("read socks credentials: %v", err)
+	}
+	password := make([]byte, size[0])
+	_, err = io.ReadFull(rw, password)
+	if err != nil {
+		return "", fmt.Errorf("read socks credentials: %v", err)
+	}
+
+	if !u.check(string(name), string(password)) {
+		_, _ = rw.Write([]byte{userPasswordVersion, 1})
+		return "", fmt.Errorf("%w for user '%s'", errAuthFailed, name)
+	}
+	_, err = rw.Write([]byte{userPasswordVersion, 0})
+	if err != nil {
+		return "", fmt.Errorf("write socks auth status: %v", err)
+	}
+	return string(name), nil
+}
+
+// authenticateHTTP checks Basic credentials in Proxy-Authorization header.
+func (u Users) authenticateHTTP(req *http.Request) (string, error) {
+	auth := req.Header.Get("Proxy-Authorization")
+	if !strings.HasPrefix(auth, "Basic ") {
+		return "", fmt.Errorf("%w: no credentials", errAuthFailed)
+	}
+	decoded, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(auth, "Basic "))
+	if err != nil {
+		return "", fmt.Errorf("%w: invalid credentials", errAuthFailed)
+	}
+	name, password, _ := strings.Cut(string(decoded), ":")
+	if !u.check(name, password) {
+		return "", fmt.Errorf("%w for user '%s'", errAuthFailed, name)
+	}
+	return name, nil
+}
+
+func writeHTTPAuthRequired(w io.Writer) error {
+	_, err := io.WriteString(w, "HTTP/1.1 407 Proxy Authentication Required\r\n"+
+		"Proxy-Authenticate: Basic realm=\"proxy\"\r\nContent-Length: 0\r\nConnection: close\r\n\r\n")
+	return err
+}
@@ -0,0 +1,76 @@
+package socksproxy
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"testing"
+
+	"github.com/pymq/demhack4/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/proxy"
+)
+
+func TestNewUsers(t *testing.T) {
+	users, err := NewUsers(nil)
+	require.NoError(t, err)
+	assert.Nil(t, users)
+
+	_, err = NewUsers([]config.ProxyUser{{Name: "", Password: "secret"}})
+	assert.Error(t, err)
+	_, err = NewUsers([]config.ProxyUser{{Name: "alice", Password: "1"}, {Name: "alice", Password: "2"}})
+	assert.Error(t, err)
+}
+
+func TestAuthentication(t *testing.T) {
+	target := newTestHTTPServer(t, "target")
+	server, err := NewServer(ServerOptions{Egress: config.Egress{AllowPrivate: true}})
+	require.NoError(t, err)
+	defer server.Close()
+	users, err := NewUsers([]config.ProxyUser{{Name: "alice", Password: "secret"}, {Name: "bob", Password: "hunter2"}})
+	require.NoError(t, err)
+	listenAddr := serveTunnel(t, server, users).listener.Addr().String()
+
+	// SOCKS5
+	dialer, err := proxy.SOCKS5("tcp", listenAddr, &proxy.Auth{User: "bob", Password: "hunter2"}, nil)
+	require.NoError(t, err)
+	conn, err := dialer.Dial("tcp", target.Listener.Addr().String())
+	require.NoError(t, err)
+	_ = conn.Close()
+	dialer, err = proxy.SOCKS5("tcp", listenAddr, &proxy.Auth{User: "bob", Password: "secret"}, nil)
+	require.NoError(t, err)
+	_, err = dialer.Dial("tcp", target.Listener.Addr().String())
+	assert.Error(t, err, "wrong password")
+	dialer, err = proxy.SOCKS5("tcp", listenAddr, nil, nil)
+	require.NoError(t, err)
+	_, err = dialer.Dial("tcp", target.Listener.Addr().String())
+	assert.Error(t, err, "no credentials")
+
+	// HTTP
+	get := func(user *url.Userinfo) int {
+		proxyURL := &url.URL{Scheme: "http", Host: listenAddr, User: user}
+		httpClient := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL)}}
+		resp, err := httpClient.Get(target.URL)
+		require.NoError(t, err)
+		_, _ = io.Copy(io.Discard, resp.Body)
+		_ = resp.Body.Close()
+		return resp.StatusCode
+	}
+	assert.Equal(t, http.StatusOK, get(url.UserPassword("alice", "secret")))
+	assert.Equal(t, http.StatusProxyAuthRequired, get(url.UserPassword("alice", "hunter2")))
+	assert.Equal(t, http.StatusProxyAuthRequired, get(nil))
+
+	// SOCKS4 can't authenticate
+	conn, err = net.Dial("tcp", listenAddr)
+	require.NoError(t, err)
+	defer conn.Close()
+	addr := target.Listener.Addr().(*net.TCPAddr)
+	_, err = conn.Write(append(append([]byte{4, 1, byte(addr.Port >> 8), byte(addr.Port)}, addr.IP.To4()...), 'a', 0))
+	require.NoError(t, err)
+	reply := make([]byte, 8)
+	_, err = io.ReadFull(conn, reply)
+	require.NoError(t, err)
+	assert.Equal(t, byte(socks4Rejected), reply[1])
+}
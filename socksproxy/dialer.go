@@ -0,0 +1,209 @@
+package socksproxy
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"sync/atomic"
+	"time"
+
+	"github.com/pymq/demhack4/config"
+	"golang.org/x/net/proxy"
+)
+
+// Dialer connects to destinations of proxied streams.
+type Dialer interface {
+	DialContext(ctx context.Context, network, addr string) (net.Conn, error)
+}
+
+// NewDialer creates dialer from egress config: direct or through upstream proxy,
+// bound to source address and resolving names with configured DNS servers.
+func NewDialer(cfg config.Egress) (Dialer, error) {
+	config.SetEgressDefaults(&cfg)
+
+	direct := &net.Dialer{Timeout: cfg.DialTimeout}
+	localIP, err := bindIP(cfg)
+	if err != nil {
+		return nil, err
+	}
+	if localIP != nil {
+		direct.LocalAddr = &net.TCPAddr{IP: localIP}
+	}
+	if len(cfg.DNSServers) > 0 {
+		direct.Resolver, err = newResolver(cfg.DNSServers, (&net.Dialer{Timeout: cfg.DialTimeout}).DialContext)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if cfg.Upstream == "" {
+		return direct, nil
+	}
+	return newUpstreamDialer(cfg.Upstream, direct)
+}
+
+// bindIP returns configured source IP of outgoing connections, nil if it is not set.
+func bindIP(cfg config.Egress) (net.IP, error) {
+	switch {
+	case cfg.BindAddr != "" && cfg.BindInterface != "":
+		return nil, errors.New("proxy: only one of bind address and bind interface can be set")
+	case cfg.BindAddr != "":
+		ip := net.ParseIP(cfg.BindAddr)
+		if ip == nil {
+			return nil, fmt.Errorf("proxy: invalid bind address '%s'", cfg.BindAddr)
+		}
+		return ip, nil
+	case cfg.BindInterface != "":
+		iface, err := net.InterfaceByName(cfg.BindInterface)
+		if err != nil {
+			return nil, fmt.Errorf("proxy: bind interface: %v", err)
+		}
+		addrs, err := iface.Addrs()
+		if err != nil {
+			return nil, fmt.Errorf("proxy: addresses of interface '%s': %v", cfg.BindInterface, err)
+		}
+		// prefer IPv4, most destinations are reachable by it
+		var found net.IP
+		for _, addr := range addrs {
+			ipNet, ok := addr.(*net.IPNet)
+			if !ok || ipNet.IP.IsLinkLocalUnicast() {
+				continue
+			}
+			if ipNet.IP.To4() != nil {
+				return ipNet.IP, nil
+			}
+			if found == nil {
+				found = ipNet.IP
+			}
+		}
+		if found == nil {
+			return nil, fmt.Errorf("proxy: interface '%s' has no usable address", cfg.BindInterface)
+		}
+		return found, nil
+	default:
+		return nil, nil
+	}
+}
+
+// newResolver creates resolver which queries given DNS servers in turn.
+func newResolver(servers []string, dial func(ctx context.Context, network, addr string) (net.Conn, error)) (*net.Resolver, error) {
+	addrs := make([]string, 0, len(servers))
+	for _, server := range servers {
+		if _, _, err := net.SplitHostPort(server); err != nil {
+			server = net.JoinHostPort(server, "53")
+		}
+		host, _, _ := net.SplitHostPort(server)
+		if net.ParseIP(host) == nil {
+			return nil, fmt.Errorf("proxy: DNS server should be an IP address, got '%s'", server)
+		}
+		addrs = append(addrs, server)
+	}
+
+	var next uint32
+	return &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+			i := atomic.AddUint32(&next, 1)
+			return dial(ctx, network, addrs[int(i)%len(addrs)])
+		},
+	}, nil
+}
+
+// newUpstreamDialer creates dialer through upstream SOCKS5 or HTTP proxy.
+func newUpstreamDialer(upstream string, forward *net.Dialer) (Dialer, error) {
+	u, err := url.Parse(upstream)
+	if err != nil {
+		return nil, fmt.Errorf("proxy: invalid upstream '%s': %v", upstream, err)
+	}
+	if u.Host == "" {
+		return nil, fmt.Errorf("proxy: upstream '%s' has no address", upstream)
+	}
+
+	switch u.Scheme {
+	case "socks5", "socks5h":
+		var auth *proxy.Auth
+		if u.User != nil {
+			password, _ := u.User.Password()
+			auth = &proxy.Auth{User: u.User.Username(), Password: password}
+		}
+		d, err := proxy.SOCKS5("tcp", u.Host, auth, forward)
+		if err != nil {
+			return nil, fmt.Errorf("proxy: upstream: %v", err)
+		}
+		return d.(Dialer), nil
+	case "http":
+		return &httpDialer{addr: u.Host, user: u.User, forward: forward}, nil
+	default:
+		return nil, fmt.Errorf("proxy: unsupported upstream scheme '%s'", u.Scheme)
+	}
+}
+
+// httpDialer connects through HTTP proxy with CONNECT method.
+type httpDialer struct {
+	addr    string
+	user    *url.Userinfo
+	forward *net.Dialer
+}
+
+func (d *httpDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	if network != "tcp" && network != "tcp4" && network != "tcp6" {
+		return nil, fmt.Errorf("proxy: network '%s' is not supported by http upstream", network)
+	}
+	conn, err := d.forward.DialContext(ctx, "tcp", d.addr)
+	if err != nil {
+		return nil, fmt.Errorf("proxy: connect to upstream: %v", err)
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = conn.SetDeadline(deadline)
+		defer conn.SetDeadline(time.Time{})
+	}
+
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: addr},
+		Host:   addr,
+		Header: http.Header{},
+	}
+	if d.user != nil {
+		password, _ := d.user.Password()
+		credentials := base64.StdEncoding.EncodeToString([]byte(d.user.Username() + ":" + password))
+		req.Header.Set("Proxy-Authorization", "Basic "+credentials)
+	}
+	err = req.Write(conn)
+	if err != nil {
+		_ = conn.Close()
+		return nil, fmt.Errorf("proxy: write CONNECT to upstream: %v", err)
+	}
+
+	r := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(r, req)
+	if err != nil {
+		_ = conn.Close()
+		return nil, fmt.Errorf("proxy: read CONNECT response of upstream: %v", err)
+	}
+	_ = resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		_ = conn.Close()
+		return nil, fmt.Errorf("proxy: upstream refused to connect to %s: %s", addr, resp.Status)
+	}
+	if r.Buffered() > 0 {
+		// destination spoke first, e.g. ssh banner
+		return &bufferedConn{Conn: conn, r: r}, nil
+	}
+	return conn, nil
+}
+
+// bufferedConn returns data read ahead into buffer before data of connection.
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
@@ -0,0 +1,156 @@
+package socksproxy
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+
+	"github.com/haxii/socks5"
+	"github.com/pymq/demhack4/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// listenBanner accepts connections, which greet client first and echo the rest.
+func listenBanner(t *testing.T) net.Listener {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = l.Close() })
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				_, _ = conn.Write([]byte("hello\n"))
+				_, _ = io.Copy(conn, conn)
+			}()
+		}
+	}()
+	return l
+}
+
+// listenHTTPProxy accepts CONNECT requests with given credentials.
+func listenHTTPProxy(t *testing.T, authorization string) net.Listener {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = l.Close() })
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				r := bufio.NewReader(conn)
+				req, err := http.ReadRequest(r)
+				if err != nil {
+					return
+				}
+				if req.Method != http.MethodConnect || req.Header.Get("Proxy-Authorization") != authorization {
+					_, _ = conn.Write([]byte("HTTP/1.1 407 Proxy Authentication Required\r\n\r\n"))
+					return
+				}
+				target, err := net.Dial("tcp", req.Host)
+				if err != nil {
+					_, _ = conn.Write([]byte("HTTP/1.1 502 Bad Gateway\r\n\r\n"))
+					return
+				}
+				defer target.Close()
+				_, _ = conn.Write([]byte("HTTP/1.1 200 Connection established\r\n\r\n"))
+				go func() { _, _ = io.Copy(target, r) }()
+				_, _ = io.Copy(conn, target)
+			}()
+		}
+	}()
+	return l
+}
+
+func assertBannerEcho(t *testing.T, dialer Dialer, addr string) {
+	conn, err := dialer.DialContext(context.Background(), "tcp", addr)
+	require.NoError(t, err)
+	defer conn.Close()
+
+	r := bufio.NewReader(conn)
+	line, err := r.ReadString('\n')
+	require.NoError(t, err)
+	assert.Equal(t, "hello\n", line)
+
+	_, err = conn.Write([]byte("ping\n"))
+	require.NoError(t, err)
+	line, err = r.ReadString('\n')
+	require.NoError(t, err)
+	assert.Equal(t, "ping\n", line)
+}
+
+func TestDialerHTTPUpstream(t *testing.T) {
+	target := listenBanner(t)
+	upstream := listenHTTPProxy(t, "Basic dXNlcjpwYXNz")
+
+	dialer, err := NewDialer(config.Egress{Upstream: "http://user:pass@" + upstream.Addr().String()})
+	require.NoError(t, err)
+	assertBannerEcho(t, dialer, target.Addr().String())
+
+	dialer, err = NewDialer(config.Egress{Upstream: "http://" + upstream.Addr().String()})
+	require.NoError(t, err)
+	_, err = dialer.DialContext(context.Background(), "tcp", target.Addr().String())
+	assert.ErrorContains(t, err, "407")
+}
+
+func TestDialerSOCKSUpstream(t *testing.T) {
+	target := listenBanner(t)
+	upstreamServer, err := socks5.New(&socks5.Config{Credentials: socks5.StaticCredentials{"user": "pass"}})
+	require.NoError(t, err)
+	upstream, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer upstream.Close()
+	go func() { _ = upstreamServer.Serve(upstream) }()
+
+	dialer, err := NewDialer(config.Egress{Upstream: "socks5://user:pass@" + upstream.Addr().String()})
+	require.NoError(t, err)
+	assertBannerEcho(t, dialer, target.Addr().String())
+}
+
+func TestDialerBind(t *testing.T) {
+	target, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer target.Close()
+	accepted := make(chan net.Addr, 1)
+	go func() {
+		conn, err := target.Accept()
+		if err == nil {
+			accepted <- conn.RemoteAddr()
+			_ = conn.Close()
+		}
+	}()
+
+	dialer, err := NewDialer(config.Egress{BindAddr: "127.0.0.1"})
+	require.NoError(t, err)
+	conn, err := dialer.DialContext(context.Background(), "tcp", target.Addr().String())
+	require.NoError(t, err)
+	_ = conn.Close()
+	assert.Equal(t, "127.0.0.1", (<-accepted).(*net.TCPAddr).IP.String())
+}
+
+func TestDialerInvalidConfig(t *testing.T) {
+	for _, cfg := range []config.Egress{
+		{Upstream: "ftp://127.0.0.1:21"},
+		{Upstream: "socks5://"},
+		{BindAddr: "localhost"},
+		{BindAddr: "127.0.0.1", BindInterface: "lo"},
+		{BindInterface: "no-such-interface0"},
+		{DNSServers: []string{"dns.example.com"}},
+	} {
+		_, err := NewDialer(cfg)
+		assert.Error(t, err, "%+v", cfg)
+	}
+
+	_, err := NewDialer(config.Egress{DNSServers: []string{"1.1.1.1", "[2606:4700::1111]:53"}})
+	assert.NoError(t, err)
+}
@@ -0,0 +1,201 @@
+package socksproxy
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Remote forward is requested by client in a control stream, which starts with forwardStreamMark
+// followed by 2 bytes of port, and server answers with status byte. Server listens on the port
+// while control stream is open, and opens stream to client for every accepted connection,
+// starting it with 2 bytes of port, so client knows where to connect it.
+const (
+	forwardStreamMark byte = 0xf3
+
+	forwardOK     byte = 0
+	forwardDenied byte = 1
+	forwardFailed byte = 2
+	forwardInUse  byte = 3
+
+	// forwardOpenTimeout limits opening of client stream for accepted connection
+	forwardOpenTimeout = 30 * time.Second
+)
+
+// ErrForwardDenied is returned when server policy doesn't allow to expose the port.
+var ErrForwardDenied = errors.New("remote forward port is not allowed by server")
+
+// ErrForwardInUse is returned when the port is already forwarded by another client.
+var ErrForwardInUse = errors.New("remote forward port is used by another client")
+
+// Dial asks SOCKS server on the other side of stream to connect it to addr, "host:port".
+func Dial(stream io.ReadWriter, addr string) error {
+	host, port, err := splitHostPort(addr, 0)
+	if err != nil {
+		return err
+	}
+	req := &Request{Command: CommandConnect, Host: host, Port: port}
+	err = req.encode()
+	if err != nil {
+		return err
+	}
+	err = req.Forward(stream)
+	if err != nil {
+		return err
+	}
+	code, err := readReply(stream)
+	if err != nil {
+		return err
+	}
+	if code != ReplySucceeded {
+		return fmt.Errorf("server refused to connect to %s with code %d", addr, code)
+	}
+	return nil
+}
+
+// RequestRemoteForward asks server to listen on port. Forward lasts until stream is closed.
+func RequestRemoteForward(stream io.ReadWriter, port int) error {
+	_, err := stream.Write([]byte{forwardStreamMark, byte(port >> 8), byte(port)})
+	if err != nil {
+		return fmt.Errorf("request remote forward: %v", err)
+	}
+	status := make([]byte, 1)
+	_, err = io.ReadFull(stream, status)
+	if err != nil {
+		return fmt.Errorf("read remote forward status: %v", err)
+	}
+	switch status[0] {
+	case forwardOK:
+		return nil
+	case forwardDenied:
+		return ErrForwardDenied
+	case forwardInUse:
+		return ErrForwardInUse
+	default:
+		return errors.New("server failed to listen on remote forward port")
+	}
+}
+
+// ReadForwardedPort reads port of remote forward, which connection came to, from stream opened by server.
+func ReadForwardedPort(stream io.Reader) (int, error) {
+	var port [2]byte
+	_, err := io.ReadFull(stream, port[:])
+	if err != nil {
+		return 0, fmt.Errorf("read forwarded port: %v", err)
+	}
+	return int(binary.BigEndian.Uint16(port[:])), nil
+}
+
+// serveRemoteForward listens on port requested in control stream, if policy allows it.
+func (s *Server) serveRemoteForward(stream io.ReadWriteCloser, r *bufio.Reader, peer Peer) {
+	defer stream.Close()
+	port, err := ReadForwardedPort(r)
+	if err != nil {
+		return
+	}
+	if peer.OpenStream == nil || port == 0 || !s.forwardAllowed(peer.Client, port) {
+		log.Warnf("proxy: server: client %s: remote forward of port %d denied", clientName(peer.Client), port)
+		_, _ = stream.Write([]byte{forwardDenied})
+		return
+	}
+	if !s.reserveForward(peer.Client, port) {
+		log.Warnf("proxy: server: client %s: remote forward of port %d denied, port is forwarded by another client",
+			clientName(peer.Client), port)
+		_, _ = stream.Write([]byte{forwardInUse})
+		return
+	}
+	defer s.releaseForward(port)
+	listener, err := net.Listen("tcp", net.JoinHostPort(s.forwardBind, strconv.Itoa(port)))
+	if err != nil {
+		log.Warnf("proxy: server: client %s: remote forward: %v", clientName(peer.Client), err)
+		_, _ = stream.Write([]byte{forwardFailed})
+		return
+	}
+	defer listener.Close()
+	_, err = stream.Write([]byte{forwardOK})
+	if err != nil {
+		return
+	}
+	log.Infof("proxy: server: client %s: forwarding %s", clientName(peer.Client), listener.Addr())
+
+	// control stream carries nothing more, its end closes listener
+	go func() {
+		_, _ = io.Copy(io.Discard, r)
+		_ = listener.Close()
+	}()
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		go s.forwardConn(conn, port, peer)
+	}
+}
+
+// forwardOwner is a client forwarding port, with number of its requests of the port.
+type forwardOwner struct {
+	client   string
+	requests int
+}
+
+// forwardAllowed reports whether client may forward port, by its own ports if they are configured.
+func (s *Server) forwardAllowed(client string, port int) bool {
+	ports, ok := s.forwardClientPorts[client]
+	if !ok {
+		ports = s.forwardPorts
+	}
+	return containsPort(ports, port)
+}
+
+// reserveForward marks port as forwarded by client, unless another client forwards it.
+// Client may request its port again, e.g. from a new session, then listener decides.
+func (s *Server) reserveForward(client string, port int) bool {
+	s.forwardsLock.Lock()
+	defer s.forwardsLock.Unlock()
+	owner, ok := s.forwards[port]
+	if ok && owner.client != client {
+		return false
+	}
+	s.forwards[port] = forwardOwner{client: client, requests: owner.requests + 1}
+	return true
+}
+
+// releaseForward undoes reserveForward of client.
+func (s *Server) releaseForward(port int) {
+	s.forwardsLock.Lock()
+	defer s.forwardsLock.Unlock()
+	owner := s.forwards[port]
+	owner.requests--
+	if owner.requests <= 0 {
+		delete(s.forwards, port)
+	} else {
+		s.forwards[port] = owner
+	}
+}
+
+// forwardConn passes connection accepted by remote forward to client.
+func (s *Server) forwardConn(conn net.Conn, port int, peer Peer) {
+	ctx, cancel := context.WithTimeout(context.Background(), forwardOpenTimeout)
+	defer cancel()
+	stream, err := peer.OpenStream(ctx)
+	if err != nil {
+		log.Warnf("proxy: server: client %s: open remote forward stream: %v", clientName(peer.Client), err)
+		_ = conn.Close()
+		return
+	}
+	_, err = stream.Write([]byte{byte(port >> 8), byte(port)})
+	if err != nil {
+		_ = conn.Close()
+		_ = stream.Close()
+		return
+	}
+	pipe(conn, stream)
+}
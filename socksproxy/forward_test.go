@@ -0,0 +1,182 @@
+package socksproxy
+
+import (
+	"context"
+	"io"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/pymq/demhack4/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newEchoListener(t *testing.T) net.Listener {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				_, _ = io.Copy(conn, conn)
+				_ = conn.Close()
+			}()
+		}
+	}()
+	return listener
+}
+
+func freePort(t *testing.T) int {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer listener.Close()
+	return listener.Addr().(*net.TCPAddr).Port
+}
+
+func TestDial(t *testing.T) {
+	echo := newEchoListener(t)
+	server, err := NewServer(ServerOptions{Egress: config.Egress{AllowPrivate: true}})
+	require.NoError(t, err)
+	defer server.Close()
+
+	stream, serverStream := net.Pipe()
+	defer stream.Close()
+	server.ServeConn(serverStream, Peer{})
+	require.NoError(t, Dial(stream, echo.Addr().String()))
+	_, err = stream.Write([]byte("ping"))
+	require.NoError(t, err)
+	buf := make([]byte, 4)
+	_, err = io.ReadFull(stream, buf)
+	require.NoError(t, err)
+	assert.Equal(t, "ping", string(buf))
+
+	denied, err := NewServer(ServerOptions{})
+	require.NoError(t, err)
+	defer denied.Close()
+	stream, serverStream = net.Pipe()
+	defer stream.Close()
+	denied.ServeConn(serverStream, Peer{})
+	assert.Error(t, Dial(stream, echo.Addr().String()), "private address should be denied")
+}
+
+func TestRemoteForward(t *testing.T) {
+	echo := newEchoListener(t)
+	port := freePort(t)
+	server, err := NewServer(ServerOptions{RemoteForward: config.RemoteForward{Ports: []string{strconv.Itoa(port)}}})
+	require.NoError(t, err)
+	defer server.Close()
+
+	// client side connects streams opened by server to echo server
+	peer := Peer{OpenStream: func(ctx context.Context) (io.ReadWriteCloser, error) {
+		stream, clientStream := net.Pipe()
+		go func() {
+			forwarded, err := ReadForwardedPort(clientStream)
+			if !assert.NoError(t, err) || !assert.Equal(t, port, forwarded) {
+				_ = clientStream.Close()
+				return
+			}
+			conn, err := net.Dial("tcp", echo.Addr().String())
+			if !assert.NoError(t, err) {
+				_ = clientStream.Close()
+				return
+			}
+			pipe(clientStream, conn)
+		}()
+		return stream, nil
+	}}
+
+	ctrl, serverCtrl := net.Pipe()
+	server.ServeConn(serverCtrl, peer)
+	require.NoError(t, RequestRemoteForward(ctrl, port))
+
+	addr := net.JoinHostPort("127.0.0.1", strconv.Itoa(port))
+	conn, err := net.Dial("tcp", addr)
+	require.NoError(t, err)
+	defer conn.Close()
+	_, err = conn.Write([]byte("ping"))
+	require.NoError(t, err)
+	buf := make([]byte, 4)
+	require.NoError(t, conn.SetReadDeadline(time.Now().Add(5*time.Second)))
+	_, err = io.ReadFull(conn, buf)
+	require.NoError(t, err)
+	assert.Equal(t, "ping", string(buf))
+
+	// closing control stream stops listener
+	require.NoError(t, ctrl.Close())
+	require.Eventually(t, func() bool {
+		conn, err := net.Dial("tcp", addr)
+		if err == nil {
+			_ = conn.Close()
+		}
+		return err != nil
+	}, 5*time.Second, 10*time.Millisecond)
+}
+
+func TestRemoteForwardDenied(t *testing.T) {
+	port := freePort(t)
+	server, err := NewServer(ServerOptions{RemoteForward: config.RemoteForward{Ports: []string{strconv.Itoa(port + 1)}}})
+	require.NoError(t, err)
+	defer server.Close()
+	peer := Peer{OpenStream: func(ctx context.Context) (io.ReadWriteCloser, error) {
+		t.Error("stream shouldn't be opened")
+		return nil, io.EOF
+	}}
+
+	ctrl, serverCtrl := net.Pipe()
+	defer ctrl.Close()
+	server.ServeConn(serverCtrl, peer)
+	assert.ErrorIs(t, RequestRemoteForward(ctrl, port), ErrForwardDenied)
+
+	// session which can't open streams can't forward
+	ctrl, serverCtrl = net.Pipe()
+	defer ctrl.Close()
+	server.ServeConn(serverCtrl, Peer{})
+	assert.ErrorIs(t, RequestRemoteForward(ctrl, port+1), ErrForwardDenied)
+}
+
+func TestRemoteForwardClients(t *testing.T) {
+	port := freePort(t)
+	reserved := freePort(t)
+	server, err := NewServer(ServerOptions{RemoteForward: config.RemoteForward{
+		Ports:       []string{strconv.Itoa(port)},
+		ClientPorts: map[string][]string{"owner": {strconv.Itoa(reserved)}},
+	}})
+	require.NoError(t, err)
+	defer server.Close()
+	openStream := func(ctx context.Context) (io.ReadWriteCloser, error) {
+		return nil, io.EOF
+	}
+	request := func(client string, port int) (net.Conn, error) {
+		ctrl, serverCtrl := net.Pipe()
+		t.Cleanup(func() { _ = ctrl.Close() })
+		server.ServeConn(serverCtrl, Peer{Client: client, OpenStream: openStream})
+		return ctrl, RequestRemoteForward(ctrl, port)
+	}
+
+	// ports of client replace common ones
+	_, err = request("other", reserved)
+	assert.ErrorIs(t, err, ErrForwardDenied)
+	_, err = request("owner", port)
+	assert.ErrorIs(t, err, ErrForwardDenied)
+	_, err = request("owner", reserved)
+	assert.NoError(t, err)
+
+	// port forwarded by one client isn't given to another until the forward ends
+	ctrl, err := request("first", port)
+	require.NoError(t, err)
+	_, err = request("second", port)
+	assert.ErrorIs(t, err, ErrForwardInUse)
+	require.NoError(t, ctrl.Close())
+	require.Eventually(t, func() bool {
+		ctrl, serverCtrl := net.Pipe()
+		defer ctrl.Close()
+		server.ServeConn(serverCtrl, Peer{Client: "second", OpenStream: openStream})
+		return RequestRemoteForward(ctrl, port) == nil
+	}, 5*time.Second, 10*time.Millisecond)
+}
@@ -0,0 +1,123 @@
+package socksproxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// pacRule is a routing rule in PAC script, address matches when rule has no domains and nets.
+type pacRule struct {
+	Proxy   string      `json:"proxy"`
+	Domains []string    `json:"domains"`
+	Nets    [][2]string `json:"nets"`
+	Ports   [][2]int    `json:"ports"`
+}
+
+const pacScript = `var rules = %s;
+
+function portOf(url) {
+  var m = /^[a-z][a-z0-9+.-]*:\/\/(?:[^@\/]*@)?(?:\[[^\]]*\]|[^:\/]*)(?::(\d+))?/i.exec(url);
+  if (m && m[1]) return parseInt(m[1], 10);
+  return /^(https|wss):/i.test(url) ? 443 : 80;
+}
+
+function matchAddr(rule, host, ip) {
+  if (rule.domains.length == 0 && rule.nets.length == 0) return true;
+  for (var i = 0; i < rule.domains.length; i++) {
+    if (host == rule.domains[i] || dnsDomainIs(host, "." + rule.domains[i])) return true;
+  }
+  if (!ip) return false;
+  for (var i = 0; i < rule.nets.length; i++) {
+    if (isInNet(ip, rule.nets[i][0], rule.nets[i][1])) return true;
+  }
+  return false;
+}
+
+function matchPort(rule, port) {
+  if (rule.ports.length == 0) return true;
+  for (var i = 0; i < rule.ports.length; i++) {
+    if (port >= rule.ports[i][0] && port <= rule.ports[i][1]) return true;
+  }
+  return false;
+}
+
+function FindProxyForURL(url, host) {
+  host = host.toLowerCase();
+  var port = portOf(url);
+  var ip = /^\d+\.\d+\.\d+\.\d+$/.test(host) ? host : %s;
+  for (var i = 0; i < rules.length; i++) {
+    if (matchAddr(rules[i], host, ip) && matchPort(rules[i], port)) return rules[i].proxy;
+  }
+  return %q;
+}
+`
+
+// PAC returns proxy auto-config script, which applies routing rules in browser: destinations
+// routed through tunnel or blocked go to proxy listener at proxyAddr, which blocks them by the same rules.
+// PAC can't match IPv6 networks, they are skipped, and rules left without criteria are dropped.
+func (r *Router) PAC(proxyAddr string) string {
+	proxy := fmt.Sprintf("SOCKS5 %s; PROXY %s", proxyAddr, proxyAddr)
+	result := func(route string) string {
+		if route == RouteDirect {
+			return "DIRECT"
+		}
+		return proxy
+	}
+
+	rules := make([]pacRule, 0, len(r.rules))
+	for _, rr := range r.rules {
+		pr := pacRule{
+			Proxy:   result(rr.route),
+			Domains: append([]string{}, rr.domains...),
+			Nets:    [][2]string{},
+			Ports:   [][2]int{},
+		}
+		for _, network := range rr.networks {
+			if ip4 := network.IP.To4(); ip4 != nil && len(network.Mask) == net.IPv4len {
+				pr.Nets = append(pr.Nets, [2]string{ip4.String(), net.IP(network.Mask).String()})
+			}
+		}
+		if len(pr.Domains) == 0 && len(pr.Nets) == 0 && len(rr.networks) > 0 {
+			continue
+		}
+		for _, ports := range rr.ports {
+			pr.Ports = append(pr.Ports, [2]int{ports.from, ports.to})
+		}
+		rules = append(rules, pr)
+	}
+	data, _ := json.Marshal(rules)
+
+	resolve := "null"
+	if r.resolve {
+		resolve = "dnsResolve(host)"
+	}
+	return fmt.Sprintf(pacScript, data, resolve, result(r.defaultRoute))
+}
+
+// PACHandler serves PAC script for proxy listener at listenAddr.
+func (r *Router) PACHandler(listenAddr string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "application/x-ns-proxy-autoconfig")
+		_, _ = io.WriteString(w, r.PAC(pacProxyAddr(listenAddr, req.Host)))
+	})
+}
+
+// pacProxyAddr returns address of proxy listener for PAC, which is fetched from host:
+// unspecified listener host is replaced by host.
+func pacProxyAddr(listenAddr, host string) string {
+	listenHost, port, err := net.SplitHostPort(listenAddr)
+	if err != nil {
+		return listenAddr
+	}
+	if ip := net.ParseIP(listenHost); listenHost != "" && (ip == nil || !ip.IsUnspecified()) {
+		return listenAddr
+	}
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	return net.JoinHostPort(strings.Trim(host, "[]"), port)
+}
@@ -0,0 +1,238 @@
+package socksproxy
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/pymq/demhack4/config"
+)
+
+const (
+	ActionAllow = "allow"
+	ActionDeny  = "deny"
+)
+
+// Destination is a target of proxied connection. Name is empty for IP destinations,
+// IP is nil for names which are not resolved locally.
+type Destination struct {
+	Name string
+	IP   net.IP
+	Port int
+}
+
+func (d Destination) String() string {
+	host := d.Name
+	if d.IP != nil {
+		if host != "" {
+			host += " (" + d.IP.String() + ")"
+		} else {
+			host = d.IP.String()
+		}
+	}
+	return fmt.Sprintf("%s:%d", host, d.Port)
+}
+
+// Policy decides which destinations clients may connect to.
+type Policy struct {
+	rules       []rule
+	clientRules map[string][]rule
+	defaults    []rule
+}
+
+type rule struct {
+	allow    bool
+	networks []*net.IPNet
+	domains  []string
+	ports    []portRange
+	desc     string
+}
+
+type portRange struct {
+	from, to int
+}
+
+// NewPolicy parses egress rules of config.
+func NewPolicy(cfg config.Egress) (*Policy, error) {
+	p := &Policy{clientRules: map[string][]rule{}}
+	var err error
+	p.rules, err = parseRules(cfg.Rules, "rule")
+	if err != nil {
+		return nil, err
+	}
+	for client, rules := range cfg.ClientRules {
+		p.clientRules[client], err = parseRules(rules, "client rule")
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if !cfg.AllowPrivate {
+		p.defaults, err = parseRules([]config.EgressRule{
+			{Action: ActionDeny, Networks: config.DefaultDeniedNetworks, Domains: config.DefaultDeniedDomains},
+			{Action: ActionDeny, Ports: config.DefaultDeniedPorts},
+		}, "default rule")
+		if err != nil {
+			return nil, err
+		}
+	}
+	return p, nil
+}
+
+func parseRules(rules []config.EgressRule, kind string) ([]rule, error) {
+	parsed := make([]rule, 0, len(rules))
+	for i, r := range rules {
+		pr, err := parseRule(r)
+		if err != nil {
+			return nil, fmt.Errorf("proxy: egress %s %d: %v", kind, i+1, err)
+		}
+		pr.desc = fmt.Sprintf("%s %d", kind, i+1)
+		parsed = append(parsed, pr)
+	}
+	return parsed, nil
+}
+
+func parseRule(r config.EgressRule) (rule, error) {
+	var allow bool
+	switch r.Action {
+	case ActionAllow:
+		allow = true
+	case ActionDeny:
+	default:
+		return rule{}, fmt.Errorf("invalid action '%s'", r.Action)
+	}
+	pr, err := parseMatch(r.Networks, r.Domains, r.Ports)
+	pr.allow = allow
+	return pr, err
+}
+
+// parseMatch parses criteria of rule: networks, domains and ports.
+func parseMatch(networks, domains, ports []string) (rule, error) {
+	var pr rule
+	for _, network := range networks {
+		ipNet, err := parseNetwork(network)
+		if err != nil {
+			return rule{}, err
+		}
+		pr.networks = append(pr.networks, ipNet)
+	}
+
+	for _, domain := range domains {
+		domain = strings.ToLower(strings.Trim(domain, "."))
+		if domain == "" {
+			return rule{}, fmt.Errorf("empty domain")
+		}
+		pr.domains = append(pr.domains, domain)
+	}
+
+	var err error
+	pr.ports, err = parsePorts(ports)
+	if err != nil {
+		return rule{}, err
+	}
+	return pr, nil
+}
+
+// parseNetwork parses CIDR or IP address, which is a network of one address.
+func parseNetwork(network string) (*net.IPNet, error) {
+	if !strings.Contains(network, "/") {
+		ip := net.ParseIP(network)
+		if ip == nil {
+			return nil, fmt.Errorf("invalid network '%s'", network)
+		}
+		bits := 8 * net.IPv6len
+		if ip.To4() != nil {
+			ip, bits = ip.To4(), 8*net.IPv4len
+		}
+		return &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}, nil
+	}
+	_, ipNet, err := net.ParseCIDR(network)
+	if err != nil {
+		return nil, fmt.Errorf("invalid network '%s'", network)
+	}
+	return ipNet, nil
+}
+
+// parsePorts parses ports and ranges like "8000-8080".
+func parsePorts(ports []string) ([]portRange, error) {
+	ranges := make([]portRange, 0, len(ports))
+	for _, p := range ports {
+		from, to, isRange := strings.Cut(p, "-")
+		if !isRange {
+			to = from
+		}
+		fromPort, err1 := strconv.Atoi(from)
+		toPort, err2 := strconv.Atoi(to)
+		if err1 != nil || err2 != nil || fromPort < 1 || toPort > 65535 || fromPort > toPort {
+			return nil, fmt.Errorf("invalid ports '%s'", p)
+		}
+		ranges = append(ranges, portRange{from: fromPort, to: toPort})
+	}
+	return ranges, nil
+}
+
+// Allow checks destination for client with given public key. It returns description
+// of the rule which made decision, empty if no rule matched.
+func (p *Policy) Allow(client string, dest Destination) (bool, string) {
+	for _, rules := range [][]rule{p.clientRules[client], p.rules, p.defaults} {
+		for _, r := range rules {
+			if r.match(dest) {
+				return r.allow, r.desc
+			}
+		}
+	}
+	return true, ""
+}
+
+// hasNetworks reports if rules, which apply to client, match destinations by networks.
+func (p *Policy) hasNetworks(client string) bool {
+	for _, rules := range [][]rule{p.clientRules[client], p.rules, p.defaults} {
+		for _, r := range rules {
+			if len(r.networks) > 0 {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (r rule) match(dest Destination) bool {
+	return r.matchAddr(dest) && r.matchPort(dest.Port)
+}
+
+func (r rule) matchAddr(dest Destination) bool {
+	if len(r.networks) == 0 && len(r.domains) == 0 {
+		return true
+	}
+	if dest.IP != nil {
+		for _, network := range r.networks {
+			if network.Contains(dest.IP) {
+				return true
+			}
+		}
+	}
+	name := strings.ToLower(strings.TrimSuffix(dest.Name, "."))
+	if name == "" {
+		return false
+	}
+	for _, domain := range r.domains {
+		if name == domain || strings.HasSuffix(name, "."+domain) {
+			return true
+		}
+	}
+	return false
+}
+
+func (r rule) matchPort(port int) bool {
+	return len(r.ports) == 0 || containsPort(r.ports, port)
+}
+
+func containsPort(ranges []portRange, port int) bool {
+	for _, pr := range ranges {
+		if port >= pr.from && port <= pr.to {
+			return true
+		}
+	}
+	return false
+}
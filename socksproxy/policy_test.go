@@ -0,0 +1,205 @@
+package socksproxy
+
+import (
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"testing"
+
+	"github.com/haxii/socks5"
+	"github.com/pymq/demhack4/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/dns/dnsmessage"
+	"golang.org/x/net/proxy"
+)
+
+func TestPolicy(t *testing.T) {
+	p, err := NewPolicy(config.Egress{
+		Rules: []config.EgressRule{
+			{Action: ActionAllow, Networks: []string{"10.1.2.3"}, Ports: []string{"8080"}},
+			{Action: ActionDeny, Domains: []string{"Blocked.example"}},
+			{Action: ActionDeny, Ports: []string{"6660-6669"}},
+		},
+		ClientRules: map[string][]config.EgressRule{
+			"age1admin": {{Action: ActionAllow, Networks: []string{"192.168.0.0/16"}}},
+		},
+	})
+	require.NoError(t, err)
+
+	for _, tc := range []struct {
+		client  string
+		dest    Destination
+		allowed bool
+	}{
+		{dest: Destination{IP: net.ParseIP("1.1.1.1"), Port: 443}, allowed: true},
+		{dest: Destination{Name: "example.com", Port: 443}, allowed: true},
+		{dest: Destination{IP: net.ParseIP("127.0.0.1"), Port: 80}},
+		{dest: Destination{IP: net.ParseIP("::ffff:127.0.0.1"), Port: 80}},
+		{dest: Destination{IP: net.ParseIP("::1"), Port: 80}},
+		{dest: Destination{IP: net.ParseIP("169.254.169.254"), Port: 80}},
+		{dest: Destination{Name: "localhost", Port: 80}},
+		{dest: Destination{Name: "example.com", IP: net.ParseIP("10.0.0.1"), Port: 443}},
+		{dest: Destination{IP: net.ParseIP("1.1.1.1"), Port: 25}},
+		{dest: Destination{IP: net.ParseIP("10.1.2.3"), Port: 8080}, allowed: true},
+		{dest: Destination{IP: net.ParseIP("10.1.2.3"), Port: 8081}},
+		{dest: Destination{Name: "blocked.example", Port: 443}},
+		{dest: Destination{Name: "www.blocked.example.", Port: 443}},
+		{dest: Destination{Name: "notblocked.example", Port: 443}, allowed: true},
+		{dest: Destination{IP: net.ParseIP("1.1.1.1"), Port: 6667}},
+		{dest: Destination{IP: net.ParseIP("192.168.1.1"), Port: 80}},
+		{client: "age1admin", dest: Destination{IP: net.ParseIP("192.168.1.1"), Port: 80}, allowed: true},
+		{client: "age1admin", dest: Destination{Name: "blocked.example", Port: 443}},
+	} {
+		allowed, _ := p.Allow(tc.client, tc.dest)
+		assert.Equal(t, tc.allowed, allowed, "%s %s", tc.client, tc.dest)
+	}
+
+	p, err = NewPolicy(config.Egress{AllowPrivate: true})
+	require.NoError(t, err)
+	allowed, _ := p.Allow("", Destination{IP: net.ParseIP("127.0.0.1"), Port: 25})
+	assert.True(t, allowed)
+}
+
+func TestPolicyInvalidRules(t *testing.T) {
+	for _, r := range []config.EgressRule{
+		{Action: "permit"},
+		{Action: ActionDeny, Networks: []string{"10.0.0.0/33"}},
+		{Action: ActionDeny, Networks: []string{"example.com"}},
+		{Action: ActionDeny, Domains: []string{"."}},
+		{Action: ActionDeny, Ports: []string{"0"}},
+		{Action: ActionDeny, Ports: []string{"100-10"}},
+		{Action: ActionDeny, Ports: []string{"70000"}},
+	} {
+		_, err := NewPolicy(config.Egress{Rules: []config.EgressRule{r}})
+		assert.Error(t, err, "%+v", r)
+	}
+}
+
+func TestServerDeniesPrivateDestination(t *testing.T) {
+	target, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer target.Close()
+
+	server, err := NewServer(ServerOptions{})
+	require.NoError(t, err)
+	defer server.Close()
+	client, err := NewClient("127.0.0.1:0")
+	require.NoError(t, err)
+	defer client.Close()
+	go func() {
+		for conn := range client.ConnsChan() {
+			server.ServeConn(conn, Peer{})
+		}
+	}()
+
+	dialer, err := proxy.SOCKS5("tcp", client.listener.Addr().String(), nil, nil)
+	require.NoError(t, err)
+	_, err = dialer.Dial("tcp", target.Addr().String())
+	assert.ErrorContains(t, err, "not allowed by ruleset")
+
+	_, err = server.dial(context.Background(), "", "tcp", net.JoinHostPort("localhost", "80"))
+	assert.ErrorIs(t, err, errDenied)
+}
+
+func TestUnrestrictedServer(t *testing.T) {
+	egress := config.Egress{Rules: []config.EgressRule{{Action: ActionDeny, Networks: []string{"0.0.0.0/0"}}}}
+	server, err := NewServer(ServerOptions{Egress: egress, Unrestricted: true})
+	require.NoError(t, err)
+	defer server.Close()
+	for _, dest := range []Destination{
+		{IP: net.IPv4(93, 184, 216, 34), Port: 25},
+		{IP: net.IPv4(127, 0, 0, 1), Port: 22},
+		{Name: "localhost", Port: 80},
+	} {
+		allowed, _ := server.policy.Allow("", dest)
+		assert.True(t, allowed, "%v", dest)
+	}
+}
+
+// listenLoopbackDNS answers A queries for any name with 127.0.0.1, over TCP only.
+func listenLoopbackDNS(t *testing.T) net.Listener {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = l.Close() })
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				for {
+					var l [2]byte
+					if _, err := io.ReadFull(conn, l[:]); err != nil {
+						return
+					}
+					query := make([]byte, binary.BigEndian.Uint16(l[:]))
+					if _, err := io.ReadFull(conn, query); err != nil {
+						return
+					}
+					var msg dnsmessage.Message
+					if err := msg.Unpack(query); err != nil || len(msg.Questions) != 1 {
+						return
+					}
+					msg.Header.Response = true
+					q := msg.Questions[0]
+					if q.Type == dnsmessage.TypeA {
+						msg.Answers = []dnsmessage.Resource{{
+							Header: dnsmessage.ResourceHeader{Name: q.Name, Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET, TTL: 60},
+							Body:   &dnsmessage.AResource{A: [4]byte{127, 0, 0, 1}},
+						}}
+					}
+					answer, err := msg.Pack()
+					if err != nil {
+						return
+					}
+					binary.BigEndian.PutUint16(l[:], uint16(len(answer)))
+					if _, err := conn.Write(append(l[:], answer...)); err != nil {
+						return
+					}
+				}
+			}()
+		}
+	}()
+	return l
+}
+
+func TestServerChecksNamesPassedToUpstream(t *testing.T) {
+	target := listenBanner(t)
+	_, port, _ := net.SplitHostPort(target.Addr().String())
+	dns := listenLoopbackDNS(t)
+
+	upstreamServer, err := socks5.New(&socks5.Config{Resolver: staticResolver{}})
+	require.NoError(t, err)
+	upstream, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer upstream.Close()
+	go func() { _ = upstreamServer.Serve(upstream) }()
+
+	egress := config.Egress{Upstream: "socks5://" + upstream.Addr().String(), DNSServers: []string{dns.Addr().String()}}
+	server, err := NewServer(ServerOptions{Egress: egress})
+	require.NoError(t, err)
+	defer server.Close()
+
+	// name of loopback address is denied by default rules, though upstream resolves it
+	_, err = server.dial(context.Background(), "", "tcp", net.JoinHostPort("internal.example.com", port))
+	assert.ErrorIs(t, err, errDenied)
+
+	egress.AllowPrivate = true
+	server, err = NewServer(ServerOptions{Egress: egress})
+	require.NoError(t, err)
+	defer server.Close()
+	conn, err := server.dial(context.Background(), "", "tcp", net.JoinHostPort("internal.example.com", port))
+	require.NoError(t, err)
+	_ = conn.Close()
+}
+
+// staticResolver resolves every name to 127.0.0.1, like upstream proxy with its own resolver.
+type staticResolver struct{}
+
+func (staticResolver) Resolve(ctx context.Context, _ string) (context.Context, net.IP, error) {
+	return ctx, net.IPv4(127, 0, 0, 1), nil
+}
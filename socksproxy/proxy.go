@@ -1,55 +1,356 @@
 package socksproxy
 
 import (
+	"bufio"
+	"context"
 	"errors"
+	"fmt"
 	"io"
 	"net"
+	"strconv"
 	"sync"
+	"time"
 
 	"github.com/haxii/socks5"
+	"github.com/pymq/demhack4/config"
+	"github.com/pymq/demhack4/dnsproxy"
+	"github.com/pymq/demhack4/encoding"
 	log "github.com/sirupsen/logrus"
 )
 
+var errDenied = errors.New("denied by egress policy")
+
 type Server struct {
-	socks     *socks5.Server
-	conns     map[net.Conn]struct{}
-	connsLock sync.Mutex
+	dialer      Dialer
+	dialTimeout time.Duration
+	policy      *Policy
+	// resolver resolves names to check their addresses by policy
+	resolver *net.Resolver
+	// upstream is set if connections go through upstream proxy, names are passed to it after check
+	upstream bool
+	// bindIP is source address of relayed datagrams, nil if any
+	bindIP net.IP
+	dns    *dnsproxy.Server
+	// forwardPorts may be exposed by remote forwards on forwardBind,
+	// forwardClientPorts replace them for clients with given public keys
+	forwardPorts       []portRange
+	forwardClientPorts map[string][]portRange
+	forwardBind        string
+	// forwards are clients of forwarded ports
+	forwards     map[int]forwardOwner
+	forwardsLock sync.Mutex
+	conns        map[net.Conn]struct{}
+	connsLock    sync.Mutex
+}
+
+type ServerOptions struct {
+	Egress        config.Egress
+	RemoteForward config.RemoteForward
+	// Dialer overrides dialer created from Egress config
+	Dialer Dialer
+	// Unrestricted skips egress rules, including default denials, e.g. for direct routes of client itself
+	Unrestricted bool
+}
+
+// Peer is client side of tunnel session, which served streams come from.
+type Peer struct {
+	// Client is public key of client
+	Client string
+	// OpenStream opens stream to client, nil if session can't do it
+	OpenStream func(ctx context.Context) (io.ReadWriteCloser, error)
+}
+
+func NewServer(opts ServerOptions) (*Server, error) {
+	config.SetEgressDefaults(&opts.Egress)
+	s := &Server{
+		dialer:      opts.Dialer,
+		dialTimeout: opts.Egress.DialTimeout,
+		conns:       map[net.Conn]struct{}{},
+		forwards:    map[int]forwardOwner{},
+	}
+	var err error
+	if s.dialer == nil {
+		s.dialer, err = NewDialer(opts.Egress)
+		if err != nil {
+			return nil, err
+		}
+	}
+	s.bindIP, err = bindIP(opts.Egress)
+	if err != nil {
+		return nil, err
+	}
+	if opts.Unrestricted {
+		s.policy = &Policy{clientRules: map[string][]rule{}}
+	} else {
+		s.policy, err = NewPolicy(opts.Egress)
+		if err != nil {
+			return nil, err
+		}
+	}
+	s.forwardPorts, err = parsePorts(opts.RemoteForward.Ports)
+	if err != nil {
+		return nil, fmt.Errorf("proxy: remote forward: %v", err)
+	}
+	s.forwardClientPorts = map[string][]portRange{}
+	for client, ports := range opts.RemoteForward.ClientPorts {
+		s.forwardClientPorts[client], err = parsePorts(ports)
+		if err != nil {
+			return nil, fmt.Errorf("proxy: remote forward of client %s: %v", clientName(client), err)
+		}
+	}
+	s.forwardBind = opts.RemoteForward.BindAddr
+	if s.forwardBind == "" {
+		s.forwardBind = "127.0.0.1"
+	}
+	s.upstream = opts.Egress.Upstream != ""
+	if len(opts.Egress.DNSServers) > 0 {
+		dial := (&net.Dialer{Timeout: opts.Egress.DialTimeout}).DialContext
+		if s.upstream {
+			// stream connection makes resolver use DNS over TCP
+			dial = func(ctx context.Context, _, addr string) (net.Conn, error) {
+				return s.dialer.DialContext(ctx, "tcp", addr)
+			}
+		}
+		s.resolver, err = newResolver(opts.Egress.DNSServers, dial)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		s.resolver = net.DefaultResolver
+	}
+	s.dns = dnsproxy.NewServer(dnsproxy.ServerOptions{
+		Servers: opts.Egress.DNSServers,
+		Dial:    s.dialDNS(s.upstream),
+		TCPOnly: s.upstream,
+		Timeout: opts.Egress.DialTimeout,
+	})
+	return s, nil
+}
+
+// dialDNS returns dialer of resolvers: through upstream proxy, or direct from bind address.
+func (s *Server) dialDNS(upstream bool) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	if upstream {
+		return s.dialer.DialContext
+	}
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		d := &net.Dialer{}
+		if s.bindIP != nil && network == "udp" {
+			d.LocalAddr = &net.UDPAddr{IP: s.bindIP}
+		} else if s.bindIP != nil {
+			d.LocalAddr = &net.TCPAddr{IP: s.bindIP}
+		}
+		return d.DialContext(ctx, network, addr)
+	}
 }
 
-func NewServer() *Server {
+// socksServer creates SOCKS server for connection of client with given public key.
+func (s *Server) socksServer(client string) (*socks5.Server, error) {
 	conf := &socks5.Config{
-		// we don't bind address for server
-		BindIP:   net.IPv4(127, 0, 0, 1),
-		BindPort: 8000,
+		// names are resolved on dial, so they can be checked by policy or passed to upstream proxy
+		Resolver: passthroughResolver{},
+		Rules:    clientRules{server: s, client: client},
+		Logger:   logger{},
+		Dial: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			return s.dial(ctx, client, network, addr)
+		},
 	}
 	server, err := socks5.New(conf)
 	if err != nil {
-		panic(err)
+		return nil, fmt.Errorf("proxy: create socks5 server: %v", err)
+	}
+	return server, nil
+}
+
+// dial checks destination by policy and connects to it, limiting the whole connection setup
+// including upstream handshake. Names are resolved and dialed by checked address, or passed
+// to upstream proxy after check.
+func (s *Server) dial(ctx context.Context, client, network, addr string) (net.Conn, error) {
+	ctx, cancel := context.WithTimeout(ctx, s.dialTimeout)
+	defer cancel()
+
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid port '%s'", portStr)
 	}
 
-	return &Server{
-		socks: server,
-		conns: map[net.Conn]struct{}{},
+	if ip := net.ParseIP(host); ip == nil && s.upstream {
+		err = s.checkName(ctx, client, host, port)
+		if err != nil {
+			return nil, err
+		}
+		return s.dialer.DialContext(ctx, network, addr)
 	}
+
+	ip, err := s.lookup(ctx, client, host, port)
+	if err != nil {
+		return nil, err
+	}
+	return s.dialer.DialContext(ctx, network, net.JoinHostPort(ip.String(), portStr))
 }
 
-func (s *Server) ServeConn(ioConn io.ReadWriteCloser) {
+// lookup resolves host and returns its first address allowed by policy.
+func (s *Server) lookup(ctx context.Context, client, host string, port int) (net.IP, error) {
+	if ip := net.ParseIP(host); ip != nil {
+		if !s.allow(client, Destination{IP: ip, Port: port}) {
+			return nil, errDenied
+		}
+		return ip, nil
+	}
+	ips, err := s.resolver.LookupIP(ctx, "ip", host)
+	if err != nil {
+		return nil, err
+	}
+	for _, ip := range ips {
+		if s.allow(client, Destination{Name: host, IP: ip, Port: port}) {
+			return ip, nil
+		}
+	}
+	return nil, errDenied
+}
+
+// checkName checks name, which is passed to upstream proxy, by policy. If policy has network rules,
+// e.g. default ones, name is resolved and all its addresses should be allowed, so name of private
+// address doesn't get through. Names which can't be resolved are denied then.
+func (s *Server) checkName(ctx context.Context, client, host string, port int) error {
+	if !s.allow(client, Destination{Name: host, Port: port}) {
+		return errDenied
+	}
+	if !s.policy.hasNetworks(client) {
+		return nil
+	}
+	ips, err := s.resolver.LookupIP(ctx, "ip", host)
+	if err != nil {
+		log.Warnf("proxy: server: connection of client %s to %s:%d denied, its addresses can't be checked: %v",
+			clientName(client), host, port, err)
+		return fmt.Errorf("%w: resolve name to check its addresses: %v", errDenied, err)
+	}
+	for _, ip := range ips {
+		if !s.allow(client, Destination{Name: host, IP: ip, Port: port}) {
+			return errDenied
+		}
+	}
+	return nil
+}
+
+// allow checks destination by policy and logs denial.
+func (s *Server) allow(client string, dest Destination) bool {
+	allowed, rule := s.policy.Allow(client, dest)
+	if !allowed {
+		log.Warnf("proxy: server: connection of client %s to %s denied by %s", clientName(client), dest, rule)
+	}
+	return allowed
+}
+
+func clientName(client string) string {
+	if client == "" {
+		return "<unknown>"
+	}
+	return encoding.Fingerprint(client)
+}
+
+// clientRules checks SOCKS request by policy before resolving and dialing, to reply with proper error.
+type clientRules struct {
+	server *Server
+	client string
+}
+
+func (r clientRules) Allow(ctx context.Context, req *socks5.Request) (context.Context, bool) {
+	dest := Destination{Name: req.DestAddr.FQDN, IP: req.DestAddr.IP, Port: req.DestAddr.Port}
+	return ctx, r.server.allow(r.client, dest)
+}
+
+// ServeConn serves SOCKS connection, UDP association, DNS stream or remote forward request of peer.
+func (s *Server) ServeConn(ioConn io.ReadWriteCloser, peer Peer) {
+	client := peer.Client
 	conn := ConnWrapper{ReadWriteCloser: ioConn}
+	socks, err := s.socksServer(client)
+	if err != nil {
+		log.Errorf("proxy: server: %v", err)
+		_ = conn.Close()
+		return
+	}
 	s.connsLock.Lock()
 	s.conns[conn] = struct{}{}
 	s.connsLock.Unlock()
 
 	go func() {
-		err := s.socks.ServeConn(conn)
+		defer func() {
+			s.connsLock.Lock()
+			delete(s.conns, conn)
+			s.connsLock.Unlock()
+		}()
+
+		r := bufio.NewReader(ioConn)
+		mark, err := r.Peek(1)
+		if err != nil {
+			_ = conn.Close()
+			return
+		}
+		switch mark[0] {
+		case udpStreamMark:
+			_, _ = r.Discard(1)
+			s.serveUDP(ioConn, r, client)
+			return
+		case dnsproxy.StreamMark:
+			_, _ = r.Discard(1)
+			s.dns.ServeStream(ioConn, r)
+			return
+		case forwardStreamMark:
+			_, _ = r.Discard(1)
+			s.serveRemoteForward(ioConn, r, peer)
+			return
+		}
+
+		err = socks.ServeConn(&bufferedConn{Conn: conn, r: r})
 		if err != nil {
 			log.Warnf("proxy: server: ServeConn: %v", err)
 		}
-		s.connsLock.Lock()
-		delete(s.conns, conn)
-		s.connsLock.Unlock()
 	}()
 }
 
+// ServeDestination connects stream of client directly to destination, which is known without SOCKS request.
+func (s *Server) ServeDestination(ioConn io.ReadWriteCloser, destination, client string) {
+	conn := ConnWrapper{ReadWriteCloser: ioConn}
+	s.connsLock.Lock()
+	s.conns[conn] = struct{}{}
+	s.connsLock.Unlock()
+
+	go func() {
+		defer func() {
+			s.connsLock.Lock()
+			delete(s.conns, conn)
+			s.connsLock.Unlock()
+		}()
+
+		target, err := s.dial(context.Background(), client, "tcp", destination)
+		if err != nil {
+			log.Warnf("proxy: server: connect to %s: %v", destination, err)
+			_ = conn.Close()
+			return
+		}
+		pipe(conn, target)
+	}()
+}
+
+// pipe copies data both ways, until one of sides is closed.
+func pipe(first, second io.ReadWriteCloser) {
+	done := make(chan struct{}, 2)
+	copyConn := func(dst, src io.ReadWriteCloser) {
+		_, _ = io.Copy(dst, src)
+		done <- struct{}{}
+	}
+	go copyConn(first, second)
+	go copyConn(second, first)
+	<-done
+	_ = first.Close()
+	_ = second.Close()
+	<-done
+}
+
 func (s *Server) Close() error {
 	s.connsLock.Lock()
 	defer s.connsLock.Unlock()
@@ -64,6 +365,20 @@ func (s *Server) Close() error {
 	return nil
 }
 
+// passthroughResolver leaves names unresolved for dialer.
+type passthroughResolver struct{}
+
+func (passthroughResolver) Resolve(ctx context.Context, _ string) (context.Context, net.IP, error) {
+	return ctx, nil, nil
+}
+
+// logger passes errors of socks5 library to logrus.
+type logger struct{}
+
+func (logger) Printf(format string, v ...interface{}) {
+	log.Warnf("proxy: server: "+format, v...)
+}
+
 type Client struct {
 	listener net.Listener
 	connsCh  chan net.Conn
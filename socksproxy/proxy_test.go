@@ -6,6 +6,7 @@ import (
 	"net/http"
 	"testing"
 
+	"github.com/pymq/demhack4/config"
 	"github.com/stretchr/testify/require"
 	"golang.org/x/net/proxy"
 )
@@ -15,12 +16,13 @@ import (
 
 func TestProxy(t *testing.T) {
 	const listenAddr = "localhost:8673"
-	socksServer := NewServer()
+	socksServer, err := NewServer(ServerOptions{Egress: config.Egress{AllowPrivate: true}})
+	require.NoError(t, err)
 	socksClient, err := NewClient(listenAddr)
 	require.NoError(t, err)
 	go func() {
 		conn := <-socksClient.ConnsChan()
-		socksServer.ServeConn(conn)
+		socksServer.ServeConn(conn, Peer{})
 	}()
 
 	dialer, err := proxy.SOCKS5("tcp", listenAddr, nil, nil)
@@ -0,0 +1,204 @@
+package socksproxy
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+)
+
+const (
+	socksVersion = 5
+
+	methodNoAuth       byte = 0
+	methodNoAcceptable byte = 0xff
+
+	CommandConnect      byte = 1
+	CommandBind         byte = 2
+	CommandUDPAssociate byte = 3
+
+	addrIPv4   byte = 1
+	addrDomain byte = 3
+	addrIPv6   byte = 4
+
+	ReplySucceeded           byte = 0
+	ReplyGeneralFailure      byte = 1
+	ReplyNotAllowed          byte = 2
+	ReplyCommandNotSupported byte = 7
+)
+
+// Request is proxy request read by client side of tunnel, after the greeting is answered locally.
+// It is passed to server as SOCKS5 request whatever protocol client speaks.
+type Request struct {
+	Command byte
+	Host    string
+	Port    int
+	// User is authenticated name of client, empty if listener has no users
+	User string
+	// Conn is client connection to serve after request, it returns data read ahead first
+	Conn net.Conn
+	// HTTP is set for plain HTTP proxy request, which is forwarded by ForwardHTTP
+	HTTP  *http.Request
+	proto protocol
+	users Users
+	r     *bufio.Reader
+	raw   []byte
+}
+
+// Addr returns destination address of request.
+func (r *Request) Addr() string {
+	return net.JoinHostPort(r.Host, strconv.Itoa(r.Port))
+}
+
+// ReadRequest answers greeting of SOCKS5 client and reads its request. Clients authenticate
+// with username and password if there are users, otherwise only clients offering no
+// authentication are accepted.
+func ReadRequest(conn io.ReadWriter, users Users) (*Request, error) {
+	header := make([]byte, 2)
+	_, err := io.ReadFull(conn, header)
+	if err != nil {
+		return nil, fmt.Errorf("read socks greeting: %v", err)
+	}
+	if header[0] != socksVersion {
+		return nil, fmt.Errorf("unsupported socks version %d", header[0])
+	}
+	methods := make([]byte, header[1])
+	_, err = io.ReadFull(conn, methods)
+	if err != nil {
+		return nil, fmt.Errorf("read socks greeting: %v", err)
+	}
+	required := methodNoAuth
+	if users != nil {
+		required = methodUserPassword
+	}
+	method := methodNoAcceptable
+	for _, m := range methods {
+		if m == required {
+			method = required
+		}
+	}
+	_, err = conn.Write([]byte{socksVersion, method})
+	if err != nil {
+		return nil, fmt.Errorf("write socks method: %v", err)
+	}
+	var user string
+	switch method {
+	case methodNoAcceptable:
+		return nil, fmt.Errorf("socks client doesn't support required auth method %d", required)
+	case methodUserPassword:
+		user, err = users.authenticateSOCKS5(conn)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// request: version, command, reserved, address
+	raw := make([]byte, 3, 32)
+	_, err = io.ReadFull(conn, raw)
+	if err != nil {
+		return nil, fmt.Errorf("read socks request: %v", err)
+	}
+	if raw[0] != socksVersion {
+		return nil, fmt.Errorf("invalid socks request version %d", raw[0])
+	}
+	host, port, addr, err := readAddr(conn)
+	if err != nil {
+		return nil, fmt.Errorf("read socks request: %v", err)
+	}
+	return &Request{Command: raw[1], Host: host, Port: port, User: user, raw: append(raw, addr...)}, nil
+}
+
+// readAddr reads SOCKS5 address type, address and port, returning them with their encoding.
+func readAddr(r io.Reader) (string, int, []byte, error) {
+	buf := make([]byte, 1, 1+1+255+2)
+	_, err := io.ReadFull(r, buf)
+	if err != nil {
+		return "", 0, nil, err
+	}
+	var size int
+	switch buf[0] {
+	case addrIPv4:
+		size = net.IPv4len
+	case addrIPv6:
+		size = net.IPv6len
+	case addrDomain:
+		buf = buf[:2]
+		_, err = io.ReadFull(r, buf[1:])
+		if err != nil {
+			return "", 0, nil, err
+		}
+		size = int(buf[1])
+	default:
+		return "", 0, nil, fmt.Errorf("invalid address type %d", buf[0])
+	}
+	start := len(buf)
+	buf = buf[:start+size+2]
+	_, err = io.ReadFull(r, buf[start:])
+	if err != nil {
+		return "", 0, nil, err
+	}
+
+	host := string(buf[start : start+size])
+	if buf[0] != addrDomain {
+		host = net.IP(buf[start : start+size]).String()
+	}
+	return host, int(binary.BigEndian.Uint16(buf[start+size:])), buf, nil
+}
+
+// appendAddr encodes address in SOCKS5 format.
+func appendAddr(buf []byte, ip net.IP, port int) []byte {
+	if ip4 := ip.To4(); ip4 != nil {
+		buf = append(buf, addrIPv4)
+		buf = append(buf, ip4...)
+	} else {
+		buf = append(buf, addrIPv6)
+		buf = append(buf, ip.To16()...)
+	}
+	return append(buf, byte(port>>8), byte(port))
+}
+
+// appendHostAddr encodes host, which is IP address or domain name, in SOCKS5 format.
+func appendHostAddr(buf []byte, host string, port int) ([]byte, error) {
+	if ip := net.ParseIP(host); ip != nil {
+		return appendAddr(buf, ip, port), nil
+	}
+	if len(host) == 0 || len(host) > 255 {
+		return nil, fmt.Errorf("invalid host '%s'", host)
+	}
+	buf = append(buf, addrDomain, byte(len(host)))
+	buf = append(buf, host...)
+	return append(buf, byte(port>>8), byte(port)), nil
+}
+
+// Forward sends request to SOCKS server on the other side of stream, as if client sent it.
+// Replies of server to the request are left in stream for client.
+func (r *Request) Forward(stream io.ReadWriter) error {
+	_, err := stream.Write(append([]byte{socksVersion, 1, methodNoAuth}, r.raw...))
+	if err != nil {
+		return fmt.Errorf("forward socks request: %v", err)
+	}
+	reply := make([]byte, 2)
+	_, err = io.ReadFull(stream, reply)
+	if err != nil {
+		return fmt.Errorf("read socks method of server: %v", err)
+	}
+	if reply[0] != socksVersion || reply[1] != methodNoAuth {
+		return fmt.Errorf("unexpected socks method of server %d", reply[1])
+	}
+	return nil
+}
+
+// Reply answers request of client with given code and bound address.
+func Reply(conn io.Writer, code byte, bind *net.UDPAddr) error {
+	buf := []byte{socksVersion, code, 0}
+	if bind != nil {
+		buf = appendAddr(buf, bind.IP, bind.Port)
+	} else {
+		buf = appendAddr(buf, net.IPv4zero, 0)
+	}
+	_, err := conn.Write(buf)
+	return err
+}
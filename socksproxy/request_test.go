@@ -0,0 +1,77 @@
+package socksproxy
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"testing"
+
+	"github.com/pymq/demhack4/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/proxy"
+)
+
+func TestRequestForward(t *testing.T) {
+	target, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer target.Close()
+	go func() {
+		conn, err := target.Accept()
+		if err != nil {
+			return
+		}
+		_, _ = io.Copy(conn, conn)
+		_ = conn.Close()
+	}()
+
+	server, err := NewServer(ServerOptions{Egress: config.Egress{AllowPrivate: true}})
+	require.NoError(t, err)
+	defer server.Close()
+	client := serveTunnel(t, server, nil)
+
+	dialer, err := proxy.SOCKS5("tcp", client.listener.Addr().String(), nil, nil)
+	require.NoError(t, err)
+	conn, err := dialer.Dial("tcp", target.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+	_, err = conn.Write([]byte("hello"))
+	require.NoError(t, err)
+	buf := make([]byte, 5)
+	_, err = io.ReadFull(conn, buf)
+	require.NoError(t, err)
+	assert.Equal(t, "hello", string(buf))
+}
+
+// pipelined is client connection with all data sent at once, replies are collected.
+type pipelined struct {
+	io.Reader
+	replies bytes.Buffer
+}
+
+func (p *pipelined) Write(b []byte) (int, error) {
+	return p.replies.Write(b)
+}
+
+func TestReadRequest(t *testing.T) {
+	for _, tc := range []struct {
+		data []byte
+		addr string
+	}{
+		{data: []byte{5, 1, 0, 5, 1, 0, 1, 10, 0, 0, 1, 0, 80}, addr: "10.0.0.1:80"},
+		{data: []byte{5, 2, 2, 0, 5, 1, 0, 3, 3, 'a', '.', 'b', 1, 187}, addr: "a.b:443"},
+		{data: append(append([]byte{5, 1, 0, 5, 3, 0, 4}, net.IPv6loopback...), 0, 53), addr: "[::1]:53"},
+	} {
+		conn := &pipelined{Reader: bytes.NewReader(tc.data)}
+		req, err := ReadRequest(conn, nil)
+		require.NoError(t, err)
+		assert.Equal(t, []byte{5, 0}, conn.replies.Bytes())
+		assert.Equal(t, tc.addr, req.Addr())
+		assert.Equal(t, tc.data[2+tc.data[1]:], req.raw)
+	}
+
+	conn := &pipelined{Reader: bytes.NewReader([]byte{5, 1, 2})}
+	_, err := ReadRequest(conn, nil)
+	assert.Error(t, err, "only username/password auth is offered")
+	assert.Equal(t, []byte{5, 0xff}, conn.replies.Bytes())
+}
@@ -0,0 +1,184 @@
+package socksproxy
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pymq/demhack4/config"
+)
+
+const (
+	RouteTunnel = "tunnel"
+	RouteDirect = "direct"
+	RouteBlock  = "block"
+
+	// routeResolveTimeout limits local lookup of name to match it by networks
+	routeResolveTimeout = 5 * time.Second
+	// routeLookupTTL is how long looked up address of name, or failure, is used for routing
+	routeLookupTTL = time.Minute
+	// maxRouteLookups limits cached lookups, cache is cleared when it is full
+	maxRouteLookups = 4096
+)
+
+// ErrRouteBlocked is returned for destinations blocked by routing rules.
+var ErrRouteBlocked = errors.New("destination is blocked by routing rules")
+
+// Router decides how client connects to destinations of proxy listener: through tunnel, directly or not at all.
+type Router struct {
+	rules        []routeRule
+	defaultRoute string
+	resolve      bool
+	resolver     ipResolver
+	lookupsLock  sync.Mutex
+	lookups      map[string]routeLookup
+	now          func() time.Time
+}
+
+type ipResolver interface {
+	LookupIP(ctx context.Context, network, host string) ([]net.IP, error)
+}
+
+type routeLookup struct {
+	ip      net.IP // nil if name wasn't resolved
+	expires time.Time
+}
+
+type routeRule struct {
+	rule
+	route string
+}
+
+// NewRouter parses routing rules of config, reading their lists.
+func NewRouter(cfg config.Routing) (*Router, error) {
+	r := &Router{
+		defaultRoute: cfg.Default,
+		resolve:      cfg.ResolveNames,
+		resolver:     net.DefaultResolver,
+		lookups:      map[string]routeLookup{},
+		now:          time.Now,
+	}
+	if r.defaultRoute == "" {
+		r.defaultRoute = RouteTunnel
+	}
+	if !validRoute(r.defaultRoute) {
+		return nil, fmt.Errorf("routing: invalid default route '%s'", cfg.Default)
+	}
+	for i, rr := range cfg.Rules {
+		if !validRoute(rr.Route) {
+			return nil, fmt.Errorf("routing: rule %d: invalid route '%s'", i+1, rr.Route)
+		}
+		networks, domains := rr.Networks, rr.Domains
+		for _, path := range rr.Lists {
+			listNetworks, listDomains, err := readRouteList(path)
+			if err != nil {
+				return nil, fmt.Errorf("routing: rule %d: %v", i+1, err)
+			}
+			networks = append(networks[:len(networks):len(networks)], listNetworks...)
+			domains = append(domains[:len(domains):len(domains)], listDomains...)
+		}
+		parsed, err := parseMatch(networks, domains, rr.Ports)
+		if err != nil {
+			return nil, fmt.Errorf("routing: rule %d: %v", i+1, err)
+		}
+		parsed.desc = fmt.Sprintf("route rule %d", i+1)
+		r.rules = append(r.rules, routeRule{rule: parsed, route: rr.Route})
+	}
+	return r, nil
+}
+
+func validRoute(route string) bool {
+	return route == RouteTunnel || route == RouteDirect || route == RouteBlock
+}
+
+// readRouteList reads networks and domains of list file, telling them apart by parsing.
+func readRouteList(path string) ([]string, []string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, nil, fmt.Errorf("read list: %v", err)
+	}
+	defer f.Close()
+
+	var networks, domains []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if _, err := parseNetwork(line); err == nil {
+			networks = append(networks, line)
+		} else {
+			domains = append(domains, line)
+		}
+	}
+	if err = scanner.Err(); err != nil {
+		return nil, nil, fmt.Errorf("read list %s: %v", path, err)
+	}
+	return networks, domains, nil
+}
+
+// Route returns route of destination. Names are matched by networks only if router resolves them,
+// lookup is done only when rule with networks is reached.
+func (r *Router) Route(ctx context.Context, host string, port int) string {
+	if len(r.rules) == 0 {
+		return r.defaultRoute
+	}
+	dest := Destination{Port: port}
+	if ip := net.ParseIP(host); ip != nil {
+		dest.IP = ip
+	} else {
+		dest.Name = host
+	}
+	resolved := dest.IP != nil || !r.resolve
+	for _, rr := range r.rules {
+		if !resolved && len(rr.networks) > 0 && rr.matchPort(port) {
+			dest.IP = r.lookup(ctx, host)
+			resolved = true
+		}
+		if rr.match(dest) {
+			return rr.route
+		}
+	}
+	return r.defaultRoute
+}
+
+// lookup returns address of name, nil if it can't be resolved. Results are cached for routeLookupTTL.
+func (r *Router) lookup(ctx context.Context, name string) net.IP {
+	name = strings.ToLower(name)
+	r.lookupsLock.Lock()
+	cached, ok := r.lookups[name]
+	r.lookupsLock.Unlock()
+	if ok && r.now().Before(cached.expires) {
+		return cached.ip
+	}
+
+	lookupCtx, cancel := context.WithTimeout(ctx, routeResolveTimeout)
+	ips, err := r.resolver.LookupIP(lookupCtx, "ip", name)
+	cancel()
+	var ip net.IP
+	if err == nil && len(ips) > 0 {
+		ip = ips[0]
+	} else if ctx.Err() != nil {
+		return nil // connection was canceled, don't cache it
+	}
+
+	r.lookupsLock.Lock()
+	defer r.lookupsLock.Unlock()
+	if len(r.lookups) >= maxRouteLookups {
+		r.lookups = map[string]routeLookup{}
+	}
+	r.lookups[name] = routeLookup{ip: ip, expires: r.now().Add(routeLookupTTL)}
+	return ip
+}
+
+// Default returns route of destinations not matched by rules.
+func (r *Router) Default() string {
+	return r.defaultRoute
+}
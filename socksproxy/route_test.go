@@ -0,0 +1,144 @@
+package socksproxy
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pymq/demhack4/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestRouter(t *testing.T) *Router {
+	list := filepath.Join(t.TempDir(), "domestic.txt")
+	require.NoError(t, os.WriteFile(list, []byte("# domestic\n\n5.0.0.0/8\nexample.ru\n2a00::/16\n"), 0600))
+	r, err := NewRouter(config.Routing{
+		Rules: []config.RouteRule{
+			{Route: RouteBlock, Domains: []string{"ads.example.ru"}},
+			{Route: RouteTunnel, Domains: []string{"news.example.ru"}, Ports: []string{"443"}},
+			{Route: RouteDirect, Lists: []string{list}},
+			{Route: RouteDirect, Networks: []string{"192.168.0.0/16"}},
+			{Route: RouteDirect, Networks: []string{"fd00::/8"}},
+		},
+	})
+	require.NoError(t, err)
+	return r
+}
+
+func TestRouter(t *testing.T) {
+	r := newTestRouter(t)
+	for _, tc := range []struct {
+		host  string
+		port  int
+		route string
+	}{
+		{host: "ads.example.ru", port: 443, route: RouteBlock},
+		{host: "news.example.ru", port: 443, route: RouteTunnel},
+		{host: "news.example.ru", port: 80, route: RouteDirect},
+		{host: "shop.Example.RU", port: 443, route: RouteDirect},
+		{host: "5.1.2.3", port: 443, route: RouteDirect},
+		{host: "2a00::1", port: 443, route: RouteDirect},
+		{host: "192.168.1.1", port: 22, route: RouteDirect},
+		{host: "example.com", port: 443, route: RouteTunnel},
+		{host: "6.1.2.3", port: 443, route: RouteTunnel},
+	} {
+		assert.Equal(t, tc.route, r.Route(context.Background(), tc.host, tc.port), "%s:%d", tc.host, tc.port)
+	}
+
+	_, err := NewRouter(config.Routing{Rules: []config.RouteRule{{Route: "proxy"}}})
+	assert.Error(t, err)
+	_, err = NewRouter(config.Routing{Rules: []config.RouteRule{{Route: RouteDirect, Lists: []string{"missing.txt"}}}})
+	assert.Error(t, err)
+
+	r, err = NewRouter(config.Routing{Default: RouteDirect})
+	require.NoError(t, err)
+	assert.Equal(t, RouteDirect, r.Route(context.Background(), "example.com", 443))
+}
+
+// countingResolver resolves names of map and counts lookups.
+type countingResolver struct {
+	ips     map[string]net.IP
+	lookups map[string]int
+}
+
+func (r *countingResolver) LookupIP(_ context.Context, _, host string) ([]net.IP, error) {
+	r.lookups[host]++
+	if ip, ok := r.ips[host]; ok {
+		return []net.IP{ip}, nil
+	}
+	return nil, errors.New("no such host")
+}
+
+func TestRouterResolveNames(t *testing.T) {
+	r, err := NewRouter(config.Routing{
+		ResolveNames: true,
+		Rules: []config.RouteRule{
+			{Route: RouteTunnel, Domains: []string{"news.example.ru"}},
+			{Route: RouteDirect, Networks: []string{"5.0.0.0/8"}, Ports: []string{"443"}},
+		},
+	})
+	require.NoError(t, err)
+	resolver := &countingResolver{
+		ips:     map[string]net.IP{"shop.example.ru": net.IPv4(5, 1, 2, 3), "news.example.ru": net.IPv4(5, 1, 2, 4)},
+		lookups: map[string]int{},
+	}
+	r.resolver = resolver
+	now := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	r.now = func() time.Time { return now }
+
+	assert.Equal(t, RouteDirect, r.Route(context.Background(), "shop.example.ru", 443))
+	assert.Equal(t, RouteDirect, r.Route(context.Background(), "Shop.Example.RU", 443))
+	assert.Equal(t, 1, resolver.lookups["shop.example.ru"], "lookup is cached")
+	assert.Equal(t, RouteTunnel, r.Route(context.Background(), "missing.example.ru", 443))
+	assert.Equal(t, RouteTunnel, r.Route(context.Background(), "missing.example.ru", 443))
+	assert.Equal(t, 1, resolver.lookups["missing.example.ru"], "failure is cached")
+
+	// names matched before network rules, or not matching their ports, aren't looked up
+	assert.Equal(t, RouteTunnel, r.Route(context.Background(), "news.example.ru", 443))
+	assert.Equal(t, RouteTunnel, r.Route(context.Background(), "shop.example.ru", 80))
+	assert.Zero(t, resolver.lookups["news.example.ru"])
+
+	now = now.Add(routeLookupTTL)
+	r.Route(context.Background(), "shop.example.ru", 443)
+	assert.Equal(t, 2, resolver.lookups["shop.example.ru"], "expired lookup is repeated")
+}
+
+func TestPAC(t *testing.T) {
+	pac := newTestRouter(t).PAC("127.0.0.1:9090")
+	assert.Contains(t, pac, "function FindProxyForURL(url, host)")
+	assert.Contains(t, pac, `return "SOCKS5 127.0.0.1:9090; PROXY 127.0.0.1:9090";`)
+	assert.Contains(t, pac, "var ip = /^\\d+\\.\\d+\\.\\d+\\.\\d+$/.test(host) ? host : null;")
+
+	data := strings.TrimSuffix(strings.SplitN(strings.TrimPrefix(pac, "var rules = "), "\n", 2)[0], ";")
+	var rules []pacRule
+	require.NoError(t, json.Unmarshal([]byte(data), &rules))
+	// rule of IPv6 network only can't be expressed in PAC
+	require.Len(t, rules, 4)
+	assert.Equal(t, []string{"ads.example.ru"}, rules[0].Domains)
+	assert.Equal(t, [][2]int{{443, 443}}, rules[1].Ports)
+	assert.Equal(t, "DIRECT", rules[2].Proxy)
+	assert.Equal(t, [][2]string{{"5.0.0.0", "255.0.0.0"}}, rules[2].Nets)
+	assert.Equal(t, []string{"example.ru"}, rules[2].Domains)
+	assert.Equal(t, [][2]string{{"192.168.0.0", "255.255.0.0"}}, rules[3].Nets)
+}
+
+func TestPACHandler(t *testing.T) {
+	r, err := NewRouter(config.Routing{})
+	require.NoError(t, err)
+
+	w := httptest.NewRecorder()
+	r.PACHandler("0.0.0.0:9090").ServeHTTP(w, httptest.NewRequest("GET", "http://10.0.0.2:9091/proxy.pac", nil))
+	assert.Equal(t, "application/x-ns-proxy-autoconfig", w.Header().Get("Content-Type"))
+	assert.Contains(t, w.Body.String(), `return "SOCKS5 10.0.0.2:9090; PROXY 10.0.0.2:9090";`)
+
+	assert.Equal(t, "localhost:9090", pacProxyAddr("localhost:9090", "10.0.0.2:9091"))
+	assert.Equal(t, "[::1]:9090", pacProxyAddr(":9090", "[::1]:9091"))
+}
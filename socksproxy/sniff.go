@@ -0,0 +1,93 @@
+package socksproxy
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+// maxSniffBytes limits buffering of connection start, SOCKS request with credentials fits in it
+const maxSniffBytes = 1024
+
+var errNeedMore = errors.New("need more data")
+
+// sniffer reports destination port of SOCKS5 request read from connection, without altering the data.
+type sniffer struct {
+	io.ReadWriteCloser
+	buf       []byte
+	done      bool
+	onRequest func(port int)
+}
+
+// Sniff wraps client side of SOCKS5 connection and calls onRequest once with destination port.
+func Sniff(conn io.ReadWriteCloser, onRequest func(port int)) io.ReadWriteCloser {
+	return &sniffer{ReadWriteCloser: conn, onRequest: onRequest}
+}
+
+func (s *sniffer) Read(p []byte) (int, error) {
+	n, err := s.ReadWriteCloser.Read(p)
+	if n > 0 && !s.done {
+		s.buf = append(s.buf, p[:n]...)
+		port, perr := parseRequestPort(s.buf)
+		switch {
+		case perr == nil:
+			s.done, s.buf = true, nil
+			s.onRequest(port)
+		case perr != errNeedMore || len(s.buf) > maxSniffBytes:
+			s.done, s.buf = true, nil
+		}
+	}
+	return n, err
+}
+
+// parseRequestPort parses greeting, optional username/password auth and request of SOCKS5 client.
+func parseRequestPort(data []byte) (int, error) {
+	// greeting: version, number of methods, methods
+	if len(data) < 2 {
+		return 0, errNeedMore
+	}
+	if data[0] != 5 {
+		return 0, errors.New("not a socks5 connection")
+	}
+	pos := 2 + int(data[1])
+	if len(data) < pos+1 {
+		return 0, errNeedMore
+	}
+
+	// username/password auth: version 1, username, password
+	if data[pos] == 1 {
+		if len(data) < pos+2 {
+			return 0, errNeedMore
+		}
+		pos += 2 + int(data[pos+1])
+		if len(data) < pos+1 {
+			return 0, errNeedMore
+		}
+		pos += 1 + int(data[pos])
+	}
+
+	// request: version, command, reserved, address type, address, port
+	if len(data) < pos+4 {
+		return 0, errNeedMore
+	}
+	if data[pos] != 5 {
+		return 0, errors.New("invalid socks5 request")
+	}
+	switch data[pos+3] {
+	case 1:
+		pos += 4 + 4
+	case 4:
+		pos += 4 + 16
+	case 3:
+		if len(data) < pos+5 {
+			return 0, errNeedMore
+		}
+		pos += 5 + int(data[pos+4])
+	default:
+		return 0, errors.New("invalid socks5 address type")
+	}
+	if len(data) < pos+2 {
+		return 0, errNeedMore
+	}
+	return int(binary.BigEndian.Uint16(data[pos:])), nil
+}
@@ -0,0 +1,55 @@
+package socksproxy
+
+import (
+	"io"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type bufConn struct {
+	io.Reader
+	io.Writer
+}
+
+func (bufConn) Close() error {
+	return nil
+}
+
+type chunkReader struct {
+	data []byte
+}
+
+// Read returns one byte at a time, like slow connection
+func (r *chunkReader) Read(p []byte) (int, error) {
+	if len(r.data) == 0 {
+		return 0, io.EOF
+	}
+	p[0] = r.data[0]
+	r.data = r.data[1:]
+	return 1, nil
+}
+
+func TestSniff(t *testing.T) {
+	tests := []struct {
+		name string
+		data []byte
+		port int
+	}{
+		{"ipv4", []byte{5, 1, 0, 5, 1, 0, 1, 127, 0, 0, 1, 0, 22}, 22},
+		{"domain with auth", append([]byte{5, 2, 0, 2, 1, 1, 'u', 2, 'p', 'w', 5, 1, 0, 3, 7, 'e', 'x', '.', 'c', 'o', 'm', '.'}, 1, 187), 443},
+		{"not socks", []byte("GET / HTTP/1.1\r\n\r\n"), 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			port := 0
+			conn := Sniff(bufConn{Reader: &chunkReader{data: append([]byte(nil), tt.data...)}}, func(p int) {
+				port = p
+			})
+			data, err := io.ReadAll(conn)
+			assert.NoError(t, err)
+			assert.Equal(t, tt.data, data)
+			assert.Equal(t, tt.port, port)
+		})
+	}
+}
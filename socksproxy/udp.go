@@ -0,0 +1,232 @@
+package socksproxy
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// UDP associations are relayed in a dedicated stream, which starts with udpStreamMark instead
+// of SOCKS version. Every datagram is framed by 2 bytes of length and keeps SOCKS5 UDP header:
+// reserved (2 bytes), fragment, destination (source in replies) address and port.
+const (
+	udpStreamMark byte = 0xf5
+	// MaxDatagramSize limits payload of relayed datagram, larger ones are dropped.
+	// It fits DNS over EDNS and most games and VoIP, while keeping frames few carrier messages long.
+	MaxDatagramSize = 8 * 1024
+	udpHeaderMaxLen = 3 + 1 + 1 + 255 + 2
+)
+
+var errDatagramTooLong = errors.New("datagram is too long")
+
+// writeDatagram writes SOCKS5 UDP datagram to stream with length prefix.
+func writeDatagram(w io.Writer, datagram []byte) error {
+	if len(datagram) > udpHeaderMaxLen+MaxDatagramSize {
+		return errDatagramTooLong
+	}
+	frame := make([]byte, 2+len(datagram))
+	binary.BigEndian.PutUint16(frame, uint16(len(datagram)))
+	copy(frame[2:], datagram)
+	_, err := w.Write(frame)
+	return err
+}
+
+// readDatagram reads datagram framed by writeDatagram.
+func readDatagram(r io.Reader) ([]byte, error) {
+	var size [2]byte
+	_, err := io.ReadFull(r, size[:])
+	if err != nil {
+		return nil, err
+	}
+	n := int(binary.BigEndian.Uint16(size[:]))
+	if n > udpHeaderMaxLen+MaxDatagramSize {
+		return nil, errDatagramTooLong
+	}
+	datagram := make([]byte, n)
+	_, err = io.ReadFull(r, datagram)
+	if err != nil {
+		return nil, err
+	}
+	return datagram, nil
+}
+
+// parseDatagram splits SOCKS5 UDP datagram into address and payload. Fragmented datagrams are not supported.
+func parseDatagram(datagram []byte) (string, int, []byte, error) {
+	if len(datagram) < 4 {
+		return "", 0, nil, errors.New("datagram is too short")
+	}
+	if datagram[2] != 0 {
+		return "", 0, nil, errors.New("fragmented datagrams are not supported")
+	}
+	r := bytes.NewReader(datagram[3:])
+	host, port, _, err := readAddr(r)
+	if err != nil {
+		return "", 0, nil, fmt.Errorf("invalid datagram address: %v", err)
+	}
+	payload := datagram[len(datagram)-r.Len():]
+	if len(payload) > MaxDatagramSize {
+		return "", 0, nil, errDatagramTooLong
+	}
+	return host, port, payload, nil
+}
+
+// encodeDatagram adds SOCKS5 UDP header with given address to payload.
+func encodeDatagram(addr *net.UDPAddr, payload []byte) []byte {
+	buf := appendAddr(make([]byte, 3, udpHeaderMaxLen+len(payload)), addr.IP, addr.Port)
+	return append(buf, payload...)
+}
+
+// serveUDP relays datagrams of client UDP association to destinations allowed by policy.
+// Only replies from destinations client has sent to are passed back.
+func (s *Server) serveUDP(stream io.ReadWriteCloser, r io.Reader, client string) {
+	defer stream.Close()
+	if s.upstream {
+		log.Warnf("proxy: server: UDP association of client %s refused, UDP is not supported through upstream proxy", clientName(client))
+		return
+	}
+	pc, err := net.ListenUDP("udp", &net.UDPAddr{IP: s.bindIP})
+	if err != nil {
+		log.Warnf("proxy: server: listen UDP: %v", err)
+		return
+	}
+	defer pc.Close()
+
+	var peersLock sync.Mutex
+	peers := map[string]struct{}{}
+	go func() {
+		defer stream.Close()
+		buf := make([]byte, MaxDatagramSize+1)
+		for {
+			n, addr, err := pc.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			peersLock.Lock()
+			_, known := peers[addr.String()]
+			peersLock.Unlock()
+			if !known || n > MaxDatagramSize {
+				continue
+			}
+			err = writeDatagram(stream, encodeDatagram(addr, buf[:n]))
+			if err != nil {
+				return
+			}
+		}
+	}()
+
+	for {
+		datagram, err := readDatagram(r)
+		if err != nil {
+			if !errors.Is(err, io.EOF) && !errors.Is(err, net.ErrClosed) {
+				log.Warnf("proxy: server: read UDP association stream: %v", err)
+			}
+			return
+		}
+		host, port, payload, err := parseDatagram(datagram)
+		if err != nil {
+			log.Debugf("proxy: server: drop datagram: %v", err)
+			continue
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), s.dialTimeout)
+		ip, err := s.lookup(ctx, client, host, port)
+		cancel()
+		if err != nil {
+			log.Debugf("proxy: server: drop datagram to %s: %v", net.JoinHostPort(host, strconv.Itoa(port)), err)
+			continue
+		}
+		addr := &net.UDPAddr{IP: ip, Port: port}
+		peersLock.Lock()
+		peers[addr.String()] = struct{}{}
+		peersLock.Unlock()
+		_, err = pc.WriteToUDP(payload, addr)
+		if err != nil {
+			log.Debugf("proxy: server: send datagram to %s: %v", addr, err)
+		}
+	}
+}
+
+// OpenUDPAssociation serves UDP ASSOCIATE request of ctrl connection over stream: it binds UDP socket
+// on address of control connection, replies to client and relays its datagrams until either
+// control connection or stream is closed. Both are closed on return.
+func OpenUDPAssociation(ctrl net.Conn, stream io.ReadWriteCloser) error {
+	defer ctrl.Close()
+	defer stream.Close()
+	local, _ := ctrl.LocalAddr().(*net.TCPAddr)
+	remote, _ := ctrl.RemoteAddr().(*net.TCPAddr)
+	if local == nil || remote == nil {
+		_ = Reply(ctrl, ReplyGeneralFailure, nil)
+		return errors.New("UDP association needs TCP control connection")
+	}
+	pc, err := net.ListenUDP("udp", &net.UDPAddr{IP: local.IP})
+	if err != nil {
+		_ = Reply(ctrl, ReplyGeneralFailure, nil)
+		return fmt.Errorf("listen UDP: %v", err)
+	}
+	defer pc.Close()
+	_, err = stream.Write([]byte{udpStreamMark})
+	if err != nil {
+		_ = Reply(ctrl, ReplyGeneralFailure, nil)
+		return fmt.Errorf("open UDP association stream: %v", err)
+	}
+	err = Reply(ctrl, ReplySucceeded, pc.LocalAddr().(*net.UDPAddr))
+	if err != nil {
+		return fmt.Errorf("reply to UDP association: %v", err)
+	}
+
+	// association lives until control connection is closed by client
+	go func() {
+		_, _ = io.Copy(io.Discard, ctrl)
+		_ = pc.Close()
+		_ = stream.Close()
+	}()
+
+	var appLock sync.Mutex
+	var app *net.UDPAddr // client application sending datagrams, replies go to it
+	go func() {
+		defer pc.Close()
+		for {
+			datagram, err := readDatagram(stream)
+			if err != nil {
+				return
+			}
+			appLock.Lock()
+			dst := app
+			appLock.Unlock()
+			if dst == nil {
+				continue
+			}
+			_, _ = pc.WriteToUDP(datagram, dst)
+		}
+	}()
+
+	buf := make([]byte, udpHeaderMaxLen+MaxDatagramSize+1)
+	for {
+		n, addr, err := pc.ReadFromUDP(buf)
+		if err != nil {
+			return nil
+		}
+		if !addr.IP.Equal(remote.IP) {
+			// only host of control connection may use association
+			continue
+		}
+		appLock.Lock()
+		app = addr
+		appLock.Unlock()
+		err = writeDatagram(stream, buf[:n])
+		if errors.Is(err, errDatagramTooLong) {
+			log.Debugf("proxy: client: drop datagram of %d bytes", n)
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("relay datagram: %v", err)
+		}
+	}
+}
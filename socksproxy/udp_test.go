@@ -0,0 +1,133 @@
+package socksproxy
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/pymq/demhack4/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// associate makes SOCKS5 UDP ASSOCIATE request and returns relay address.
+func associate(t *testing.T, ctrl net.Conn) *net.UDPAddr {
+	_, err := ctrl.Write([]byte{5, 1, 0, 5, CommandUDPAssociate, 0, addrIPv4, 0, 0, 0, 0, 0, 0})
+	require.NoError(t, err)
+	method := make([]byte, 2)
+	_, err = io.ReadFull(ctrl, method)
+	require.NoError(t, err)
+	require.Equal(t, []byte{5, 0}, method)
+
+	reply := make([]byte, 3)
+	_, err = io.ReadFull(ctrl, reply)
+	require.NoError(t, err)
+	require.Equal(t, ReplySucceeded, reply[1])
+	host, port, _, err := readAddr(ctrl)
+	require.NoError(t, err)
+	return &net.UDPAddr{IP: net.ParseIP(host), Port: port}
+}
+
+func TestUDPAssociation(t *testing.T) {
+	echo, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	require.NoError(t, err)
+	defer echo.Close()
+	go func() {
+		buf := make([]byte, 2*MaxDatagramSize)
+		for {
+			n, addr, err := echo.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			_, _ = echo.WriteToUDP(buf[:n], addr)
+		}
+	}()
+
+	server, err := NewServer(ServerOptions{Egress: config.Egress{AllowPrivate: true}})
+	require.NoError(t, err)
+	defer server.Close()
+	client := serveTunnel(t, server, nil)
+
+	ctrl, err := net.Dial("tcp", client.listener.Addr().String())
+	require.NoError(t, err)
+	defer ctrl.Close()
+	relay := associate(t, ctrl)
+	app, err := net.DialUDP("udp", nil, relay)
+	require.NoError(t, err)
+	defer app.Close()
+
+	echoAddr := echo.LocalAddr().(*net.UDPAddr)
+	_, err = app.Write(encodeDatagram(echoAddr, []byte("ping")))
+	require.NoError(t, err)
+	require.NoError(t, app.SetReadDeadline(time.Now().Add(5*time.Second)))
+	buf := make([]byte, 2*MaxDatagramSize)
+	n, err := app.Read(buf)
+	require.NoError(t, err)
+	host, port, payload, err := parseDatagram(buf[:n])
+	require.NoError(t, err)
+	assert.Equal(t, echoAddr.IP.String(), host)
+	assert.Equal(t, echoAddr.Port, port)
+	assert.Equal(t, "ping", string(payload))
+
+	// too long datagram is dropped, association keeps working
+	_, err = app.Write(encodeDatagram(echoAddr, make([]byte, MaxDatagramSize+1)))
+	require.NoError(t, err)
+	_, err = app.Write(encodeDatagram(echoAddr, []byte("pong")))
+	require.NoError(t, err)
+	n, err = app.Read(buf)
+	require.NoError(t, err)
+	_, _, payload, err = parseDatagram(buf[:n])
+	require.NoError(t, err)
+	assert.Equal(t, "pong", string(payload))
+
+	// closing control connection ends association
+	require.NoError(t, ctrl.Close())
+	require.Eventually(t, func() bool {
+		_, _ = app.Write(encodeDatagram(echoAddr, []byte("late")))
+		require.NoError(t, app.SetReadDeadline(time.Now().Add(50*time.Millisecond)))
+		_, err := app.Read(buf)
+		return err != nil
+	}, 5*time.Second, 10*time.Millisecond)
+}
+
+func TestUDPAssociationDeniedByPolicy(t *testing.T) {
+	echo, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	require.NoError(t, err)
+	defer echo.Close()
+
+	server, err := NewServer(ServerOptions{})
+	require.NoError(t, err)
+	defer server.Close()
+	client := serveTunnel(t, server, nil)
+
+	ctrl, err := net.Dial("tcp", client.listener.Addr().String())
+	require.NoError(t, err)
+	defer ctrl.Close()
+	app, err := net.DialUDP("udp", nil, associate(t, ctrl))
+	require.NoError(t, err)
+	defer app.Close()
+
+	_, err = app.Write(encodeDatagram(echo.LocalAddr().(*net.UDPAddr), []byte("ping")))
+	require.NoError(t, err)
+	require.NoError(t, echo.SetReadDeadline(time.Now().Add(200*time.Millisecond)))
+	_, _, err = echo.ReadFromUDP(make([]byte, 16))
+	assert.Error(t, err, "datagram to private address should be dropped")
+}
+
+func TestUnsupportedCommand(t *testing.T) {
+	server, err := NewServer(ServerOptions{Egress: config.Egress{AllowPrivate: true}})
+	require.NoError(t, err)
+	defer server.Close()
+	client := serveTunnel(t, server, nil)
+
+	conn, err := net.Dial("tcp", client.listener.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+	_, err = conn.Write([]byte{5, 1, 0, 5, CommandBind, 0, addrIPv4, 127, 0, 0, 1, 0, 80})
+	require.NoError(t, err)
+	reply := make([]byte, 5)
+	_, err = io.ReadFull(conn, reply)
+	require.NoError(t, err)
+	assert.Equal(t, []byte{5, 0, 5, ReplyCommandNotSupported, 0}, reply)
+}
@@ -0,0 +1,108 @@
+package tunnel
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/pymq/demhack4/socksproxy"
+)
+
+// DialContext connects to addr through server, it is compatible with proxy.ContextDialer
+// of golang.org/x/net/proxy. Only TCP is supported, host names are resolved by server.
+// Deadlines of returned connection are supported with yamux only.
+func (t *Tunnel) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	switch network {
+	case "tcp", "tcp4", "tcp6":
+	default:
+		return nil, fmt.Errorf("tunnel: dial %s: unsupported network '%s'", addr, network)
+	}
+	_, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, fmt.Errorf("tunnel: dial %s: %v", addr, err)
+	}
+	port, _ := strconv.Atoi(portStr)
+
+	stream, err := t.OpenStream(ctx, t.priorityRules.Match(port))
+	if err != nil {
+		return nil, fmt.Errorf("tunnel: dial %s: %v", addr, err)
+	}
+	// SOCKS exchange takes round trip through carrier, which may be long
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- socksproxy.Dial(stream, addr)
+	}()
+	select {
+	case err = <-errCh:
+	case <-ctx.Done():
+		_ = stream.Close()
+		err = ctx.Err()
+	}
+	if err != nil {
+		_ = stream.Close()
+		return nil, fmt.Errorf("tunnel: dial %s: %v", addr, err)
+	}
+	return &conn{ConnWrapper: socksproxy.ConnWrapper{ReadWriteCloser: stream}, stream: stream, remote: Addr(addr)}, nil
+}
+
+// Dial connects to addr through server, it is compatible with proxy.Dialer.
+func (t *Tunnel) Dial(network, addr string) (net.Conn, error) {
+	return t.DialContext(context.Background(), network, addr)
+}
+
+// Transport returns HTTP transport, which connects through the tunnel.
+func (t *Tunnel) Transport() *http.Transport {
+	return &http.Transport{
+		DialContext:           t.DialContext,
+		ForceAttemptHTTP2:     true,
+		MaxIdleConns:          100,
+		IdleConnTimeout:       90 * time.Second,
+		TLSHandshakeTimeout:   time.Minute,
+		ExpectContinueTimeout: time.Second,
+	}
+}
+
+// Addr is an address of connection through the tunnel.
+type Addr string
+
+func (a Addr) Network() string {
+	return "tunnel"
+}
+
+func (a Addr) String() string {
+	return string(a)
+}
+
+type conn struct {
+	socksproxy.ConnWrapper
+	stream *Stream
+	remote Addr
+}
+
+// CloseWrite closes write side of connection, destination reads EOF and may still answer.
+func (c *conn) CloseWrite() error {
+	return c.stream.CloseWrite()
+}
+
+func (c *conn) SetDeadline(t time.Time) error {
+	return c.stream.SetDeadline(t)
+}
+
+func (c *conn) SetReadDeadline(t time.Time) error {
+	return c.stream.SetReadDeadline(t)
+}
+
+func (c *conn) SetWriteDeadline(t time.Time) error {
+	return c.stream.SetWriteDeadline(t)
+}
+
+func (c *conn) LocalAddr() net.Addr {
+	return Addr("")
+}
+
+func (c *conn) RemoteAddr() net.Addr {
+	return c.remote
+}
@@ -0,0 +1,133 @@
+package tunnel
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/pymq/demhack4/encoding"
+	"github.com/pymq/demhack4/icq"
+	log "github.com/sirupsen/logrus"
+)
+
+// ErrNoHandshakeAck is returned when server doesn't reply to handshake in time:
+// server is offline, server key or bot room is wrong.
+var ErrNoHandshakeAck = errors.New("server did not acknowledge handshake, check that server is online and profile is correct")
+
+// HandshakeRejectedError is returned when server refused to open session.
+type HandshakeRejectedError struct {
+	Reason string
+}
+
+func (e HandshakeRejectedError) Error() string {
+	return fmt.Sprintf("server rejected connection: %s", e.Reason)
+}
+
+// VersionMismatchError is returned when client and server protocol versions are incompatible.
+type VersionMismatchError struct {
+	ClientVersion int
+	ServerVersion int
+}
+
+func (e VersionMismatchError) Error() string {
+	return fmt.Sprintf("protocol version mismatch: client version %d, server version %d, update the older side",
+		e.ClientVersion, e.ServerVersion)
+}
+
+// ThrottledError is returned when server throttles client by quota. RetryAfter is zero,
+// if only message rate is capped.
+type ThrottledError struct {
+	Reason     string
+	RetryAfter time.Duration
+}
+
+func (e ThrottledError) Error() string {
+	if e.RetryAfter > 0 {
+		return fmt.Sprintf("server throttled connection: %s, retry in %s", e.Reason, e.RetryAfter)
+	}
+	return fmt.Sprintf("server throttled connection: %s", e.Reason)
+}
+
+// handshake sends client public key and waits for server acknowledgement.
+func (t *Tunnel) handshake(ctx context.Context, encoder *encoding.Encoder, cli icq.Client, msgCh chan icq.ICQMessageEvent) error {
+	h := encoding.Handshake{
+		Version:     encoding.ProtocolVersion,
+		PublicKey:   string(encoder.GetOwnPublicKey()),
+		InviteToken: t.cfg.InviteToken,
+		Mux:         t.cfg.Mux,
+	}
+	if t.cfg.FEC.Enabled {
+		h.FEC = &encoding.FECParams{
+			DataShards:      t.cfg.FEC.DataShards,
+			ParityShards:    t.cfg.FEC.ParityShards,
+			MaxParityShards: t.cfg.FEC.MaxParityShards,
+			Adaptive:        t.cfg.FEC.Adaptive,
+		}
+	}
+	handshake, err := h.Marshal()
+	if err != nil {
+		return fmt.Errorf("marshal handshake error: %v", err)
+	}
+	encKey, err := encoder.PackMessage(encoding.PublicKey, handshake)
+	if err != nil {
+		return fmt.Errorf("pack message error: %v", err)
+	}
+
+	err = t.pacer.Do(ctx, func() error {
+		return cli.SendMessage(ctx, encKey, t.cfg.ICQ.BotRoomID)
+	})
+	if err != nil {
+		return fmt.Errorf("send public key error: %v", err)
+	}
+
+	ack, err := waitHandshakeAck(ctx, encoder, msgCh, t.handshakeTimeout())
+	if err != nil {
+		return err
+	}
+	switch ack.Status {
+	case encoding.HandshakeAccepted:
+		return nil
+	case encoding.HandshakeVersionMismatch:
+		return VersionMismatchError{ClientVersion: encoding.ProtocolVersion, ServerVersion: ack.Version}
+	case encoding.HandshakeThrottled:
+		return ThrottledError{Reason: ack.Reason, RetryAfter: time.Duration(ack.RetryAfter) * time.Second}
+	default:
+		return HandshakeRejectedError{Reason: ack.Reason}
+	}
+}
+
+func waitHandshakeAck(ctx context.Context, enc icq.Encoding, msgCh chan icq.ICQMessageEvent, timeout time.Duration) (encoding.HandshakeAck, error) {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return encoding.HandshakeAck{}, ctx.Err()
+		case <-timer.C:
+			return encoding.HandshakeAck{}, ErrNoHandshakeAck
+		case msg, open := <-msgCh:
+			if !open {
+				return encoding.HandshakeAck{}, ErrNoHandshakeAck
+			}
+			if msg.Err != nil {
+				log.Warnf("wait handshake ack: %v", msg.Err)
+				continue
+			}
+			data, flags, err := enc.UnpackMessage(msg.Text)
+			if errors.Is(err, encoding.ErrForeignSession) {
+				continue
+			} else if err != nil {
+				log.Warnf("wait handshake ack: unpack message: %v", err)
+				continue
+			}
+			if flags != encoding.PublicKeyAck {
+				log.Warnf("wait handshake ack: unexpected message type '%d'", flags)
+				continue
+			}
+
+			return encoding.UnmarshalHandshakeAck(data)
+		}
+	}
+}
@@ -0,0 +1,131 @@
+package tunnel
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/pymq/demhack4/config"
+	"github.com/pymq/demhack4/encoding"
+	"github.com/pymq/demhack4/icq"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeServer answers handshake sent by client with ack, if it is set.
+type fakeServer struct {
+	t         *testing.T
+	encoder   *encoding.Encoder
+	msgCh     chan icq.ICQMessageEvent
+	ack       *encoding.HandshakeAck
+	handshake encoding.Handshake
+}
+
+func (s *fakeServer) SendMessage(_ context.Context, msg []byte, _ string) error {
+	header, err := encoding.PeekHeader(msg)
+	require.NoError(s.t, err)
+	data, flags, err := s.encoder.UnpackMessage(msg)
+	require.NoError(s.t, err)
+	require.Equal(s.t, encoding.PublicKey, flags)
+	s.handshake, err = encoding.UnmarshalHandshake(data)
+	require.NoError(s.t, err)
+
+	if s.ack == nil {
+		return nil
+	}
+	payload, err := s.ack.Marshal()
+	require.NoError(s.t, err)
+	enc := s.encoder.Copy()
+	require.NoError(s.t, enc.SetPeerPublicKey([]byte(s.handshake.PublicKey)))
+
+	// message of another session in the same chat is skipped by client
+	enc.SetSession(header.Session + 1)
+	foreign, err := enc.PackMessage(encoding.PublicKeyAck, payload)
+	require.NoError(s.t, err)
+	s.msgCh <- icq.ICQMessageEvent{Text: foreign}
+
+	enc.SetSession(header.Session)
+	reply, err := enc.PackMessage(encoding.PublicKeyAck, payload)
+	require.NoError(s.t, err)
+	s.msgCh <- icq.ICQMessageEvent{Text: reply}
+	return nil
+}
+
+func TestHandshake(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		ack      *encoding.HandshakeAck
+		expected error
+	}{
+		{
+			name: "accepted",
+			ack:  &encoding.HandshakeAck{Version: encoding.ProtocolVersion, Status: encoding.HandshakeAccepted},
+		},
+		{
+			name:     "no ack",
+			expected: ErrNoHandshakeAck,
+		},
+		{
+			name:     "rejected",
+			ack:      &encoding.HandshakeAck{Version: encoding.ProtocolVersion, Status: encoding.HandshakeRejected, Reason: "invalid invite token"},
+			expected: HandshakeRejectedError{Reason: "invalid invite token"},
+		},
+		{
+			name:     "version mismatch",
+			ack:      &encoding.HandshakeAck{Version: encoding.ProtocolVersion + 1, Status: encoding.HandshakeVersionMismatch},
+			expected: VersionMismatchError{ClientVersion: encoding.ProtocolVersion, ServerVersion: encoding.ProtocolVersion + 1},
+		},
+		{
+			name:     "throttled",
+			ack:      &encoding.HandshakeAck{Version: encoding.ProtocolVersion, Status: encoding.HandshakeThrottled, Reason: "traffic limit exceeded", RetryAfter: 60},
+			expected: ThrottledError{Reason: "traffic limit exceeded", RetryAfter: time.Minute},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			serverKey, err := encoding.GenerateKey()
+			require.NoError(t, err)
+			tun, err := New(Options{Config: config.Client{
+				ServerPublicKey:  serverKey.Recipient().String(),
+				InviteToken:      "secret",
+				HandshakeTimeout: 200 * time.Millisecond,
+			}})
+			require.NoError(t, err)
+			server := &fakeServer{
+				t:       t,
+				encoder: encoding.NewEncoder(serverKey),
+				msgCh:   make(chan icq.ICQMessageEvent, 2),
+				ack:     tc.ack,
+			}
+			encoder := tun.encoder.Copy()
+			encoder.SetSession(7)
+
+			err = tun.handshake(context.Background(), encoder, server, server.msgCh)
+			if tc.expected == nil {
+				assert.NoError(t, err)
+			} else {
+				assert.Equal(t, tc.expected, err)
+			}
+			assert.Equal(t, encoding.ProtocolVersion, server.handshake.Version)
+			assert.Equal(t, "secret", server.handshake.InviteToken)
+			assert.Equal(t, string(tun.encoder.GetOwnPublicKey()), server.handshake.PublicKey)
+		})
+	}
+}
+
+// cancelingClient cancels handshake right after it is sent.
+type cancelingClient struct {
+	cancel context.CancelFunc
+}
+
+func (c cancelingClient) SendMessage(context.Context, []byte, string) error {
+	c.cancel()
+	return nil
+}
+
+func TestHandshakeCanceled(t *testing.T) {
+	tun := newTestTunnel(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	err := tun.handshake(ctx, tun.encoder, cancelingClient{cancel: cancel}, make(chan icq.ICQMessageEvent))
+	assert.ErrorIs(t, err, context.Canceled)
+}
@@ -0,0 +1,615 @@
+// Package tunnel is the client side of the tunnel for Go programs: it connects to server through
+// carrier chat, reconnects when session dies and opens streams proxied by server.
+package tunnel
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	mathrand "math/rand"
+	"os"
+	"sync"
+	"time"
+
+	"filippo.io/age"
+	"github.com/pymq/demhack4/config"
+	"github.com/pymq/demhack4/encoding"
+	"github.com/pymq/demhack4/icq"
+	"github.com/pymq/demhack4/mux"
+	"github.com/pymq/demhack4/sched"
+	"github.com/pymq/demhack4/socksproxy"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	reconnectMinDelay = time.Second
+	// acceptBacklog limits streams opened by server and not accepted yet
+	acceptBacklog = 16
+)
+
+// ErrClosed is returned by streams opened after tunnel is closed.
+var ErrClosed = errors.New("tunnel is closed")
+
+type Status int
+
+const (
+	StatusStopped Status = iota
+	StatusConnecting
+	StatusConnected
+	StatusReconnecting
+)
+
+func (s Status) String() string {
+	switch s {
+	case StatusStopped:
+		return "stopped"
+	case StatusConnecting:
+		return "connecting"
+	case StatusConnected:
+		return "connected"
+	case StatusReconnecting:
+		return "reconnecting"
+	default:
+		return fmt.Sprintf("unknown(%d)", int(s))
+	}
+}
+
+type Options struct {
+	// Config is client config, its defaults are set by New. Proxy listener, DNS and forwards
+	// are served by client app and aren't used here. Tunnel has own key, if PrivateKey is empty.
+	Config config.Client
+	// MessageLimits stores probed message limits, carrier is probed on every start if it is nil
+	// and message limit isn't configured
+	MessageLimits *config.MessageLimits
+	// OnConnect is called in own goroutine, when tunnel connects or reconnects
+	OnConnect func()
+}
+
+// Tunnel is a client of server, which is started and closed any number of times.
+type Tunnel struct {
+	cfg           config.Client
+	encoder       *encoding.Encoder
+	messageLimits *config.MessageLimits
+	pacer         *icq.Pacer // shared by reconnections, rate limits are per account
+	priorityRules sched.Rules
+	onConnect     func()
+	accepted      chan *Stream
+	lock          sync.Mutex // guards fields below
+	cancel        context.CancelFunc
+	done          chan struct{} // closed when supervisor exits
+	status        Status
+	statusErr     error
+	session       *session
+	ready         chan struct{} // closed when session is set or tunnel is stopped
+	lastRTT       icq.RTTStats
+}
+
+func New(opts Options) (*Tunnel, error) {
+	cfg := opts.Config
+	config.SetClientDefaults(&cfg)
+	if !mux.Valid(cfg.Mux) {
+		return nil, fmt.Errorf("tunnel: unknown mux '%s'", cfg.Mux)
+	}
+
+	var privateKey *age.X25519Identity
+	var err error
+	if cfg.PrivateKey == "" {
+		privateKey, err = encoding.GenerateKey()
+	} else {
+		privateKey, err = encoding.UnmarshalPrivateKey(cfg.PrivateKey)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("tunnel: private key: %v", err)
+	}
+	cfg.PrivateKey = privateKey.String()
+	serverPubKey, err := encoding.UnmarshalPublicKey(cfg.ServerPublicKey)
+	if err != nil {
+		return nil, fmt.Errorf("tunnel: server public key: %v", err)
+	}
+	encoder := encoding.NewEncoder(privateKey)
+	err = encoder.SetPeerPublicKey([]byte(serverPubKey.String()))
+	if err != nil {
+		return nil, fmt.Errorf("tunnel: server public key: %v", err)
+	}
+
+	return &Tunnel{
+		cfg:           cfg,
+		encoder:       encoder,
+		messageLimits: opts.MessageLimits,
+		pacer:         icq.NewPacer(cfg.RateLimit, config.ICQClientRateLimit),
+		priorityRules: sched.NewRules(cfg.StreamPriority),
+		onConnect:     opts.OnConnect,
+		accepted:      make(chan *Stream, acceptBacklog),
+		ready:         closedChan(),
+	}, nil
+}
+
+func closedChan() chan struct{} {
+	ch := make(chan struct{})
+	close(ch)
+	return ch
+}
+
+// PublicKey returns public key of client, which server knows it by.
+func (t *Tunnel) PublicKey() string {
+	return string(t.encoder.GetOwnPublicKey())
+}
+
+// Start connects to server and keeps tunnel connected until ctx is done or Close is called.
+// If server refuses connection permanently, tunnel stops with error in Status.
+func (t *Tunnel) Start(ctx context.Context) (err error) {
+	t.lock.Lock()
+	if t.cancel != nil {
+		t.lock.Unlock()
+		return errors.New("tunnel: already started")
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	t.cancel = cancel
+	t.done = make(chan struct{})
+	t.ready = make(chan struct{})
+	t.lock.Unlock()
+	defer func() {
+		if err != nil {
+			cancel()
+			t.lock.Lock()
+			t.cancel = nil
+			close(t.done)
+			t.lock.Unlock()
+			t.setStatus(StatusStopped, err)
+		}
+	}()
+
+	t.setStatus(StatusConnecting, nil)
+	s, err := t.connect(ctx)
+	if err != nil {
+		return err
+	}
+	t.setStatus(StatusConnected, nil)
+	go t.supervise(ctx, s)
+	return nil
+}
+
+// Close closes tunnel with its streams.
+func (t *Tunnel) Close() error {
+	t.lock.Lock()
+	cancel, done := t.cancel, t.done
+	t.cancel = nil
+	t.lock.Unlock()
+	if cancel == nil {
+		return nil
+	}
+	cancel()
+	<-done
+	return nil
+}
+
+// Done returns channel, which is closed when started tunnel stops: it is closed
+// or server refused connection permanently.
+func (t *Tunnel) Done() <-chan struct{} {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	return t.done
+}
+
+// Status returns current tunnel status and the last connection error, if any.
+func (t *Tunnel) Status() (Status, error) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	return t.status, t.statusErr
+}
+
+func (t *Tunnel) setStatus(status Status, err error) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if t.status != status {
+		log.Infof("tunnel status: %s", status)
+	}
+	t.status = status
+	t.statusErr = err
+	if status == StatusStopped {
+		t.closeReady()
+	}
+}
+
+// closeReady wakes streams waiting for session, t.lock should be held.
+func (t *Tunnel) closeReady() {
+	select {
+	case <-t.ready:
+	default:
+		close(t.ready)
+	}
+}
+
+// RTT returns round trip estimate of current session.
+func (t *Tunnel) RTT() icq.RTTStats {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if t.session == nil {
+		return icq.RTTStats{}
+	}
+	return t.session.rwc.RTT()
+}
+
+// StreamStats returns outgoing queues of current session streams.
+func (t *Tunnel) StreamStats() []sched.StreamStats {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if t.session == nil {
+		return nil
+	}
+	return t.session.sched.Stats()
+}
+
+func (t *Tunnel) setSession(s *session) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if s == nil && t.session != nil {
+		// remember link latency to size timeouts of the next connection
+		t.lastRTT = t.session.rwc.RTT()
+	}
+	t.session = s
+	if s != nil {
+		t.closeReady()
+	} else if t.status != StatusStopped {
+		t.ready = make(chan struct{})
+	}
+}
+
+// currentSession returns session, waiting for it while tunnel is connecting.
+func (t *Tunnel) currentSession(ctx context.Context) (*session, error) {
+	for {
+		t.lock.Lock()
+		s, ready, status, statusErr := t.session, t.ready, t.status, t.statusErr
+		t.lock.Unlock()
+		if s != nil {
+			return s, nil
+		}
+		if status == StatusStopped {
+			if statusErr != nil {
+				return nil, statusErr
+			}
+			return nil, ErrClosed
+		}
+		select {
+		case <-ready:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// handshakeTimeout is configured timeout, extended if link was slow before.
+func (t *Tunnel) handshakeTimeout() time.Duration {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	timeout := t.cfg.HandshakeTimeout
+	if t.lastRTT.Samples > 0 && 2*t.lastRTT.RTO() > timeout {
+		timeout = 2 * t.lastRTT.RTO()
+	}
+	return timeout
+}
+
+// Stream is a stream to SOCKS server on the other side of tunnel, see socksproxy for
+// requests it serves, or a stream opened by server.
+type Stream struct {
+	io.ReadWriteCloser
+	mux   mux.Stream // unwrapped stream, for half-close and deadlines
+	id    uint32
+	sched *sched.Conn
+}
+
+// CloseWrite closes write side of stream, peer reads EOF and may still send data.
+// Streams of mux without half-close, msgmux, are left open.
+func (s *Stream) CloseWrite() error {
+	if cw, ok := s.mux.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return nil
+}
+
+// SetPriority changes priority of stream, e.g. when destination becomes known.
+func (s *Stream) SetPriority(priority sched.Priority) {
+	s.sched.SetPriority(s.id, priority)
+}
+
+type deadliner interface {
+	SetDeadline(t time.Time) error
+	SetReadDeadline(t time.Time) error
+	SetWriteDeadline(t time.Time) error
+}
+
+// SetDeadline sets read and write deadlines of stream, mux without deadlines, msgmux, returns os.ErrNoDeadline.
+func (s *Stream) SetDeadline(t time.Time) error {
+	if d, ok := s.mux.(deadliner); ok {
+		return d.SetDeadline(t)
+	}
+	return os.ErrNoDeadline
+}
+
+func (s *Stream) SetReadDeadline(t time.Time) error {
+	if d, ok := s.mux.(deadliner); ok {
+		return d.SetReadDeadline(t)
+	}
+	return os.ErrNoDeadline
+}
+
+func (s *Stream) SetWriteDeadline(t time.Time) error {
+	if d, ok := s.mux.(deadliner); ok {
+		return d.SetWriteDeadline(t)
+	}
+	return os.ErrNoDeadline
+}
+
+// OpenStream opens stream with given priority, zero priority is detected by destination port later.
+// While tunnel reconnects, it waits for new session.
+func (t *Tunnel) OpenStream(ctx context.Context, priority sched.Priority) (*Stream, error) {
+	s, err := t.currentSession(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return s.open(ctx, priority)
+}
+
+// Accept returns next stream opened by server, e.g. for remote forward.
+func (t *Tunnel) Accept(ctx context.Context) (*Stream, error) {
+	select {
+	case stream := <-t.accepted:
+		return stream, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// session is one handshaked session with server
+type session struct {
+	mux    mux.Session
+	rwc    *icq.RWC
+	sched  *sched.Conn
+	cancel context.CancelFunc
+}
+
+func (s *session) open(ctx context.Context, priority sched.Priority) (*Stream, error) {
+	stream, err := s.mux.OpenStream(ctx, "")
+	if err != nil {
+		return nil, err
+	}
+	if priority != 0 {
+		s.sched.SetPriority(stream.StreamID(), priority)
+	}
+	return &Stream{ReadWriteCloser: s.sched.Track(stream, stream.StreamID()), mux: stream, id: stream.StreamID(), sched: s.sched}, nil
+}
+
+// acceptLoop passes streams opened by server to Accept until session is closed.
+func (s *session) acceptLoop(accepted chan *Stream) {
+	for {
+		stream, err := s.mux.AcceptStream()
+		if err != nil {
+			return
+		}
+		select {
+		case accepted <- &Stream{ReadWriteCloser: s.sched.Track(stream, stream.StreamID()), mux: stream, id: stream.StreamID(), sched: s.sched}:
+		default:
+			log.Warnf("tunnel: accept backlog is full, closing stream")
+			_ = stream.Close()
+		}
+	}
+}
+
+func (s *session) close() {
+	err := s.mux.Close()
+	if err != nil {
+		log.Warnf("close mux session error: %v", err)
+	}
+	s.cancel()
+}
+
+// connect opens new session: handshake with random session id and mux client on top of it.
+func (t *Tunnel) connect(ctx context.Context) (*session, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	s, err := t.connectSession(ctx)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	s.cancel = cancel
+
+	t.setSession(s)
+	go s.acceptLoop(t.accepted)
+	if t.onConnect != nil {
+		go t.onConnect()
+	}
+	return s, nil
+}
+
+func (t *Tunnel) connectSession(ctx context.Context) (*session, error) {
+	sessionID, err := newSessionID()
+	if err != nil {
+		return nil, fmt.Errorf("generate session id error: %v", err)
+	}
+	encoder := t.encoder.Copy()
+	encoder.SetSession(sessionID)
+
+	icqClient := icq.NewICQClient(t.cfg.ICQ.ClientToken)
+	msgCh := icqClient.MessageChan(ctx, t.cfg.ICQ.BotRoomID)
+	err = t.handshake(ctx, encoder, icqClient, msgCh)
+	if err != nil {
+		return nil, err
+	}
+	rwc := icq.NewRWCClient(ctx, icqClient, msgCh, encoder, encoding.MaxMessageLen, t.cfg.ICQ.BotRoomID)
+	rwc.SetPacer(t.pacer)
+	rwc.OnThrottle(func(notice encoding.QuotaNotice) {
+		t.setStatus(StatusConnected, ThrottledError{
+			Reason:     notice.Reason,
+			RetryAfter: time.Duration(notice.RetryAfter) * time.Second,
+		})
+	})
+	if t.cfg.FEC.Enabled {
+		err = rwc.EnableFEC(t.cfg.FEC)
+		if err != nil {
+			_ = rwc.Close()
+			return nil, fmt.Errorf("enable fec error: %v", err)
+		}
+	}
+	err = t.setupMessageLimit(ctx, rwc)
+	if err != nil {
+		_ = rwc.Close()
+		return nil, err
+	}
+	rwc.StartKeepalive(t.cfg.Keepalive)
+
+	muxSession, conn, err := mux.New(t.cfg.Mux, socksproxy.ConnWrapper{ReadWriteCloser: rwc}, true, rwc.PayloadLimit)
+	if err != nil {
+		_ = rwc.Close()
+		return nil, fmt.Errorf("init %s client connection error: %v", t.cfg.Mux, err)
+	}
+
+	return &session{mux: muxSession, rwc: rwc, sched: conn}, nil
+}
+
+// supervise replaces session when it dies, until ctx is done.
+func (t *Tunnel) supervise(ctx context.Context, s *session) {
+	defer func() {
+		t.setSession(nil)
+		if s != nil {
+			s.close()
+		}
+		// keep error of permanent failure
+		if status, _ := t.Status(); status != StatusStopped {
+			t.setStatus(StatusStopped, nil)
+		}
+		t.lock.Lock()
+		close(t.done)
+		t.lock.Unlock()
+	}()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-s.mux.CloseChan():
+			if rtt := s.rwc.RTT(); !rtt.Alive {
+				log.Warnf("server stopped answering pings, reconnecting")
+			} else {
+				log.Warnf("tunnel session closed, reconnecting")
+			}
+			t.setSession(nil)
+			s.close()
+			s = t.reconnect(ctx)
+			if s == nil {
+				return
+			}
+		}
+	}
+}
+
+// reconnect retries handshake with exponential backoff and jitter.
+// Returns nil if ctx is done or server refused connection permanently.
+func (t *Tunnel) reconnect(ctx context.Context) *session {
+	delay := reconnectMinDelay
+	for attempt := 1; ; attempt++ {
+		t.setStatus(StatusReconnecting, nil)
+		s, err := t.connect(ctx)
+		if err == nil {
+			t.setStatus(StatusConnected, nil)
+			return s
+		}
+		if ctx.Err() != nil {
+			return nil
+		}
+		if isPermanentError(err) {
+			log.Errorf("reconnect failed permanently: %v", err)
+			t.setStatus(StatusStopped, err)
+			return nil
+		}
+
+		sleep := reconnectSleep(delay, err, mathrand.Int63n)
+		log.Warnf("reconnect attempt %d failed: %v, next attempt in %s", attempt, err, sleep.Round(time.Second))
+		t.setStatus(StatusReconnecting, err)
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(sleep):
+		}
+		delay = nextReconnectDelay(delay, t.cfg.ReconnectMaxDelay)
+	}
+}
+
+// reconnectSleep returns pause after failed attempt: delay with jitter of ±50%, in [delay/2, delay*3/2),
+// or longer RetryAfter of server which throttled connection. int63n is a random source, like rand.Int63n.
+func reconnectSleep(delay time.Duration, err error, int63n func(n int64) int64) time.Duration {
+	sleep := delay/2 + time.Duration(int63n(int64(delay)))
+	var throttledErr ThrottledError
+	if errors.As(err, &throttledErr) && throttledErr.RetryAfter > sleep {
+		sleep = throttledErr.RetryAfter
+	}
+	return sleep
+}
+
+// nextReconnectDelay doubles delay up to maxDelay.
+func nextReconnectDelay(delay, maxDelay time.Duration) time.Duration {
+	delay *= 2
+	if delay > maxDelay {
+		delay = maxDelay
+	}
+	return delay
+}
+
+// isPermanentError reports errors which won't go away by retrying.
+func isPermanentError(err error) bool {
+	var rejectedErr HandshakeRejectedError
+	var versionErr VersionMismatchError
+	return errors.As(err, &rejectedErr) || errors.As(err, &versionErr)
+}
+
+// setupMessageLimit applies configured or stored message limit, probing carrier if there is none,
+// and announces it to server.
+func (t *Tunnel) setupMessageLimit(ctx context.Context, rwc *icq.RWC) error {
+	limit := t.cfg.MessageLimit
+	if limit <= 0 {
+		key := "icq/" + t.cfg.ICQ.BotRoomID
+		var ok bool
+		if t.messageLimits != nil {
+			limit, ok = t.messageLimits.Get(key)
+		}
+		if !ok {
+			log.Infof("probing carrier message size limit")
+			var err error
+			limit, err = rwc.ProbeMessageLimit(ctx, t.cfg.ProbeTimeout)
+			if err != nil {
+				return fmt.Errorf("probe message limit error: %v", err)
+			}
+			log.Infof("carrier message size limit: %d", limit)
+			// only probed limit is stored, connection shrinks it on refused messages and grows back to it
+			t.saveMessageLimit(key, limit)
+		}
+	}
+
+	rwc.SetMessageLimit(limit)
+	err := rwc.AnnounceMessageLimit()
+	if err != nil {
+		return fmt.Errorf("announce message limit error: %v", err)
+	}
+	return nil
+}
+
+func (t *Tunnel) saveMessageLimit(key string, limit int) {
+	if t.messageLimits == nil {
+		return
+	}
+	err := t.messageLimits.Set(key, limit)
+	if err != nil {
+		log.Warnf("save message limit: %v", err)
+	}
+}
+
+func newSessionID() (encoding.SessionID, error) {
+	var data [8]byte
+	_, err := rand.Read(data[:])
+	if err != nil {
+		return 0, err
+	}
+	return encoding.SessionID(binary.BigEndian.Uint64(data[:]) | 1), nil // zero is reserved
+}
@@ -0,0 +1,234 @@
+package tunnel
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	mathrand "math/rand"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/pymq/demhack4/config"
+	"github.com/pymq/demhack4/encoding"
+	"github.com/pymq/demhack4/mux"
+	"github.com/pymq/demhack4/socksproxy"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestTunnel(t *testing.T) *Tunnel {
+	serverKey, err := encoding.GenerateKey()
+	require.NoError(t, err)
+	tun, err := New(Options{Config: config.Client{ServerPublicKey: serverKey.Recipient().String()}})
+	require.NoError(t, err)
+	return tun
+}
+
+// connectTo sets session of tunnel, which streams are served by proxy server.
+func connectTo(t *testing.T, tun *Tunnel, server *socksproxy.Server) {
+	clientConn, serverConn := net.Pipe()
+	clientMux, sched, err := mux.New(mux.Yamux, clientConn, true, nil)
+	require.NoError(t, err)
+	serverMux, _, err := mux.New(mux.Yamux, serverConn, false, nil)
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		_ = clientMux.Close()
+		_ = serverMux.Close()
+	})
+	go func() {
+		for {
+			stream, err := serverMux.AcceptStream()
+			if err != nil {
+				return
+			}
+			server.ServeConn(stream, socksproxy.Peer{})
+		}
+	}()
+	tun.setStatus(StatusConnected, nil)
+	tun.setSession(&session{mux: clientMux, sched: sched, cancel: func() {}})
+}
+
+func TestNew(t *testing.T) {
+	_, err := New(Options{Config: config.Client{ServerPublicKey: "invalid"}})
+	assert.Error(t, err)
+
+	tun := newTestTunnel(t)
+	assert.NotEmpty(t, tun.PublicKey())
+	status, err := tun.Status()
+	assert.Equal(t, StatusStopped, status)
+	assert.NoError(t, err)
+	_, err = tun.OpenStream(context.Background(), 0)
+	assert.ErrorIs(t, err, ErrClosed)
+}
+
+func TestOpenStreamWaitsForSession(t *testing.T) {
+	tun := newTestTunnel(t)
+	tun.ready = make(chan struct{})
+	tun.setStatus(StatusReconnecting, nil)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	_, err := tun.OpenStream(ctx, 0)
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+
+	server, err := socksproxy.NewServer(socksproxy.ServerOptions{})
+	require.NoError(t, err)
+	defer server.Close()
+	opened := make(chan error, 1)
+	go func() {
+		_, err := tun.OpenStream(context.Background(), 0)
+		opened <- err
+	}()
+	connectTo(t, tun, server)
+	select {
+	case err = <-opened:
+		assert.NoError(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("stream wasn't opened after session was set")
+	}
+}
+
+func TestDialContext(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = fmt.Fprintf(w, "hello %s", r.URL.Path)
+	}))
+	defer srv.Close()
+	server, err := socksproxy.NewServer(socksproxy.ServerOptions{Egress: config.Egress{AllowPrivate: true}})
+	require.NoError(t, err)
+	defer server.Close()
+	tun := newTestTunnel(t)
+	connectTo(t, tun, server)
+
+	_, err = tun.DialContext(context.Background(), "udp", srv.Listener.Addr().String())
+	assert.Error(t, err)
+
+	client := &http.Client{Transport: tun.Transport(), Timeout: 5 * time.Second}
+	resp, err := client.Get(srv.URL + "/tunnel")
+	require.NoError(t, err)
+	body, err := io.ReadAll(resp.Body)
+	_ = resp.Body.Close()
+	require.NoError(t, err)
+	assert.Equal(t, "hello /tunnel", string(body))
+
+	conn, err := tun.DialContext(context.Background(), "tcp", srv.Listener.Addr().String())
+	require.NoError(t, err)
+	assert.Equal(t, srv.Listener.Addr().String(), conn.RemoteAddr().String())
+	_ = conn.Close()
+}
+
+func TestDialContextCloseWrite(t *testing.T) {
+	// destination answers after it reads the whole request
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer l.Close()
+	go func() {
+		c, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		request, _ := io.ReadAll(c)
+		_, _ = fmt.Fprintf(c, "got %d bytes", len(request))
+	}()
+	server, err := socksproxy.NewServer(socksproxy.ServerOptions{Egress: config.Egress{AllowPrivate: true}})
+	require.NoError(t, err)
+	defer server.Close()
+	tun := newTestTunnel(t)
+	connectTo(t, tun, server)
+
+	conn, err := tun.DialContext(context.Background(), "tcp", l.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+	_, err = conn.Write([]byte("request"))
+	require.NoError(t, err)
+	require.NoError(t, conn.(interface{ CloseWrite() error }).CloseWrite())
+	answer, err := io.ReadAll(conn)
+	require.NoError(t, err)
+	assert.Equal(t, "got 7 bytes", string(answer))
+}
+
+func TestDialContextReadDeadline(t *testing.T) {
+	// destination never answers
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer l.Close()
+	go func() {
+		c, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		_, _ = io.Copy(io.Discard, c)
+	}()
+	server, err := socksproxy.NewServer(socksproxy.ServerOptions{Egress: config.Egress{AllowPrivate: true}})
+	require.NoError(t, err)
+	defer server.Close()
+	tun := newTestTunnel(t)
+	connectTo(t, tun, server)
+
+	conn, err := tun.DialContext(context.Background(), "tcp", l.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+	require.NoError(t, conn.SetReadDeadline(time.Now().Add(50*time.Millisecond)))
+	read := make(chan error, 1)
+	go func() {
+		_, err := conn.Read(make([]byte, 1))
+		read <- err
+	}()
+	select {
+	case err = <-read:
+		var netErr net.Error
+		require.ErrorAs(t, err, &netErr)
+		assert.True(t, netErr.Timeout())
+	case <-time.After(5 * time.Second):
+		t.Fatal("read deadline didn't fire")
+	}
+
+	// connection is usable after deadline is reset
+	require.NoError(t, conn.SetDeadline(time.Time{}))
+	_, err = conn.Write([]byte("ping"))
+	assert.NoError(t, err)
+}
+
+func TestReconnectDelay(t *testing.T) {
+	delay := reconnectMinDelay
+	var delays []time.Duration
+	for i := 0; i < 5; i++ {
+		delay = nextReconnectDelay(delay, 10*time.Second)
+		delays = append(delays, delay)
+	}
+	assert.Equal(t, []time.Duration{2 * time.Second, 4 * time.Second, 8 * time.Second, 10 * time.Second, 10 * time.Second}, delays)
+}
+
+func TestReconnectSleep(t *testing.T) {
+	lowest := func(int64) int64 { return 0 }
+	highest := func(n int64) int64 { return n - 1 }
+	err := errors.New("send public key error")
+
+	assert.Equal(t, 2*time.Second, reconnectSleep(4*time.Second, err, lowest))
+	assert.Equal(t, 6*time.Second-1, reconnectSleep(4*time.Second, err, highest))
+	for i := 0; i < 100; i++ {
+		sleep := reconnectSleep(4*time.Second, err, mathrand.Int63n)
+		assert.GreaterOrEqual(t, sleep, 2*time.Second)
+		assert.Less(t, sleep, 6*time.Second)
+	}
+
+	// server asks to wait longer than backoff
+	throttled := fmt.Errorf("connect: %w", ThrottledError{Reason: "traffic limit exceeded", RetryAfter: time.Hour})
+	assert.Equal(t, time.Hour, reconnectSleep(4*time.Second, throttled, highest))
+	// shorter RetryAfter doesn't shorten backoff
+	throttled = ThrottledError{Reason: "message rate cap", RetryAfter: time.Second}
+	assert.Equal(t, 2*time.Second, reconnectSleep(4*time.Second, throttled, lowest))
+}
+
+func TestIsPermanentError(t *testing.T) {
+	assert.True(t, isPermanentError(HandshakeRejectedError{Reason: "invalid invite token"}))
+	assert.True(t, isPermanentError(fmt.Errorf("connect: %w", VersionMismatchError{ClientVersion: 1, ServerVersion: 2})))
+	assert.False(t, isPermanentError(ErrNoHandshakeAck))
+	assert.False(t, isPermanentError(ThrottledError{Reason: "traffic limit exceeded", RetryAfter: time.Hour}))
+	assert.False(t, isPermanentError(errors.New("send public key error")))
+}